@@ -0,0 +1,546 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// The server image has no system zoneinfo, so embed the IANA database
+	_ "time/tzdata"
+)
+
+const (
+	minutesPerDay = 24 * 60
+	// maxAvailabilityWindows limits how many windows one user can declare.
+	maxAvailabilityWindows = 50
+	// maxOverlapDays bounds how far ahead overlaps are computed.
+	maxOverlapDays = 28
+	// maxOverlapGroup bounds how many users one overlap query compares.
+	maxOverlapGroup = 10
+)
+
+var weekdayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+type AvailabilityWindow struct {
+	Day   string `json:"day"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type AvailabilitySchedule struct {
+	TimeZone string               `json:"timeZone"`
+	Windows  []AvailabilityWindow `json:"windows"`
+}
+
+type TimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type AvailabilityOverlap struct {
+	TimeZone     string      `json:"timeZone"`
+	From         time.Time   `json:"from"`
+	Until        time.Time   `json:"until"`
+	Windows      []TimeRange `json:"windows"`
+	TotalMinutes int         `json:"totalMinutes"`
+}
+
+// weeklySchedule is a user's availability as wall-clock windows in their
+// own time zone. Windows are expanded per calendar day, so a window keeps its
+// local hours across DST changes while its UTC instants shift.
+type weeklySchedule struct {
+	location *time.Location
+	windows  []weeklyWindow
+}
+
+type weeklyWindow struct {
+	Weekday     time.Weekday `db:"weekday"`
+	StartMinute int          `db:"start_minute"`
+	EndMinute   int          `db:"end_minute"`
+}
+
+func initAvailabilityTables() error {
+	_, err := db.Exec(`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS time_zone VARCHAR(64);
+
+	CREATE TABLE IF NOT EXISTS user_availability (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		weekday INTEGER NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+		start_minute INTEGER NOT NULL CHECK (start_minute BETWEEN 0 AND 1439),
+		end_minute INTEGER NOT NULL CHECK (end_minute BETWEEN 1 AND 1440),
+		CHECK (end_minute > start_minute)
+	);
+	CREATE INDEX IF NOT EXISTS user_availability_user_id_idx ON user_availability (user_id);
+	`)
+	return err
+}
+
+// loadTimeZone resolves an IANA zone name. "Local" is rejected because it
+// would mean the server's zone rather than the user's.
+func loadTimeZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// parseClock parses "HH:MM" into minutes after midnight. "24:00" is allowed
+// so a window can run to the end of the day.
+func parseClock(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("time %q must be HH:MM", value)
+	}
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("time %q must be HH:MM", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(strings.TrimSpace(day))
+	for i, name := range weekdayNames {
+		if name == day || name[:3] == day {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// parseAvailabilityWindows validates windows and rejects overlaps within a
+// day. A window that crosses midnight must be split into two.
+func parseAvailabilityWindows(windows []AvailabilityWindow) ([]weeklyWindow, error) {
+	if len(windows) > maxAvailabilityWindows {
+		return nil, fmt.Errorf("at most %d windows are allowed", maxAvailabilityWindows)
+	}
+
+	parsed := make([]weeklyWindow, 0, len(windows))
+	for _, window := range windows {
+		weekday, ok := parseWeekday(window.Day)
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", window.Day)
+		}
+		start, err := parseClock(window.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(window.End)
+		if err != nil {
+			return nil, err
+		}
+		if start >= minutesPerDay || end <= start {
+			return nil, fmt.Errorf("window on %s must end after it starts", weekdayNames[weekday])
+		}
+		parsed = append(parsed, weeklyWindow{Weekday: weekday, StartMinute: start, EndMinute: end})
+	}
+
+	sortWeeklyWindows(parsed)
+	for i := 1; i < len(parsed); i++ {
+		prev, cur := parsed[i-1], parsed[i]
+		if prev.Weekday == cur.Weekday && cur.StartMinute < prev.EndMinute {
+			return nil, fmt.Errorf("windows on %s overlap", weekdayNames[cur.Weekday])
+		}
+	}
+	return parsed, nil
+}
+
+func sortWeeklyWindows(windows []weeklyWindow) {
+	sort.Slice(windows, func(i, j int) bool {
+		if windows[i].Weekday != windows[j].Weekday {
+			return windows[i].Weekday < windows[j].Weekday
+		}
+		return windows[i].StartMinute < windows[j].StartMinute
+	})
+}
+
+func (s *weeklySchedule) toResponse() AvailabilitySchedule {
+	response := AvailabilitySchedule{
+		TimeZone: s.location.String(),
+		Windows:  []AvailabilityWindow{},
+	}
+	for _, window := range s.windows {
+		response.Windows = append(response.Windows, AvailabilityWindow{
+			Day:   weekdayNames[window.Weekday],
+			Start: formatClock(window.StartMinute),
+			End:   formatClock(window.EndMinute),
+		})
+	}
+	return response
+}
+
+// expand returns the concrete instants covered by the schedule within
+// [from, until), merged and in order.
+func (s *weeklySchedule) expand(from, until time.Time) []TimeRange {
+	var ranges []TimeRange
+
+	// Start a day early and finish a day late so windows that straddle the
+	// range edges in other zones are included, then clip
+	first := from.In(s.location)
+	last := until.In(s.location)
+	day := time.Date(first.Year(), first.Month(), first.Day()-1, 12, 0, 0, 0, s.location)
+	end := time.Date(last.Year(), last.Month(), last.Day()+1, 12, 0, 0, 0, s.location)
+
+	for ; !day.After(end); day = time.Date(day.Year(), day.Month(), day.Day()+1, 12, 0, 0, 0, s.location) {
+		for _, window := range s.windows {
+			if window.Weekday != day.Weekday() {
+				continue
+			}
+			start := availabilityTime(day, window.StartMinute, s.location)
+			stop := availabilityTime(day, window.EndMinute, s.location)
+			start = laterTime(start, from)
+			stop = earlierTime(stop, until)
+			if stop.After(start) {
+				ranges = append(ranges, TimeRange{Start: start.UTC(), End: stop.UTC()})
+			}
+		}
+	}
+	return mergeTimeRanges(ranges)
+}
+
+// availabilityTime returns the instant minute minutes into day's wall
+// clock in loc, where minute may be 24:00 for the next midnight. A time
+// skipped by a DST change becomes the moment the clocks jump, so a window
+// keeps just the part of it that exists. A repeated time is its first
+// occurrence.
+func availabilityTime(day time.Time, minute int, loc *time.Location) time.Time {
+	day = time.Date(day.Year(), day.Month(), day.Day()+minute/minutesPerDay, 0, 0, 0, 0, time.UTC)
+	minute %= minutesPerDay
+	t := wallTime(day, minute/60, minute%60, 0, loc)
+	if t.Hour()*60+t.Minute() != minute {
+		jump, _ := t.ZoneBounds()
+		return jump
+	}
+	return t
+}
+
+func mergeTimeRanges(ranges []TimeRange) []TimeRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start.Before(ranges[j].Start)
+	})
+	var merged []TimeRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && !r.Start.After(merged[n-1].End) {
+			merged[n-1].End = laterTime(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// intersectTimeRanges returns the instants covered by both a and b, which
+// must each be sorted and non-overlapping.
+func intersectTimeRanges(a, b []TimeRange) []TimeRange {
+	var result []TimeRange
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start := laterTime(a[i].Start, b[j].Start)
+		end := earlierTime(a[i].End, b[j].End)
+		if end.After(start) {
+			result = append(result, TimeRange{Start: start, End: end})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+// groupOverlap intersects the schedules of everyone in schedules over
+// [from, until) and presents the result in location.
+func groupOverlap(schedules []*weeklySchedule, from, until time.Time, location *time.Location) AvailabilityOverlap {
+	var common []TimeRange
+	for i, schedule := range schedules {
+		expanded := schedule.expand(from, until)
+		if i == 0 {
+			common = expanded
+		} else {
+			common = intersectTimeRanges(common, expanded)
+		}
+	}
+
+	overlap := AvailabilityOverlap{
+		TimeZone: location.String(),
+		From:     from.In(location),
+		Until:    until.In(location),
+		Windows:  []TimeRange{},
+	}
+	var total time.Duration
+	for _, r := range common {
+		overlap.Windows = append(overlap.Windows, TimeRange{Start: r.Start.In(location), End: r.End.In(location)})
+		total += r.End.Sub(r.Start)
+	}
+	overlap.TotalMinutes = int(total / time.Minute)
+	return overlap
+}
+
+// loadWeeklySchedule returns the user's schedule, or nil when they have not
+// set a time zone.
+func loadWeeklySchedule(userID int) (*weeklySchedule, error) {
+	var zone sql.NullString
+	if err := db.Get(&zone, "SELECT time_zone FROM users WHERE id = $1", userID); err != nil {
+		return nil, err
+	}
+	if !zone.Valid {
+		return nil, nil
+	}
+	location, err := loadTimeZone(zone.String)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &weeklySchedule{location: location}
+	err = db.Select(&schedule.windows, `
+		SELECT weekday, start_minute, end_minute
+		FROM user_availability
+		WHERE user_id = $1
+		ORDER BY weekday, start_minute
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// canViewAvailability reports whether viewer may see owner's schedule. Like
+// the rest of a private profile, it is limited to followers.
+func canViewAvailability(viewerID, ownerID int) (bool, error) {
+	if viewerID == ownerID {
+		return true, nil
+	}
+	var visible bool
+	err := db.Get(&visible, `
+		SELECT NOT u.is_private OR EXISTS(
+			SELECT 1 FROM followers WHERE follower_id = $1 AND following_id = u.id
+		)
+		FROM users u WHERE u.id = $2
+	`, viewerID, ownerID)
+	return visible, err
+}
+
+func getAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	schedule, err := loadWeeklySchedule(userID)
+	if err != nil {
+		log.Printf("Error loading availability: %v", err)
+		http.Error(w, `{"error":"Error loading availability"}`, http.StatusInternalServerError)
+		return
+	}
+	if schedule == nil {
+		json.NewEncoder(w).Encode(AvailabilitySchedule{TimeZone: "", Windows: []AvailabilityWindow{}})
+		return
+	}
+
+	json.NewEncoder(w).Encode(schedule.toResponse())
+}
+
+func updateAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody AvailabilitySchedule
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	location, err := loadTimeZone(requestBody.TimeZone)
+	if err != nil {
+		http.Error(w, `{"error":"Unknown time zone"}`, http.StatusBadRequest)
+		return
+	}
+	windows, err := parseAvailabilityWindows(requestBody.Windows)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The schedule is replaced as a whole
+	_, err = tx.Exec("UPDATE users SET time_zone = $1 WHERE id = $2", location.String(), userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating availability"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("DELETE FROM user_availability WHERE user_id = $1", userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating availability"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, window := range windows {
+		_, err = tx.Exec(`
+			INSERT INTO user_availability (user_id, weekday, start_minute, end_minute)
+			VALUES ($1, $2, $3, $4)
+		`, userID, int(window.Weekday), window.StartMinute, window.EndMinute)
+		if err != nil {
+			log.Printf("Error saving availability window: %v", err)
+			http.Error(w, `{"error":"Error updating availability"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating availability"}`, http.StatusInternalServerError)
+		return
+	}
+
+	schedule := &weeklySchedule{location: location, windows: windows}
+	json.NewEncoder(w).Encode(schedule.toResponse())
+}
+
+// availabilityOverlapHandler returns the hours the requester and every user
+// in ?users= are all available over the next ?days= days (default 7).
+// Results are shown in ?tz=, defaulting to the requester's own zone.
+func availabilityOverlapHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	usernames := []string{claims.Username}
+	seen := map[string]bool{claims.Username: true}
+	for _, username := range strings.Split(query.Get("users"), ",") {
+		username = strings.TrimSpace(username)
+		if username != "" && !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	if len(usernames) < 2 {
+		http.Error(w, `{"error":"At least one other user is required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(usernames) > maxOverlapGroup {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("At most %d users can be compared", maxOverlapGroup))
+		return
+	}
+
+	days := 7
+	if value := query.Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxOverlapDays {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Days must be between 1 and %d", maxOverlapDays))
+			return
+		}
+		days = parsed
+	}
+
+	var viewerID int
+	var schedules []*weeklySchedule
+	for i, username := range usernames {
+		userID, err := userIDByUsername(username)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeJSONError(w, http.StatusNotFound, fmt.Sprintf("User not found: %s", username))
+				return
+			}
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if i == 0 {
+			viewerID = userID
+		} else {
+			visible, err := canViewAvailability(viewerID, userID)
+			if err != nil {
+				http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+				return
+			}
+			if !visible {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Availability of %s is private", username))
+				return
+			}
+		}
+
+		schedule, err := loadWeeklySchedule(userID)
+		if err != nil {
+			log.Printf("Error loading availability: %v", err)
+			http.Error(w, `{"error":"Error loading availability"}`, http.StatusInternalServerError)
+			return
+		}
+		if schedule == nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("%s has not set their availability", username))
+			return
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	location := schedules[0].location
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := loadTimeZone(tz)
+		if err != nil {
+			http.Error(w, `{"error":"Unknown time zone"}`, http.StatusBadRequest)
+			return
+		}
+		location = loc
+	}
+
+	from := time.Now().Truncate(time.Minute)
+	overlap := groupOverlap(schedules, from, from.AddDate(0, 0, days), location)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":   usernames,
+		"overlap": overlap,
+	})
+}
+
+// profileAvailability returns the owner's schedule and, when the viewer has
+// one too, their overlap over the next week. Both are nil when the viewer may
+// not see the owner's schedule.
+func profileAvailability(viewerID, ownerID int) (*AvailabilitySchedule, *AvailabilityOverlap, error) {
+	visible, err := canViewAvailability(viewerID, ownerID)
+	if err != nil || !visible {
+		return nil, nil, err
+	}
+
+	owner, err := loadWeeklySchedule(ownerID)
+	if err != nil || owner == nil {
+		return nil, nil, err
+	}
+	schedule := owner.toResponse()
+
+	if viewerID == 0 || viewerID == ownerID {
+		return &schedule, nil, nil
+	}
+	viewer, err := loadWeeklySchedule(viewerID)
+	if err != nil || viewer == nil {
+		return &schedule, nil, err
+	}
+
+	from := time.Now().Truncate(time.Minute)
+	overlap := groupOverlap([]*weeklySchedule{viewer, owner}, from, from.AddDate(0, 0, 7), viewer.location)
+	return &schedule, &overlap, nil
+}
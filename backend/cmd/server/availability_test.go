@@ -0,0 +1,296 @@
+package main
+
+import "testing"
+
+// timeRanges pairs up RFC 3339 start and end times.
+func timeRanges(values ...string) []TimeRange {
+	var ranges []TimeRange
+	for i := 0; i+1 < len(values); i += 2 {
+		ranges = append(ranges, TimeRange{Start: utc(values[i]), End: utc(values[i+1])})
+	}
+	return ranges
+}
+
+// sameRanges compares ranges as instants, whatever their location.
+func sameRanges(got, want []TimeRange) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !got[i].Start.Equal(want[i].Start) || !got[i].End.Equal(want[i].End) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustSchedule(t *testing.T, zone string, windows ...AvailabilityWindow) *weeklySchedule {
+	t.Helper()
+	parsed, err := parseAvailabilityWindows(windows)
+	if err != nil {
+		t.Fatalf("parseAvailabilityWindows error: %v", err)
+	}
+	return &weeklySchedule{location: mustLocation(t, zone), windows: parsed}
+}
+
+func TestWeeklyScheduleExpand(t *testing.T) {
+	tests := []struct {
+		name        string
+		zone        string
+		windows     []AvailabilityWindow
+		from, until string
+		want        []TimeRange
+	}{
+		{
+			name:    "evening in UTC-5 falls on the next UTC day",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"monday", "19:00", "21:00"}},
+			from:    "2026-03-02T00:00:00Z", until: "2026-03-04T00:00:00Z",
+			want: timeRanges("2026-03-03T00:00:00Z", "2026-03-03T02:00:00Z"),
+		},
+		{
+			name:    "local hours kept across spring forward",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"saturday", "19:00", "21:00"}, {"sunday", "19:00", "21:00"}},
+			from:    "2026-03-07T00:00:00Z", until: "2026-03-09T12:00:00Z",
+			want: timeRanges(
+				"2026-03-08T00:00:00Z", "2026-03-08T02:00:00Z",
+				"2026-03-08T23:00:00Z", "2026-03-09T01:00:00Z",
+			),
+		},
+		{
+			name:    "window across the spring forward gap is an hour shorter",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "01:00", "04:00"}},
+			from:    "2026-03-08T00:00:00Z", until: "2026-03-09T00:00:00Z",
+			want: timeRanges("2026-03-08T06:00:00Z", "2026-03-08T08:00:00Z"),
+		},
+		{
+			name:    "window starting in the gap starts when the clocks jump",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "02:30", "03:30"}},
+			from:    "2026-03-08T00:00:00Z", until: "2026-03-09T00:00:00Z",
+			want: timeRanges("2026-03-08T07:00:00Z", "2026-03-08T07:30:00Z"),
+		},
+		{
+			name:    "window ending in the gap ends when the clocks jump",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "01:30", "02:30"}},
+			from:    "2026-03-08T00:00:00Z", until: "2026-03-09T00:00:00Z",
+			want: timeRanges("2026-03-08T06:30:00Z", "2026-03-08T07:00:00Z"),
+		},
+		{
+			name:    "window inside the gap never happens",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "02:00", "03:00"}},
+			from:    "2026-03-08T00:00:00Z", until: "2026-03-09T00:00:00Z",
+		},
+		{
+			name:    "whole spring forward day lasts 23 hours",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "00:00", "24:00"}},
+			from:    "2026-03-08T00:00:00Z", until: "2026-03-10T00:00:00Z",
+			want: timeRanges("2026-03-08T05:00:00Z", "2026-03-09T04:00:00Z"),
+		},
+		{
+			name:    "local hours kept across fall back",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"saturday", "19:00", "21:00"}, {"sunday", "19:00", "21:00"}},
+			from:    "2026-10-31T00:00:00Z", until: "2026-11-02T12:00:00Z",
+			want: timeRanges(
+				"2026-10-31T23:00:00Z", "2026-11-01T01:00:00Z",
+				"2026-11-02T00:00:00Z", "2026-11-02T02:00:00Z",
+			),
+		},
+		{
+			name:    "window across the repeated hour is an hour longer",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "00:00", "03:00"}},
+			from:    "2026-11-01T00:00:00Z", until: "2026-11-02T00:00:00Z",
+			want: timeRanges("2026-11-01T04:00:00Z", "2026-11-01T08:00:00Z"),
+		},
+		{
+			name:    "window ending in the repeated hour ends at its first pass",
+			zone:    "America/New_York",
+			windows: []AvailabilityWindow{{"sunday", "00:30", "01:30"}},
+			from:    "2026-11-01T00:00:00Z", until: "2026-11-02T00:00:00Z",
+			want: timeRanges("2026-11-01T04:30:00Z", "2026-11-01T05:30:00Z"),
+		},
+		{
+			name:    "window in Europe across its own spring forward",
+			zone:    "Europe/Berlin",
+			windows: []AvailabilityWindow{{"sunday", "01:00", "04:00"}},
+			from:    "2026-03-29T00:00:00Z", until: "2026-03-30T00:00:00Z",
+			want: timeRanges("2026-03-29T00:00:00Z", "2026-03-29T02:00:00Z"),
+		},
+		{
+			name:    "window split at midnight is merged back",
+			zone:    "Europe/Berlin",
+			windows: []AvailabilityWindow{{"friday", "22:00", "24:00"}, {"saturday", "00:00", "02:00"}},
+			from:    "2026-01-05T00:00:00Z", until: "2026-01-12T00:00:00Z",
+			want: timeRanges("2026-01-09T21:00:00Z", "2026-01-10T01:00:00Z"),
+		},
+		{
+			name:    "window split at the end of the week is merged back",
+			zone:    "UTC",
+			windows: []AvailabilityWindow{{"sunday", "00:00", "01:00"}, {"saturday", "23:00", "24:00"}},
+			from:    "2026-01-10T12:00:00Z", until: "2026-01-11T12:00:00Z",
+			want: timeRanges("2026-01-10T23:00:00Z", "2026-01-11T01:00:00Z"),
+		},
+		{
+			name:    "window crossing UTC midnight is clipped to the range",
+			zone:    "Asia/Tokyo",
+			windows: []AvailabilityWindow{{"monday", "08:00", "10:00"}},
+			from:    "2026-01-12T00:00:00Z", until: "2026-01-13T00:00:00Z",
+			want: timeRanges("2026-01-12T00:00:00Z", "2026-01-12T01:00:00Z"),
+		},
+		{
+			name:    "range inside a window",
+			zone:    "UTC",
+			windows: []AvailabilityWindow{{"monday", "10:00", "12:00"}},
+			from:    "2026-01-12T11:00:00Z", until: "2026-01-12T11:30:00Z",
+			want: timeRanges("2026-01-12T11:00:00Z", "2026-01-12T11:30:00Z"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := mustSchedule(t, test.zone, test.windows...)
+			got := schedule.expand(utc(test.from), utc(test.until))
+			if !sameRanges(got, test.want) {
+				t.Errorf("expand = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergeTimeRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []TimeRange
+		want   []TimeRange
+	}{
+		{"empty", nil, nil},
+		{
+			"disjoint out of order",
+			timeRanges("2026-01-01T12:00:00Z", "2026-01-01T13:00:00Z", "2026-01-01T10:00:00Z", "2026-01-01T11:00:00Z"),
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T11:00:00Z", "2026-01-01T12:00:00Z", "2026-01-01T13:00:00Z"),
+		},
+		{
+			"overlapping",
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T12:00:00Z", "2026-01-01T11:00:00Z", "2026-01-01T13:00:00Z"),
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T13:00:00Z"),
+		},
+		{
+			"touching",
+			timeRanges("2026-01-01T11:00:00Z", "2026-01-01T12:00:00Z", "2026-01-01T10:00:00Z", "2026-01-01T11:00:00Z"),
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T12:00:00Z"),
+		},
+		{
+			"contained",
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T14:00:00Z", "2026-01-01T11:00:00Z", "2026-01-01T12:00:00Z"),
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T14:00:00Z"),
+		},
+		{
+			"chain",
+			timeRanges(
+				"2026-01-01T13:00:00Z", "2026-01-01T15:00:00Z",
+				"2026-01-01T10:00:00Z", "2026-01-01T12:00:00Z",
+				"2026-01-01T11:30:00Z", "2026-01-01T13:00:00Z",
+				"2026-01-01T16:00:00Z", "2026-01-01T17:00:00Z",
+			),
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T15:00:00Z", "2026-01-01T16:00:00Z", "2026-01-01T17:00:00Z"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeTimeRanges(test.ranges); !sameRanges(got, test.want) {
+				t.Errorf("mergeTimeRanges = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIntersectTimeRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []TimeRange
+		want []TimeRange
+	}{
+		{"empty", nil, timeRanges("2026-01-01T10:00:00Z", "2026-01-01T11:00:00Z"), nil},
+		{
+			"disjoint",
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T11:00:00Z"),
+			timeRanges("2026-01-01T12:00:00Z", "2026-01-01T13:00:00Z"),
+			nil,
+		},
+		{
+			"touching has no common time",
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T11:00:00Z"),
+			timeRanges("2026-01-01T11:00:00Z", "2026-01-01T12:00:00Z"),
+			nil,
+		},
+		{
+			"partial overlap",
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T12:00:00Z"),
+			timeRanges("2026-01-01T11:00:00Z", "2026-01-01T13:00:00Z"),
+			timeRanges("2026-01-01T11:00:00Z", "2026-01-01T12:00:00Z"),
+		},
+		{
+			"one range across several",
+			timeRanges("2026-01-01T09:00:00Z", "2026-01-01T18:00:00Z"),
+			timeRanges(
+				"2026-01-01T08:00:00Z", "2026-01-01T10:00:00Z",
+				"2026-01-01T12:00:00Z", "2026-01-01T13:00:00Z",
+				"2026-01-01T17:00:00Z", "2026-01-01T19:00:00Z",
+			),
+			timeRanges(
+				"2026-01-01T09:00:00Z", "2026-01-01T10:00:00Z",
+				"2026-01-01T12:00:00Z", "2026-01-01T13:00:00Z",
+				"2026-01-01T17:00:00Z", "2026-01-01T18:00:00Z",
+			),
+		},
+		{
+			"interleaved",
+			timeRanges("2026-01-01T10:00:00Z", "2026-01-01T12:00:00Z", "2026-01-01T14:00:00Z", "2026-01-01T16:00:00Z"),
+			timeRanges("2026-01-01T11:00:00Z", "2026-01-01T15:00:00Z"),
+			timeRanges("2026-01-01T11:00:00Z", "2026-01-01T12:00:00Z", "2026-01-01T14:00:00Z", "2026-01-01T15:00:00Z"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := intersectTimeRanges(test.a, test.b); !sameRanges(got, test.want) {
+				t.Errorf("intersectTimeRanges(a, b) = %v, want %v", got, test.want)
+			}
+			if got := intersectTimeRanges(test.b, test.a); !sameRanges(got, test.want) {
+				t.Errorf("intersectTimeRanges(b, a) = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGroupOverlap(t *testing.T) {
+	schedules := []*weeklySchedule{
+		mustSchedule(t, "America/New_York", AvailabilityWindow{"monday", "12:00", "16:00"}),
+		mustSchedule(t, "Europe/Berlin", AvailabilityWindow{"monday", "18:00", "21:00"}),
+	}
+	kolkata := mustLocation(t, "Asia/Kolkata")
+
+	overlap := groupOverlap(schedules, utc("2026-01-12T00:00:00Z"), utc("2026-01-19T00:00:00Z"), kolkata)
+	want := timeRanges("2026-01-12T17:00:00Z", "2026-01-12T20:00:00Z")
+	if !sameRanges(overlap.Windows, want) {
+		t.Fatalf("Windows = %v, want %v", overlap.Windows, want)
+	}
+	if overlap.TotalMinutes != 180 {
+		t.Errorf("TotalMinutes = %d, want 180", overlap.TotalMinutes)
+	}
+	if overlap.TimeZone != "Asia/Kolkata" || overlap.Windows[0].Start.Location() != kolkata {
+		t.Errorf("overlap presented in %s, %v, want Asia/Kolkata", overlap.TimeZone, overlap.Windows[0].Start.Location())
+	}
+
+	// Nobody else's hours line up with a window outside them
+	schedules = append(schedules, mustSchedule(t, "UTC", AvailabilityWindow{"tuesday", "17:00", "20:00"}))
+	overlap = groupOverlap(schedules, utc("2026-01-12T00:00:00Z"), utc("2026-01-19T00:00:00Z"), kolkata)
+	if len(overlap.Windows) != 0 || overlap.TotalMinutes != 0 {
+		t.Errorf("overlap = %v (%d minutes), want none", overlap.Windows, overlap.TotalMinutes)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type BlockedUser struct {
+	Username  string    `json:"username" db:"username"`
+	BlockedAt time.Time `json:"blockedAt" db:"created_at"`
+}
+
+type MutedUser struct {
+	Username string    `json:"username" db:"username"`
+	MutedAt  time.Time `json:"mutedAt" db:"created_at"`
+}
+
+func initBlockTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id INTEGER NOT NULL REFERENCES users(id),
+		blocked_id INTEGER NOT NULL REFERENCES users(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id),
+		CHECK (blocker_id <> blocked_id)
+	);
+	CREATE INDEX IF NOT EXISTS user_blocks_blocked_id_idx ON user_blocks (blocked_id);
+
+	CREATE TABLE IF NOT EXISTS user_mutes (
+		muter_id INTEGER NOT NULL REFERENCES users(id),
+		muted_id INTEGER NOT NULL REFERENCES users(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (muter_id, muted_id),
+		CHECK (muter_id <> muted_id)
+	);
+	`)
+	return err
+}
+
+// isBlocked reports whether either user has blocked the other.
+func isBlocked(q queryer, a, b int) (bool, error) {
+	var blocked bool
+	err := q.Get(&blocked, `
+		SELECT EXISTS(
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		)
+	`, a, b)
+	return blocked, err
+}
+
+// blockUserHandler blocks a user. Follows and follow requests between the
+// two are removed in both directions.
+func blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	targetUsername := mux.Vars(r)["username"]
+	if claims.Username == targetUsername {
+		http.Error(w, `{"error":"You cannot block yourself"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	targetID, err := userIDByUsername(targetUsername)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO user_blocks (blocker_id, blocked_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, userID, targetID)
+	if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM followers
+			WHERE (follower_id = $1 AND following_id = $2) OR (follower_id = $2 AND following_id = $1)
+		`, userID, targetID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM follow_requests
+			WHERE (requester_id = $1 AND target_id = $2) OR (requester_id = $2 AND target_id = $1)
+		`, userID, targetID)
+	}
+	if err != nil {
+		log.Printf("Error blocking user: %v", err)
+		http.Error(w, `{"error":"Error blocking user"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error blocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "User blocked"})
+}
+
+func unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err := db.Exec(`
+		DELETE FROM user_blocks
+		WHERE blocker_id = (SELECT id FROM users WHERE username = $1)
+		AND blocked_id = (SELECT id FROM users WHERE username = $2)
+	`, claims.Username, mux.Vars(r)["username"])
+	if err != nil {
+		http.Error(w, `{"error":"Error unblocking user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "User unblocked"})
+}
+
+// listBlocksHandler lists the users the caller has blocked, most recent
+// first.
+func listBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	blocked := []BlockedUser{}
+	err := db.Select(&blocked, `
+		SELECT u.username, b.created_at
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = (SELECT id FROM users WHERE username = $1)
+		ORDER BY b.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error listing blocks: %v", err)
+		http.Error(w, `{"error":"Error listing blocked users"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(blocked)
+}
+
+// muteUserHandler mutes a user. Unlike a block, the two can still follow
+// and message each other; the muted user just stops showing up in the
+// caller's feed.
+func muteUserHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	targetUsername := mux.Vars(r)["username"]
+	if claims.Username == targetUsername {
+		http.Error(w, `{"error":"You cannot mute yourself"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	targetID, err := userIDByUsername(targetUsername)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_mutes (muter_id, muted_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, userID, targetID)
+	if err != nil {
+		log.Printf("Error muting user: %v", err)
+		http.Error(w, `{"error":"Error muting user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "User muted"})
+}
+
+func unmuteUserHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err := db.Exec(`
+		DELETE FROM user_mutes
+		WHERE muter_id = (SELECT id FROM users WHERE username = $1)
+		AND muted_id = (SELECT id FROM users WHERE username = $2)
+	`, claims.Username, mux.Vars(r)["username"])
+	if err != nil {
+		http.Error(w, `{"error":"Error unmuting user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "User unmuted"})
+}
+
+// listMutesHandler lists the users the caller has muted, most recent first.
+func listMutesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	muted := []MutedUser{}
+	err := db.Select(&muted, `
+		SELECT u.username, m.created_at
+		FROM user_mutes m
+		JOIN users u ON u.id = m.muted_id
+		WHERE m.muter_id = (SELECT id FROM users WHERE username = $1)
+		ORDER BY m.created_at DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error listing mutes: %v", err)
+		http.Error(w, `{"error":"Error listing muted users"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(muted)
+}
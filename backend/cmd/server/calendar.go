@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// calendarCancelledRetention is how long cancelled events stay in feeds so
+// subscribed calendars see the cancellation.
+const calendarCancelledRetention = 30 * 24 * time.Hour
+
+func initCalendarTables() error {
+	_, err := db.Exec(`
+	ALTER TABLE events ADD COLUMN IF NOT EXISTS sequence INTEGER NOT NULL DEFAULT 0;
+
+	CREATE TABLE IF NOT EXISTS calendar_tokens (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id),
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return err
+}
+
+// eventUID is the iCalendar UID of an event. It only depends on the id, so
+// calendar clients keep updating the same entry across edits.
+func eventUID(eventID int) string {
+	return fmt.Sprintf("event-%d@airdate", eventID)
+}
+
+// hashCalendarToken returns the stored form of a subscription token. Only
+// hashes are kept so a database leak does not expose working feed URLs.
+func hashCalendarToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// toICS returns the event's VEVENTs: the event itself, carrying the
+// recurrence rule and cancelled occurrences, followed by one per edited
+// occurrence.
+func (e *Event) toICS(exceptions []eventException) []icsEvent {
+	location, err := loadTimeZone(e.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	description := e.Description
+	if e.HostUsername != "" {
+		if description != "" {
+			description += "\n\n"
+		}
+		description += "Hosted by " + e.HostUsername + " on airdate"
+	}
+
+	event := icsEvent{
+		UID:         eventUID(e.ID),
+		Summary:     e.Title,
+		Description: description,
+		Start:       e.StartsAt,
+		End:         e.EndsAt,
+		Location:    location,
+		Stamp:       e.UpdatedAt,
+		Sequence:    e.Sequence,
+		Cancelled:   e.Status == "cancelled",
+	}
+	if e.GameName != nil {
+		event.Categories = []string{*e.GameName}
+	}
+	if e.StreamURL != nil {
+		event.URL = *e.StreamURL
+	}
+	if e.Recurrence == nil {
+		return []icsEvent{event}
+	}
+
+	event.RRule = *e.Recurrence
+	event.SeriesEnd = e.SeriesEndsAt
+	events := []icsEvent{event}
+	for _, exception := range exceptions {
+		if exception.Status == "cancelled" {
+			event.ExDates = append(event.ExDates, exception.OccurrenceStart)
+			continue
+		}
+		override := event
+		override.RRule = ""
+		override.ExDates = nil
+		occurrenceStart := exception.OccurrenceStart
+		override.RecurrenceID = &occurrenceStart
+		override.Start = exception.StartsAt
+		override.End = exception.EndsAt
+		override.Stamp = laterTime(e.UpdatedAt, exception.UpdatedAt)
+		if exception.Title != nil {
+			override.Summary = *exception.Title
+		}
+		if exception.Description != nil {
+			override.Description = *exception.Description
+		}
+		events = append(events, override)
+	}
+	events[0] = event
+	return events
+}
+
+// loadCalendarEvents returns events visible to viewerID that match
+// condition, including recently cancelled ones. condition may refer to the
+// viewer as $1 and to args from $2.
+func loadCalendarEvents(viewerID int, condition string, args ...interface{}) ([]*Event, error) {
+	params := append([]interface{}{viewerID, time.Now().Add(-calendarCancelledRetention)}, args...)
+	events := []*Event{}
+	err := db.Select(&events, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE `+eventVisibleTo("$1")+`
+		AND (e.series_ends_at IS NULL OR e.series_ends_at > $2)
+		AND (e.status = 'scheduled' OR e.updated_at > $2)
+		AND `+condition+`
+		ORDER BY e.starts_at, e.id
+	`, params...)
+	return events, err
+}
+
+func writeEventsCalendar(w http.ResponseWriter, name, filename string, events []*Event) {
+	var recurring []int
+	for _, event := range events {
+		if event.Recurrence != nil {
+			recurring = append(recurring, event.ID)
+		}
+	}
+	exceptions, err := loadEventExceptions(recurring, nil)
+	if err != nil {
+		log.Printf("Error loading event exceptions: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]icsEvent, 0, len(events))
+	for _, event := range events {
+		items = append(items, event.toICS(exceptions[event.ID])...)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+	if err := writeCalendar(w, name, time.Now(), items); err != nil {
+		log.Printf("Error writing calendar: %v", err)
+	}
+}
+
+// eventCalendarHandler serves a single event as an .ics file.
+func eventCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	event, err := loadEvent(db, eventID, viewerIDFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEventsCalendar(w, event.Title, fmt.Sprintf("event-%d.ics", event.ID), []*Event{event})
+}
+
+// userCalendarHandler serves the events a user hosts that the caller may
+// see.
+func userCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	hostID, err := userIDByUsername(username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	events, err := loadCalendarEvents(viewerIDFromRequest(r), "e.host_id = $3", hostID)
+	if err != nil {
+		log.Printf("Error loading calendar events: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEventsCalendar(w, username+" on airdate", username+".ics", events)
+}
+
+// subscriptionCalendarHandler serves the token owner's personal agenda:
+// events they host or plan to attend. Calendar apps can't send an
+// Authorization header, so the secret token in the URL identifies the user.
+func subscriptionCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	var owner struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	err := db.Get(&owner, `
+		SELECT u.id, u.username
+		FROM calendar_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+	`, hashCalendarToken(token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Calendar not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	events, err := loadCalendarEvents(owner.ID, `(e.host_id = $1 OR EXISTS(
+		SELECT 1 FROM event_rsvps r
+		WHERE r.event_id = e.id AND r.user_id = $1 AND r.status IN ('going', 'maybe')))`)
+	if err != nil {
+		log.Printf("Error loading calendar events: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeEventsCalendar(w, "airdate: "+owner.Username, "airdate.ics", events)
+}
+
+// regenerateCalendarTokenHandler issues a new subscription token, revoking
+// any previous one. The token is only shown in this response.
+func regenerateCalendarTokenHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Error generating calendar token: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(raw)
+
+	_, err = db.Exec(`
+		INSERT INTO calendar_tokens (user_id, token_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id)
+		DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = CURRENT_TIMESTAMP
+	`, userID, hashCalendarToken(token))
+	if err != nil {
+		log.Printf("Error saving calendar token: %v", err)
+		http.Error(w, `{"error":"Error generating calendar link"}`, http.StatusInternalServerError)
+		return
+	}
+
+	path := "/calendar/" + token + ".ics"
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Calendar link generated; any previous link no longer works",
+		"path":    path,
+		"url":     requestBaseURL(r) + path,
+	})
+}
+
+// requestBaseURL returns the scheme and host the request was made to,
+// honouring X-Forwarded-Proto from a proxy.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
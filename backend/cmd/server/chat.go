@@ -0,0 +1,918 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxChatMessageLength = 2000
+	// maxChatMentions bounds the notifications one message can send.
+	maxChatMentions = 10
+)
+
+var chatMentionPattern = regexp.MustCompile(`(?:^|\s)@([A-Za-z0-9_.-]+)`)
+
+// chatRoomParents maps each kind of chat room to the column naming its
+// parent. A room's members are always read from its parent, so joining or
+// leaving a squad, community or LFG group joins or leaves its chat too.
+var chatRoomParents = map[string]string{
+	"squad":     "squad_id",
+	"community": "community_id",
+	"lfg":       "lfg_post_id",
+}
+
+// ChatRoom is the group chat of a squad, community or LFG post. Ref is the
+// squad tag, community slug or post id.
+type ChatRoom struct {
+	ID            int        `json:"id" db:"id"`
+	Kind          string     `json:"kind" db:"kind"`
+	Ref           string     `json:"ref" db:"ref"`
+	Name          string     `json:"name" db:"name"`
+	UnreadCount   int        `json:"unreadCount" db:"unread_count"`
+	LastMessageAt *time.Time `json:"lastMessageAt,omitempty" db:"last_message_at"`
+}
+
+type ChatMessage struct {
+	ID        int64          `json:"id" db:"id"`
+	RoomID    int            `json:"roomId" db:"room_id"`
+	Sender    string         `json:"sender" db:"sender"`
+	Body      string         `json:"body" db:"body"`
+	Mentions  pq.StringArray `json:"mentions" db:"mentions"`
+	Deleted   bool           `json:"deleted" db:"deleted"`
+	EditedAt  *time.Time     `json:"editedAt,omitempty" db:"edited_at"`
+	CreatedAt time.Time      `json:"createdAt" db:"created_at"`
+}
+
+type ChatReadReceipt struct {
+	Username   string    `json:"username" db:"username"`
+	LastReadID int64     `json:"lastReadId" db:"last_read_id"`
+	ReadAt     time.Time `json:"readAt" db:"read_at"`
+}
+
+const chatRoomColumns = `
+	r.id,
+	CASE WHEN r.squad_id IS NOT NULL THEN 'squad'
+		WHEN r.community_id IS NOT NULL THEN 'community' ELSE 'lfg' END AS kind,
+	COALESCE(s.tag, c.slug, r.lfg_post_id::TEXT) AS ref,
+	COALESCE(s.name, c.name, p.game_name) AS name,
+	r.last_message_at`
+
+const chatRoomJoins = `
+	FROM chat_rooms r
+	LEFT JOIN squads s ON s.id = r.squad_id
+	LEFT JOIN communities c ON c.id = r.community_id
+	LEFT JOIN lfg_posts p ON p.id = r.lfg_post_id`
+
+// chatMessageColumns blanks the body and mentions of deleted messages.
+const chatMessageColumns = `
+	m.id, m.room_id, u.username AS sender,
+	CASE WHEN m.deleted_at IS NULL THEN m.body ELSE '' END AS body,
+	CASE WHEN m.deleted_at IS NULL THEN m.mentions ELSE '{}' END AS mentions,
+	m.deleted_at IS NOT NULL AS deleted, m.edited_at, m.created_at`
+
+func initChatTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS chat_rooms (
+		id SERIAL PRIMARY KEY,
+		squad_id INTEGER UNIQUE REFERENCES squads(id) ON DELETE CASCADE,
+		community_id INTEGER UNIQUE REFERENCES communities(id) ON DELETE CASCADE,
+		lfg_post_id INTEGER UNIQUE REFERENCES lfg_posts(id) ON DELETE CASCADE,
+		last_message_at TIMESTAMPTZ,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CHECK (num_nonnulls(squad_id, community_id, lfg_post_id) = 1)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS chat_messages (
+		id BIGSERIAL PRIMARY KEY,
+		room_id INTEGER NOT NULL REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		sender_id INTEGER NOT NULL REFERENCES users(id),
+		body TEXT NOT NULL,
+		mentions TEXT[] NOT NULL DEFAULT '{}',
+		edited_at TIMESTAMPTZ,
+		deleted_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS chat_messages_room_id_idx ON chat_messages (room_id, id DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS chat_reads (
+		room_id INTEGER NOT NULL REFERENCES chat_rooms(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		last_read_id BIGINT NOT NULL DEFAULT 0,
+		read_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (room_id, user_id)
+	);
+	`)
+	return err
+}
+
+// chatRoomMembers returns the members of a room's parent and their role
+// there: a squad or community role, or host or member of an LFG post.
+func chatRoomMembers(q queryer, kind string, parentID int) (map[int]string, error) {
+	var query string
+	switch kind {
+	case "squad":
+		query = "SELECT user_id, role FROM squad_members WHERE squad_id = $1"
+	case "community":
+		query = "SELECT user_id, role FROM community_members WHERE community_id = $1"
+	case "lfg":
+		query = `
+			SELECT user_id, 'host' AS role FROM lfg_posts WHERE id = $1
+			UNION
+			SELECT user_id, 'member' AS role FROM lfg_members WHERE post_id = $1 AND status = 'accepted'`
+	default:
+		return nil, fmt.Errorf("unknown chat room kind %q", kind)
+	}
+
+	var rows []struct {
+		UserID int    `db:"user_id"`
+		Role   string `db:"role"`
+	}
+	if err := q.Select(&rows, query, parentID); err != nil {
+		return nil, err
+	}
+	members := make(map[int]string, len(rows))
+	for _, row := range rows {
+		members[row.UserID] = row.Role
+	}
+	return members, nil
+}
+
+// chatRoomRole returns userID's role in the room's parent, or "" if they
+// aren't a member.
+func chatRoomRole(q queryer, kind string, parentID, userID int) (string, error) {
+	var query string
+	switch kind {
+	case "squad":
+		query = "SELECT role FROM squad_members WHERE squad_id = $1 AND user_id = $2"
+	case "community":
+		query = "SELECT role FROM community_members WHERE community_id = $1 AND user_id = $2"
+	case "lfg":
+		query = `
+			SELECT 'host' FROM lfg_posts WHERE id = $1 AND user_id = $2
+			UNION ALL
+			SELECT 'member' FROM lfg_members WHERE post_id = $1 AND user_id = $2 AND status = 'accepted'
+			LIMIT 1`
+	default:
+		return "", fmt.Errorf("unknown chat room kind %q", kind)
+	}
+
+	var role string
+	err := q.Get(&role, query, parentID, userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// canModerateChat reports whether a role can delete other people's
+// messages.
+func canModerateChat(role string) bool {
+	return role == "owner" || role == "captain" || role == "moderator" || role == "host"
+}
+
+// chatAccess is a room and the caller's role in it.
+type chatAccess struct {
+	RoomID   int
+	Kind     string
+	ParentID int
+	UserID   int
+	Username string
+	Role     string
+}
+
+// loadChatAccess checks that userID belongs to the room.
+func loadChatAccess(roomID, userID int) (*chatAccess, error) {
+	var room struct {
+		Kind     string `db:"kind"`
+		ParentID int    `db:"parent_id"`
+	}
+	err := db.Get(&room, `
+		SELECT CASE WHEN squad_id IS NOT NULL THEN 'squad'
+				WHEN community_id IS NOT NULL THEN 'community' ELSE 'lfg' END AS kind,
+			COALESCE(squad_id, community_id, lfg_post_id) AS parent_id
+		FROM chat_rooms WHERE id = $1
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := chatRoomRole(db, room.Kind, room.ParentID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		// Rooms are private to members, so outsiders see nothing at all
+		return nil, sql.ErrNoRows
+	}
+	return &chatAccess{RoomID: roomID, Kind: room.Kind, ParentID: room.ParentID, UserID: userID, Role: role}, nil
+}
+
+// chatAccessFromRequest loads the room in the URL for the caller.
+func chatAccessFromRequest(w http.ResponseWriter, r *http.Request) (*chatAccess, bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	roomID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid room id"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	access, err := loadChatAccess(roomID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Room not found"}`, http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error loading chat room: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+	access.Username = claims.Username
+	return access, true
+}
+
+// publishToRoom pushes an event to every member connected right now.
+func publishToRoom(access *chatAccess, kind string, payload interface{}) {
+	members, err := chatRoomMembers(db, access.Kind, access.ParentID)
+	if err != nil {
+		log.Printf("Error loading members of chat room %d: %v", access.RoomID, err)
+		return
+	}
+	if err := realtime.publish(chatMemberIDs(members), kind, payload); err != nil {
+		log.Printf("Error publishing to chat room %d: %v", access.RoomID, err)
+	}
+}
+
+// parseChatMentions returns the members mentioned in body, by username.
+func parseChatMentions(body string, members map[int]string, senderID int) (map[string]int, error) {
+	var usernames []string
+	for _, match := range chatMentionPattern.FindAllStringSubmatch(body, -1) {
+		name := strings.TrimRight(match[1], ".-")
+		if name != "" && !containsString(usernames, name) {
+			usernames = append(usernames, name)
+		}
+		if len(usernames) == maxChatMentions {
+			break
+		}
+	}
+	mentioned := make(map[string]int)
+	if len(usernames) == 0 {
+		return mentioned, nil
+	}
+
+	var users []struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	if err := db.Select(&users, "SELECT id, username FROM users WHERE username = ANY($1)", pq.Array(usernames)); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if _, ok := members[user.ID]; ok && user.ID != senderID {
+			mentioned[user.Username] = user.ID
+		}
+	}
+	return mentioned, nil
+}
+
+func validateChatBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" || len(body) > maxChatMessageLength {
+		return "", fmt.Errorf("Message must be between 1 and %d characters", maxChatMessageLength)
+	}
+	return body, nil
+}
+
+// sendChatMessage stores a message, pushes it to the room and notifies
+// anyone mentioned.
+func sendChatMessage(access *chatAccess, body string) (*ChatMessage, error) {
+	members, err := chatRoomMembers(db, access.Kind, access.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	mentioned, err := parseChatMentions(body, members, access.UserID)
+	if err != nil {
+		return nil, err
+	}
+	mentions := make([]string, 0, len(mentioned))
+	for username := range mentioned {
+		mentions = append(mentions, username)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	message := ChatMessage{RoomID: access.RoomID, Sender: access.Username, Body: body, Mentions: mentions}
+	err = tx.QueryRow(`
+		INSERT INTO chat_messages (room_id, sender_id, body, mentions)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, access.RoomID, access.UserID, body, pq.Array(mentions)).Scan(&message.ID, &message.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE chat_rooms SET last_message_at = $2 WHERE id = $1", access.RoomID, message.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := markChatRead(tx, access, message.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := realtime.publish(chatMemberIDs(members), "chat_message", message); err != nil {
+		log.Printf("Error publishing to chat room %d: %v", access.RoomID, err)
+	}
+	for _, userID := range mentioned {
+		notify(userID, "chat_mention", map[string]interface{}{
+			"roomId":    access.RoomID,
+			"messageId": message.ID,
+			"from":      access.Username,
+		})
+	}
+	return &message, nil
+}
+
+// markChatRead moves the caller's read marker forward to messageID.
+func markChatRead(tx execQueryer, access *chatAccess, messageID int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO chat_reads (room_id, user_id, last_read_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE
+		SET last_read_id = EXCLUDED.last_read_id, read_at = NOW()
+		WHERE chat_reads.last_read_id < EXCLUDED.last_read_id
+	`, access.RoomID, access.UserID, messageID)
+	return err
+}
+
+// readChatRoom marks the room read up to messageID, or to its latest
+// message if messageID is 0, and shares the receipt with the room.
+func readChatRoom(access *chatAccess, messageID int64) error {
+	var latest int64
+	err := db.Get(&latest, `
+		SELECT COALESCE(MAX(id), 0) FROM chat_messages
+		WHERE room_id = $1 AND ($2 = 0 OR id <= $2)
+	`, access.RoomID, messageID)
+	if err != nil {
+		return err
+	}
+	if latest == 0 {
+		return nil
+	}
+	if err := markChatRead(db, access, latest); err != nil {
+		return err
+	}
+
+	publishToRoom(access, "chat_read", map[string]interface{}{
+		"roomId":     access.RoomID,
+		"username":   access.Username,
+		"lastReadId": latest,
+	})
+	return nil
+}
+
+// openChatRoomHandler returns the chat room of a squad, community or LFG
+// post the caller belongs to, creating it on first use.
+func openChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	kind := mux.Vars(r)["kind"]
+	ref := mux.Vars(r)["ref"]
+	column, ok := chatRoomParents[kind]
+	if !ok {
+		http.Error(w, `{"error":"Unknown room kind"}`, http.StatusNotFound)
+		return
+	}
+
+	var parentID int
+	var err error
+	switch kind {
+	case "squad":
+		err = db.Get(&parentID, "SELECT id FROM squads WHERE tag = $1", strings.ToUpper(ref))
+	case "community":
+		err = db.Get(&parentID, "SELECT id FROM communities WHERE slug = $1", ref)
+	case "lfg":
+		parentID, err = strconv.Atoi(ref)
+		if err != nil {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Room not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	role, err := chatRoomRole(db, kind, parentID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		http.Error(w, `{"error":"Room not found"}`, http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO chat_rooms (`+column+`) VALUES ($1) ON CONFLICT (`+column+`) DO NOTHING`, parentID)
+	if err != nil {
+		log.Printf("Error creating chat room: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var room ChatRoom
+	err = db.Get(&room, `
+		SELECT `+chatRoomColumns+`,
+			(SELECT COUNT(*) FROM chat_messages m
+			WHERE m.room_id = r.id AND m.sender_id <> $2 AND m.deleted_at IS NULL
+			AND m.id > COALESCE((SELECT last_read_id FROM chat_reads cr
+				WHERE cr.room_id = r.id AND cr.user_id = $2), 0)) AS unread_count
+		`+chatRoomJoins+`
+		WHERE r.`+column+` = $1
+	`, parentID, userID)
+	if err != nil {
+		log.Printf("Error loading chat room: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(room)
+}
+
+// listChatRoomsHandler lists the rooms the caller is in, most recently
+// active first.
+func listChatRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rooms := []ChatRoom{}
+	err = db.Select(&rooms, `
+		SELECT `+chatRoomColumns+`,
+			(SELECT COUNT(*) FROM chat_messages m
+			WHERE m.room_id = r.id AND m.sender_id <> $1 AND m.deleted_at IS NULL
+			AND m.id > COALESCE((SELECT last_read_id FROM chat_reads cr
+				WHERE cr.room_id = r.id AND cr.user_id = $1), 0)) AS unread_count
+		`+chatRoomJoins+`
+		WHERE r.squad_id IN (SELECT squad_id FROM squad_members WHERE user_id = $1)
+		OR r.community_id IN (SELECT community_id FROM community_members WHERE user_id = $1)
+		OR r.lfg_post_id IN (
+			SELECT id FROM lfg_posts WHERE user_id = $1
+			UNION
+			SELECT post_id FROM lfg_members WHERE user_id = $1 AND status = 'accepted')
+		ORDER BY r.last_message_at DESC NULLS LAST, r.id DESC
+	`, userID)
+	if err != nil {
+		log.Printf("Error listing chat rooms: %v", err)
+		http.Error(w, `{"error":"Error listing rooms"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// chatHistoryHandler pages backwards through a room, newest first, the
+// same way as direct message history.
+func chatHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+
+	access, ok := chatAccessFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	messages := []ChatMessage{}
+	err := db.Select(&messages, `
+		SELECT `+chatMessageColumns+`
+		FROM chat_messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.room_id = $1 AND ($2 = 0 OR m.id < $2)
+		ORDER BY m.id DESC
+		LIMIT $3
+	`, access.RoomID, before, limit+1)
+	if err != nil {
+		log.Printf("Error loading chat messages: %v", err)
+		http.Error(w, `{"error":"Error loading messages"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"messages": messages}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		response["messages"] = messages
+		response["nextCursor"] = strconv.FormatInt(messages[limit-1].ID, 10)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func postChatMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, err := validateChatBody(requestBody.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	access, ok := chatAccessFromRequest(w, r)
+	if !ok {
+		return
+	}
+	message, err := sendChatMessage(access, body)
+	if err != nil {
+		log.Printf("Error sending chat message: %v", err)
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(message)
+}
+
+// lockChatMessage locks a message in the caller's room.
+func lockChatMessage(w http.ResponseWriter, r *http.Request, tx queryer, access *chatAccess) (int64, int, bool) {
+	messageID, err := strconv.ParseInt(mux.Vars(r)["messageId"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid message id"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	var message struct {
+		SenderID int  `db:"sender_id"`
+		Deleted  bool `db:"deleted"`
+	}
+	err = tx.Get(&message, `
+		SELECT sender_id, deleted_at IS NOT NULL AS deleted FROM chat_messages
+		WHERE id = $1 AND room_id = $2 FOR UPDATE
+	`, messageID, access.RoomID)
+	if err == nil && message.Deleted {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Message not found"}`, http.StatusNotFound)
+			return 0, 0, false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	return messageID, message.SenderID, true
+}
+
+func loadChatMessage(messageID int64) (*ChatMessage, error) {
+	var message ChatMessage
+	err := db.Get(&message, `
+		SELECT `+chatMessageColumns+`
+		FROM chat_messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.id = $1
+	`, messageID)
+	return &message, err
+}
+
+// editChatMessageHandler lets the sender rewrite a message. Mentions are
+// re-read from the new text, and only newly mentioned members are
+// notified.
+func editChatMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, err := validateChatBody(requestBody.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	access, ok := chatAccessFromRequest(w, r)
+	if !ok {
+		return
+	}
+	members, err := chatRoomMembers(db, access.Kind, access.ParentID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	mentioned, err := parseChatMentions(body, members, access.UserID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	mentions := make([]string, 0, len(mentioned))
+	for username := range mentioned {
+		mentions = append(mentions, username)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	messageID, senderID, ok := lockChatMessage(w, r, tx, access)
+	if !ok {
+		return
+	}
+	if senderID != access.UserID {
+		http.Error(w, `{"error":"You can only edit your own messages"}`, http.StatusForbidden)
+		return
+	}
+
+	var previous pq.StringArray
+	if err := tx.Get(&previous, "SELECT mentions FROM chat_messages WHERE id = $1", messageID); err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE chat_messages SET body = $2, mentions = $3, edited_at = NOW() WHERE id = $1
+	`, messageID, body, pq.Array(mentions))
+	if err != nil {
+		http.Error(w, `{"error":"Error editing message"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error editing message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	message, err := loadChatMessage(messageID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	publishToRoom(access, "chat_message_edited", message)
+	for username, userID := range mentioned {
+		if !containsString(previous, username) {
+			notify(userID, "chat_mention", map[string]interface{}{
+				"roomId":    access.RoomID,
+				"messageId": messageID,
+				"from":      access.Username,
+			})
+		}
+	}
+	json.NewEncoder(w).Encode(message)
+}
+
+// deleteChatMessageHandler removes a message. Senders can delete their
+// own, and squad owners and captains, community owners and moderators and
+// LFG hosts can delete anyone's. The message stays in history as deleted
+// so replies still make sense.
+func deleteChatMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access, ok := chatAccessFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	messageID, senderID, ok := lockChatMessage(w, r, tx, access)
+	if !ok {
+		return
+	}
+	if senderID != access.UserID && !canModerateChat(access.Role) {
+		http.Error(w, `{"error":"You can't delete this message"}`, http.StatusForbidden)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE chat_messages SET deleted_at = NOW() WHERE id = $1", messageID); err != nil {
+		http.Error(w, `{"error":"Error deleting message"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error deleting message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	publishToRoom(access, "chat_message_deleted", map[string]interface{}{
+		"roomId":    access.RoomID,
+		"messageId": messageID,
+	})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Message deleted"})
+}
+
+// markChatReadHandler marks the room read up to the given message, or
+// entirely if none is given.
+func markChatReadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		MessageID int64 `json:"messageId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	access, ok := chatAccessFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := readChatRoom(access, requestBody.MessageID); err != nil {
+		log.Printf("Error marking chat read: %v", err)
+		http.Error(w, `{"error":"Error marking room read"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Room marked read"})
+}
+
+// chatReadReceiptsHandler lists how far each member has read.
+func chatReadReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	access, ok := chatAccessFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Former members keep their rows but aren't shown
+	members, err := chatRoomMembers(db, access.Kind, access.ParentID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	receipts := []ChatReadReceipt{}
+	err = db.Select(&receipts, `
+		SELECT u.username, cr.last_read_id, cr.read_at
+		FROM chat_reads cr
+		JOIN users u ON u.id = cr.user_id
+		WHERE cr.room_id = $1 AND cr.user_id = ANY($2)
+		ORDER BY cr.last_read_id DESC, u.username
+	`, access.RoomID, pq.Array(chatMemberIDs(members)))
+	if err != nil {
+		log.Printf("Error loading read receipts: %v", err)
+		http.Error(w, `{"error":"Error loading read receipts"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(receipts)
+}
+
+func chatMemberIDs(members map[int]string) []int {
+	userIDs := make([]int, 0, len(members))
+	for userID := range members {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+// registerChatRealtime lets clients send messages, typing indicators and
+// read receipts over the WebSocket as well as REST.
+func registerChatRealtime(hub *realtimeHub) {
+	roomAccess := func(client *realtimeClient, roomID int) (*chatAccess, error) {
+		access, err := loadChatAccess(roomID, client.userID)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("Room not found")
+		}
+		if err != nil {
+			log.Printf("Error loading chat room: %v", err)
+			return nil, fmt.Errorf("Internal server error")
+		}
+		access.Username = client.username
+		return access, nil
+	}
+
+	hub.handle("chat_send", func(client *realtimeClient, payload json.RawMessage) error {
+		var frame struct {
+			RoomID int    `json:"roomId"`
+			Body   string `json:"body"`
+		}
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			return fmt.Errorf("Invalid payload")
+		}
+		body, err := validateChatBody(frame.Body)
+		if err != nil {
+			return err
+		}
+		access, err := roomAccess(client, frame.RoomID)
+		if err != nil {
+			return err
+		}
+		if _, err := sendChatMessage(access, body); err != nil {
+			log.Printf("Error sending chat message: %v", err)
+			return fmt.Errorf("Error sending message")
+		}
+		return nil
+	})
+
+	// Typing indicators aren't stored; clients show them for a few
+	// seconds after the last one arrives
+	hub.handle("chat_typing", func(client *realtimeClient, payload json.RawMessage) error {
+		var frame struct {
+			RoomID int `json:"roomId"`
+		}
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			return fmt.Errorf("Invalid payload")
+		}
+		access, err := roomAccess(client, frame.RoomID)
+		if err != nil {
+			return err
+		}
+		publishToRoom(access, "chat_typing", map[string]interface{}{
+			"roomId":   access.RoomID,
+			"username": access.Username,
+		})
+		return nil
+	})
+
+	hub.handle("chat_read", func(client *realtimeClient, payload json.RawMessage) error {
+		var frame struct {
+			RoomID    int   `json:"roomId"`
+			MessageID int64 `json:"messageId"`
+		}
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			return fmt.Errorf("Invalid payload")
+		}
+		access, err := roomAccess(client, frame.RoomID)
+		if err != nil {
+			return err
+		}
+		if err := readChatRoom(access, frame.MessageID); err != nil {
+			log.Printf("Error marking chat read: %v", err)
+			return fmt.Errorf("Error marking room read")
+		}
+		return nil
+	})
+}
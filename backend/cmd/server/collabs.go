@@ -0,0 +1,942 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	maxCollabTimes         = 5
+	maxCollabMessageLength = 2000
+	maxCollabTitleLength   = maxEventTitleLength
+)
+
+var collabFormats = []string{"co_stream", "video", "tournament"}
+
+// CollabProposal is a collaboration being negotiated between two creators.
+// Each counter-proposal starts a new round of times; only the latest round
+// can be accepted, and only by the creator whose turn it is.
+type CollabProposal struct {
+	ID        int          `json:"id" db:"id"`
+	Proposer  string       `json:"proposer" db:"proposer"`
+	Recipient string       `json:"recipient" db:"recipient"`
+	GameName  string       `json:"gameName" db:"game_name"`
+	Format    string       `json:"format" db:"format"`
+	Title     string       `json:"title" db:"title"`
+	TimeZone  string       `json:"timeZone" db:"time_zone"`
+	Status    string       `json:"status" db:"status"`
+	Awaiting  *string      `json:"awaiting,omitempty" db:"awaiting"`
+	Round     int          `json:"round" db:"round"`
+	EventID   *int         `json:"eventId,omitempty" db:"event_id"`
+	Times     []CollabTime `json:"times" db:"-"`
+	CreatedAt time.Time    `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time    `json:"updatedAt" db:"updated_at"`
+}
+
+type CollabTime struct {
+	ID         int       `json:"id" db:"id"`
+	ProposedBy string    `json:"proposedBy" db:"proposed_by"`
+	StartsAt   time.Time `json:"startsAt" db:"starts_at"`
+	EndsAt     time.Time `json:"endsAt" db:"ends_at"`
+}
+
+type CollabMessage struct {
+	ID        int       `json:"id" db:"id"`
+	Sender    string    `json:"sender" db:"sender"`
+	Kind      string    `json:"kind" db:"kind"`
+	Body      string    `json:"body" db:"body"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+const collabColumns = `
+	c.id, p.username AS proposer, r.username AS recipient, c.game_name, c.format, c.title,
+	c.time_zone, c.status, a.username AS awaiting, c.round, c.event_id, c.created_at, c.updated_at`
+
+const collabJoins = `
+	FROM collab_proposals c
+	JOIN users p ON p.id = c.proposer_id
+	JOIN users r ON r.id = c.recipient_id
+	LEFT JOIN users a ON a.id = c.awaiting_id`
+
+func initCollabTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS collab_proposals (
+		id SERIAL PRIMARY KEY,
+		proposer_id INTEGER NOT NULL REFERENCES users(id),
+		recipient_id INTEGER NOT NULL REFERENCES users(id),
+		game_name VARCHAR(255) NOT NULL,
+		format VARCHAR(20) NOT NULL,
+		title VARCHAR(200) NOT NULL,
+		time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		awaiting_id INTEGER REFERENCES users(id),
+		round INTEGER NOT NULL DEFAULT 1,
+		event_id INTEGER REFERENCES events(id) ON DELETE SET NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CHECK (proposer_id <> recipient_id)
+	);
+	CREATE INDEX IF NOT EXISTS collab_proposals_proposer_id_idx ON collab_proposals (proposer_id);
+	CREATE INDEX IF NOT EXISTS collab_proposals_recipient_id_idx ON collab_proposals (recipient_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS collab_times (
+		id SERIAL PRIMARY KEY,
+		proposal_id INTEGER NOT NULL REFERENCES collab_proposals(id) ON DELETE CASCADE,
+		round INTEGER NOT NULL,
+		proposed_by INTEGER NOT NULL REFERENCES users(id),
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		CHECK (ends_at > starts_at)
+	);
+	CREATE INDEX IF NOT EXISTS collab_times_proposal_id_idx ON collab_times (proposal_id, round);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS collab_messages (
+		id SERIAL PRIMARY KEY,
+		proposal_id INTEGER NOT NULL REFERENCES collab_proposals(id) ON DELETE CASCADE,
+		sender_id INTEGER NOT NULL REFERENCES users(id),
+		kind VARCHAR(20) NOT NULL DEFAULT 'message',
+		body TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS collab_messages_proposal_id_idx ON collab_messages (proposal_id, id);
+	`)
+	return err
+}
+
+// isCreator reports whether the user has connected a streaming account.
+func isCreator(q queryer, userID int) (bool, error) {
+	var creator bool
+	err := q.Get(&creator, `
+		SELECT COALESCE(twitch_username, '') <> '' OR COALESCE(youtube_channel, '') <> ''
+		FROM users WHERE id = $1
+	`, userID)
+	return creator, err
+}
+
+// collabTimeInput is a proposed time slot.
+type collabTimeInput struct {
+	StartsAt time.Time `json:"startsAt" db:"starts_at"`
+	EndsAt   time.Time `json:"endsAt" db:"ends_at"`
+}
+
+func validateCollabTimes(times []collabTimeInput) error {
+	if len(times) == 0 || len(times) > maxCollabTimes {
+		return fmt.Errorf("Propose between 1 and %d times", maxCollabTimes)
+	}
+	now := time.Now()
+	for _, t := range times {
+		if !t.EndsAt.After(t.StartsAt) {
+			return fmt.Errorf("Each time must end after it starts")
+		}
+		if t.EndsAt.Sub(t.StartsAt) > maxEventDuration {
+			return fmt.Errorf("Each time can last at most 48 hours")
+		}
+		if !t.StartsAt.After(now) {
+			return fmt.Errorf("Proposed times must be in the future")
+		}
+	}
+	return nil
+}
+
+func normalizeCollabMessage(message string) (string, error) {
+	message = strings.TrimSpace(message)
+	if len(message) > maxCollabMessageLength {
+		return "", fmt.Errorf("Message must be at most %d characters", maxCollabMessageLength)
+	}
+	return message, nil
+}
+
+func insertCollabTimes(tx execQueryer, proposalID, round, proposedBy int, times []collabTimeInput) error {
+	for _, t := range times {
+		_, err := tx.Exec(`
+			INSERT INTO collab_times (proposal_id, round, proposed_by, starts_at, ends_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, proposalID, round, proposedBy, t.StartsAt, t.EndsAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertCollabMessage(tx execQueryer, proposalID, senderID int, kind, body string) error {
+	_, err := tx.Exec(`
+		INSERT INTO collab_messages (proposal_id, sender_id, kind, body)
+		VALUES ($1, $2, $3, $4)
+	`, proposalID, senderID, kind, body)
+	return err
+}
+
+// loadCollab returns the proposal if userID is one of its two creators,
+// and sql.ErrNoRows otherwise.
+func loadCollab(q queryer, proposalID, userID int) (*CollabProposal, error) {
+	var proposal CollabProposal
+	err := q.Get(&proposal, `
+		SELECT `+collabColumns+collabJoins+`
+		WHERE c.id = $1 AND (c.proposer_id = $2 OR c.recipient_id = $2)
+	`, proposalID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal.Times = []CollabTime{}
+	err = q.Select(&proposal.Times, `
+		SELECT t.id, u.username AS proposed_by, t.starts_at, t.ends_at
+		FROM collab_times t
+		JOIN users u ON u.id = t.proposed_by
+		WHERE t.proposal_id = $1 AND t.round = $2
+		ORDER BY t.starts_at, t.id
+	`, proposalID, proposal.Round)
+	if err != nil {
+		return nil, err
+	}
+	return &proposal, nil
+}
+
+func createCollabHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Recipient string            `json:"recipient"`
+		GameName  string            `json:"gameName"`
+		Format    string            `json:"format"`
+		Title     string            `json:"title"`
+		Message   string            `json:"message"`
+		TimeZone  string            `json:"timeZone"`
+		Times     []collabTimeInput `json:"times"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	game, ok := lookupCatalogGame(requestBody.GameName)
+	if !ok {
+		http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+		return
+	}
+	format := strings.ToLower(strings.TrimSpace(requestBody.Format))
+	if !containsString(collabFormats, format) {
+		writeJSONError(w, http.StatusBadRequest, "Format must be one of "+strings.Join(collabFormats, ", "))
+		return
+	}
+	if err := validateCollabTimes(requestBody.Times); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	message, err := normalizeCollabMessage(requestBody.Message)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var proposer struct {
+		ID       int            `db:"id"`
+		TimeZone sql.NullString `db:"time_zone"`
+	}
+	if err := db.Get(&proposer, "SELECT id, time_zone FROM users WHERE username = $1", claims.Username); err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	zone := "UTC"
+	if proposer.TimeZone.Valid {
+		zone = proposer.TimeZone.String
+	}
+	if strings.TrimSpace(requestBody.TimeZone) != "" {
+		zone = requestBody.TimeZone
+	}
+	location, err := loadTimeZone(zone)
+	if err != nil {
+		http.Error(w, `{"error":"Unknown time zone"}`, http.StatusBadRequest)
+		return
+	}
+
+	var recipient struct {
+		ID        int  `db:"id"`
+		IsPrivate bool `db:"is_private"`
+	}
+	err = db.Get(&recipient, "SELECT id, is_private FROM users WHERE username = $1", requestBody.Recipient)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if recipient.ID == proposer.ID {
+		http.Error(w, `{"error":"You cannot collaborate with yourself"}`, http.StatusBadRequest)
+		return
+	}
+
+	for _, check := range []struct {
+		userID  int
+		message string
+	}{
+		{proposer.ID, "Connect Twitch or YouTube to propose collaborations"},
+		{recipient.ID, "This user hasn't connected Twitch or YouTube"},
+	} {
+		creator, err := isCreator(db, check.userID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !creator {
+			writeJSONError(w, http.StatusBadRequest, check.message)
+			return
+		}
+	}
+
+	// Private creators only hear from people they've let follow them
+	if recipient.IsPrivate {
+		var follows bool
+		err := db.Get(&follows, `
+			SELECT EXISTS(SELECT 1 FROM followers WHERE follower_id = $1 AND following_id = $2)
+		`, proposer.ID, recipient.ID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !follows {
+			http.Error(w, `{"error":"This account is private"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	title := strings.TrimSpace(requestBody.Title)
+	if title == "" {
+		title = fmt.Sprintf("%s × %s", claims.Username, requestBody.Recipient)
+	}
+	if len(title) > maxCollabTitleLength {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Title must be at most %d characters", maxCollabTitleLength))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var proposalID int
+	err = tx.QueryRow(`
+		INSERT INTO collab_proposals (proposer_id, recipient_id, game_name, format, title, time_zone, awaiting_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $2)
+		RETURNING id
+	`, proposer.ID, recipient.ID, game, format, title, location.String()).Scan(&proposalID)
+	if err != nil {
+		log.Printf("Error creating collab proposal: %v", err)
+		http.Error(w, `{"error":"Error creating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := insertCollabTimes(tx, proposalID, 1, proposer.ID, requestBody.Times); err != nil {
+		http.Error(w, `{"error":"Error creating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := insertCollabMessage(tx, proposalID, proposer.ID, "proposal", message); err != nil {
+		http.Error(w, `{"error":"Error creating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error creating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+
+	notify(recipient.ID, "collab_proposed", map[string]interface{}{
+		"proposalId": proposalID,
+		"from":       claims.Username,
+	})
+
+	proposal, err := loadCollab(db, proposalID, proposer.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(proposal)
+}
+
+// listCollabsHandler lists the caller's proposals, newest activity first.
+// role narrows to incoming or outgoing ones and status to one state.
+func listCollabsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	condition := "(c.proposer_id = $1 OR c.recipient_id = $1)"
+	switch r.URL.Query().Get("role") {
+	case "":
+	case "incoming":
+		condition = "c.recipient_id = $1"
+	case "outgoing":
+		condition = "c.proposer_id = $1"
+	default:
+		http.Error(w, `{"error":"Role must be incoming or outgoing"}`, http.StatusBadRequest)
+		return
+	}
+	args := []interface{}{userID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		condition += " AND c.status = $2"
+		args = append(args, status)
+	}
+
+	proposals := []CollabProposal{}
+	err = db.Select(&proposals, `
+		SELECT `+collabColumns+collabJoins+`
+		WHERE `+condition+`
+		ORDER BY c.updated_at DESC, c.id DESC
+		LIMIT 100
+	`, args...)
+	if err != nil {
+		log.Printf("Error listing collab proposals: %v", err)
+		http.Error(w, `{"error":"Error listing proposals"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range proposals {
+		proposals[i].Times = []CollabTime{}
+	}
+
+	json.NewEncoder(w).Encode(proposals)
+}
+
+func collabIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid proposal id"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// getCollabHandler returns a proposal with its current times and the full
+// negotiation thread.
+func getCollabHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	proposalID, ok := collabIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	proposal, err := loadCollab(db, proposalID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Proposal not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	thread := []CollabMessage{}
+	err = db.Select(&thread, `
+		SELECT m.id, u.username AS sender, m.kind, m.body, m.created_at
+		FROM collab_messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.proposal_id = $1
+		ORDER BY m.id
+	`, proposalID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"proposal": proposal,
+		"thread":   thread,
+	})
+}
+
+// collabAction is a locked proposal the caller takes part in.
+type collabAction struct {
+	ID          int
+	UserID      int
+	OtherID     int
+	ProposerID  int
+	RecipientID int
+	AwaitingID  *int
+	Status      string
+	Round       int
+}
+
+// lockCollab locks a proposal the caller is party to.
+func lockCollab(w http.ResponseWriter, r *http.Request, tx queryer, userID int) (*collabAction, bool) {
+	proposalID, ok := collabIDFromRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	var row struct {
+		ProposerID  int    `db:"proposer_id"`
+		RecipientID int    `db:"recipient_id"`
+		AwaitingID  *int   `db:"awaiting_id"`
+		Status      string `db:"status"`
+		Round       int    `db:"round"`
+	}
+	err := tx.Get(&row, `
+		SELECT proposer_id, recipient_id, awaiting_id, status, round
+		FROM collab_proposals
+		WHERE id = $1 AND (proposer_id = $2 OR recipient_id = $2)
+		FOR UPDATE
+	`, proposalID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Proposal not found"}`, http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	action := &collabAction{
+		ID:          proposalID,
+		UserID:      userID,
+		OtherID:     row.ProposerID,
+		ProposerID:  row.ProposerID,
+		RecipientID: row.RecipientID,
+		AwaitingID:  row.AwaitingID,
+		Status:      row.Status,
+		Round:       row.Round,
+	}
+	if userID == row.ProposerID {
+		action.OtherID = row.RecipientID
+	}
+	return action, true
+}
+
+// requireTurn checks that the proposal is open and waiting on the caller.
+func (a *collabAction) requireTurn(w http.ResponseWriter) bool {
+	if a.Status != "pending" {
+		http.Error(w, `{"error":"Proposal is no longer open"}`, http.StatusConflict)
+		return false
+	}
+	if a.AwaitingID == nil || *a.AwaitingID != a.UserID {
+		http.Error(w, `{"error":"Waiting for the other creator to respond"}`, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// finishCollabAction commits tx, notifies the other creator and responds
+// with the updated proposal. It reports whether tx was committed.
+func finishCollabAction(w http.ResponseWriter, tx *sqlx.Tx, a *collabAction, kind, username string) bool {
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return false
+	}
+
+	notify(a.OtherID, kind, map[string]interface{}{
+		"proposalId": a.ID,
+		"from":       username,
+	})
+
+	proposal, err := loadCollab(db, a.ID, a.UserID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return true
+	}
+	json.NewEncoder(w).Encode(proposal)
+	return true
+}
+
+// postCollabMessageHandler adds a message to the thread. Either creator
+// can write at any time, including after the proposal is settled.
+func postCollabMessageHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body, err := normalizeCollabMessage(requestBody.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body == "" {
+		http.Error(w, `{"error":"Message is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	action, ok := lockCollab(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if err := insertCollabMessage(tx, action.ID, userID, "message", body); err != nil {
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE collab_proposals SET updated_at = CURRENT_TIMESTAMP WHERE id = $1", action.ID); err != nil {
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+	finishCollabAction(w, tx, action, "collab_message", claims.Username)
+}
+
+// counterCollabHandler replaces the proposed times with new ones, and
+// optionally the game or format, handing the turn back to the other
+// creator.
+func counterCollabHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Times    []collabTimeInput `json:"times"`
+		GameName *string           `json:"gameName"`
+		Format   *string           `json:"format"`
+		Message  string            `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if err := validateCollabTimes(requestBody.Times); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	message, err := normalizeCollabMessage(requestBody.Message)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var game, format *string
+	if requestBody.GameName != nil {
+		name, ok := lookupCatalogGame(*requestBody.GameName)
+		if !ok {
+			http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+			return
+		}
+		game = &name
+	}
+	if requestBody.Format != nil {
+		value := strings.ToLower(strings.TrimSpace(*requestBody.Format))
+		if !containsString(collabFormats, value) {
+			writeJSONError(w, http.StatusBadRequest, "Format must be one of "+strings.Join(collabFormats, ", "))
+			return
+		}
+		format = &value
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	action, ok := lockCollab(w, r, tx, userID)
+	if !ok || !action.requireTurn(w) {
+		return
+	}
+
+	round := action.Round + 1
+	_, err = tx.Exec(`
+		UPDATE collab_proposals
+		SET round = $2, awaiting_id = $3, game_name = COALESCE($4, game_name),
+			format = COALESCE($5, format), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, action.ID, round, action.OtherID, game, format)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := insertCollabTimes(tx, action.ID, round, userID, requestBody.Times); err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := insertCollabMessage(tx, action.ID, userID, "counter", message); err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	finishCollabAction(w, tx, action, "collab_countered", claims.Username)
+}
+
+// acceptCollabHandler accepts one of the current times and schedules the
+// collaboration as an event hosted by the original proposer, with the
+// other creator invited and going.
+func acceptCollabHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		TimeID  int    `json:"timeId"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	message, err := normalizeCollabMessage(requestBody.Message)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	action, ok := lockCollab(w, r, tx, userID)
+	if !ok || !action.requireTurn(w) {
+		return
+	}
+
+	var chosen collabTimeInput
+	err = tx.Get(&chosen, `
+		SELECT starts_at, ends_at FROM collab_times
+		WHERE id = $1 AND proposal_id = $2 AND round = $3
+	`, requestBody.TimeID, action.ID, action.Round)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Pick one of the currently proposed times"}`, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !chosen.StartsAt.After(time.Now()) {
+		http.Error(w, `{"error":"That time has already passed; counter-propose a new one"}`, http.StatusConflict)
+		return
+	}
+
+	var proposal struct {
+		GameName string `db:"game_name"`
+		Format   string `db:"format"`
+		Title    string `db:"title"`
+		TimeZone string `db:"time_zone"`
+	}
+	err = tx.Get(&proposal, "SELECT game_name, format, title, time_zone FROM collab_proposals WHERE id = $1", action.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Co-streams go out publicly on the host's channel; recording a video
+	// is just between the two
+	fields := eventFields{Kind: "session", Visibility: "public", TimeZone: proposal.TimeZone}
+	input := eventInput{
+		Title:    &proposal.Title,
+		GameName: &proposal.GameName,
+		StartsAt: &chosen.StartsAt,
+		EndsAt:   &chosen.EndsAt,
+	}
+	switch proposal.Format {
+	case "co_stream":
+		fields.Kind = "stream"
+		var platform string
+		err := tx.Get(&platform, `
+			SELECT CASE WHEN COALESCE(twitch_username, '') <> '' THEN 'twitch' ELSE 'youtube' END
+			FROM users WHERE id = $1
+		`, action.ProposerID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		input.Platform = &platform
+	case "video":
+		fields.Visibility = "invite"
+	}
+	err = fields.apply(input)
+	if err == nil {
+		err = fields.fillStreamURL(action.ProposerID)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var eventID int
+	err = tx.QueryRow(`
+		INSERT INTO events (host_id, title, description, game_name, kind, starts_at, ends_at,
+			time_zone, visibility, series_ends_at, platform, stream_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id
+	`, action.ProposerID, fields.Title, fields.Description, fields.GameName, fields.Kind, fields.StartsAt,
+		fields.EndsAt, fields.TimeZone, fields.Visibility, fields.SeriesEndsAt, fields.Platform,
+		fields.StreamURL).Scan(&eventID)
+	if err != nil {
+		log.Printf("Error creating collab event: %v", err)
+		http.Error(w, `{"error":"Error scheduling collaboration"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO event_invites (event_id, user_id) VALUES ($1, $2)
+	`, eventID, action.RecipientID)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO event_rsvps (event_id, user_id, status) VALUES ($1, $2, 'going')
+		`, eventID, action.RecipientID)
+	}
+	if err != nil {
+		log.Printf("Error adding collaborator to event: %v", err)
+		http.Error(w, `{"error":"Error scheduling collaboration"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collab_proposals
+		SET status = 'accepted', awaiting_id = NULL, event_id = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, action.ID, eventID)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := insertCollabMessage(tx, action.ID, userID, "accept", message); err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if !finishCollabAction(w, tx, action, "collab_accepted", claims.Username) {
+		return
+	}
+
+	// A co-stream reaches the host's followers like any stream they schedule
+	if fields.listedStream() {
+		recordActivity(action.ProposerID, "stream_scheduled", &eventID, fields.GameName, fields.streamActivity(eventID))
+	}
+}
+
+// declineCollabHandler turns down the proposal when it's the caller's
+// turn; cancelCollabHandler withdraws it while waiting on the other side.
+func declineCollabHandler(w http.ResponseWriter, r *http.Request) {
+	closeCollab(w, r, "declined")
+}
+
+func cancelCollabHandler(w http.ResponseWriter, r *http.Request) {
+	closeCollab(w, r, "cancelled")
+}
+
+func closeCollab(w http.ResponseWriter, r *http.Request, status string) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Message string `json:"message"`
+	}
+	// The message is optional, so an empty body is fine
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil && err != io.EOF {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	message, err := normalizeCollabMessage(requestBody.Message)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	action, ok := lockCollab(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if status == "declined" {
+		if !action.requireTurn(w) {
+			return
+		}
+	} else {
+		if action.Status != "pending" {
+			http.Error(w, `{"error":"Proposal is no longer open"}`, http.StatusConflict)
+			return
+		}
+		if action.AwaitingID != nil && *action.AwaitingID == userID {
+			http.Error(w, `{"error":"It's your turn; decline the proposal instead"}`, http.StatusConflict)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collab_proposals SET status = $2, awaiting_id = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, action.ID, status)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	kind := "decline"
+	if status == "cancelled" {
+		kind = "cancel"
+	}
+	if err := insertCollabMessage(tx, action.ID, userID, kind, message); err != nil {
+		http.Error(w, `{"error":"Error updating proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	finishCollabAction(w, tx, action, "collab_"+status, claims.Username)
+}
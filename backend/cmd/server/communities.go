@@ -0,0 +1,1459 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxCommunityNameLength        = 80
+	maxCommunityDescriptionLength = 2000
+	maxAnnouncementTitleLength    = 200
+	maxAnnouncementBodyLength     = 5000
+	// maxPinnedAnnouncements keeps the top of a community page short.
+	maxPinnedAnnouncements = 3
+)
+
+var (
+	communityRoles        = []string{"owner", "moderator", "member"}
+	communityJoinPolicies = []string{"public", "private"}
+	communitySlugPattern  = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]{1,38}[a-z0-9])$`)
+)
+
+// Community is a larger group around a game or a creator. Anyone can join a
+// public community; private ones work like private accounts, with join
+// requests approved by the owner or a moderator.
+type Community struct {
+	ID          int       `json:"id" db:"id"`
+	Slug        string    `json:"slug" db:"slug"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	GameName    *string   `json:"gameName,omitempty" db:"game_name"`
+	Creator     *string   `json:"creator,omitempty" db:"creator"`
+	JoinPolicy  string    `json:"joinPolicy" db:"join_policy"`
+	MemberCount int       `json:"memberCount" db:"member_count"`
+	MyRole      string    `json:"myRole,omitempty" db:"-"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+type CommunityMember struct {
+	Username string    `json:"username" db:"username"`
+	Role     string    `json:"role" db:"role"`
+	JoinedAt time.Time `json:"joinedAt" db:"joined_at"`
+}
+
+type CommunityJoinRequest struct {
+	Username  string    `json:"username" db:"username"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+type Announcement struct {
+	ID        int        `json:"id" db:"id"`
+	Author    string     `json:"author" db:"author"`
+	Title     string     `json:"title" db:"title"`
+	Body      string     `json:"body" db:"body"`
+	Pinned    bool       `json:"pinned" db:"pinned"`
+	PinnedAt  *time.Time `json:"pinnedAt,omitempty" db:"pinned_at"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time  `json:"updatedAt" db:"updated_at"`
+}
+
+const communityColumns = `
+	c.id, c.slug, c.name, c.description, c.game_name, cr.username AS creator, c.join_policy, c.created_at,
+	(SELECT COUNT(*) FROM community_members m WHERE m.community_id = c.id) AS member_count`
+
+const communityJoins = `
+	FROM communities c
+	LEFT JOIN users cr ON cr.id = c.creator_id`
+
+const announcementColumns = `
+	a.id, u.username AS author, a.title, a.body, a.pinned_at IS NOT NULL AS pinned, a.pinned_at,
+	a.created_at, a.updated_at`
+
+func initCommunityTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS communities (
+		id SERIAL PRIMARY KEY,
+		slug VARCHAR(40) NOT NULL UNIQUE,
+		name VARCHAR(80) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		game_name VARCHAR(255),
+		creator_id INTEGER REFERENCES users(id),
+		join_policy VARCHAR(20) NOT NULL DEFAULT 'public',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS communities_game_name_idx ON communities (game_name);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS community_members (
+		community_id INTEGER NOT NULL REFERENCES communities(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		role VARCHAR(20) NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (community_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS community_members_user_id_idx ON community_members (user_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS community_members_owner_idx ON community_members (community_id) WHERE role = 'owner';
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS community_join_requests (
+		id SERIAL PRIMARY KEY,
+		community_id INTEGER NOT NULL REFERENCES communities(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		status VARCHAR(20) DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(community_id, user_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS community_announcements (
+		id SERIAL PRIMARY KEY,
+		community_id INTEGER NOT NULL REFERENCES communities(id) ON DELETE CASCADE,
+		author_id INTEGER NOT NULL REFERENCES users(id),
+		title VARCHAR(200) NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		pinned_at TIMESTAMPTZ,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS community_announcements_community_id_idx
+		ON community_announcements (community_id, created_at DESC);
+	`)
+	return err
+}
+
+// communityFields holds the validated editable part of a community.
+type communityFields struct {
+	Name        string  `db:"name"`
+	Description string  `db:"description"`
+	GameName    *string `db:"game_name"`
+	CreatorID   *int    `db:"creator_id"`
+	JoinPolicy  string  `db:"join_policy"`
+}
+
+type communityInput struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	GameName    *string `json:"gameName"`
+	Creator     *string `json:"creator"`
+	JoinPolicy  *string `json:"joinPolicy"`
+}
+
+// apply overlays the fields present in input onto f. An empty game or
+// creator detaches the community from it.
+func (f *communityFields) apply(input communityInput) error {
+	if input.Name != nil {
+		f.Name = strings.TrimSpace(*input.Name)
+	}
+	if f.Name == "" || len(f.Name) > maxCommunityNameLength {
+		return fmt.Errorf("Name is required and must be at most %d characters", maxCommunityNameLength)
+	}
+
+	if input.Description != nil {
+		f.Description = strings.TrimSpace(*input.Description)
+	}
+	if len(f.Description) > maxCommunityDescriptionLength {
+		return fmt.Errorf("Description must be at most %d characters", maxCommunityDescriptionLength)
+	}
+
+	if input.GameName != nil {
+		if strings.TrimSpace(*input.GameName) == "" {
+			f.GameName = nil
+		} else {
+			game, ok := lookupCatalogGame(*input.GameName)
+			if !ok {
+				return fmt.Errorf("Unknown game")
+			}
+			f.GameName = &game
+		}
+	}
+
+	if input.Creator != nil {
+		if strings.TrimSpace(*input.Creator) == "" {
+			f.CreatorID = nil
+		} else {
+			creatorID, err := userIDByUsername(strings.TrimSpace(*input.Creator))
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("Creator not found")
+			}
+			if err != nil {
+				return err
+			}
+			creator, err := isCreator(db, creatorID)
+			if err != nil {
+				return err
+			}
+			if !creator {
+				return fmt.Errorf("That user hasn't connected Twitch or YouTube")
+			}
+			f.CreatorID = &creatorID
+		}
+	}
+
+	if input.JoinPolicy != nil {
+		f.JoinPolicy = strings.ToLower(strings.TrimSpace(*input.JoinPolicy))
+	}
+	if !containsString(communityJoinPolicies, f.JoinPolicy) {
+		return fmt.Errorf("Join policy must be public or private")
+	}
+	return nil
+}
+
+// loadCommunity returns the community with the given slug, with the
+// viewer's role in it.
+func loadCommunity(slug string, viewerID int) (*Community, error) {
+	var community Community
+	err := db.Get(&community, `SELECT `+communityColumns+communityJoins+` WHERE c.slug = $1`, slug)
+	if err != nil {
+		return nil, err
+	}
+	if viewerID != 0 {
+		err = db.Get(&community.MyRole, `
+			SELECT role FROM community_members WHERE community_id = $1 AND user_id = $2
+		`, community.ID, viewerID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return &community, nil
+}
+
+// communityMembership is a locked community and the caller's role in it,
+// empty if they aren't a member.
+type communityMembership struct {
+	CommunityID int
+	JoinPolicy  string
+	Role        string
+}
+
+func (m *communityMembership) isStaff() bool {
+	return m.Role == "owner" || m.Role == "moderator"
+}
+
+// lockCommunity locks the community named in the URL.
+func lockCommunity(w http.ResponseWriter, r *http.Request, tx queryer, userID int) (*communityMembership, bool) {
+	var community struct {
+		ID         int    `db:"id"`
+		JoinPolicy string `db:"join_policy"`
+	}
+	err := tx.Get(&community, "SELECT id, join_policy FROM communities WHERE slug = $1 FOR UPDATE", mux.Vars(r)["slug"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Community not found"}`, http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	membership := &communityMembership{CommunityID: community.ID, JoinPolicy: community.JoinPolicy}
+	err = tx.Get(&membership.Role, `
+		SELECT role FROM community_members WHERE community_id = $1 AND user_id = $2
+	`, community.ID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+	return membership, true
+}
+
+// communityStaffIDs returns the owner and moderators of a community.
+func communityStaffIDs(q queryer, communityID int) ([]int, error) {
+	var ids []int
+	err := q.Select(&ids, `
+		SELECT user_id FROM community_members
+		WHERE community_id = $1 AND role IN ('owner', 'moderator')
+		ORDER BY user_id
+	`, communityID)
+	return ids, err
+}
+
+// canSeeCommunityContent reports whether the viewer may read a community's
+// members and announcements: anyone for public communities, members only
+// for private ones.
+func canSeeCommunityContent(community *Community) bool {
+	return community.JoinPolicy == "public" || community.MyRole != ""
+}
+
+// pageParams reads limit and offset query parameters.
+func pageParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = parsed
+	}
+	offset := 0
+	if value := r.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, `{"error":"Invalid offset"}`, http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = parsed
+	}
+	return limit, offset, true
+}
+
+func writeCommunity(w http.ResponseWriter, slug string, viewerID, status int) {
+	community, err := loadCommunity(slug, viewerID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(community)
+}
+
+func createCommunityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		communityInput
+		Slug string `json:"slug"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	slug := strings.ToLower(strings.TrimSpace(requestBody.Slug))
+	// "mine" would be shadowed by the caller's own list
+	if !communitySlugPattern.MatchString(slug) || slug == "mine" {
+		http.Error(w, `{"error":"Slug must be 3 to 40 lowercase letters, digits or hyphens"}`, http.StatusBadRequest)
+		return
+	}
+	fields := communityFields{JoinPolicy: "public"}
+	if err := fields.apply(requestBody.communityInput); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var communityID int
+	err = tx.QueryRow(`
+		INSERT INTO communities (slug, name, description, game_name, creator_id, join_policy)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, slug, fields.Name, fields.Description, fields.GameName, fields.CreatorID, fields.JoinPolicy).Scan(&communityID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, `{"error":"That slug is already taken"}`, http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating community: %v", err)
+		http.Error(w, `{"error":"Error creating community"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO community_members (community_id, user_id, role) VALUES ($1, $2, 'owner')
+	`, communityID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error creating community"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error creating community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeCommunity(w, slug, userID, http.StatusCreated)
+}
+
+// listCommunitiesHandler lists communities, largest first, optionally for
+// one game or creator or matching a search term.
+func listCommunitiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	conditions := []string{"TRUE"}
+	var args []interface{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+
+	if game := query.Get("game"); game != "" {
+		name, ok := lookupCatalogGame(game)
+		if !ok {
+			http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+			return
+		}
+		addCondition("c.game_name = $%d", name)
+	}
+	if creator := query.Get("creator"); creator != "" {
+		addCondition("cr.username = $%d", creator)
+	}
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		addCondition("c.name ILIKE '%%' || $%d || '%%'", q)
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	args = append(args, limit, offset)
+
+	communities := []Community{}
+	err := db.Select(&communities, fmt.Sprintf(`
+		SELECT `+communityColumns+communityJoins+`
+		WHERE %s
+		ORDER BY member_count DESC, c.id
+		LIMIT $%d OFFSET $%d
+	`, strings.Join(conditions, " AND "), len(args)-1, len(args)), args...)
+	if err != nil {
+		log.Printf("Error listing communities: %v", err)
+		http.Error(w, `{"error":"Error listing communities"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(communities)
+}
+
+// myCommunitiesHandler lists the communities the caller belongs to.
+func myCommunitiesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var rows []struct {
+		Community
+		Role string `db:"role"`
+	}
+	err = db.Select(&rows, `
+		SELECT `+communityColumns+`, me.role
+		`+communityJoins+`
+		JOIN community_members me ON me.community_id = c.id AND me.user_id = $1
+		ORDER BY me.joined_at DESC, c.id
+	`, userID)
+	if err != nil {
+		log.Printf("Error listing communities: %v", err)
+		http.Error(w, `{"error":"Error listing communities"}`, http.StatusInternalServerError)
+		return
+	}
+
+	communities := make([]Community, len(rows))
+	for i, row := range rows {
+		communities[i] = row.Community
+		communities[i].MyRole = row.Role
+	}
+	json.NewEncoder(w).Encode(communities)
+}
+
+func getCommunityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	community, err := loadCommunity(mux.Vars(r)["slug"], viewerIDFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Community not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading community: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(community)
+}
+
+// updateCommunityHandler edits the community. Opening a private community
+// lets everyone waiting in.
+func updateCommunityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input communityInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "owner" {
+		http.Error(w, `{"error":"Only the owner can edit the community"}`, http.StatusForbidden)
+		return
+	}
+
+	var fields communityFields
+	err = tx.Get(&fields, `
+		SELECT name, description, game_name, creator_id, join_policy
+		FROM communities WHERE id = $1
+	`, membership.CommunityID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := fields.apply(input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE communities
+		SET name = $2, description = $3, game_name = $4, creator_id = $5, join_policy = $6,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, membership.CommunityID, fields.Name, fields.Description, fields.GameName, fields.CreatorID, fields.JoinPolicy)
+	if err != nil {
+		log.Printf("Error updating community: %v", err)
+		http.Error(w, `{"error":"Error updating community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var admitted []int
+	if membership.JoinPolicy == "private" && fields.JoinPolicy == "public" {
+		err = tx.Select(&admitted, `
+			WITH accepted AS (
+				UPDATE community_join_requests SET status = 'accepted'
+				WHERE community_id = $1 AND status = 'pending'
+				RETURNING user_id
+			)
+			INSERT INTO community_members (community_id, user_id)
+			SELECT $1, user_id FROM accepted
+			ON CONFLICT DO NOTHING
+			RETURNING user_id
+		`, membership.CommunityID)
+		if err != nil {
+			http.Error(w, `{"error":"Error updating community"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	slug := mux.Vars(r)["slug"]
+	for _, memberID := range admitted {
+		notify(memberID, "community_request_accepted", map[string]interface{}{"community": slug})
+	}
+	writeCommunity(w, slug, userID, http.StatusOK)
+}
+
+func deleteCommunityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "owner" {
+		http.Error(w, `{"error":"Only the owner can delete the community"}`, http.StatusForbidden)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM communities WHERE id = $1", membership.CommunityID); err != nil {
+		http.Error(w, `{"error":"Error deleting community"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error deleting community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Community deleted"})
+}
+
+// joinCommunityHandler joins a public community straight away, or asks to
+// join a private one the same way a follow request reaches a private
+// account: a rejected request can be sent again.
+func joinCommunityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "" {
+		http.Error(w, `{"error":"You are already a member"}`, http.StatusConflict)
+		return
+	}
+
+	if membership.JoinPolicy == "private" {
+		_, err = tx.Exec(`
+			INSERT INTO community_join_requests (community_id, user_id, status)
+			VALUES ($1, $2, 'pending')
+			ON CONFLICT (community_id, user_id)
+			DO UPDATE SET status = 'pending', created_at = CURRENT_TIMESTAMP
+			WHERE community_join_requests.status <> 'pending'
+		`, membership.CommunityID, userID)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO community_members (community_id, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, membership.CommunityID, userID)
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Error joining community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var staffIDs []int
+	if membership.JoinPolicy == "private" {
+		staffIDs, err = communityStaffIDs(tx, membership.CommunityID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error joining community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if membership.JoinPolicy == "private" {
+		for _, staffID := range staffIDs {
+			notify(staffID, "community_join_request", map[string]interface{}{
+				"community": mux.Vars(r)["slug"],
+				"username":  claims.Username,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"membershipState": "requested",
+			"message":         "Join request sent",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"membershipState": "member",
+		"message":         "Joined community",
+	})
+}
+
+// leaveCommunityHandler leaves the community or withdraws a pending join
+// request. The owner must hand the community over first.
+func leaveCommunityHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role == "owner" {
+		http.Error(w, `{"error":"The owner must hand over or delete the community"}`, http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM community_members WHERE community_id = $1 AND user_id = $2", membership.CommunityID, userID)
+	if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM community_join_requests WHERE community_id = $1 AND user_id = $2
+		`, membership.CommunityID, userID)
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Error leaving community"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error leaving community"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"membershipState": "not_member",
+		"message":         "Left community",
+	})
+}
+
+// communityJoinRequestsHandler lists pending join requests, oldest first,
+// for the owner and moderators.
+func communityJoinRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	viewerID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	community, err := loadCommunity(mux.Vars(r)["slug"], viewerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Community not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if community.MyRole != "owner" && community.MyRole != "moderator" {
+		http.Error(w, `{"error":"Only the owner and moderators can see join requests"}`, http.StatusForbidden)
+		return
+	}
+
+	requests := []CommunityJoinRequest{}
+	err = db.Select(&requests, `
+		SELECT u.username, q.created_at
+		FROM community_join_requests q
+		JOIN users u ON u.id = q.user_id
+		WHERE q.community_id = $1 AND q.status = 'pending'
+		ORDER BY q.created_at, q.id
+	`, community.ID)
+	if err != nil {
+		log.Printf("Error listing join requests: %v", err)
+		http.Error(w, `{"error":"Error listing join requests"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(requests)
+}
+
+func acceptCommunityRequestHandler(w http.ResponseWriter, r *http.Request) {
+	respondToCommunityRequest(w, r, true)
+}
+
+func rejectCommunityRequestHandler(w http.ResponseWriter, r *http.Request) {
+	respondToCommunityRequest(w, r, false)
+}
+
+func respondToCommunityRequest(w http.ResponseWriter, r *http.Request, accept bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	requesterID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if !membership.isStaff() {
+		http.Error(w, `{"error":"Only the owner and moderators can answer join requests"}`, http.StatusForbidden)
+		return
+	}
+
+	status := "rejected"
+	if accept {
+		status = "accepted"
+	}
+	result, err := tx.Exec(`
+		UPDATE community_join_requests SET status = $3
+		WHERE community_id = $1 AND user_id = $2 AND status = 'pending'
+	`, membership.CommunityID, requesterID, status)
+	if err != nil {
+		http.Error(w, `{"error":"Error answering join request"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No pending join request"}`, http.StatusNotFound)
+		return
+	}
+	if accept {
+		_, err = tx.Exec(`
+			INSERT INTO community_members (community_id, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, membership.CommunityID, requesterID)
+		if err != nil {
+			http.Error(w, `{"error":"Error answering join request"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error answering join request"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if accept {
+		notify(requesterID, "community_request_accepted", map[string]interface{}{"community": mux.Vars(r)["slug"]})
+		json.NewEncoder(w).Encode(map[string]string{"message": "Join request accepted"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Join request rejected"})
+}
+
+// communityMembersHandler pages through the member list, staff first.
+// Private communities only show it to members.
+func communityMembersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	community, err := loadCommunity(mux.Vars(r)["slug"], viewerIDFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Community not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !canSeeCommunityContent(community) {
+		http.Error(w, `{"error":"This community is private"}`, http.StatusForbidden)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	condition := "m.community_id = $1"
+	args := []interface{}{community.ID}
+	if role := r.URL.Query().Get("role"); role != "" {
+		if !containsString(communityRoles, role) {
+			writeJSONError(w, http.StatusBadRequest, "Role must be one of "+strings.Join(communityRoles, ", "))
+			return
+		}
+		condition += " AND m.role = $2"
+		args = append(args, role)
+	}
+
+	members := []CommunityMember{}
+	err = db.Select(&members, fmt.Sprintf(`
+		SELECT u.username, m.role, m.joined_at
+		FROM community_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE %s
+		ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'moderator' THEN 1 ELSE 2 END, m.joined_at, u.id
+		LIMIT $%d OFFSET $%d
+	`, condition, len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		log.Printf("Error listing community members: %v", err)
+		http.Error(w, `{"error":"Error listing members"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var total int
+	if err := db.Get(&total, "SELECT COUNT(*) FROM community_members m WHERE "+condition, args...); err != nil {
+		http.Error(w, `{"error":"Error listing members"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"members": members,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// setCommunityRoleHandler changes a member's role. Only the owner can do
+// it; making someone else owner hands the community over and leaves the
+// old owner a moderator.
+func setCommunityRoleHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	role := strings.ToLower(strings.TrimSpace(requestBody.Role))
+	if !containsString(communityRoles, role) {
+		writeJSONError(w, http.StatusBadRequest, "Role must be one of "+strings.Join(communityRoles, ", "))
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	memberID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "owner" {
+		http.Error(w, `{"error":"Only the owner can change roles"}`, http.StatusForbidden)
+		return
+	}
+	if memberID == userID {
+		http.Error(w, `{"error":"Make another member owner to step down"}`, http.StatusBadRequest)
+		return
+	}
+
+	if role == "owner" {
+		_, err = tx.Exec(`
+			UPDATE community_members SET role = 'moderator' WHERE community_id = $1 AND user_id = $2
+		`, membership.CommunityID, userID)
+		if err != nil {
+			http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	result, err := tx.Exec(`
+		UPDATE community_members SET role = $3 WHERE community_id = $1 AND user_id = $2
+	`, membership.CommunityID, memberID, role)
+	if err != nil {
+		http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"User is not a member"}`, http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+		return
+	}
+
+	notify(memberID, "community_role_changed", map[string]interface{}{
+		"community": mux.Vars(r)["slug"],
+		"role":      role,
+	})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role updated", "role": role})
+}
+
+// removeCommunityMemberHandler removes a member. The owner can remove
+// anyone else and moderators can remove plain members.
+func removeCommunityMemberHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	memberID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+
+	var memberRole string
+	err = tx.Get(&memberRole, `
+		SELECT role FROM community_members WHERE community_id = $1 AND user_id = $2
+	`, membership.CommunityID, memberID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User is not a member"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	allowed := memberID != userID && (membership.Role == "owner" ||
+		(membership.Role == "moderator" && memberRole == "member"))
+	if !allowed {
+		http.Error(w, `{"error":"You can't remove this member"}`, http.StatusForbidden)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM community_members WHERE community_id = $1 AND user_id = $2", membership.CommunityID, memberID)
+	if err != nil {
+		http.Error(w, `{"error":"Error removing member"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error removing member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	notify(memberID, "community_removed", map[string]interface{}{"community": mux.Vars(r)["slug"]})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member removed"})
+}
+
+// listAnnouncementsHandler pages through announcements with pinned ones
+// first, most recently pinned at the top.
+func listAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	community, err := loadCommunity(mux.Vars(r)["slug"], viewerIDFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Community not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !canSeeCommunityContent(community) {
+		http.Error(w, `{"error":"This community is private"}`, http.StatusForbidden)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	announcements := []Announcement{}
+	err = db.Select(&announcements, `
+		SELECT `+announcementColumns+`
+		FROM community_announcements a
+		JOIN users u ON u.id = a.author_id
+		WHERE a.community_id = $1
+		ORDER BY a.pinned_at DESC NULLS LAST, a.created_at DESC, a.id DESC
+		LIMIT $2 OFFSET $3
+	`, community.ID, limit, offset)
+	if err != nil {
+		log.Printf("Error listing announcements: %v", err)
+		http.Error(w, `{"error":"Error listing announcements"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(announcements)
+}
+
+type announcementInput struct {
+	Title *string `json:"title"`
+	Body  *string `json:"body"`
+}
+
+func (input announcementInput) validate(title, body *string) error {
+	if input.Title != nil {
+		*title = strings.TrimSpace(*input.Title)
+	}
+	if *title == "" || len(*title) > maxAnnouncementTitleLength {
+		return fmt.Errorf("Title is required and must be at most %d characters", maxAnnouncementTitleLength)
+	}
+	if input.Body != nil {
+		*body = strings.TrimSpace(*input.Body)
+	}
+	if len(*body) > maxAnnouncementBodyLength {
+		return fmt.Errorf("Body must be at most %d characters", maxAnnouncementBodyLength)
+	}
+	return nil
+}
+
+func loadAnnouncement(q queryer, communityID, announcementID int) (*Announcement, error) {
+	var announcement Announcement
+	err := q.Get(&announcement, `
+		SELECT `+announcementColumns+`
+		FROM community_announcements a
+		JOIN users u ON u.id = a.author_id
+		WHERE a.community_id = $1 AND a.id = $2
+	`, communityID, announcementID)
+	if err != nil {
+		return nil, err
+	}
+	return &announcement, nil
+}
+
+// createAnnouncementHandler posts an announcement and notifies members.
+// Only the owner and moderators can post.
+func createAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input struct {
+		announcementInput
+		Pinned bool `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	var title, body string
+	if err := input.validate(&title, &body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if !membership.isStaff() {
+		http.Error(w, `{"error":"Only the owner and moderators can post announcements"}`, http.StatusForbidden)
+		return
+	}
+	if input.Pinned && !checkPinnedRoom(w, tx, membership.CommunityID) {
+		return
+	}
+
+	var announcementID int
+	err = tx.QueryRow(`
+		INSERT INTO community_announcements (community_id, author_id, title, body, pinned_at)
+		VALUES ($1, $2, $3, $4, CASE WHEN $5 THEN NOW() END)
+		RETURNING id
+	`, membership.CommunityID, userID, title, body, input.Pinned).Scan(&announcementID)
+	if err != nil {
+		log.Printf("Error creating announcement: %v", err)
+		http.Error(w, `{"error":"Error posting announcement"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var memberIDs []int
+	err = tx.Select(&memberIDs, `
+		SELECT user_id FROM community_members WHERE community_id = $1 AND user_id <> $2
+	`, membership.CommunityID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error posting announcement"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error posting announcement"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, memberID := range memberIDs {
+		notify(memberID, "community_announcement", map[string]interface{}{
+			"community":      mux.Vars(r)["slug"],
+			"announcementId": announcementID,
+			"title":          title,
+		})
+	}
+
+	announcement, err := loadAnnouncement(db, membership.CommunityID, announcementID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(announcement)
+}
+
+// checkPinnedRoom reports whether another announcement can be pinned.
+func checkPinnedRoom(w http.ResponseWriter, tx queryer, communityID int) bool {
+	var pinned int
+	err := tx.Get(&pinned, `
+		SELECT COUNT(*) FROM community_announcements WHERE community_id = $1 AND pinned_at IS NOT NULL
+	`, communityID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return false
+	}
+	if pinned >= maxPinnedAnnouncements {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("At most %d announcements can be pinned", maxPinnedAnnouncements))
+		return false
+	}
+	return true
+}
+
+// lockAnnouncement locks the announcement in the URL for the owner or a
+// moderator.
+func lockAnnouncement(w http.ResponseWriter, r *http.Request, tx queryer, userID int) (*communityMembership, int, *time.Time, bool) {
+	membership, ok := lockCommunity(w, r, tx, userID)
+	if !ok {
+		return nil, 0, nil, false
+	}
+	if !membership.isStaff() {
+		http.Error(w, `{"error":"Only the owner and moderators can manage announcements"}`, http.StatusForbidden)
+		return nil, 0, nil, false
+	}
+
+	announcementID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid announcement id"}`, http.StatusBadRequest)
+		return nil, 0, nil, false
+	}
+	var pinnedAt *time.Time
+	err = tx.Get(&pinnedAt, `
+		SELECT pinned_at FROM community_announcements WHERE community_id = $1 AND id = $2 FOR UPDATE
+	`, membership.CommunityID, announcementID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Announcement not found"}`, http.StatusNotFound)
+			return nil, 0, nil, false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, 0, nil, false
+	}
+	return membership, announcementID, pinnedAt, true
+}
+
+func updateAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input announcementInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, announcementID, _, ok := lockAnnouncement(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	current, err := loadAnnouncement(tx, membership.CommunityID, announcementID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	title, body := current.Title, current.Body
+	if err := input.validate(&title, &body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE community_announcements SET title = $2, body = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, announcementID, title, body)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating announcement"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating announcement"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeAnnouncement(w, membership.CommunityID, announcementID)
+}
+
+func deleteAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, announcementID, _, ok := lockAnnouncement(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM community_announcements WHERE id = $1", announcementID); err != nil {
+		http.Error(w, `{"error":"Error deleting announcement"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error deleting announcement"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Announcement deleted"})
+}
+
+func pinAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	setAnnouncementPinned(w, r, true)
+}
+
+func unpinAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	setAnnouncementPinned(w, r, false)
+}
+
+func setAnnouncementPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, announcementID, pinnedAt, ok := lockAnnouncement(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if pinned && pinnedAt == nil && !checkPinnedRoom(w, tx, membership.CommunityID) {
+		return
+	}
+	if pinned == (pinnedAt != nil) {
+		writeAnnouncement(w, membership.CommunityID, announcementID)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE community_announcements SET pinned_at = CASE WHEN $2 THEN NOW() END
+		WHERE id = $1
+	`, announcementID, pinned)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating announcement"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating announcement"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeAnnouncement(w, membership.CommunityID, announcementID)
+}
+
+func writeAnnouncement(w http.ResponseWriter, communityID, announcementID int) {
+	announcement, err := loadAnnouncement(db, communityID, announcementID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(announcement)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCreateCommunityRejectsBadSlugs(t *testing.T) {
+	// "mine" is the caller's own list under /communities
+	for _, slug := range []string{"mine", "MINE", " mine ", "ab", "-abc", "abc-", "a_bc", "a bc", ""} {
+		// Nothing reaches the database
+		useFakeDB(t)
+
+		body := `{"slug":"` + slug + `","name":"Night owls"}`
+		w := serve(createCommunityHandler, testRequest("POST", "/communities", body, "owner"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("slug %q: create = %d %s, want 400", slug, w.Code, w.Body)
+		}
+	}
+}
+
+// communityMemberIDs are the users of the community tests: the owner, a
+// moderator, a member and someone outside the community.
+var communityMemberIDs = map[string]int{"owner": 1, "moderator": 2, "member": 3, "outsider": 4}
+
+var communityRolesByID = map[int]string{1: "owner", 2: "moderator", 3: "member"}
+
+// useFakeCommunity answers lookups of the community "owls" with joinPolicy
+// and the roles in communityRolesByID.
+func useFakeCommunity(f *fakeDB, joinPolicy string) {
+	f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRow("id", communityMemberIDs[args[0].(string)])
+	})
+	f.on("WHERE c.slug = $1", func(args []interface{}) fakeResult {
+		return fakeRows(
+			[]string{"id", "slug", "name", "description", "game_name", "creator", "join_policy", "created_at", "member_count"},
+			[]interface{}{6, "owls", "Night owls", "", nil, nil, joinPolicy, time.Now(), len(communityRolesByID)},
+		)
+	})
+	f.on("SELECT id, join_policy FROM communities WHERE slug = $1 FOR UPDATE", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"id", "join_policy"}, []interface{}{6, joinPolicy})
+	})
+	f.on("SELECT role FROM community_members WHERE community_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+		role, ok := communityRolesByID[args[1].(int)]
+		if !ok {
+			return fakeRows([]string{"role"})
+		}
+		return fakeRow("role", role)
+	})
+}
+
+func TestCommunityContentVisibility(t *testing.T) {
+	tests := []struct {
+		joinPolicy string
+		viewer     string
+		want       int
+	}{
+		{"public", "", http.StatusOK},
+		{"public", "outsider", http.StatusOK},
+		{"private", "", http.StatusForbidden},
+		{"private", "outsider", http.StatusForbidden},
+		{"private", "member", http.StatusOK},
+		{"private", "owner", http.StatusOK},
+	}
+	handlers := map[string]http.HandlerFunc{
+		"members":       communityMembersHandler,
+		"announcements": listAnnouncementsHandler,
+	}
+	for _, test := range tests {
+		for page, handler := range handlers {
+			t.Run(test.joinPolicy+" "+page+" for "+test.viewer, func(t *testing.T) {
+				f := useFakeDB(t)
+				useFakeCommunity(f, test.joinPolicy)
+				f.on("FROM community_members m JOIN users u ON u.id = m.user_id", func(args []interface{}) fakeResult {
+					return fakeRows([]string{"username", "role", "joined_at"}, []interface{}{"owner", "owner", time.Now()})
+				})
+				f.on("SELECT COUNT(*) FROM community_members m WHERE", func(args []interface{}) fakeResult {
+					return fakeRow("count", 1)
+				})
+				f.on("FROM community_announcements a", func(args []interface{}) fakeResult {
+					return fakeRows([]string{"id", "author", "title", "body", "pinned", "pinned_at", "created_at", "updated_at"})
+				})
+
+				r := mux.SetURLVars(testRequest("GET", "/communities/owls/"+page, "", test.viewer), map[string]string{"slug": "owls"})
+				if w := serve(handler, r); w.Code != test.want {
+					t.Errorf("%s = %d %s, want %d", page, w.Code, w.Body, test.want)
+				}
+			})
+		}
+	}
+}
+
+func TestJoinCommunityHandler(t *testing.T) {
+	tests := []struct {
+		joinPolicy string
+		joiner     string
+		want       int
+		state      string
+		joined     bool
+		requested  bool
+		notified   []int
+	}{
+		{joinPolicy: "public", joiner: "outsider", want: http.StatusOK, state: "member", joined: true},
+		{joinPolicy: "private", joiner: "outsider", want: http.StatusOK, state: "requested", requested: true, notified: []int{1, 2}},
+		{joinPolicy: "public", joiner: "member", want: http.StatusConflict},
+		{joinPolicy: "private", joiner: "moderator", want: http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.joinPolicy+" "+test.joiner, func(t *testing.T) {
+			f := useFakeDB(t)
+			useFakeCommunity(f, test.joinPolicy)
+			var joined, requested bool
+			f.on("INSERT INTO community_members", func(args []interface{}) fakeResult {
+				joined = true
+				return fakeAffected(1)
+			})
+			f.on("INSERT INTO community_join_requests", func(args []interface{}) fakeResult {
+				requested = true
+				return fakeAffected(1)
+			})
+			f.on("WHERE community_id = $1 AND role IN ('owner', 'moderator')", func(args []interface{}) fakeResult {
+				return fakeRows([]string{"user_id"}, []interface{}{1}, []interface{}{2})
+			})
+			notifications := recordNotifications(t)
+
+			r := mux.SetURLVars(testRequest("POST", "/communities/owls/join", "", test.joiner), map[string]string{"slug": "owls"})
+			w := serve(joinCommunityHandler, r)
+			if w.Code != test.want {
+				t.Fatalf("join = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+			if joined != test.joined || requested != test.requested {
+				t.Errorf("joined %v, requested %v, want %v, %v", joined, requested, test.joined, test.requested)
+			}
+			if got := notifications.recipients("community_join_request"); !reflect.DeepEqual(got, test.notified) {
+				t.Errorf("notified %v, want %v", got, test.notified)
+			}
+			if test.state != "" {
+				var response map[string]string
+				json.NewDecoder(w.Body).Decode(&response)
+				if response["membershipState"] != test.state {
+					t.Errorf("membership state %q, want %q", response["membershipState"], test.state)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	emailNotificationJob = "email_notification"
+	emailDigestJob       = "email_digest"
+	// maxDigestItems bounds each section of a digest.
+	maxDigestItems = 20
+	// digestEventWindow is how far ahead a digest lists events.
+	digestEventWindow = 7 * 24 * time.Hour
+)
+
+var emailDigestFrequencies = []string{"off", "daily", "weekly"}
+
+// emailNotificationFormats are the notifications also sent by email to
+// users who aren't online, with the payload field naming who it's from.
+var emailNotificationFormats = map[string]struct{ field, format string }{
+	"follow_request":          {"from", "%s wants to follow you"},
+	"new_follower":            {"from", "%s started following you"},
+	"follow_request_accepted": {"by", "%s accepted your follow request"},
+	"event_invite":            {"host", "%s invited you to an event"},
+	"collab_proposed":         {"from", "%s proposed a collab"},
+	"squad_invite":            {"from", "%s invited you to a squad"},
+	"community_join_request":  {"username", "%s asked to join your community"},
+	"post_comment":            {"from", "%s commented on your post"},
+	"post_reply":              {"from", "%s replied to your comment"},
+}
+
+// Email templates. Each is defined once for the text part and once, with
+// escaping, for the HTML part. Notifications and digests carry an
+// unsubscribe link; account emails are sent regardless of preferences.
+const emailTextTemplates = `
+{{define "notification"}}Hi {{.Username}},
+
+{{.Summary}}.
+
+See it on Pixel & Chill: {{.Link}}
+
+--
+You're getting this because email notifications are on for your account.
+Unsubscribe: {{.UnsubscribeURL}}
+{{end}}
+
+{{define "digest"}}Hi {{.Username}},
+
+Here's your {{.Frequency}} Pixel & Chill digest.
+{{if .FollowRequests}}
+Waiting for your answer:
+{{range .FollowRequests}}  - {{.Username}} wants to follow you
+{{end}}{{end}}{{if .NewFollowers}}
+New followers:
+{{range .NewFollowers}}  - {{.Username}}
+{{end}}{{end}}{{if .Events}}
+Coming up:
+{{range .Events}}  - {{.Title}}, {{.StartsAt.Format "Mon Jan 2 15:04 MST"}}
+{{end}}{{end}}
+Open Pixel & Chill: {{.Link}}
+
+--
+You're getting this because {{.Frequency}} digests are on for your account.
+Unsubscribe: {{.UnsubscribeURL}}
+{{end}}
+
+{{define "account"}}Hi {{.Username}},
+
+{{.Message}}
+
+{{.Action}}: {{.Link}}
+
+This link expires in {{.Expires}}. If you didn't ask for this, you can ignore this email.
+{{end}}`
+
+const emailHTMLTemplates = `
+{{define "notification"}}<!DOCTYPE html>
+<html><body style="font-family:sans-serif">
+<p>Hi {{.Username}},</p>
+<p>{{.Summary}}.</p>
+<p><a href="{{.Link}}">See it on Pixel &amp; Chill</a></p>
+<p style="color:#888;font-size:12px">You're getting this because email notifications are on for your account.
+<a href="{{.UnsubscribeURL}}">Unsubscribe</a></p>
+</body></html>
+{{end}}
+
+{{define "digest"}}<!DOCTYPE html>
+<html><body style="font-family:sans-serif">
+<p>Hi {{.Username}},</p>
+<p>Here's your {{.Frequency}} Pixel &amp; Chill digest.</p>
+{{if .FollowRequests}}<h3>Waiting for your answer</h3>
+<ul>{{range .FollowRequests}}<li>{{.Username}} wants to follow you</li>{{end}}</ul>{{end}}
+{{if .NewFollowers}}<h3>New followers</h3>
+<ul>{{range .NewFollowers}}<li>{{.Username}}</li>{{end}}</ul>{{end}}
+{{if .Events}}<h3>Coming up</h3>
+<ul>{{range .Events}}<li>{{.Title}}, {{.StartsAt.Format "Mon Jan 2 15:04 MST"}}</li>{{end}}</ul>{{end}}
+<p><a href="{{.Link}}">Open Pixel &amp; Chill</a></p>
+<p style="color:#888;font-size:12px">You're getting this because {{.Frequency}} digests are on for your account.
+<a href="{{.UnsubscribeURL}}">Unsubscribe</a></p>
+</body></html>
+{{end}}
+
+{{define "account"}}<!DOCTYPE html>
+<html><body style="font-family:sans-serif">
+<p>Hi {{.Username}},</p>
+<p>{{.Message}}</p>
+<p><a href="{{.Link}}">{{.Action}}</a></p>
+<p style="color:#888;font-size:12px">This link expires in {{.Expires}}. If you didn't ask for this, you can ignore this email.</p>
+</body></html>
+{{end}}`
+
+var (
+	emailText = texttemplate.Must(texttemplate.New("email").Parse(emailTextTemplates))
+	emailHTML = htmltemplate.Must(htmltemplate.New("email").Parse(emailHTMLTemplates))
+)
+
+func initEmailTables() error {
+	_, err := db.Exec(`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_notifications BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_digest VARCHAR(10) NOT NULL DEFAULT 'weekly';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS last_digest_at TIMESTAMPTZ;
+	`)
+	return err
+}
+
+// appURL is the frontend that email links point to.
+func appURL() string {
+	if value := os.Getenv("APP_URL"); value != "" {
+		return strings.TrimRight(value, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// apiURL is this server as reached from an email, for unsubscribe links.
+func apiURL() string {
+	if value := os.Getenv("API_URL"); value != "" {
+		return strings.TrimRight(value, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// unsubscribeToken signs an unsubscribe link, so links work without
+// logging in but can't be forged for other users.
+func unsubscribeToken(userID int, list string) string {
+	mac := hmac.New(sha256.New, jwtKey)
+	fmt.Fprintf(mac, "unsubscribe:%d:%s", userID, list)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeURL(userID int, list string) string {
+	return fmt.Sprintf("%s/email/unsubscribe?user=%d&list=%s&token=%s",
+		apiURL(), userID, list, unsubscribeToken(userID, list))
+}
+
+// renderEmail fills both versions of a template.
+func renderEmail(to, subject, name string, data map[string]interface{}) (Email, error) {
+	var text, html bytes.Buffer
+	if err := emailText.ExecuteTemplate(&text, name, data); err != nil {
+		return Email{}, err
+	}
+	if err := emailHTML.ExecuteTemplate(&html, name, data); err != nil {
+		return Email{}, err
+	}
+	return Email{To: to, Subject: subject, Text: text.String(), HTML: html.String()}, nil
+}
+
+// renderListEmail renders an email the user can unsubscribe from. The
+// unsubscribe link is also offered as one-click List-Unsubscribe headers.
+func renderListEmail(to, subject, name string, userID int, list string, data map[string]interface{}) (Email, error) {
+	link := unsubscribeURL(userID, list)
+	data["UnsubscribeURL"] = link
+
+	email, err := renderEmail(to, subject, name, data)
+	if err != nil {
+		return Email{}, err
+	}
+	email.Headers = map[string]string{
+		"List-Unsubscribe":      "<" + link + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	return email, nil
+}
+
+// emailRecipient is a user as far as email is concerned.
+type emailRecipient struct {
+	Username      string     `db:"username"`
+	Email         *string    `db:"email"`
+	Verified      bool       `db:"email_verified"`
+	Notifications bool       `db:"email_notifications"`
+	Digest        string     `db:"email_digest"`
+	LastDigestAt  *time.Time `db:"last_digest_at"`
+}
+
+func loadEmailRecipient(userID int) (*emailRecipient, error) {
+	var recipient emailRecipient
+	err := db.Get(&recipient, `
+		SELECT username, email, email_verified, email_notifications, email_digest, last_digest_at
+		FROM users WHERE id = $1
+	`, userID)
+	return &recipient, err
+}
+
+// emailChannel is a notificationChannel that emails the notifications in
+// emailNotificationFormats to users with a verified address who aren't
+// connected right now. Sending is left to a job so notify doesn't wait on
+// the mail server.
+type emailChannel struct{}
+
+func (emailChannel) Name() string {
+	return "email"
+}
+
+func (emailChannel) Deliver(n Notification) error {
+	if _, ok := emailNotificationFormats[n.Type]; !ok {
+		return nil
+	}
+	if realtime != nil && realtime.connected(n.UserID) {
+		return nil
+	}
+	muted, err := isNotificationMuted(db, n.UserID, n.Type)
+	if err != nil || muted {
+		return err
+	}
+
+	var wanted bool
+	err = db.Get(&wanted, `
+		SELECT email IS NOT NULL AND email_verified AND email_notifications FROM users WHERE id = $1
+	`, n.UserID)
+	if err != nil || !wanted {
+		return err
+	}
+
+	_, err = enqueueJob(db, emailNotificationJob, "", time.Now(), map[string]interface{}{
+		"userId":  n.UserID,
+		"type":    n.Type,
+		"payload": n.Payload,
+	})
+	return err
+}
+
+func sendEmailNotification(payload json.RawMessage) error {
+	var job struct {
+		UserID  int                    `json:"userId"`
+		Type    string                 `json:"type"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	format, ok := emailNotificationFormats[job.Type]
+	if !ok {
+		return nil
+	}
+
+	recipient, err := loadEmailRecipient(job.UserID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Settings may have changed since the job was queued
+	if recipient.Email == nil || !recipient.Verified || !recipient.Notifications {
+		return nil
+	}
+
+	summary := fmt.Sprintf(format.format, fmt.Sprint(job.Payload[format.field]))
+	email, err := renderListEmail(*recipient.Email, summary, "notification", job.UserID, "notifications", map[string]interface{}{
+		"Username": recipient.Username,
+		"Summary":  summary,
+		"Link":     appURL() + "/notifications",
+	})
+	if err != nil {
+		return err
+	}
+	return mailer.Send(email)
+}
+
+// digestUser is someone listed in a digest.
+type digestUser struct {
+	Username string    `db:"username"`
+	At       time.Time `db:"created_at"`
+}
+
+func digestPeriod(frequency string) time.Duration {
+	if frequency == "daily" {
+		return 24 * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// planEmailDigests queues a digest for everyone whose last one is a period
+// old. The dedupe key names the day, so each user gets at most one a day
+// however often this runs.
+func planEmailDigests(now time.Time) error {
+	var userIDs []int
+	err := db.Select(&userIDs, `
+		SELECT id FROM users
+		WHERE email IS NOT NULL AND email_verified AND email_digest IN ('daily', 'weekly')
+		AND (last_digest_at IS NULL OR last_digest_at < $1::TIMESTAMPTZ + INTERVAL '1 hour'
+			- CASE email_digest WHEN 'daily' THEN INTERVAL '1 day' ELSE INTERVAL '7 days' END)
+	`, now)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		dedupeKey := fmt.Sprintf("email_digest:%d:%s", userID, now.UTC().Format("2006-01-02"))
+		if _, err := enqueueJob(db, emailDigestJob, dedupeKey, now, map[string]int{"userId": userID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendEmailDigest sends a digest of pending follow requests, new followers
+// and upcoming events. Nothing is sent when there is nothing to report.
+func sendEmailDigest(payload json.RawMessage) error {
+	var job struct {
+		UserID int `json:"userId"`
+	}
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+
+	recipient, err := loadEmailRecipient(job.UserID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if recipient.Email == nil || !recipient.Verified || !containsString([]string{"daily", "weekly"}, recipient.Digest) {
+		return nil
+	}
+
+	now := time.Now()
+	since := now.Add(-digestPeriod(recipient.Digest))
+	if recipient.LastDigestAt != nil {
+		since = *recipient.LastDigestAt
+	}
+
+	requests := []digestUser{}
+	err = db.Select(&requests, `
+		SELECT u.username, fr.created_at
+		FROM follow_requests fr
+		JOIN users u ON u.id = fr.requester_id
+		WHERE fr.target_id = $1 AND fr.status = 'pending'
+		ORDER BY fr.created_at DESC
+		LIMIT $2
+	`, job.UserID, maxDigestItems)
+	if err != nil {
+		return err
+	}
+
+	followers := []digestUser{}
+	err = db.Select(&followers, `
+		SELECT u.username, f.created_at
+		FROM followers f
+		JOIN users u ON u.id = f.follower_id
+		WHERE f.following_id = $1 AND f.created_at > $2
+		ORDER BY f.created_at DESC
+		LIMIT $3
+	`, job.UserID, since, maxDigestItems)
+	if err != nil {
+		return err
+	}
+
+	upcoming, err := upcomingOccurrences(job.UserID, now, now.Add(digestEventWindow))
+	if err != nil {
+		return err
+	}
+
+	if len(requests) > 0 || len(followers) > 0 || len(upcoming) > 0 {
+		subject := fmt.Sprintf("Your %s Pixel & Chill digest", recipient.Digest)
+		email, err := renderListEmail(*recipient.Email, subject, "digest", job.UserID, "digest", map[string]interface{}{
+			"Username":       recipient.Username,
+			"Frequency":      recipient.Digest,
+			"FollowRequests": requests,
+			"NewFollowers":   followers,
+			"Events":         upcoming,
+			"Link":           appURL(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := mailer.Send(email); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec("UPDATE users SET last_digest_at = $2 WHERE id = $1", job.UserID, now)
+	return err
+}
+
+// upcomingOccurrences lists occurrences between from and to of scheduled
+// events the user hosts or has responded to without declining, like their
+// agenda.
+func upcomingOccurrences(userID int, from, to time.Time) ([]EventOccurrence, error) {
+	events := []*Event{}
+	err := db.Select(&events, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.status = 'scheduled'
+		AND (e.host_id = $1 OR EXISTS(
+			SELECT 1 FROM event_rsvps r
+			WHERE r.event_id = e.id AND r.user_id = $1 AND r.status <> 'declined'))
+		AND (e.series_ends_at IS NULL OR e.series_ends_at > $2)
+		AND (e.starts_at < $3 OR EXISTS(
+			SELECT 1 FROM event_exceptions x WHERE x.event_id = e.id AND x.starts_at < $3))
+	`, userID, from, to)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+
+	ids := make([]int, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	exceptions, err := loadEventExceptions(ids, &TimeRange{Start: from, End: to})
+	if err != nil {
+		return nil, err
+	}
+
+	var occurrences []EventOccurrence
+	for _, event := range events {
+		expanded, err := expandEvent(event, exceptions[event.ID], from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, occurrence := range expanded {
+			if occurrence.Status == "scheduled" {
+				occurrences = append(occurrences, occurrence)
+			}
+		}
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartsAt.Before(occurrences[j].StartsAt)
+	})
+	if len(occurrences) > maxDigestItems {
+		occurrences = occurrences[:maxDigestItems]
+	}
+	return occurrences, nil
+}
+
+// registerEmail sends notification emails and digests through m.
+func registerEmail(m Mailer) {
+	mailer = m
+	registerNotificationChannel(emailChannel{})
+	registerJobHandler(emailNotificationJob, sendEmailNotification)
+	registerJobHandler(emailDigestJob, sendEmailDigest)
+	registerJobPlanner(planEmailDigests)
+}
+
+// unsubscribeHandler turns off the list in a signed unsubscribe link.
+// Opening the link shows a confirmation button, so link scanners in mail
+// filters can't unsubscribe anyone; mail clients offering one-click
+// unsubscribe POST straight to the same URL.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, err := strconv.Atoi(query.Get("user"))
+	list := query.Get("list")
+	if err != nil || (list != "notifications" && list != "digest") ||
+		!hmac.Equal([]byte(query.Get("token")), []byte(unsubscribeToken(userID, list))) {
+		http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	what := "notification emails"
+	if list == "digest" {
+		what = "digest emails"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "GET" {
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body style="font-family:sans-serif">
+<form method="POST"><p>Stop getting %s from Pixel &amp; Chill?</p>
+<button type="submit">Unsubscribe</button></form>
+</body></html>`, what)
+		return
+	}
+
+	update := "UPDATE users SET email_notifications = FALSE WHERE id = $1"
+	if list == "digest" {
+		update = "UPDATE users SET email_digest = 'off' WHERE id = $1"
+	}
+	if _, err := db.Exec(update, userID); err != nil {
+		log.Printf("Error unsubscribing user %d: %v", userID, err)
+		http.Error(w, "Error unsubscribing", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `<!DOCTYPE html><html><body style="font-family:sans-serif">
+<p>You won't get %s any more. You can turn them back on in your settings.</p>
+</body></html>`, what)
+}
+
+type EmailPreferences struct {
+	Email         *string `json:"email,omitempty" db:"email"`
+	EmailVerified bool    `json:"emailVerified" db:"email_verified"`
+	Notifications bool    `json:"notifications" db:"email_notifications"`
+	Digest        string  `json:"digest" db:"email_digest"`
+}
+
+func loadEmailPreferences(username string) (*EmailPreferences, error) {
+	var preferences EmailPreferences
+	err := db.Get(&preferences, `
+		SELECT email, email_verified, email_notifications, email_digest FROM users WHERE username = $1
+	`, username)
+	return &preferences, err
+}
+
+func getEmailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	preferences, err := loadEmailPreferences(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Error loading preferences"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(preferences)
+}
+
+// updateEmailPreferencesHandler changes the fields present in the body.
+func updateEmailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Notifications *bool   `json:"notifications"`
+		Digest        *string `json:"digest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	var digest *string
+	if requestBody.Digest != nil {
+		value := strings.ToLower(strings.TrimSpace(*requestBody.Digest))
+		if !containsString(emailDigestFrequencies, value) {
+			http.Error(w, `{"error":"Digest must be off, daily or weekly"}`, http.StatusBadRequest)
+			return
+		}
+		digest = &value
+	}
+
+	_, err := db.Exec(`
+		UPDATE users
+		SET email_notifications = COALESCE($2, email_notifications),
+			email_digest = COALESCE($3, email_digest)
+		WHERE username = $1
+	`, claims.Username, requestBody.Notifications, digest)
+	if err != nil {
+		log.Printf("Error updating email preferences: %v", err)
+		http.Error(w, `{"error":"Error updating preferences"}`, http.StatusInternalServerError)
+		return
+	}
+
+	preferences, err := loadEmailPreferences(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Error loading preferences"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(preferences)
+}
@@ -0,0 +1,1140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxEventTitleLength       = 200
+	maxEventDescriptionLength = 2000
+	// maxEventDuration bounds a single session or stream.
+	maxEventDuration = 48 * time.Hour
+	maxEventInvites  = 100
+	// maxListedSeries bounds how many recurring series one listing sorts.
+	maxListedSeries = 500
+)
+
+var (
+	eventKinds        = []string{"session", "stream"}
+	eventVisibilities = []string{"public", "followers", "invite"}
+)
+
+type Event struct {
+	ID           int       `json:"id" db:"id"`
+	HostUsername string    `json:"hostUsername" db:"host_username"`
+	Title        string    `json:"title" db:"title"`
+	Description  string    `json:"description,omitempty" db:"description"`
+	GameName     *string   `json:"gameName,omitempty" db:"game_name"`
+	Kind         string    `json:"kind" db:"kind"`
+	Platform     *string   `json:"platform,omitempty" db:"platform"`
+	StreamURL    *string   `json:"streamUrl,omitempty" db:"stream_url"`
+	StartsAt     time.Time `json:"startsAt" db:"starts_at"`
+	EndsAt       time.Time `json:"endsAt" db:"ends_at"`
+	TimeZone     string    `json:"timeZone" db:"time_zone"`
+	// Recurrence is an RRULE value; StartsAt and EndsAt then describe the
+	// first occurrence
+	Recurrence     *string          `json:"recurrence,omitempty" db:"recurrence"`
+	SeriesEndsAt   *time.Time       `json:"seriesEndsAt,omitempty" db:"series_ends_at"`
+	NextOccurrence *EventOccurrence `json:"nextOccurrence,omitempty" db:"-"`
+	Capacity       *int             `json:"capacity,omitempty" db:"capacity"`
+	Visibility     string           `json:"visibility" db:"visibility"`
+	Status         string           `json:"status" db:"status"`
+	GoingCount     int              `json:"goingCount" db:"going_count"`
+	MaybeCount     int              `json:"maybeCount" db:"maybe_count"`
+	WaitlistCount  int              `json:"waitlistCount" db:"waitlist_count"`
+	MyRSVP         string           `json:"myRsvp,omitempty" db:"-"`
+	CreatedAt      time.Time        `json:"createdAt" db:"created_at"`
+	UpdatedAt      time.Time        `json:"updatedAt" db:"updated_at"`
+	// Sequence counts revisions for calendar clients
+	Sequence int `json:"-" db:"sequence"`
+}
+
+type EventAttendee struct {
+	Username  string    `json:"username" db:"username"`
+	Status    string    `json:"status" db:"status"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// eventColumns selects everything Event needs from events e joined to the
+// host as h.
+const eventColumns = `
+	e.id, h.username AS host_username, e.title, e.description, e.game_name, e.kind, e.platform, e.stream_url,
+	e.starts_at, e.ends_at, e.time_zone, e.recurrence, e.series_ends_at, e.capacity, e.visibility, e.status,
+	(SELECT COUNT(*) FROM event_rsvps r WHERE r.event_id = e.id AND r.status = 'going') AS going_count,
+	(SELECT COUNT(*) FROM event_rsvps r WHERE r.event_id = e.id AND r.status = 'maybe') AS maybe_count,
+	(SELECT COUNT(*) FROM event_rsvps r WHERE r.event_id = e.id AND r.status = 'waitlisted') AS waitlist_count,
+	e.created_at, e.updated_at, e.sequence`
+
+// eventVisibleTo returns a condition on events e that holds when the user
+// whose id is bound to param may see the event. Anonymous viewers use 0.
+func eventVisibleTo(param string) string {
+	return `(e.host_id = ` + param + `
+		OR e.visibility = 'public'
+		OR (e.visibility = 'followers' AND EXISTS(
+			SELECT 1 FROM followers f WHERE f.follower_id = ` + param + ` AND f.following_id = e.host_id))
+		OR (e.visibility = 'invite' AND EXISTS(
+			SELECT 1 FROM event_invites i WHERE i.event_id = e.id AND i.user_id = ` + param + `)))`
+}
+
+func initEventTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS events (
+		id SERIAL PRIMARY KEY,
+		host_id INTEGER NOT NULL REFERENCES users(id),
+		title VARCHAR(200) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		game_name VARCHAR(255),
+		kind VARCHAR(20) NOT NULL DEFAULT 'session',
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+		capacity INTEGER,
+		visibility VARCHAR(20) NOT NULL DEFAULT 'public',
+		status VARCHAR(20) NOT NULL DEFAULT 'scheduled',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CHECK (ends_at > starts_at)
+	);
+	CREATE INDEX IF NOT EXISTS events_host_id_starts_at_idx ON events (host_id, starts_at);
+	CREATE INDEX IF NOT EXISTS events_starts_at_idx ON events (starts_at);
+
+	ALTER TABLE events ADD COLUMN IF NOT EXISTS recurrence TEXT;
+	ALTER TABLE events ADD COLUMN IF NOT EXISTS series_ends_at TIMESTAMPTZ;
+	ALTER TABLE events ADD COLUMN IF NOT EXISTS platform VARCHAR(20);
+	ALTER TABLE events ADD COLUMN IF NOT EXISTS stream_url VARCHAR(500);
+	CREATE INDEX IF NOT EXISTS events_stream_host_id_idx ON events (host_id) WHERE kind = 'stream';
+	UPDATE events SET series_ends_at = ends_at WHERE recurrence IS NULL AND series_ends_at IS NULL;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Single-occurrence edits and cancellations of recurring events, keyed
+	// by the occurrence's original start
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS event_exceptions (
+		event_id INTEGER NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		occurrence_start TIMESTAMPTZ NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'scheduled',
+		title VARCHAR(200),
+		description TEXT,
+		starts_at TIMESTAMPTZ NOT NULL,
+		ends_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (event_id, occurrence_start),
+		CHECK (ends_at > starts_at)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS event_invites (
+		event_id INTEGER NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (event_id, user_id)
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS event_rsvps (
+		event_id INTEGER NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		status VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (event_id, user_id)
+	);
+	`)
+	return err
+}
+
+func equalStringPointers(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// eventInput is the editable part of an event, shared by create and edit.
+type eventInput struct {
+	Title       *string    `json:"title"`
+	Description *string    `json:"description"`
+	GameName    *string    `json:"gameName"`
+	Kind        *string    `json:"kind"`
+	Platform    *string    `json:"platform"`
+	StreamURL   *string    `json:"streamUrl"`
+	StartsAt    *time.Time `json:"startsAt"`
+	EndsAt      *time.Time `json:"endsAt"`
+	TimeZone    *string    `json:"timeZone"`
+	Recurrence  *string    `json:"recurrence"`
+	Capacity    *int       `json:"capacity"`
+	Visibility  *string    `json:"visibility"`
+}
+
+// eventFields holds validated values ready to store.
+type eventFields struct {
+	Title       string
+	Description string
+	GameName    *string
+	Kind        string
+	Platform    *string
+	StreamURL   *string
+	StartsAt    time.Time
+	EndsAt      time.Time
+	TimeZone    string
+	Recurrence  *string
+	Capacity    *int
+	Visibility  string
+	// SeriesEndsAt is when the last occurrence ends, nil if the event
+	// repeats indefinitely
+	SeriesEndsAt *time.Time
+}
+
+// listedStream reports whether the event is a stream shown in the host's
+// followers' feeds. Invite-only streams stay out of them.
+func (f *eventFields) listedStream() bool {
+	return f.Kind == "stream" && f.Visibility != "invite"
+}
+
+// streamActivity is the payload of a stream_scheduled activity.
+func (f *eventFields) streamActivity(eventID int) map[string]interface{} {
+	return map[string]interface{}{
+		"eventId":  eventID,
+		"title":    f.Title,
+		"gameName": f.GameName,
+		"platform": f.Platform,
+		"startsAt": f.StartsAt,
+	}
+}
+
+// apply overlays the fields present in input onto f and validates the
+// result. A capacity of 0 removes the limit and an empty recurrence makes
+// the event a one-off.
+func (f *eventFields) apply(input eventInput) error {
+	if input.Title != nil {
+		f.Title = strings.TrimSpace(*input.Title)
+	}
+	if f.Title == "" || len(f.Title) > maxEventTitleLength {
+		return fmt.Errorf("Title is required and must be at most %d characters", maxEventTitleLength)
+	}
+
+	if input.Description != nil {
+		f.Description = strings.TrimSpace(*input.Description)
+	}
+	if len(f.Description) > maxEventDescriptionLength {
+		return fmt.Errorf("Description must be at most %d characters", maxEventDescriptionLength)
+	}
+
+	if input.GameName != nil {
+		if strings.TrimSpace(*input.GameName) == "" {
+			f.GameName = nil
+		} else {
+			game, ok := lookupCatalogGame(*input.GameName)
+			if !ok {
+				return fmt.Errorf("Unknown game")
+			}
+			f.GameName = &game
+		}
+	}
+
+	if input.Kind != nil {
+		f.Kind = strings.ToLower(strings.TrimSpace(*input.Kind))
+	}
+	if !containsString(eventKinds, f.Kind) {
+		return fmt.Errorf("Kind must be one of %s", strings.Join(eventKinds, ", "))
+	}
+	if err := f.applyStream(input); err != nil {
+		return err
+	}
+
+	if input.Visibility != nil {
+		f.Visibility = strings.ToLower(strings.TrimSpace(*input.Visibility))
+	}
+	if !containsString(eventVisibilities, f.Visibility) {
+		return fmt.Errorf("Visibility must be one of %s", strings.Join(eventVisibilities, ", "))
+	}
+
+	if input.TimeZone != nil {
+		location, err := loadTimeZone(*input.TimeZone)
+		if err != nil {
+			return fmt.Errorf("Unknown time zone")
+		}
+		f.TimeZone = location.String()
+	}
+
+	if input.Capacity != nil {
+		if *input.Capacity < 0 {
+			return fmt.Errorf("Capacity cannot be negative")
+		}
+		if *input.Capacity == 0 {
+			f.Capacity = nil
+		} else {
+			capacity := *input.Capacity
+			f.Capacity = &capacity
+		}
+	}
+
+	if input.StartsAt != nil {
+		f.StartsAt = *input.StartsAt
+	}
+	if input.EndsAt != nil {
+		f.EndsAt = *input.EndsAt
+	}
+	if !f.EndsAt.After(f.StartsAt) {
+		return fmt.Errorf("Event must end after it starts")
+	}
+	if f.EndsAt.Sub(f.StartsAt) > maxEventDuration {
+		return fmt.Errorf("Events can last at most 48 hours")
+	}
+
+	if input.Recurrence != nil {
+		if strings.TrimSpace(*input.Recurrence) == "" {
+			f.Recurrence = nil
+		} else {
+			rule, err := parseRecurrenceRule(*input.Recurrence)
+			if err != nil {
+				return err
+			}
+			canonical := rule.String()
+			f.Recurrence = &canonical
+		}
+	}
+
+	seriesEnd := f.EndsAt
+	f.SeriesEndsAt = &seriesEnd
+	if f.Recurrence != nil {
+		rule, err := parseRecurrenceRule(*f.Recurrence)
+		if err != nil {
+			return err
+		}
+		location, err := loadTimeZone(f.TimeZone)
+		if err != nil {
+			return fmt.Errorf("Unknown time zone")
+		}
+		// Occurrences are generated to the second
+		f.StartsAt = f.StartsAt.Truncate(time.Second)
+		f.EndsAt = f.EndsAt.Truncate(time.Second)
+		if err := rule.validateStart(f.StartsAt, location); err != nil {
+			return err
+		}
+		if end, ok := rule.lastEnd(f.StartsAt, f.EndsAt.Sub(f.StartsAt), location); ok {
+			f.SeriesEndsAt = &end
+		} else {
+			f.SeriesEndsAt = nil
+		}
+	}
+	return nil
+}
+
+// loadEvent returns the event if viewerID may see it, and sql.ErrNoRows
+// otherwise so hidden events are indistinguishable from missing ones.
+func loadEvent(q queryer, eventID, viewerID int) (*Event, error) {
+	var event Event
+	err := q.Get(&event, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.id = $1 AND `+eventVisibleTo("$2"), eventID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := fillMyRSVPs([]*Event{&event}, viewerID); err != nil {
+		return nil, err
+	}
+	if err := fillNextOccurrences([]*Event{&event}); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// fillMyRSVPs sets MyRSVP on each event from the viewer's responses.
+func fillMyRSVPs(events []*Event, viewerID int) error {
+	if viewerID == 0 || len(events) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(events))
+	for i, event := range events {
+		ids[i] = int64(event.ID)
+	}
+
+	var rsvps []struct {
+		EventID int    `db:"event_id"`
+		Status  string `db:"status"`
+	}
+	err := db.Select(&rsvps, `
+		SELECT event_id, status FROM event_rsvps
+		WHERE user_id = $1 AND event_id = ANY($2)
+	`, viewerID, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	byEvent := make(map[int]string)
+	for _, rsvp := range rsvps {
+		byEvent[rsvp.EventID] = rsvp.Status
+	}
+	for _, event := range events {
+		event.MyRSVP = byEvent[event.ID]
+	}
+	return nil
+}
+
+func eventIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid event id"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// viewerIDFromRequest returns the signed-in user's id, or 0 for anonymous
+// requests.
+func viewerIDFromRequest(r *http.Request) int {
+	claims, ok := r.Context().Value(userClaimsKey).(*Claims)
+	if !ok || claims == nil {
+		claims = optionalClaims(r)
+	}
+	if claims == nil {
+		return 0
+	}
+	id, err := userIDByUsername(claims.Username)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+func createEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input eventInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if input.StartsAt == nil || input.EndsAt == nil {
+		http.Error(w, `{"error":"Start and end times are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var host struct {
+		ID       int            `db:"id"`
+		TimeZone sql.NullString `db:"time_zone"`
+	}
+	if err := db.Get(&host, "SELECT id, time_zone FROM users WHERE username = $1", claims.Username); err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Events default to the host's own time zone
+	fields := eventFields{Kind: "session", Visibility: "public", TimeZone: "UTC"}
+	if host.TimeZone.Valid {
+		fields.TimeZone = host.TimeZone.String
+	}
+	if err := fields.apply(input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := fields.fillStreamURL(host.ID); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if fields.SeriesEndsAt != nil && !fields.SeriesEndsAt.After(time.Now()) {
+		http.Error(w, `{"error":"Event must end in the future"}`, http.StatusBadRequest)
+		return
+	}
+
+	var eventID int
+	err := db.QueryRow(`
+		INSERT INTO events (host_id, title, description, game_name, kind, starts_at, ends_at,
+			time_zone, capacity, visibility, recurrence, series_ends_at, platform, stream_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id
+	`, host.ID, fields.Title, fields.Description, fields.GameName, fields.Kind, fields.StartsAt,
+		fields.EndsAt, fields.TimeZone, fields.Capacity, fields.Visibility, fields.Recurrence,
+		fields.SeriesEndsAt, fields.Platform, fields.StreamURL).Scan(&eventID)
+	if err != nil {
+		log.Printf("Error creating event: %v", err)
+		http.Error(w, `{"error":"Error creating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if fields.listedStream() {
+		recordActivity(host.ID, "stream_scheduled", &eventID, fields.GameName, fields.streamActivity(eventID))
+	}
+
+	event, err := loadEvent(db, eventID, host.ID)
+	if err != nil {
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(event)
+}
+
+func getEventHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	viewerID := viewerIDFromRequest(r)
+
+	event, err := loadEvent(db, eventID, viewerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	attendees := []EventAttendee{}
+	err = db.Select(&attendees, `
+		SELECT u.username, r.status, r.updated_at
+		FROM event_rsvps r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.event_id = $1 AND r.status IN ('going', 'maybe', 'waitlisted')
+		ORDER BY CASE r.status WHEN 'going' THEN 0 WHEN 'maybe' THEN 1 ELSE 2 END, r.updated_at, u.id
+	`, eventID)
+	if err != nil {
+		log.Printf("Error loading attendees: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"event":     event,
+		"attendees": attendees,
+	})
+}
+
+// lockHostedEvent locks an event for editing and checks that hostID owns it.
+func lockHostedEvent(w http.ResponseWriter, tx queryer, eventID, hostID int) (*eventFields, string, bool) {
+	var row struct {
+		HostID      int       `db:"host_id"`
+		Title       string    `db:"title"`
+		Description string    `db:"description"`
+		GameName    *string   `db:"game_name"`
+		Kind        string    `db:"kind"`
+		Platform    *string   `db:"platform"`
+		StreamURL   *string   `db:"stream_url"`
+		StartsAt    time.Time `db:"starts_at"`
+		EndsAt      time.Time `db:"ends_at"`
+		TimeZone    string    `db:"time_zone"`
+		Recurrence  *string   `db:"recurrence"`
+		Capacity    *int      `db:"capacity"`
+		Visibility  string    `db:"visibility"`
+		Status      string    `db:"status"`
+	}
+	err := tx.Get(&row, `
+		SELECT host_id, title, description, game_name, kind, platform, stream_url, starts_at, ends_at, time_zone,
+			recurrence, capacity, visibility, status
+		FROM events WHERE id = $1 FOR UPDATE
+	`, eventID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+			return nil, "", false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if row.HostID != hostID {
+		http.Error(w, `{"error":"Only the host can change this event"}`, http.StatusForbidden)
+		return nil, "", false
+	}
+
+	fields := &eventFields{
+		Title:       row.Title,
+		Description: row.Description,
+		GameName:    row.GameName,
+		Kind:        row.Kind,
+		Platform:    row.Platform,
+		StreamURL:   row.StreamURL,
+		StartsAt:    row.StartsAt,
+		EndsAt:      row.EndsAt,
+		TimeZone:    row.TimeZone,
+		Recurrence:  row.Recurrence,
+		Capacity:    row.Capacity,
+		Visibility:  row.Visibility,
+	}
+	return fields, row.Status, true
+}
+
+func updateEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var input eventInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	fields, status, ok := lockHostedEvent(w, tx, eventID, hostID)
+	if !ok {
+		return
+	}
+	if status != "scheduled" {
+		http.Error(w, `{"error":"Cancelled events cannot be edited"}`, http.StatusConflict)
+		return
+	}
+	previous := *fields
+	if err := fields.apply(input); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := fields.fillStreamURL(hostID); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Occurrence edits are keyed by the old schedule, so a new schedule
+	// drops them
+	if !fields.StartsAt.Equal(previous.StartsAt) || fields.TimeZone != previous.TimeZone ||
+		!equalStringPointers(fields.Recurrence, previous.Recurrence) {
+		if _, err := tx.Exec("DELETE FROM event_exceptions WHERE event_id = $1", eventID); err != nil {
+			http.Error(w, `{"error":"Error updating event"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE events
+		SET title = $2, description = $3, game_name = $4, kind = $5, starts_at = $6, ends_at = $7,
+			time_zone = $8, capacity = $9, visibility = $10, recurrence = $11, platform = $13, stream_url = $14,
+			series_ends_at = CASE WHEN $12::TIMESTAMPTZ IS NULL THEN NULL
+				ELSE GREATEST($12, (SELECT MAX(ends_at) FROM event_exceptions WHERE event_id = $1)) END,
+			updated_at = CURRENT_TIMESTAMP, sequence = sequence + 1
+		WHERE id = $1
+	`, eventID, fields.Title, fields.Description, fields.GameName, fields.Kind, fields.StartsAt,
+		fields.EndsAt, fields.TimeZone, fields.Capacity, fields.Visibility, fields.Recurrence,
+		fields.SeriesEndsAt, fields.Platform, fields.StreamURL)
+	if err != nil {
+		log.Printf("Error updating event: %v", err)
+		http.Error(w, `{"error":"Error updating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// A larger capacity may make room for people on the waitlist
+	promoted, err := promoteEventWaitlist(tx, eventID, fields.Capacity)
+	if err != nil {
+		log.Printf("Error promoting waitlist: %v", err)
+		http.Error(w, `{"error":"Error updating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	attendeeIDs, err := eventAttendeeIDs(tx, eventID)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, userID := range promoted {
+		notify(userID, "event_waitlist_promoted", map[string]interface{}{"eventId": eventID})
+	}
+	for _, userID := range attendeeIDs {
+		notify(userID, "event_updated", map[string]interface{}{"eventId": eventID})
+	}
+	// Followers' feeds follow the stream into and out of being listed
+	switch {
+	case fields.listedStream() && !previous.listedStream():
+		recordActivity(hostID, "stream_scheduled", &eventID, fields.GameName, fields.streamActivity(eventID))
+	case fields.listedStream():
+		updateActivity(hostID, "stream_scheduled", eventID, fields.GameName, fields.streamActivity(eventID))
+	case previous.listedStream():
+		removeActivity(hostID, "stream_scheduled", &eventID, nil)
+	}
+
+	event, err := loadEvent(db, eventID, hostID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(event)
+}
+
+func cancelEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, status, ok := lockHostedEvent(w, tx, eventID, hostID)
+	if !ok {
+		return
+	}
+	if status == "cancelled" {
+		http.Error(w, `{"error":"Event is already cancelled"}`, http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE events SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP, sequence = sequence + 1
+		WHERE id = $1
+	`, eventID)
+	if err != nil {
+		http.Error(w, `{"error":"Error cancelling event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	attendeeIDs, err := eventAttendeeIDs(tx, eventID)
+	if err != nil {
+		http.Error(w, `{"error":"Error cancelling event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error cancelling event"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, userID := range attendeeIDs {
+		notify(userID, "event_cancelled", map[string]interface{}{"eventId": eventID})
+	}
+	removeActivity(hostID, "stream_scheduled", &eventID, nil)
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Event cancelled"})
+}
+
+// eventAttendeeIDs returns everyone with an active RSVP to the event.
+func eventAttendeeIDs(q queryer, eventID int) ([]int, error) {
+	var ids []int
+	err := q.Select(&ids, `
+		SELECT user_id FROM event_rsvps
+		WHERE event_id = $1 AND status IN ('going', 'maybe', 'waitlisted')
+		ORDER BY user_id
+	`, eventID)
+	return ids, err
+}
+
+func inviteToEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Usernames []string `json:"usernames"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Usernames) == 0 || len(requestBody.Usernames) > maxEventInvites {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invite between 1 and %d users", maxEventInvites))
+		return
+	}
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, status, ok := lockHostedEvent(w, tx, eventID, hostID)
+	if !ok {
+		return
+	}
+	if status != "scheduled" {
+		http.Error(w, `{"error":"Event is cancelled"}`, http.StatusConflict)
+		return
+	}
+
+	var invited []int
+	err = tx.Select(&invited, `
+		INSERT INTO event_invites (event_id, user_id)
+		SELECT $1, u.id FROM users u
+		WHERE u.username = ANY($2) AND u.id <> $3
+		ON CONFLICT DO NOTHING
+		RETURNING user_id
+	`, eventID, pq.Array(requestBody.Usernames), hostID)
+	if err != nil {
+		log.Printf("Error inviting to event: %v", err)
+		http.Error(w, `{"error":"Error sending invites"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error sending invites"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, userID := range invited {
+		notify(userID, "event_invite", map[string]interface{}{
+			"eventId": eventID,
+			"host":    claims.Username,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Invites sent",
+		"invited": len(invited),
+	})
+}
+
+func rsvpEventHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	requested := strings.ToLower(strings.TrimSpace(requestBody.Status))
+	if requested != "going" && requested != "maybe" && requested != "declined" {
+		http.Error(w, `{"error":"Status must be going, maybe or declined"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := setEventRSVP(eventID, userID, requested)
+	if err != nil {
+		if rerr, ok := err.(*rsvpError); ok {
+			writeJSONError(w, rerr.status, rerr.message)
+			return
+		}
+		log.Printf("Error saving RSVP: %v", err)
+		http.Error(w, `{"error":"Error saving RSVP"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, promotedID := range result.Promoted {
+		notify(promotedID, "event_waitlist_promoted", map[string]interface{}{"eventId": eventID})
+	}
+	if result.Status != result.Previous {
+		notify(result.HostID, "event_rsvp", map[string]interface{}{
+			"eventId":  eventID,
+			"username": claims.Username,
+			"status":   result.Status,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  result.Status,
+		"message": "RSVP saved",
+	})
+}
+
+// rsvpError is an RSVP the caller is not allowed to make.
+type rsvpError struct {
+	status  int
+	message string
+}
+
+func (e *rsvpError) Error() string {
+	return e.message
+}
+
+// rsvpResult is the outcome of an RSVP: the stored status, the one it
+// replaced, and anyone promoted off the waitlist as a result.
+type rsvpResult struct {
+	Status   string
+	Previous string
+	HostID   int
+	Promoted []int
+}
+
+// setEventRSVP records the user's response. Going becomes waitlisted when
+// the event is full, and giving up a going spot promotes the longest-waiting
+// user.
+func setEventRSVP(eventID, userID int, requested string) (*rsvpResult, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var event struct {
+		HostID       int        `db:"host_id"`
+		Capacity     *int       `db:"capacity"`
+		Status       string     `db:"status"`
+		SeriesEndsAt *time.Time `db:"series_ends_at"`
+	}
+	err = tx.Get(&event, `
+		SELECT e.host_id, e.capacity, e.status, e.series_ends_at
+		FROM events e
+		WHERE e.id = $1 AND `+eventVisibleTo("$2")+`
+		FOR UPDATE OF e
+	`, eventID, userID)
+	if err == sql.ErrNoRows {
+		return nil, &rsvpError{http.StatusNotFound, "Event not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if event.HostID == userID {
+		return nil, &rsvpError{http.StatusBadRequest, "Hosts don't RSVP to their own events"}
+	}
+	if event.Status != "scheduled" || (event.SeriesEndsAt != nil && !event.SeriesEndsAt.After(time.Now())) {
+		return nil, &rsvpError{http.StatusConflict, "Event is no longer open for RSVPs"}
+	}
+
+	var previous string
+	err = tx.Get(&previous, "SELECT status FROM event_rsvps WHERE event_id = $1 AND user_id = $2", eventID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	status := requested
+	if requested == "going" && previous != "going" && event.Capacity != nil {
+		var going int
+		err = tx.Get(&going, "SELECT COUNT(*) FROM event_rsvps WHERE event_id = $1 AND status = 'going'", eventID)
+		if err != nil {
+			return nil, err
+		}
+		if going >= *event.Capacity {
+			status = "waitlisted"
+		}
+	}
+	if requested == "going" && previous == "waitlisted" && status == "waitlisted" {
+		// Keep their place in line
+		return &rsvpResult{Status: status, Previous: previous, HostID: event.HostID}, tx.Commit()
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO event_rsvps (event_id, user_id, status)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (event_id, user_id)
+		DO UPDATE SET status = EXCLUDED.status, updated_at = CURRENT_TIMESTAMP
+	`, eventID, userID, status)
+	if err != nil {
+		return nil, err
+	}
+
+	var promoted []int
+	if previous == "going" && status != "going" {
+		promoted, err = promoteEventWaitlist(tx, eventID, event.Capacity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &rsvpResult{Status: status, Previous: previous, HostID: event.HostID, Promoted: promoted}, nil
+}
+
+// promoteEventWaitlist moves waitlisted users to going, oldest first, while
+// the event has room. The caller must hold the event's row lock.
+func promoteEventWaitlist(tx queryer, eventID int, capacity *int) ([]int, error) {
+	var promoted []int
+	err := tx.Select(&promoted, `
+		WITH open_spots AS (
+			SELECT CASE WHEN $2::INTEGER IS NULL THEN NULL
+				ELSE GREATEST($2::INTEGER - COUNT(*), 0) END AS spots
+			FROM event_rsvps WHERE event_id = $1 AND status = 'going'
+		), next_in_line AS (
+			SELECT user_id FROM event_rsvps
+			WHERE event_id = $1 AND status = 'waitlisted'
+			ORDER BY updated_at, user_id
+			LIMIT (SELECT spots FROM open_spots)
+		)
+		UPDATE event_rsvps SET status = 'going', updated_at = CURRENT_TIMESTAMP
+		WHERE event_id = $1 AND user_id IN (SELECT user_id FROM next_in_line)
+		RETURNING user_id
+	`, eventID, capacity)
+	return promoted, err
+}
+
+// listEvents runs an upcoming-events query. condition is ANDed with the
+// viewer's visibility check, which is always bound to $1.
+// sortEventsByUpcomingStart orders events by their next occurrence, or
+// their start for one-off events, keeping the order of ties.
+func sortEventsByUpcomingStart(events []*Event) []*Event {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].upcomingStart().Before(events[j].upcomingStart())
+	})
+	return events
+}
+
+func listEvents(w http.ResponseWriter, r *http.Request, viewerID int, condition string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	params := append([]interface{}{viewerID}, args...)
+	query := fmt.Sprintf(`
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.status = 'scheduled' AND (e.series_ends_at IS NULL OR e.series_ends_at > NOW())
+		AND `+eventVisibleTo("$1")+`
+		AND %s
+	`, condition)
+
+	// Recurring events sort by their next occurrence rather than the
+	// first, which the database doesn't know, so series are fetched apart
+	// from the limit and the events cut to it once sorted
+	events := []*Event{}
+	err := db.Select(&events, query+fmt.Sprintf(`
+		AND e.recurrence IS NULL
+		ORDER BY e.starts_at, e.id
+		LIMIT $%d
+	`, len(params)+1), append(params, limit)...)
+	series := []*Event{}
+	if err == nil {
+		err = db.Select(&series, query+fmt.Sprintf(`
+			AND e.recurrence IS NOT NULL
+			ORDER BY e.starts_at, e.id
+			LIMIT %d
+		`, maxListedSeries), params...)
+	}
+	if err != nil {
+		log.Printf("Error listing events: %v", err)
+		http.Error(w, `{"error":"Error listing events"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := fillNextOccurrences(series); err != nil {
+		log.Printf("Error expanding occurrences: %v", err)
+		http.Error(w, `{"error":"Error listing events"}`, http.StatusInternalServerError)
+		return
+	}
+	events = sortEventsByUpcomingStart(append(events, series...))
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	if err := fillMyRSVPs(events, viewerID); err != nil {
+		log.Printf("Error loading RSVPs: %v", err)
+		http.Error(w, `{"error":"Error listing events"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(events)
+}
+
+// userEventsHandler lists upcoming events hosted by a user.
+func userEventsHandler(w http.ResponseWriter, r *http.Request) {
+	hostID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	listEvents(w, r, viewerIDFromRequest(r), "e.host_id = $2", hostID)
+}
+
+// myEventsHandler lists upcoming events the caller hosts or has responded
+// to without declining.
+func myEventsHandler(w http.ResponseWriter, r *http.Request) {
+	viewerID := viewerIDFromRequest(r)
+	listEvents(w, r, viewerID, `(e.host_id = $1 OR EXISTS(
+		SELECT 1 FROM event_rsvps r
+		WHERE r.event_id = e.id AND r.user_id = $1 AND r.status <> 'declined'))`)
+}
+
+// followingEventsHandler lists upcoming events hosted by people the caller
+// follows.
+func followingEventsHandler(w http.ResponseWriter, r *http.Request) {
+	viewerID := viewerIDFromRequest(r)
+	listEvents(w, r, viewerID, `e.host_id IN (
+		SELECT following_id FROM followers WHERE follower_id = $1)`)
+}
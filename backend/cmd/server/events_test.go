@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSortEventsByUpcomingStart(t *testing.T) {
+	weekly := "FREQ=WEEKLY;BYDAY=SA"
+	now := utc("2026-10-18T08:00:00Z")
+	at := func(days int) time.Time { return now.Add(time.Duration(days) * 24 * time.Hour) }
+
+	// A series that started years ago but next meets in ten days
+	series := &Event{ID: 1, StartsAt: utc("2020-01-04T18:00:00Z"), Recurrence: &weekly}
+	series.NextOccurrence = &EventOccurrence{EventID: 1, StartsAt: at(10)}
+	soon := &Event{ID: 2, StartsAt: at(1)}
+	later := &Event{ID: 3, StartsAt: at(5)}
+	latest := &Event{ID: 4, StartsAt: at(20)}
+	// Its first occurrence is still ahead, so that's its next one
+	newSeries := &Event{ID: 5, StartsAt: at(3), Recurrence: &weekly}
+	newSeries.NextOccurrence = &EventOccurrence{EventID: 5, StartsAt: at(3)}
+
+	// One-off events arrive in start order, series after them
+	got := sortEventsByUpcomingStart([]*Event{soon, later, latest, series, newSeries})
+	var ids []int
+	for _, event := range got {
+		ids = append(ids, event.ID)
+	}
+	want := []int{2, 5, 3, 1, 4}
+	if len(ids) != len(want) {
+		t.Fatalf("sorted ids = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("sorted ids = %v, want %v", ids, want)
+		}
+	}
+}
+
+// eventAudienceIDs are the users of the event visibility tests: the host,
+// a follower of the host, someone invited and a stranger.
+var eventAudienceIDs = map[string]int{"host": 2, "follower": 3, "invited": 4, "stranger": 5}
+
+// useFakeEventAudience answers lookups of event 1, hosted by "host" with
+// visibility, for whichever viewer the query is bound to.
+func useFakeEventAudience(f *fakeDB, visibility string) {
+	f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRow("id", eventAudienceIDs[args[0].(string)])
+	})
+	canSee := func(viewerID int) bool {
+		switch {
+		case viewerID == eventAudienceIDs["host"] || visibility == "public":
+			return true
+		case visibility == "followers":
+			return viewerID == eventAudienceIDs["follower"]
+		case visibility == "invite":
+			return viewerID == eventAudienceIDs["invited"]
+		}
+		return false
+	}
+	start := time.Now().Add(24 * time.Hour)
+	f.on("FROM events e WHERE e.id = $1 AND "+eventVisibleTo("$2")+" FOR UPDATE OF e", func(args []interface{}) fakeResult {
+		columns := []string{"host_id", "capacity", "status", "series_ends_at"}
+		if !canSee(args[1].(int)) {
+			return fakeRows(columns)
+		}
+		return fakeRows(columns, []interface{}{eventAudienceIDs["host"], nil, "scheduled", start.Add(time.Hour)})
+	})
+	f.on("WHERE e.id = $1 AND "+eventVisibleTo("$2"), func(args []interface{}) fakeResult {
+		columns := []string{"id", "host_username", "title", "kind", "starts_at", "ends_at",
+			"time_zone", "capacity", "visibility", "status", "series_ends_at"}
+		if !canSee(args[1].(int)) {
+			return fakeRows(columns)
+		}
+		return fakeRows(columns, []interface{}{1, "host", "Scrims", "session", start,
+			start.Add(time.Hour), "UTC", nil, visibility, "scheduled", start.Add(time.Hour)})
+	})
+	f.on("SELECT event_id, status FROM event_rsvps WHERE user_id = $1", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"event_id", "status"})
+	})
+	f.on("FROM event_rsvps r JOIN users u ON u.id = r.user_id", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"username", "status", "updated_at"})
+	})
+}
+
+func TestGetEventVisibility(t *testing.T) {
+	tests := []struct {
+		visibility string
+		canSee     []string
+	}{
+		{"public", []string{"", "host", "follower", "invited", "stranger"}},
+		{"followers", []string{"host", "follower"}},
+		{"invite", []string{"host", "invited"}},
+	}
+	for _, test := range tests {
+		f := useFakeDB(t)
+		useFakeEventAudience(f, test.visibility)
+		for _, viewer := range []string{"", "host", "follower", "invited", "stranger"} {
+			r := mux.SetURLVars(testRequest("GET", "/events/1", "", viewer), map[string]string{"id": "1"})
+			w := serve(getEventHandler, r)
+			want := http.StatusNotFound
+			if containsString(test.canSee, viewer) {
+				want = http.StatusOK
+			}
+			if w.Code != want {
+				t.Errorf("%s event seen by %q = %d, want %d", test.visibility, viewer, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestRSVPEventPermissions(t *testing.T) {
+	tests := []struct {
+		visibility string
+		viewer     string
+		want       int
+	}{
+		// Hidden events can't be answered, and look like missing ones
+		{"invite", "stranger", http.StatusNotFound},
+		{"followers", "invited", http.StatusNotFound},
+		{"public", "host", http.StatusBadRequest},
+		{"invite", "invited", http.StatusOK},
+	}
+	for _, test := range tests {
+		f := useFakeDB(t)
+		useFakeEventAudience(f, test.visibility)
+		f.on("SELECT status FROM event_rsvps WHERE event_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+			return fakeRows([]string{"status"})
+		})
+		var saved []interface{}
+		f.on("INSERT INTO event_rsvps", func(args []interface{}) fakeResult {
+			saved = args
+			return fakeAffected(1)
+		})
+
+		r := mux.SetURLVars(testRequest("POST", "/events/1/rsvp", `{"status":"going"}`, test.viewer), map[string]string{"id": "1"})
+		w := serve(rsvpEventHandler, r)
+		if w.Code != test.want {
+			t.Errorf("%s RSVP to a %s event = %d %s, want %d", test.viewer, test.visibility, w.Code, w.Body, test.want)
+		}
+		if (saved != nil) != (test.want == http.StatusOK) {
+			t.Errorf("%s RSVP to a %s event saved %v", test.viewer, test.visibility, saved)
+		}
+	}
+}
+
+func TestInviteToEventRequiresHost(t *testing.T) {
+	f := useFakeDB(t)
+	useFakeEventAudience(f, "invite")
+	f.on("FROM events WHERE id = $1 FOR UPDATE", func(args []interface{}) fakeResult {
+		start := time.Now().Add(24 * time.Hour)
+		return fakeRows([]string{"host_id", "title", "description", "kind", "starts_at", "ends_at", "time_zone", "visibility", "status"},
+			[]interface{}{eventAudienceIDs["host"], "Scrims", "", "session", start, start.Add(time.Hour), "UTC", "invite", "scheduled"})
+	})
+	var invited []interface{}
+	f.on("INSERT INTO event_invites", func(args []interface{}) fakeResult {
+		invited = args
+		return fakeRows([]string{"user_id"}, []interface{}{eventAudienceIDs["stranger"]})
+	})
+
+	invite := func(username string) int {
+		r := mux.SetURLVars(testRequest("POST", "/events/1/invite", `{"usernames":["stranger"]}`, username), map[string]string{"id": "1"})
+		return serve(inviteToEventHandler, r).Code
+	}
+	// Guests can't invite more guests
+	if code := invite("invited"); code != http.StatusForbidden || invited != nil {
+		t.Errorf("invite by a guest = %d, inserted %v; want 403 and nothing", code, invited)
+	}
+	if code := invite("host"); code != http.StatusOK || invited == nil {
+		t.Errorf("invite by the host = %d, inserted %v; want 200", code, invited)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeDB stands in for Postgres in handler tests. Each statement is
+// answered by the first handler whose fragment its text contains, ignoring
+// differences in whitespace; a statement nothing answers fails the test, so
+// tests spell out every query a handler makes.
+type fakeDB struct {
+	t        *testing.T
+	mu       sync.Mutex
+	handlers []fakeHandler
+}
+
+type fakeHandler struct {
+	fragment string
+	answer   func(args []interface{}) fakeResult
+}
+
+// fakeResult is a statement's outcome: rows for a query, the number of
+// rows affected for anything else, or an error.
+type fakeResult struct {
+	columns  []string
+	rows     [][]interface{}
+	affected int64
+	err      error
+}
+
+// fakeRows is a fakeResult with columns and rows.
+func fakeRows(columns []string, rows ...[]interface{}) fakeResult {
+	return fakeResult{columns: columns, rows: rows}
+}
+
+// fakeRow is a fakeResult with a single column and row.
+func fakeRow(column string, value interface{}) fakeResult {
+	return fakeRows([]string{column}, []interface{}{value})
+}
+
+// fakeAffected is a fakeResult for a statement that changed n rows.
+func fakeAffected(n int64) fakeResult {
+	return fakeResult{affected: n}
+}
+
+var fakeDriverCount int
+
+// useFakeDB points db at a new fakeDB for the rest of the test.
+func useFakeDB(t *testing.T) *fakeDB {
+	f := &fakeDB{t: t}
+	fakeDriverCount++
+	name := fmt.Sprintf("fakedb%d", fakeDriverCount)
+	sql.Register(name, fakeDriver{f})
+	conn, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = sqlx.NewDb(conn, "postgres")
+	t.Cleanup(func() {
+		db.Close()
+		db = previous
+	})
+	return f
+}
+
+// on answers statements containing fragment.
+func (f *fakeDB) on(fragment string, answer func(args []interface{}) fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers = append(f.handlers, fakeHandler{strings.Join(strings.Fields(fragment), " "), answer})
+}
+
+func (f *fakeDB) run(query string, args []driver.NamedValue) fakeResult {
+	query = strings.Join(strings.Fields(query), " ")
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+
+	f.mu.Lock()
+	var answer func([]interface{}) fakeResult
+	for _, handler := range f.handlers {
+		if strings.Contains(query, handler.fragment) {
+			answer = handler.answer
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if answer == nil {
+		f.t.Errorf("unexpected statement: %s %v", query, values)
+		return fakeResult{err: fmt.Errorf("fakedb: no handler for statement")}
+	}
+	return answer(values)
+}
+
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return fakeConn{d.db}, nil
+}
+
+// fakeConn runs statements directly; transactions have nothing to undo.
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakedb: prepared statements are not supported")
+}
+
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+// CheckNamedValue passes arguments such as pq arrays through unconverted.
+func (c fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result := c.db.run(query, args)
+	if result.err != nil {
+		return nil, result.err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result := c.db.run(query, args)
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &fakeRowsIter{columns: result.columns, rows: result.rows}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRowsIter struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func (r *fakeRowsIter) Columns() []string { return r.columns }
+func (r *fakeRowsIter) Close() error      { return nil }
+
+func (r *fakeRowsIter) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, value := range r.rows[0] {
+		if n, ok := value.(int); ok {
+			value = int64(n)
+		}
+		dest[i] = value
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// testRequest is a request from username, or an anonymous one if username
+// is empty.
+func testRequest(method, target, body, username string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if username != "" {
+		r = r.WithContext(context.WithValue(r.Context(), userClaimsKey, &Claims{Username: username}))
+	}
+	return r
+}
+
+// serve calls handler with r and returns the response.
+func serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// activityRetention is how far back the feed goes.
+	activityRetention = 90 * 24 * time.Hour
+	// Accounts with at least heavyAccountFollowers followers appear in so
+	// many feeds that their recent activity is served from memory.
+	heavyAccountFollowers = 1000
+	// activityCacheDepth is how many activities are cached per account.
+	activityCacheDepth = 200
+)
+
+// Activity is something a user did that their followers see in their feed.
+type Activity struct {
+	ID        int64           `json:"id" db:"id"`
+	ActorID   int             `json:"-" db:"actor_id"`
+	Actor     string          `json:"actor" db:"actor"`
+	Type      string          `json:"type" db:"type"`
+	ObjectID  *int            `json:"-" db:"object_id"`
+	GameName  *string         `json:"gameName,omitempty" db:"game_name"`
+	Payload   json.RawMessage `json:"payload" db:"-"`
+	RawData   string          `json:"-" db:"payload"`
+	CreatedAt time.Time       `json:"createdAt" db:"created_at"`
+}
+
+const activityColumns = `
+	a.id, a.actor_id, u.username AS actor, a.type, a.object_id, a.game_name, a.payload, a.created_at
+	FROM activities a
+	JOIN users u ON u.id = a.actor_id`
+
+func initActivityTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS activities (
+		id BIGSERIAL PRIMARY KEY,
+		actor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(32) NOT NULL,
+		object_id INTEGER,
+		game_name VARCHAR(255),
+		payload JSONB NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS activities_actor_id_id_idx ON activities (actor_id, id DESC);
+	CREATE INDEX IF NOT EXISTS activities_created_at_idx ON activities (created_at);
+	`)
+	return err
+}
+
+// recordActivity adds to actorID's activity. Like notify, failures are
+// logged rather than returned so they never fail the request.
+func recordActivity(actorID int, kind string, objectID *int, gameName *string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err == nil {
+		_, err = db.Exec(`
+			INSERT INTO activities (actor_id, type, object_id, game_name, payload)
+			VALUES ($1, $2, $3, $4, $5)
+		`, actorID, kind, objectID, gameName, string(data))
+	}
+	if err != nil {
+		log.Printf("Error recording %s activity for user %d: %v", kind, actorID, err)
+		return
+	}
+	feedCache.invalidate(actorID)
+}
+
+// updateActivity rewrites the game and payload of activity about an object
+// that was edited, keeping its place in feeds.
+func updateActivity(actorID int, kind string, objectID int, gameName *string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err == nil {
+		_, err = db.Exec(`
+			UPDATE activities SET game_name = $4, payload = $5
+			WHERE actor_id = $1 AND type = $2 AND object_id = $3
+		`, actorID, kind, objectID, gameName, string(data))
+	}
+	if err != nil {
+		log.Printf("Error updating %s activity for user %d: %v", kind, actorID, err)
+		return
+	}
+	feedCache.invalidate(actorID)
+}
+
+// removeActivity takes back activity that no longer holds, such as a
+// follow that was undone or a stream that was cancelled. A nil objectID or
+// gameName matches any.
+func removeActivity(actorID int, kind string, objectID *int, gameName *string) {
+	_, err := db.Exec(`
+		DELETE FROM activities
+		WHERE actor_id = $1 AND type = $2
+		AND ($3::INTEGER IS NULL OR object_id = $3) AND ($4::VARCHAR IS NULL OR game_name = $4)
+	`, actorID, kind, objectID, gameName)
+	if err != nil {
+		log.Printf("Error removing %s activity for user %d: %v", kind, actorID, err)
+		return
+	}
+	feedCache.invalidate(actorID)
+}
+
+// registerActivityPruning drops activity older than the feed goes back.
+func registerActivityPruning() {
+	registerJobPlanner(func(now time.Time) error {
+		_, err := db.Exec("DELETE FROM activities WHERE created_at < $1", now.Add(-activityRetention))
+		return err
+	})
+}
+
+// visibleTo reports whether an activity may be shown to a viewer who has
+// blocked, been blocked by or muted the users in hidden. The actor is
+// checked when the feed is built; this covers the user an activity is
+// about.
+func (a *Activity) visibleTo(hidden map[int]bool) bool {
+	return a.Type != "followed" || a.ObjectID == nil || !hidden[*a.ObjectID]
+}
+
+// activityCache keeps the recent activity of heavy accounts in memory, so
+// building feeds that include them doesn't query activities each time.
+// Other instances' writes are only seen after the next refresh, which
+// bounds how stale a cached account can be.
+type activityCache struct {
+	mu     sync.RWMutex
+	heavy  map[int]bool
+	recent map[int][]Activity
+	// generation changes on every invalidation, so a load that raced with
+	// one isn't cached
+	generation int
+}
+
+var feedCache = &activityCache{heavy: map[int]bool{}, recent: map[int][]Activity{}}
+
+// feedCacheRefreshInterval reads FEED_CACHE_REFRESH_INTERVAL, defaulting to
+// one minute.
+func feedCacheRefreshInterval() time.Duration {
+	if value := os.Getenv("FEED_CACHE_REFRESH_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		log.Printf("Invalid FEED_CACHE_REFRESH_INTERVAL %q, using default", value)
+	}
+	return time.Minute
+}
+
+// start refreshes the set of heavy accounts every interval, dropping
+// everything cached so far.
+func (c *activityCache) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.reload(); err != nil {
+				log.Printf("Error refreshing feed cache: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func (c *activityCache) reload() error {
+	var ids []int
+	err := db.Select(&ids, `
+		SELECT following_id FROM followers GROUP BY following_id HAVING COUNT(*) >= $1
+	`, heavyAccountFollowers)
+	if err != nil {
+		return err
+	}
+	heavy := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		heavy[id] = true
+	}
+
+	c.mu.Lock()
+	c.heavy = heavy
+	c.recent = map[int][]Activity{}
+	c.generation++
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *activityCache) isHeavy(userID int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.heavy[userID]
+}
+
+func (c *activityCache) invalidate(userID int) {
+	c.mu.Lock()
+	delete(c.recent, userID)
+	c.generation++
+	c.mu.Unlock()
+}
+
+// activities returns userID's most recent activities, newest first.
+func (c *activityCache) activities(userID int) ([]Activity, error) {
+	c.mu.RLock()
+	cached, ok := c.recent[userID]
+	generation := c.generation
+	c.mu.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	activities := []Activity{}
+	err := db.Select(&activities, `
+		SELECT `+activityColumns+`
+		WHERE a.actor_id = $1
+		ORDER BY a.id DESC
+		LIMIT $2
+	`, userID, activityCacheDepth)
+	if err != nil {
+		return nil, err
+	}
+	for i := range activities {
+		activities[i].Payload = json.RawMessage(activities[i].RawData)
+	}
+
+	c.mu.Lock()
+	if c.heavy[userID] && c.generation == generation {
+		c.recent[userID] = activities
+	}
+	c.mu.Unlock()
+	return activities, nil
+}
+
+// loadFeed returns a page of activity from the accounts viewerID follows,
+// newest first, and whether there is more. Only accepted follows are in
+// followers, so private accounts are seen by their approved followers
+// alone; blocked and muted accounts are left out.
+//
+// Feeds are built when they're read: accounts with few followers are
+// queried directly, heavy ones come from the cache unless the page reaches
+// further back than it holds.
+func loadFeed(viewerID int, before int64, limit int) ([]Activity, bool, error) {
+	hiddenIDs := []int{}
+	err := db.Select(&hiddenIDs, `
+		SELECT muted_id FROM user_mutes WHERE muter_id = $1
+		UNION SELECT blocked_id FROM user_blocks WHERE blocker_id = $1
+		UNION SELECT blocker_id FROM user_blocks WHERE blocked_id = $1
+	`, viewerID)
+	if err != nil {
+		return nil, false, err
+	}
+	hidden := make(map[int]bool, len(hiddenIDs))
+	for _, id := range hiddenIDs {
+		hidden[id] = true
+	}
+
+	var followed []int
+	if err := db.Select(&followed, "SELECT following_id FROM followers WHERE follower_id = $1", viewerID); err != nil {
+		return nil, false, err
+	}
+
+	feed := []Activity{}
+	queried := []int{}
+	for _, userID := range followed {
+		if hidden[userID] {
+			continue
+		}
+		if !feedCache.isHeavy(userID) {
+			queried = append(queried, userID)
+			continue
+		}
+
+		cached, err := feedCache.activities(userID)
+		if err != nil {
+			return nil, false, err
+		}
+		var page []Activity
+		for i := range cached {
+			if (before != 0 && cached[i].ID >= before) || !cached[i].visibleTo(hidden) {
+				continue
+			}
+			page = append(page, cached[i])
+			if len(page) > limit {
+				break
+			}
+		}
+		// A full cache may not go back far enough to fill this page
+		if len(cached) == activityCacheDepth && len(page) <= limit {
+			queried = append(queried, userID)
+			continue
+		}
+		feed = append(feed, page...)
+	}
+
+	if len(queried) > 0 {
+		activities := []Activity{}
+		err := db.Select(&activities, `
+			SELECT `+activityColumns+`
+			WHERE a.actor_id = ANY($1) AND ($2 = 0 OR a.id < $2)
+			AND NOT (a.type = 'followed' AND a.object_id = ANY($3))
+			ORDER BY a.id DESC
+			LIMIT $4
+		`, pq.Array(queried), before, pq.Array(hiddenIDs), limit+1)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := range activities {
+			activities[i].Payload = json.RawMessage(activities[i].RawData)
+		}
+		feed = append(feed, activities...)
+	}
+
+	sort.Slice(feed, func(i, j int) bool { return feed[i].ID > feed[j].ID })
+	if len(feed) > limit {
+		return feed[:limit], true, nil
+	}
+	return feed, false, nil
+}
+
+// feedHandler serves the caller's activity feed. Pages are taken with the
+// nextCursor of the previous one as before.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	activities, more, err := loadFeed(userID, before, limit)
+	if err != nil {
+		log.Printf("Error loading feed: %v", err)
+		http.Error(w, `{"error":"Error loading feed"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"activities": activities}
+	if more {
+		response["nextCursor"] = strconv.FormatInt(activities[len(activities)-1].ID, 10)
+	}
+	json.NewEncoder(w).Encode(response)
+}
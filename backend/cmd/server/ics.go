@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icsProductID = "-//airdate//airdate calendar//EN"
+	// icsTimezoneHorizon is how far past the end of a recurring series, or
+	// past now for one without an end, VTIMEZONE transitions are listed so
+	// its occurrences stay correct.
+	icsTimezoneHorizon = 2 * 365 * 24 * time.Hour
+	icsLocalLayout     = "20060102T150405"
+	icsUTCLayout       = "20060102T150405Z"
+)
+
+// icsEvent is one VEVENT. Start and End are rendered in Location; UTC
+// events are written with a trailing Z and need no VTIMEZONE.
+type icsEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Categories  []string
+	URL         string
+	Start       time.Time
+	End         time.Time
+	Location    *time.Location
+	Stamp       time.Time
+	Sequence    int
+	Cancelled   bool
+	// RRule is the value of an RRULE property, without the "RRULE:" prefix
+	RRule string
+	// SeriesEnd is when the last occurrence of a recurring event ends, nil
+	// if it repeats indefinitely
+	SeriesEnd *time.Time
+	// ExDates are occurrence starts removed from the recurrence set
+	ExDates []time.Time
+	// RecurrenceID marks this VEVENT as an override of one occurrence
+	RecurrenceID *time.Time
+}
+
+// writeCalendar writes a VCALENDAR holding events and a VTIMEZONE for every
+// non-UTC zone they use, as of now.
+func writeCalendar(out io.Writer, name string, now time.Time, events []icsEvent) error {
+	w := &icsWriter{w: bufio.NewWriter(out)}
+
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:" + icsProductID)
+	w.line("CALSCALE:GREGORIAN")
+	w.line("METHOD:PUBLISH")
+	if name != "" {
+		w.line("X-WR-CALNAME:" + icsEscape(name))
+	}
+
+	// Each zone's VTIMEZONE covers every event that uses it
+	type span struct{ from, until time.Time }
+	spans := make(map[string]*span)
+	locations := make(map[string]*time.Location)
+	for _, event := range events {
+		loc := event.Location
+		if loc == nil || loc == time.UTC || loc.String() == "UTC" {
+			continue
+		}
+		until := event.End
+		if event.RRule != "" {
+			// A feed is read again long after a series starts, so an open
+			// one is covered from whenever it's read
+			if event.SeriesEnd != nil {
+				until = laterTime(until, *event.SeriesEnd)
+			}
+			until = laterTime(until, now).Add(icsTimezoneHorizon)
+		}
+		s, ok := spans[loc.String()]
+		if !ok {
+			spans[loc.String()] = &span{event.Start, until}
+			locations[loc.String()] = loc
+			continue
+		}
+		s.from = earlierTime(s.from, event.Start)
+		s.until = laterTime(s.until, until)
+	}
+	zoneNames := make([]string, 0, len(spans))
+	for zone := range spans {
+		zoneNames = append(zoneNames, zone)
+	}
+	sort.Strings(zoneNames)
+	for _, zone := range zoneNames {
+		writeVTimezone(w, locations[zone], spans[zone].from, spans[zone].until)
+	}
+
+	for _, event := range events {
+		writeVEvent(w, event)
+	}
+
+	w.line("END:VCALENDAR")
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func writeVEvent(w *icsWriter, event icsEvent) {
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + icsEscape(event.UID))
+	w.line("DTSTAMP:" + event.Stamp.UTC().Format(icsUTCLayout))
+	if event.RecurrenceID != nil {
+		w.line(icsDateTime("RECURRENCE-ID", *event.RecurrenceID, event.Location))
+	}
+	w.line(icsDateTime("DTSTART", event.Start, event.Location))
+	w.line(icsDateTime("DTEND", event.End, event.Location))
+	if event.RRule != "" {
+		w.line("RRULE:" + event.RRule)
+	}
+	for _, exdate := range event.ExDates {
+		w.line(icsDateTime("EXDATE", exdate, event.Location))
+	}
+	w.line("SUMMARY:" + icsEscape(event.Summary))
+	if event.Description != "" {
+		w.line("DESCRIPTION:" + icsEscape(event.Description))
+	}
+	if len(event.Categories) > 0 {
+		escaped := make([]string, len(event.Categories))
+		for i, category := range event.Categories {
+			escaped[i] = icsEscape(category)
+		}
+		w.line("CATEGORIES:" + strings.Join(escaped, ","))
+	}
+	if event.URL != "" {
+		w.line("URL:" + event.URL)
+	}
+	w.line(fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+	if event.Cancelled {
+		w.line("STATUS:CANCELLED")
+	} else {
+		w.line("STATUS:CONFIRMED")
+	}
+	w.line("TRANSP:OPAQUE")
+	w.line("END:VEVENT")
+}
+
+// icsDateTime formats a date-time property, with a TZID parameter unless
+// loc is UTC.
+func icsDateTime(property string, t time.Time, loc *time.Location) string {
+	if loc == nil || loc == time.UTC || loc.String() == "UTC" {
+		return property + ":" + t.UTC().Format(icsUTCLayout)
+	}
+	return property + ";TZID=" + loc.String() + ":" + t.In(loc).Format(icsLocalLayout)
+}
+
+// writeVTimezone describes loc's offsets between from and until as a list of
+// explicit observances, one per transition, taken from the Go zone database.
+func writeVTimezone(w *icsWriter, loc *time.Location, from, until time.Time) {
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + loc.String())
+
+	// The observance in effect at from, starting at its own transition
+	// when there is one
+	t := from.In(loc)
+	start, end := t.ZoneBounds()
+	_, offset := t.Zone()
+	if start.IsZero() {
+		writeObservance(w, time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), t, offset, offset)
+	} else {
+		_, previous := start.Add(-time.Second).Zone()
+		writeObservance(w, start, start, previous, offset)
+	}
+
+	for !end.IsZero() && !end.After(until) {
+		_, previous := t.Zone()
+		t = end.In(loc)
+		_, offset = t.Zone()
+		writeObservance(w, end, t, previous, offset)
+		_, end = t.ZoneBounds()
+	}
+
+	w.line("END:VTIMEZONE")
+}
+
+// writeObservance writes a STANDARD or DAYLIGHT block starting at instant
+// at, whose zone abbreviation and DST flag are taken from sample.
+func writeObservance(w *icsWriter, at, sample time.Time, offsetFrom, offsetTo int) {
+	kind := "STANDARD"
+	if sample.IsDST() {
+		kind = "DAYLIGHT"
+	}
+	name, _ := sample.Zone()
+
+	w.line("BEGIN:" + kind)
+	// DTSTART is local time in the offset being left
+	w.line("DTSTART:" + at.In(time.FixedZone("", offsetFrom)).Format(icsLocalLayout))
+	w.line("TZOFFSETFROM:" + icsOffset(offsetFrom))
+	w.line("TZOFFSETTO:" + icsOffset(offsetTo))
+	if name != "" {
+		w.line("TZNAME:" + icsEscape(name))
+	}
+	w.line("END:" + kind)
+}
+
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	hours, minutes, secs := seconds/3600, seconds%3600/60, seconds%60
+	if secs != 0 {
+		return fmt.Sprintf("%s%02d%02d%02d", sign, hours, minutes, secs)
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, hours, minutes)
+}
+
+// icsEscape escapes a TEXT value.
+func icsEscape(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case ';':
+			b.WriteString(`\;`)
+		case ',':
+			b.WriteString(`\,`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			// Dropped; newlines are escaped from \n alone
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// icsWriter writes content lines with CRLF endings, folding them at 75
+// octets without splitting UTF-8 sequences.
+type icsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *icsWriter) line(content string) {
+	if w.err != nil {
+		return
+	}
+	const limit = 75
+	width := 0
+	for len(content) > 0 {
+		_, size := utf8.DecodeRuneInString(content)
+		if width+size > limit {
+			w.write("\r\n ")
+			// The leading space of a continuation line counts
+			width = 1
+		}
+		w.write(content[:size])
+		width += size
+		content = content[size:]
+	}
+	w.write("\r\n")
+}
+
+func (w *icsWriter) write(s string) {
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites the file with
+// -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s; rerun with -update if the change is intended\ngot:\n%s", path, got)
+	}
+}
+
+func TestWriteCalendarRecurringGolden(t *testing.T) {
+	game := "Valorant"
+	stream := "https://twitch.tv/zoe"
+	weekly := "FREQ=WEEKLY;BYDAY=TH"
+	monthly := "FREQ=MONTHLY;BYDAY=1SU;COUNT=12"
+	monthlyStart := utc("2026-03-01T11:00:00Z")
+	monthlyEnd, _ := mustRule(t, monthly).lastEnd(monthlyStart, 3*time.Hour, mustLocation(t, "Europe/Berlin"))
+	moved := "Scrims (moved for the clock change)"
+
+	// An open series that started long before the feed is read, and one in
+	// another zone that ends in February 2027
+	events := []*Event{
+		{
+			ID: 7, HostUsername: "zoe", Title: "Thursday scrims", Description: "Bring comms; no smurfs",
+			GameName: &game, StreamURL: &stream, TimeZone: "America/New_York",
+			StartsAt: utc("2024-01-05T00:00:00Z"), EndsAt: utc("2024-01-05T02:00:00Z"),
+			Recurrence: &weekly, Status: "scheduled", Sequence: 3,
+			UpdatedAt: utc("2026-02-01T12:00:00Z"),
+		},
+		{
+			ID: 8, HostUsername: "jonas", Title: "Sunday cup", TimeZone: "Europe/Berlin",
+			StartsAt: monthlyStart, EndsAt: monthlyStart.Add(3 * time.Hour),
+			Recurrence: &monthly, SeriesEndsAt: &monthlyEnd, Status: "scheduled",
+			UpdatedAt: utc("2026-02-15T09:30:00Z"),
+		},
+	}
+	exceptions := map[int][]eventException{
+		7: {
+			{EventID: 7, OccurrenceStart: utc("2026-03-06T00:00:00Z"), Status: "cancelled", UpdatedAt: utc("2026-03-01T10:00:00Z")},
+			{
+				EventID: 7, OccurrenceStart: utc("2026-03-12T23:00:00Z"), Status: "scheduled", Title: &moved,
+				StartsAt: utc("2026-03-13T00:00:00Z"), EndsAt: utc("2026-03-13T02:00:00Z"),
+				UpdatedAt: utc("2026-03-02T10:00:00Z"),
+			},
+		},
+	}
+
+	var items []icsEvent
+	for _, event := range events {
+		items = append(items, event.toICS(exceptions[event.ID])...)
+	}
+	var out bytes.Buffer
+	if err := writeCalendar(&out, "Zoë's calendar", utc("2026-10-18T08:00:00Z"), items); err != nil {
+		t.Fatalf("writeCalendar error: %v", err)
+	}
+	checkGolden(t, "recurring_dst.ics", out.Bytes())
+
+	// The open series' zone is described until two years after now, not
+	// after its first occurrence; the other's until two years after its end
+	calendar := out.String()
+	if !strings.Contains(calendar, "DTSTART:20280312T020000") || strings.Contains(calendar, "DTSTART:20281105T020000") {
+		t.Error("America/New_York should end with the transition of 2028-03-12")
+	}
+	if !strings.Contains(calendar, "DTSTART:20281029T030000") || strings.Contains(calendar, "DTSTART:20290325T020000") {
+		t.Error("Europe/Berlin should end with the transition of 2028-10-29")
+	}
+}
+
+func TestWriteCalendarOneOffTimezone(t *testing.T) {
+	event := icsEvent{
+		UID:      eventUID(1),
+		Summary:  "Launch stream",
+		Start:    utc("2026-07-01T18:00:00Z"),
+		End:      utc("2026-07-01T20:00:00Z"),
+		Location: mustLocation(t, "Europe/Berlin"),
+		Stamp:    utc("2026-06-01T00:00:00Z"),
+	}
+	var out bytes.Buffer
+	if err := writeCalendar(&out, "", utc("2026-10-18T08:00:00Z"), []icsEvent{event}); err != nil {
+		t.Fatalf("writeCalendar error: %v", err)
+	}
+
+	// A one-off event only needs the observance it falls in
+	calendar := out.String()
+	if strings.Count(calendar, "BEGIN:DAYLIGHT")+strings.Count(calendar, "BEGIN:STANDARD") != 1 {
+		t.Errorf("want a single observance:\n%s", calendar)
+	}
+	if !strings.Contains(calendar, "DTSTART;TZID=Europe/Berlin:20260701T200000\r\n") {
+		t.Errorf("DTSTART not in local time:\n%s", calendar)
+	}
+}
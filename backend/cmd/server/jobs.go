@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxJobAttempts = 5
+	// jobBatchSize bounds how many due jobs one instance runs per tick.
+	jobBatchSize = 100
+	// jobRetention is how long finished jobs are kept; their dedupe keys
+	// stop the same work from being scheduled again meanwhile.
+	jobRetention = 30 * 24 * time.Hour
+	// jobPlannerLockKey identifies the advisory lock held while planning.
+	jobPlannerLockKey = 7460302
+)
+
+// jobHandler runs one job. Returning an error schedules a retry.
+type jobHandler func(payload json.RawMessage) error
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = make(map[string]jobHandler)
+	// jobPlanners run on every scheduler tick before due jobs, to enqueue
+	// work that can't be scheduled up front
+	jobPlanners []func(now time.Time) error
+)
+
+// registerJobHandler sets the handler for jobs of the given kind.
+func registerJobHandler(kind string, handler jobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[kind] = handler
+}
+
+// registerJobPlanner adds a function called on every scheduler tick. Only
+// one instance runs the planners at a time.
+func registerJobPlanner(planner func(now time.Time) error) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobPlanners = append(jobPlanners, planner)
+}
+
+func initJobTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS jobs (
+		id SERIAL PRIMARY KEY,
+		kind VARCHAR(64) NOT NULL,
+		dedupe_key VARCHAR(255) UNIQUE,
+		payload JSONB NOT NULL DEFAULT '{}',
+		run_at TIMESTAMPTZ NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS jobs_pending_run_at_idx ON jobs (run_at) WHERE status = 'pending';
+	`)
+	return err
+}
+
+// enqueueJob schedules a job to run at runAt. A job whose dedupeKey was
+// already used is ignored, so callers can enqueue the same work repeatedly
+// and it still runs once; an empty key never deduplicates. It reports
+// whether the job was added.
+func enqueueJob(q execQueryer, kind, dedupeKey string, runAt time.Time, payload interface{}) (bool, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	var key *string
+	if dedupeKey != "" {
+		key = &dedupeKey
+	}
+
+	result, err := q.Exec(`
+		INSERT INTO jobs (kind, dedupe_key, payload, run_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (dedupe_key) DO NOTHING
+	`, kind, key, string(data), runAt)
+	if err != nil {
+		return false, err
+	}
+	added, err := result.RowsAffected()
+	return added > 0, err
+}
+
+// startJobScheduler runs due jobs every interval. Jobs live in the
+// database, so they survive restarts, and each one is claimed with a row
+// lock so several server instances can share the work.
+func startJobScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			runJobPlanners()
+			for i := 0; i < jobBatchSize; i++ {
+				ran, err := runNextJob()
+				if err != nil {
+					log.Printf("Error running job: %v", err)
+					break
+				}
+				if !ran {
+					break
+				}
+			}
+			pruneJobs()
+			<-ticker.C
+		}
+	}()
+}
+
+func runJobPlanners() {
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("Error planning jobs: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.Get(&locked, "SELECT pg_try_advisory_xact_lock($1)", jobPlannerLockKey); err != nil {
+		log.Printf("Error planning jobs: %v", err)
+		return
+	}
+	if !locked {
+		// Another instance is planning right now
+		return
+	}
+
+	jobHandlersMu.RLock()
+	planners := jobPlanners
+	jobHandlersMu.RUnlock()
+
+	now := time.Now()
+	for _, planner := range planners {
+		if err := planner(now); err != nil {
+			log.Printf("Error planning jobs: %v", err)
+		}
+	}
+}
+
+// runNextJob claims and runs the oldest due job. The job's row stays locked
+// until its outcome is committed, and SKIP LOCKED lets other instances move
+// on to other jobs meanwhile. A job is marked done in the same transaction
+// that claimed it, so a crash before that commit leaves it pending rather
+// than lost.
+func runNextJob() (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var job struct {
+		ID       int    `db:"id"`
+		Kind     string `db:"kind"`
+		Payload  string `db:"payload"`
+		Attempts int    `db:"attempts"`
+	}
+	err = tx.Get(&job, `
+		SELECT id, kind, payload, attempts FROM jobs
+		WHERE status = 'pending' AND run_at <= NOW()
+		ORDER BY run_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	jobHandlersMu.RLock()
+	handler, ok := jobHandlers[job.Kind]
+	jobHandlersMu.RUnlock()
+
+	var runErr error
+	if ok {
+		runErr = handler(json.RawMessage(job.Payload))
+	} else {
+		runErr = fmt.Errorf("no handler for job kind %q", job.Kind)
+	}
+
+	if runErr == nil {
+		_, err = tx.Exec(`
+			UPDATE jobs SET status = 'done', attempts = attempts + 1, last_error = NULL,
+				updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, job.ID)
+	} else {
+		attempts := job.Attempts + 1
+		status := "pending"
+		if attempts >= maxJobAttempts {
+			status = "failed"
+		}
+		log.Printf("Job %d (%s) failed on attempt %d: %v", job.ID, job.Kind, attempts, runErr)
+		_, err = tx.Exec(`
+			UPDATE jobs SET status = $2, attempts = $3, last_error = $4,
+				run_at = NOW() + $5 * INTERVAL '1 second', updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, job.ID, status, attempts, runErr.Error(), int(jobRetryDelay(attempts)/time.Second))
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// jobRetryDelay backs off quadratically: 1, 4, 9, 16 minutes.
+func jobRetryDelay(attempts int) time.Duration {
+	return time.Duration(attempts*attempts) * time.Minute
+}
+
+func pruneJobs() {
+	_, err := db.Exec(`
+		DELETE FROM jobs
+		WHERE status IN ('done', 'failed') AND updated_at < $1
+	`, time.Now().Add(-jobRetention))
+	if err != nil {
+		log.Printf("Error pruning jobs: %v", err)
+	}
+}
+
+func jobSchedulerInterval() time.Duration {
+	if value := os.Getenv("JOB_SCHEDULER_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		log.Printf("Invalid JOB_SCHEDULER_INTERVAL %q, using default", value)
+	}
+	return 30 * time.Second
+}
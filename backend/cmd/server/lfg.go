@@ -0,0 +1,778 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultLFGDuration applies when a post doesn't set its own expiry.
+	defaultLFGDuration = 2 * time.Hour
+	// maxLFGDuration keeps posts from lingering after the group has formed.
+	maxLFGDuration = 7 * 24 * time.Hour
+	// maxLFGSlots is the most players one post can look for.
+	maxLFGSlots = 9
+	// maxLFGModeLength limits the free-text mode, e.g. "Ranked" or "Scrims".
+	maxLFGModeLength = 64
+)
+
+type LFGPost struct {
+	ID               int         `json:"id" db:"id"`
+	HostUsername     string      `json:"hostUsername" db:"host_username"`
+	GameName         string      `json:"gameName" db:"game_name"`
+	Mode             string      `json:"mode,omitempty" db:"mode"`
+	MinRankLevel     *int        `json:"-" db:"min_rank"`
+	MaxRankLevel     *int        `json:"-" db:"max_rank"`
+	MinRank          string      `json:"minRank,omitempty" db:"-"`
+	MaxRank          string      `json:"maxRank,omitempty" db:"-"`
+	Region           *string     `json:"region,omitempty" db:"region"`
+	VoiceRequired    bool        `json:"voiceRequired" db:"voice_required"`
+	RequiresApproval bool        `json:"requiresApproval" db:"requires_approval"`
+	Slots            int         `json:"slots" db:"slots"`
+	FilledSlots      int         `json:"filledSlots" db:"filled_slots"`
+	Description      string      `json:"description,omitempty" db:"description"`
+	Status           string      `json:"status" db:"status"`
+	ExpiresAt        time.Time   `json:"expiresAt" db:"expires_at"`
+	CreatedAt        time.Time   `json:"createdAt" db:"created_at"`
+	Members          []LFGMember `json:"members,omitempty" db:"-"`
+}
+
+type LFGMember struct {
+	Username string    `json:"username" db:"username"`
+	Status   string    `json:"status" db:"status"`
+	JoinedAt time.Time `json:"joinedAt" db:"created_at"`
+}
+
+// lfgPostColumns selects everything LFGPost needs from lfg_posts p.
+const lfgPostColumns = `
+	p.id, u.username AS host_username, p.game_name, p.mode, p.min_rank, p.max_rank,
+	p.region, p.voice_required, p.requires_approval, p.slots,
+	(SELECT COUNT(*) FROM lfg_members m WHERE m.post_id = p.id AND m.status = 'accepted') AS filled_slots,
+	p.description, p.status, p.expires_at, p.created_at`
+
+func initLFGTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS lfg_posts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		game_name VARCHAR(255) NOT NULL,
+		mode VARCHAR(64) NOT NULL DEFAULT '',
+		min_rank INTEGER,
+		max_rank INTEGER,
+		region VARCHAR(16),
+		voice_required BOOLEAN NOT NULL DEFAULT false,
+		requires_approval BOOLEAN NOT NULL DEFAULT false,
+		slots INTEGER NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS lfg_posts_status_expires_at_idx ON lfg_posts (status, expires_at);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS lfg_members (
+		id SERIAL PRIMARY KEY,
+		post_id INTEGER NOT NULL REFERENCES lfg_posts(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(post_id, user_id)
+	);
+	`)
+	return err
+}
+
+// startLFGExpiry marks posts whose expiry has passed as expired every
+// interval.
+func startLFGExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := expireLFGPosts(); err != nil {
+				log.Printf("Error expiring LFG posts: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func expireLFGPosts() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE lfg_posts SET status = 'expired'
+		WHERE status IN ('open', 'full') AND expires_at <= NOW()
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// fillRankLabels turns the stored ladder positions into tier names.
+func (p *LFGPost) fillRankLabels() {
+	if p.MinRankLevel != nil && *p.MinRankLevel >= 0 && *p.MinRankLevel < len(rankTiers) {
+		p.MinRank = rankTiers[*p.MinRankLevel]
+	}
+	if p.MaxRankLevel != nil && *p.MaxRankLevel >= 0 && *p.MaxRankLevel < len(rankTiers) {
+		p.MaxRank = rankTiers[*p.MaxRankLevel]
+	}
+}
+
+func getLFGPost(id int) (*LFGPost, error) {
+	var post LFGPost
+	err := db.Get(&post, `
+		SELECT `+lfgPostColumns+`
+		FROM lfg_posts p
+		JOIN users u ON u.id = p.user_id
+		WHERE p.id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	post.fillRankLabels()
+
+	err = db.Select(&post.Members, `
+		SELECT u.username, m.status, m.created_at
+		FROM lfg_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.post_id = $1 AND m.status IN ('pending', 'accepted')
+		ORDER BY m.created_at, m.id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+func lfgPostIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid post id"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func createLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		GameName         string     `json:"gameName"`
+		Mode             string     `json:"mode"`
+		MinRank          string     `json:"minRank"`
+		MaxRank          string     `json:"maxRank"`
+		Region           string     `json:"region"`
+		VoiceRequired    bool       `json:"voiceRequired"`
+		RequiresApproval bool       `json:"requiresApproval"`
+		Slots            int        `json:"slots"`
+		Description      string     `json:"description"`
+		ExpiresAt        *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	game, ok := lookupCatalogGame(requestBody.GameName)
+	if !ok {
+		http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+		return
+	}
+
+	mode := strings.TrimSpace(requestBody.Mode)
+	if len(mode) > maxLFGModeLength {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Mode must be at most %d characters", maxLFGModeLength))
+		return
+	}
+
+	if requestBody.Slots < 1 || requestBody.Slots > maxLFGSlots {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Slots must be between 1 and %d", maxLFGSlots))
+		return
+	}
+
+	var minRank, maxRank *int
+	if strings.TrimSpace(requestBody.MinRank) != "" {
+		level, ok := rankLevel(requestBody.MinRank)
+		if !ok {
+			http.Error(w, `{"error":"Unknown minimum rank"}`, http.StatusBadRequest)
+			return
+		}
+		minRank = &level
+	}
+	if strings.TrimSpace(requestBody.MaxRank) != "" {
+		level, ok := rankLevel(requestBody.MaxRank)
+		if !ok {
+			http.Error(w, `{"error":"Unknown maximum rank"}`, http.StatusBadRequest)
+			return
+		}
+		maxRank = &level
+	}
+	if minRank != nil && maxRank != nil && *minRank > *maxRank {
+		http.Error(w, `{"error":"Minimum rank is above maximum rank"}`, http.StatusBadRequest)
+		return
+	}
+
+	var region *string
+	if strings.TrimSpace(requestBody.Region) != "" {
+		code, ok := lookupRegion(requestBody.Region)
+		if !ok {
+			http.Error(w, `{"error":"Unknown region"}`, http.StatusBadRequest)
+			return
+		}
+		region = &code
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultLFGDuration)
+	if requestBody.ExpiresAt != nil {
+		expiresAt = *requestBody.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > maxLFGDuration {
+		http.Error(w, `{"error":"Expiry must be in the future and within 7 days"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var postID int
+	err = db.QueryRow(`
+		INSERT INTO lfg_posts (user_id, game_name, mode, min_rank, max_rank, region,
+			voice_required, requires_approval, slots, description, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`, userID, game, mode, minRank, maxRank, region, requestBody.VoiceRequired,
+		requestBody.RequiresApproval, requestBody.Slots, strings.TrimSpace(requestBody.Description),
+		expiresAt.UTC()).Scan(&postID)
+	if err != nil {
+		log.Printf("Error creating LFG post: %v", err)
+		http.Error(w, `{"error":"Error creating LFG post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	recordActivity(userID, "lfg_post", &postID, &game, map[string]interface{}{
+		"postId":   postID,
+		"gameName": game,
+		"mode":     mode,
+		"slots":    requestBody.Slots,
+		"region":   region,
+	})
+
+	post, err := getLFGPost(postID)
+	if err != nil {
+		log.Printf("Error loading LFG post: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(post)
+}
+
+func listLFGPostsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	conditions := []string{"p.status = 'open'", "p.expires_at > NOW()"}
+	var args []interface{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+
+	if game := query.Get("game"); game != "" {
+		name, ok := lookupCatalogGame(game)
+		if !ok {
+			http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+			return
+		}
+		addCondition("p.game_name = $%d", name)
+	}
+	if mode := strings.TrimSpace(query.Get("mode")); mode != "" {
+		addCondition("LOWER(p.mode) = LOWER($%d)", mode)
+	}
+	if region := query.Get("region"); region != "" {
+		code, ok := lookupRegion(region)
+		if !ok {
+			http.Error(w, `{"error":"Unknown region"}`, http.StatusBadRequest)
+			return
+		}
+		addCondition("(p.region IS NULL OR p.region = $%d)", code)
+	}
+	if rank := query.Get("rank"); rank != "" {
+		// Only posts whose rank range admits this rank
+		level, ok := rankLevel(rank)
+		if !ok {
+			http.Error(w, `{"error":"Unknown rank"}`, http.StatusBadRequest)
+			return
+		}
+		addCondition("(p.min_rank IS NULL OR p.min_rank <= $%d)", level)
+		addCondition("(p.max_rank IS NULL OR p.max_rank >= $%d)", level)
+	}
+	if voice := query.Get("voice"); voice != "" {
+		voiceRequired, err := strconv.ParseBool(voice)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid voice filter"}`, http.StatusBadRequest)
+			return
+		}
+		addCondition("p.voice_required = $%d", voiceRequired)
+	}
+
+	limit := 50
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, `{"error":"Invalid offset"}`, http.StatusBadRequest)
+			return
+		}
+		offset = parsed
+	}
+	args = append(args, limit, offset)
+
+	posts := []LFGPost{}
+	err := db.Select(&posts, fmt.Sprintf(`
+		SELECT `+lfgPostColumns+`
+		FROM lfg_posts p
+		JOIN users u ON u.id = p.user_id
+		WHERE %s
+		ORDER BY p.created_at DESC, p.id DESC
+		LIMIT $%d OFFSET $%d
+	`, strings.Join(conditions, " AND "), len(args)-1, len(args)), args...)
+	if err != nil {
+		log.Printf("Error listing LFG posts: %v", err)
+		http.Error(w, `{"error":"Error listing LFG posts"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range posts {
+		posts[i].fillRankLabels()
+	}
+
+	json.NewEncoder(w).Encode(posts)
+}
+
+func getLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := lfgPostIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := getLFGPost(postID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading LFG post: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(post)
+}
+
+func joinLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := lfgPostIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the post so concurrent joins can't overfill it
+	var post struct {
+		HostID           int       `db:"user_id"`
+		Game             string    `db:"game_name"`
+		MinRank          *int      `db:"min_rank"`
+		MaxRank          *int      `db:"max_rank"`
+		Region           *string   `db:"region"`
+		Slots            int       `db:"slots"`
+		Status           string    `db:"status"`
+		RequiresApproval bool      `db:"requires_approval"`
+		ExpiresAt        time.Time `db:"expires_at"`
+	}
+	err = tx.Get(&post, `
+		SELECT user_id, game_name, min_rank, max_rank, region, slots, status,
+			requires_approval, expires_at
+		FROM lfg_posts WHERE id = $1 FOR UPDATE
+	`, postID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if post.HostID == userID {
+		http.Error(w, `{"error":"Cannot join your own post"}`, http.StatusBadRequest)
+		return
+	}
+	if post.Status != "open" || !post.ExpiresAt.After(time.Now()) {
+		http.Error(w, `{"error":"Post is no longer open"}`, http.StatusConflict)
+		return
+	}
+
+	// The joiner's rank is the one stored for the post's game
+	var joiner struct {
+		Rank   *string `db:"rank"`
+		Region *string `db:"region"`
+	}
+	err = tx.Get(&joiner, `
+		SELECT ug.rank, u.region
+		FROM users u
+		LEFT JOIN user_games ug ON ug.user_id = u.id AND ug.game_name = $2
+		WHERE u.id = $1
+	`, userID, post.Game)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if message := lfgJoinRefusal(post.MinRank, post.MaxRank, post.Region, joiner.Rank, joiner.Region); message != "" {
+		writeJSONError(w, http.StatusForbidden, message)
+		return
+	}
+
+	var existing string
+	err = tx.Get(&existing, "SELECT status FROM lfg_members WHERE post_id = $1 AND user_id = $2", postID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if existing == "accepted" || existing == "pending" {
+		http.Error(w, `{"error":"Already joined or requested"}`, http.StatusConflict)
+		return
+	}
+
+	status := "accepted"
+	if post.RequiresApproval {
+		status = "pending"
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO lfg_members (post_id, user_id, status)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (post_id, user_id)
+		DO UPDATE SET status = EXCLUDED.status, created_at = CURRENT_TIMESTAMP
+	`, postID, userID, status)
+	if err != nil {
+		log.Printf("Error joining LFG post: %v", err)
+		http.Error(w, `{"error":"Error joining post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if status == "accepted" {
+		if err := updateLFGFullStatus(tx, postID, post.Slots); err != nil {
+			if err == errLFGPostFull {
+				http.Error(w, `{"error":"Post is full"}`, http.StatusConflict)
+				return
+			}
+			log.Printf("Error updating LFG post status: %v", err)
+			http.Error(w, `{"error":"Error joining post"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error joining post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	message := "Joined post"
+	if status == "pending" {
+		message = "Join request sent"
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  status,
+		"message": message,
+	})
+}
+
+// lfgJoinRefusal explains why a player with rank and region can't join a
+// post limited to minRank-maxRank and postRegion, or returns "" if they
+// can. A player without a rank on the ladder is outside any range.
+func lfgJoinRefusal(minRank, maxRank *int, postRegion, rank, region *string) string {
+	if minRank != nil || maxRank != nil {
+		level, ok := 0, false
+		if rank != nil {
+			level, ok = rankLevel(*rank)
+		}
+		if !ok {
+			return "Set your rank for this game to join this post"
+		}
+		if (minRank != nil && level < *minRank) || (maxRank != nil && level > *maxRank) {
+			return "Your rank is outside this post's rank range"
+		}
+	}
+	if postRegion != nil {
+		if region == nil {
+			return "Set your region to join this post"
+		}
+		if *region != *postRegion {
+			return fmt.Sprintf("This post is for players in %s", *postRegion)
+		}
+	}
+	return ""
+}
+
+var errLFGPostFull = fmt.Errorf("lfg post is full")
+
+// updateLFGFullStatus flips a post between open and full after its accepted
+// members change. The caller must hold the post's row lock.
+func updateLFGFullStatus(tx execQueryer, postID, slots int) error {
+	var filled int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM lfg_members WHERE post_id = $1 AND status = 'accepted'
+	`, postID).Scan(&filled)
+	if err != nil {
+		return err
+	}
+	if filled > slots {
+		return errLFGPostFull
+	}
+
+	_, err = tx.Exec(`
+		UPDATE lfg_posts
+		SET status = CASE WHEN $2 >= slots THEN 'full' ELSE 'open' END
+		WHERE id = $1 AND status IN ('open', 'full')
+	`, postID, filled)
+	return err
+}
+
+// execQueryer is satisfied by *sql.Tx, *sqlx.Tx and *sqlx.DB.
+type execQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// respondToLFGRequest lets the host accept or reject a pending join request.
+func respondToLFGRequest(w http.ResponseWriter, r *http.Request, accept bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := lfgPostIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	requester := mux.Vars(r)["username"]
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	requesterID, err := userIDByUsername(requester)
+	if err != nil {
+		http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var post struct {
+		HostID int    `db:"user_id"`
+		Slots  int    `db:"slots"`
+		Status string `db:"status"`
+	}
+	err = tx.Get(&post, "SELECT user_id, slots, status FROM lfg_posts WHERE id = $1 FOR UPDATE", postID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if post.HostID != hostID {
+		http.Error(w, `{"error":"Only the host can respond to join requests"}`, http.StatusForbidden)
+		return
+	}
+
+	status := "rejected"
+	if accept {
+		status = "accepted"
+		if post.Status != "open" {
+			http.Error(w, `{"error":"Post is no longer open"}`, http.StatusConflict)
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE lfg_members SET status = $3
+		WHERE post_id = $1 AND user_id = $2 AND status = 'pending'
+	`, postID, requesterID, status)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating join request"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No pending join request"}`, http.StatusNotFound)
+		return
+	}
+
+	if accept {
+		if err := updateLFGFullStatus(tx, postID, post.Slots); err != nil {
+			if err == errLFGPostFull {
+				http.Error(w, `{"error":"Post is full"}`, http.StatusConflict)
+				return
+			}
+			http.Error(w, `{"error":"Error updating join request"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating join request"}`, http.StatusInternalServerError)
+		return
+	}
+
+	message := "Join request rejected"
+	if accept {
+		message = "Join request accepted"
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func acceptLFGRequestHandler(w http.ResponseWriter, r *http.Request) {
+	respondToLFGRequest(w, r, true)
+}
+
+func rejectLFGRequestHandler(w http.ResponseWriter, r *http.Request) {
+	respondToLFGRequest(w, r, false)
+}
+
+func leaveLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := lfgPostIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var slots int
+	err = tx.Get(&slots, "SELECT slots FROM lfg_posts WHERE id = $1 FOR UPDATE", postID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM lfg_members
+		WHERE post_id = $1 AND user_id = $2 AND status IN ('pending', 'accepted')
+	`, postID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error leaving post"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Not a member of this post"}`, http.StatusNotFound)
+		return
+	}
+
+	// A full post reopens once someone leaves
+	if err := updateLFGFullStatus(tx, postID, slots); err != nil {
+		http.Error(w, `{"error":"Error leaving post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error leaving post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Left post"})
+}
+
+func closeLFGPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := lfgPostIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE lfg_posts SET status = 'closed'
+		WHERE id = $1 AND user_id = (SELECT id FROM users WHERE username = $2)
+		AND status IN ('open', 'full')
+	`, postID, claims.Username)
+	if err != nil {
+		log.Printf("Error closing LFG post: %v", err)
+		http.Error(w, `{"error":"Error closing post"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No open post of yours with that id"}`, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Post closed"})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLFGJoinRefusal(t *testing.T) {
+	level := func(tier string) *int {
+		l, ok := rankLevel(tier)
+		if !ok {
+			t.Fatalf("unknown tier %q", tier)
+		}
+		return &l
+	}
+	eu, na := stringPtr("EU"), stringPtr("NA")
+
+	tests := []struct {
+		name             string
+		minRank, maxRank *int
+		postRegion       *string
+		rank, region     *string
+		refused          bool
+	}{
+		{name: "open post"},
+		{name: "within range", minRank: level("Silver"), maxRank: level("Platinum"), rank: stringPtr("Gold")},
+		{name: "at the bounds", minRank: level("Gold"), maxRank: level("Gold"), rank: stringPtr("gold")},
+		{name: "below range", minRank: level("Gold"), rank: stringPtr("Bronze"), refused: true},
+		{name: "above range", maxRank: level("Gold"), rank: stringPtr("Diamond"), refused: true},
+		{name: "no rank", minRank: level("Iron"), refused: true},
+		{name: "rank off the ladder", minRank: level("Iron"), rank: stringPtr("Radiant-ish"), refused: true},
+		{name: "same region", postRegion: eu, region: eu},
+		{name: "other region", postRegion: eu, region: na, refused: true},
+		{name: "no region", postRegion: eu, refused: true},
+		{name: "region only checked when set", region: na},
+		{name: "rank fits, region doesn't", minRank: level("Silver"), postRegion: eu, rank: stringPtr("Gold"), region: na, refused: true},
+	}
+	for _, test := range tests {
+		got := lfgJoinRefusal(test.minRank, test.maxRank, test.postRegion, test.rank, test.region)
+		if (got != "") != test.refused {
+			t.Errorf("%s: lfgJoinRefusal = %q, want refused %v", test.name, got, test.refused)
+		}
+	}
+}
+
+func TestJoinLFGPostHandler(t *testing.T) {
+	gold, _ := rankLevel("Gold")
+	diamond, _ := rankLevel("Diamond")
+	open := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name             string
+		hostID           int
+		minRank, maxRank interface{}
+		region           interface{}
+		status           string
+		expiresAt        time.Time
+		requiresApproval bool
+		joinerRank       interface{}
+		joinerRegion     interface{}
+		want             int
+		wantStatus       string
+	}{
+		{name: "open post", hostID: 2, status: "open", expiresAt: open, want: http.StatusOK, wantStatus: "accepted"},
+		{name: "needs approval", hostID: 2, status: "open", expiresAt: open, requiresApproval: true, want: http.StatusOK, wantStatus: "pending"},
+		{name: "own post", hostID: 1, status: "open", expiresAt: open, want: http.StatusBadRequest},
+		{name: "full", hostID: 2, status: "full", expiresAt: open, want: http.StatusConflict},
+		{name: "expired", hostID: 2, status: "open", expiresAt: time.Now().Add(-time.Minute), want: http.StatusConflict},
+		{
+			name: "rank in range", hostID: 2, status: "open", expiresAt: open,
+			minRank: gold, maxRank: diamond, joinerRank: "Platinum", want: http.StatusOK, wantStatus: "accepted",
+		},
+		{name: "rank below range", hostID: 2, status: "open", expiresAt: open, minRank: gold, joinerRank: "Silver", want: http.StatusForbidden},
+		{name: "no rank", hostID: 2, status: "open", expiresAt: open, maxRank: diamond, want: http.StatusForbidden},
+		{name: "same region", hostID: 2, status: "open", expiresAt: open, region: "EU", joinerRegion: "EU", want: http.StatusOK, wantStatus: "accepted"},
+		{name: "other region", hostID: 2, status: "open", expiresAt: open, region: "EU", joinerRegion: "NA", want: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := useFakeDB(t)
+			f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+				return fakeRow("id", 1)
+			})
+			f.on("FROM lfg_posts WHERE id = $1 FOR UPDATE", func(args []interface{}) fakeResult {
+				return fakeRows(
+					[]string{"user_id", "game_name", "min_rank", "max_rank", "region", "slots", "status", "requires_approval", "expires_at"},
+					[]interface{}{test.hostID, "Valorant", test.minRank, test.maxRank, test.region, 4, test.status, test.requiresApproval, test.expiresAt},
+				)
+			})
+			f.on("LEFT JOIN user_games ug ON ug.user_id = u.id AND ug.game_name = $2", func(args []interface{}) fakeResult {
+				if args[0] != 1 || args[1] != "Valorant" {
+					t.Errorf("joiner looked up as %v", args)
+				}
+				return fakeRows([]string{"rank", "region"}, []interface{}{test.joinerRank, test.joinerRegion})
+			})
+			f.on("SELECT status FROM lfg_members WHERE post_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+				return fakeRows([]string{"status"})
+			})
+			var joined string
+			f.on("INSERT INTO lfg_members", func(args []interface{}) fakeResult {
+				joined = args[2].(string)
+				return fakeAffected(1)
+			})
+			f.on("SELECT COUNT(*) FROM lfg_members WHERE post_id = $1 AND status = 'accepted'", func(args []interface{}) fakeResult {
+				return fakeRow("count", 1)
+			})
+			f.on("UPDATE lfg_posts SET status = CASE", func(args []interface{}) fakeResult {
+				return fakeAffected(1)
+			})
+
+			r := mux.SetURLVars(testRequest("POST", "/lfg/7/join", "", "zoe"), map[string]string{"id": "7"})
+			w := serve(joinLFGPostHandler, r)
+			if w.Code != test.want {
+				t.Fatalf("join = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+			if joined != test.wantStatus {
+				t.Errorf("joined as %q, want %q", joined, test.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Email is one message with plain text and HTML versions of its body.
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// Headers are extra headers such as List-Unsubscribe.
+	Headers map[string]string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(email Email) error
+}
+
+// mailer is nil when email is turned off.
+var mailer Mailer
+
+// newMailerFromEnv picks a mailer from MAILER: "smtp" sends through
+// SMTP_ADDR, "file" drops .eml files into MAIL_DROP_DIR for local
+// testing, and anything else turns email off.
+func newMailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Pixel & Chill <no-reply@localhost>"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			addr = "localhost:1025"
+		}
+		return &smtpMailer{
+			addr:     addr,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     from,
+		}
+	case "file":
+		dir := os.Getenv("MAIL_DROP_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return &fileMailer{dir: dir, from: from}
+	case "":
+		return nil
+	default:
+		log.Printf("Unknown MAILER %q, email is turned off", os.Getenv("MAILER"))
+		return nil
+	}
+}
+
+// smtpMailer sends through an SMTP server, authenticating when a username
+// is set. Local sinks such as MailHog need no credentials.
+type smtpMailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(email Email) error {
+	message, err := buildEmailMessage(m.from, email)
+	if err != nil {
+		return err
+	}
+	sender, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		host, _, err := net.SplitHostPort(m.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	return smtp.SendMail(m.addr, auth, sender.Address, []string{email.To}, message)
+}
+
+// fileMailer writes each message to its own .eml file, which mail clients
+// can open directly.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *fileMailer) Send(email Email) error {
+	message, err := buildEmailMessage(m.from, email)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.dir, name), message, 0o644)
+}
+
+// buildEmailMessage renders email as a multipart/alternative message with
+// quoted-printable text and HTML parts.
+func buildEmailMessage(from string, email Email) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", email.Text},
+		{"text/html; charset=UTF-8", email.HTML},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	headers := []struct{ name, value string }{
+		{"From", from},
+		{"To", email.To},
+		{"Subject", mime.QEncoding.Encode("UTF-8", email.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", header.name, header.value)
+	}
+	for name, value := range email.Headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", name, value)
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMailFrom = "Pixel & Chill <no-reply@example.com>"
+
+// listEmail renders a notification email for user 42 with a fixed signing
+// key and API URL.
+func listEmail(t *testing.T) Email {
+	t.Helper()
+	previous := jwtKey
+	jwtKey = []byte("test-secret")
+	t.Cleanup(func() { jwtKey = previous })
+	t.Setenv("API_URL", "https://api.example.com/")
+	t.Setenv("APP_URL", "https://example.com")
+
+	email, err := renderListEmail("zoe@example.com", "Zoë started following you", "notification", 42, "notifications",
+		map[string]interface{}{
+			"Username": "Zoë",
+			"Summary":  "Zoë started following you",
+			"Link":     appURL() + "/notifications",
+		})
+	if err != nil {
+		t.Fatalf("renderListEmail error: %v", err)
+	}
+	return email
+}
+
+// checkEmailMessage parses a sent message and checks it carries email.
+func checkEmailMessage(t *testing.T, raw []byte, email Email) {
+	t.Helper()
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage error: %v", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != email.Subject {
+		t.Errorf("Subject = %q, want %q", subject, email.Subject)
+	}
+	for name, want := range map[string]string{
+		"From":                  testMailFrom,
+		"To":                    email.To,
+		"MIME-Version":          "1.0",
+		"List-Unsubscribe":      email.Headers["List-Unsubscribe"],
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	} {
+		if got := message.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := message.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", message.Header.Get("Content-Type"))
+	}
+	// Parts are decoded from quoted-printable as they're read
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	var types []string
+	bodies := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart error: %v", err)
+		}
+		partType, partParams, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || partParams["charset"] != "UTF-8" {
+			t.Errorf("part Content-Type = %q", part.Header.Get("Content-Type"))
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("reading %s part: %v", partType, err)
+		}
+		types = append(types, partType)
+		bodies[partType] = strings.ReplaceAll(string(data), "\r\n", "\n")
+	}
+
+	// Clients show the last part they understand, so HTML goes last
+	if strings.Join(types, ",") != "text/plain,text/html" {
+		t.Fatalf("parts = %v, want text/plain then text/html", types)
+	}
+	if bodies["text/plain"] != email.Text {
+		t.Errorf("text part = %q, want %q", bodies["text/plain"], email.Text)
+	}
+	if bodies["text/html"] != email.HTML {
+		t.Errorf("HTML part = %q, want %q", bodies["text/html"], email.HTML)
+	}
+}
+
+func TestRenderListEmail(t *testing.T) {
+	email := listEmail(t)
+
+	header := email.Headers["List-Unsubscribe"]
+	if !strings.HasPrefix(header, "<") || !strings.HasSuffix(header, ">") {
+		t.Fatalf("List-Unsubscribe = %q, want a bracketed URL", header)
+	}
+	link := header[1 : len(header)-1]
+	if !strings.HasPrefix(link, "https://api.example.com/email/unsubscribe?") {
+		t.Errorf("unsubscribe link %q isn't on the API", link)
+	}
+	if !strings.Contains(email.Text, "Unsubscribe: "+link) {
+		t.Errorf("text part lacks the unsubscribe link:\n%s", email.Text)
+	}
+	if !strings.Contains(email.HTML, `href="`+htmltemplate.HTMLEscapeString(link)+`"`) {
+		t.Errorf("HTML part lacks the unsubscribe link:\n%s", email.HTML)
+	}
+	if !strings.Contains(email.Text, "Zoë started following you.") || !strings.Contains(email.HTML, "Zoë started following you.") {
+		t.Error("summary missing from a part")
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("unsubscribe link %q: %v", link, err)
+	}
+	query := parsed.Query()
+	if query.Get("user") != "42" || query.Get("list") != "notifications" {
+		t.Errorf("unsubscribe link is for %s/%s, want 42/notifications", query.Get("user"), query.Get("list"))
+	}
+	mac := hmac.New(sha256.New, []byte("test-secret"))
+	mac.Write([]byte("unsubscribe:42:notifications"))
+	if token := query.Get("token"); token != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("token = %q, want the HMAC of user and list", token)
+	}
+}
+
+func TestUnsubscribeLinkVerifies(t *testing.T) {
+	email := listEmail(t)
+	header := email.Headers["List-Unsubscribe"]
+	link := header[1 : len(header)-1]
+
+	// Opening the link only shows the confirmation form
+	recorder := httptest.NewRecorder()
+	unsubscribeHandler(recorder, httptest.NewRequest("GET", link, nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `<form method="POST">`) {
+		t.Errorf("GET valid link = %d %q, want the confirmation form", recorder.Code, recorder.Body.String())
+	}
+
+	forged := []string{
+		strings.Replace(link, "user=42", "user=43", 1),
+		strings.Replace(link, "list=notifications", "list=digest", 1),
+		link[:len(link)-1] + "0",
+		strings.Replace(link, "token=", "token=x", 1),
+	}
+	for _, forgedLink := range forged {
+		if forgedLink == link {
+			continue
+		}
+		for _, method := range []string{"GET", "POST"} {
+			recorder := httptest.NewRecorder()
+			unsubscribeHandler(recorder, httptest.NewRequest(method, forgedLink, nil))
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("%s %s = %d, want %d", method, forgedLink, recorder.Code, http.StatusBadRequest)
+			}
+		}
+	}
+
+	// Tokens are bound to the signing key
+	jwtKey = []byte("another-secret")
+	recorder = httptest.NewRecorder()
+	unsubscribeHandler(recorder, httptest.NewRequest("GET", link, nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("link signed with an old key = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	email := listEmail(t)
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := &fileMailer{dir: dir, from: testMailFrom}
+
+	for i := 0; i < 2; i++ {
+		if err := m.Send(email); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d files, want one per message", len(entries))
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".eml" {
+			t.Errorf("file %q isn't an .eml", entry.Name())
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile error: %v", err)
+		}
+		checkEmailMessage(t, raw, email)
+	}
+}
+
+// smtpSink accepts one SMTP session and records what was sent.
+type smtpSink struct {
+	addr string
+	// auth is the decoded AUTH PLAIN response, if any
+	auth string
+	from string
+	to   string
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+func startSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sink := &smtpSink{addr: listener.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(sink.done)
+		conn, err := listener.Accept()
+		if err != nil {
+			sink.err = err
+			return
+		}
+		defer conn.Close()
+		sink.err = sink.serve(textproto.NewConn(conn))
+	}()
+	return sink
+}
+
+func (s *smtpSink) serve(conn *textproto.Conn) error {
+	conn.PrintfLine("220 sink ESMTP")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return err
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			conn.PrintfLine("250-sink")
+			conn.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			_, response, _ := strings.Cut(arg, " ")
+			decoded, err := base64.StdEncoding.DecodeString(response)
+			if err != nil {
+				return err
+			}
+			s.auth = string(decoded)
+			conn.PrintfLine("235 Authenticated")
+		case "MAIL":
+			s.from = arg
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = arg
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 Go ahead")
+			if s.data, err = conn.ReadDotBytes(); err != nil {
+				return err
+			}
+			conn.PrintfLine("250 Queued")
+		case "QUIT":
+			conn.PrintfLine("221 Bye")
+			return nil
+		default:
+			conn.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantAuth string
+	}{
+		{"without credentials", "", "", ""},
+		{"with credentials", "mailer", "hunter2", "\x00mailer\x00hunter2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email := listEmail(t)
+			sink := startSMTPSink(t)
+			m := &smtpMailer{addr: sink.addr, username: test.username, password: test.password, from: testMailFrom}
+
+			if err := m.Send(email); err != nil {
+				t.Fatalf("Send error: %v", err)
+			}
+			<-sink.done
+			if sink.err != nil {
+				t.Fatalf("SMTP session error: %v", sink.err)
+			}
+
+			if sink.auth != test.wantAuth {
+				t.Errorf("AUTH = %q, want %q", sink.auth, test.wantAuth)
+			}
+			if !strings.HasPrefix(sink.from, "FROM:<no-reply@example.com>") {
+				t.Errorf("MAIL %s, want the sender's bare address", sink.from)
+			}
+			if sink.to != "TO:<zoe@example.com>" {
+				t.Errorf("RCPT %s, want TO:<zoe@example.com>", sink.to)
+			}
+			checkEmailMessage(t, sink.data, email)
+		})
+	}
+}
+
+func TestSMTPMailerReportsRejection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		textproto.NewConn(conn).PrintfLine("554 No service")
+	}()
+
+	m := &smtpMailer{addr: listener.Addr().String(), from: testMailFrom}
+	if err := m.Send(listEmail(t)); err == nil {
+		t.Error("Send succeeded against a server refusing service")
+	}
+}
@@ -33,8 +33,9 @@ type User struct {
 	DiscordUsername *string     `json:"discordUsername,omitempty" db:"discord_username"`
 	InstagramHandle *string     `json:"instagramHandle,omitempty" db:"instagram_handle"`
 	YoutubeChannel  *string     `json:"youtubeChannel,omitempty" db:"youtube_channel"`
-	FavoriteGames   *string     `json:"favoriteGames,omitempty" db:"favorite_games"`
+	FavoriteGames   StringArray `json:"favoriteGames" db:"favorite_games"`
 	ConnectedGames  StringArray `json:"connectedGames" db:"connected_games"`
+	Region          *string     `json:"region,omitempty" db:"region"`
 	IsPrivate       bool        `json:"isPrivate" db:"is_private"`
 	FollowersCount  int         `json:"followersCount"`
 	FollowingCount  int         `json:"followingCount"`
@@ -53,8 +54,14 @@ const userClaimsKey contextKey = "claims"
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Email is optional; it is verified by a link sent after registration.
+	Email string `json:"email"`
 }
 
+// StringArray maps a one-dimensional PostgreSQL text array to a Go slice.
+// Elements are quoted and escaped following the rules of array_in/array_out,
+// so values containing commas, quotes, braces, backslashes or whitespace
+// round-trip unchanged. NULL elements are read back as empty strings.
 type StringArray []string
 
 func (a *StringArray) Scan(value interface{}) error {
@@ -65,18 +72,9 @@ func (a *StringArray) Scan(value interface{}) error {
 
 	switch v := value.(type) {
 	case []byte:
-		if string(v) == "{}" {
-			*a = StringArray{}
-			return nil
-		}
-
-		trimmed := string(v)[1 : len(string(v))-1]
-		if len(trimmed) > 0 {
-			*a = strings.Split(trimmed, ",")
-		} else {
-			*a = StringArray{}
-		}
-		return nil
+		return a.parse(string(v))
+	case string:
+		return a.parse(v)
 	default:
 		return fmt.Errorf("unsupported Scan, storing driver.Value type %T into type *StringArray", value)
 	}
@@ -86,7 +84,171 @@ func (a StringArray) Value() (driver.Value, error) {
 	if len(a) == 0 {
 		return "{}", nil
 	}
-	return fmt.Sprintf("{%s}", strings.Join(a, ",")), nil
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, elem := range a {
+		if strings.IndexByte(elem, 0) >= 0 {
+			return nil, fmt.Errorf("StringArray element %d contains a NUL byte", i)
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		// Always quoting is valid input for every element, including ones
+		// that would otherwise read back as NULL or lose surrounding spaces
+		b.WriteByte('"')
+		for j := 0; j < len(elem); j++ {
+			if elem[j] == '"' || elem[j] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(elem[j])
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+// parse decodes the text representation of a one-dimensional array. Only
+// ASCII bytes are significant to the grammar, so multi-byte UTF-8 sequences
+// pass through untouched.
+func (a *StringArray) parse(src string) error {
+	fail := func(pos int, reason string) error {
+		return fmt.Errorf("invalid array literal %q at offset %d: %s", src, pos, reason)
+	}
+
+	i := skipArraySpace(src, 0)
+
+	// Skip an explicit dimension decoration such as "[0:2]="
+	if i < len(src) && src[i] == '[' {
+		eq := strings.IndexByte(src[i:], '=')
+		if eq < 0 {
+			return fail(i, "unterminated dimension decoration")
+		}
+		i = skipArraySpace(src, i+eq+1)
+	}
+
+	if i >= len(src) || src[i] != '{' {
+		return fail(i, `expected "{"`)
+	}
+	i = skipArraySpace(src, i+1)
+
+	elems := StringArray{}
+	if i < len(src) && src[i] == '}' {
+		i++
+	} else {
+		for {
+			i = skipArraySpace(src, i)
+			if i >= len(src) {
+				return fail(i, "unexpected end of input")
+			}
+
+			var elem string
+			var err error
+			switch src[i] {
+			case '{':
+				return fail(i, "multidimensional arrays are not supported")
+			case '"':
+				elem, i, err = parseQuotedArrayElem(src, i)
+			default:
+				elem, i, err = parseUnquotedArrayElem(src, i)
+			}
+			if err != nil {
+				return fail(i, err.Error())
+			}
+			elems = append(elems, elem)
+
+			i = skipArraySpace(src, i)
+			if i >= len(src) {
+				return fail(i, "unexpected end of input")
+			}
+			if src[i] == '}' {
+				i++
+				break
+			}
+			if src[i] != ',' {
+				return fail(i, fmt.Sprintf("unexpected %q character", src[i]))
+			}
+			i++
+		}
+	}
+
+	if i = skipArraySpace(src, i); i != len(src) {
+		return fail(i, "junk after closing brace")
+	}
+
+	*a = elems
+	return nil
+}
+
+func parseQuotedArrayElem(src string, i int) (string, int, error) {
+	var b strings.Builder
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+			if i >= len(src) {
+				return "", i, fmt.Errorf("unexpected end of input")
+			}
+			b.WriteByte(src[i])
+		case '"':
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return "", i, fmt.Errorf("unterminated quoted element")
+}
+
+func parseUnquotedArrayElem(src string, i int) (string, int, error) {
+	var b strings.Builder
+	// keep is the length of the element up to its last escaped or
+	// non-space byte; anything past it is trailing whitespace
+	keep := 0
+	escaped := false
+	for ; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == ',' || c == '}':
+			elem := b.String()[:keep]
+			if elem == "" {
+				return "", i, fmt.Errorf("unexpected %q character", c)
+			}
+			if !escaped && strings.EqualFold(elem, "NULL") {
+				return "", i, nil
+			}
+			return elem, i, nil
+		case c == '\\':
+			i++
+			if i >= len(src) {
+				return "", i, fmt.Errorf("unexpected end of input")
+			}
+			escaped = true
+			b.WriteByte(src[i])
+			keep = b.Len()
+		case c == '"' || c == '{':
+			return "", i, fmt.Errorf("unexpected %q character", c)
+		default:
+			b.WriteByte(c)
+			if !isArraySpace(c) {
+				keep = b.Len()
+			}
+		}
+	}
+	return "", i, fmt.Errorf("unexpected end of input")
+}
+
+func skipArraySpace(src string, i int) int {
+	for i < len(src) && isArraySpace(src[i]) {
+		i++
+	}
+	return i
+}
+
+// isArraySpace matches the characters PostgreSQL's array parser ignores
+// around elements.
+func isArraySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
 }
 
 type UserProfile struct {
@@ -117,6 +279,36 @@ func validateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
+// userIDByUsername resolves a username to its id. It returns sql.ErrNoRows
+// when the user does not exist.
+func userIDByUsername(username string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&id)
+	return id, err
+}
+
+// writeJSONError writes a {"error": message} body for messages that are not
+// fixed strings.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// optionalClaims returns the caller's claims when the request carries a
+// valid bearer token, for public endpoints that personalize their response.
+func optionalClaims(r *http.Request) *Claims {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil
+	}
+	claims, err := validateToken(strings.Replace(authHeader, "Bearer ", "", 1))
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
 func initDatabase() error {
 	_, err := db.Exec(`
 	CREATE TABLE IF NOT EXISTS users (
@@ -128,9 +320,10 @@ func initDatabase() error {
 		instagram_handle VARCHAR(255),
 		youtube_channel VARCHAR(255),
 		favorite_games TEXT[],
-		connected_games TEXT[],
+		region VARCHAR(16),
 		is_private BOOLEAN DEFAULT false
 	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS region VARCHAR(16);
 	`)
 	if err != nil {
 		return err
@@ -143,13 +336,20 @@ func initDatabase() error {
 		game_name VARCHAR(255) NOT NULL,
 		game_username VARCHAR(255),
 		game_id VARCHAR(255),
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		rank VARCHAR(32),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, game_name)
 	);
+	ALTER TABLE user_games ADD COLUMN IF NOT EXISTS rank VARCHAR(32);
 	`)
 	if err != nil {
 		return err
 	}
 
+	if err := migrateConnectedGames(); err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`
 	CREATE TABLE IF NOT EXISTS follow_requests (
 		id SERIAL PRIMARY KEY,
@@ -177,9 +377,179 @@ func initDatabase() error {
 		return err
 	}
 
+	if err := initLFGTables(); err != nil {
+		return err
+	}
+
+	if err := initMatchmakingTables(); err != nil {
+		return err
+	}
+
+	if err := initAvailabilityTables(); err != nil {
+		return err
+	}
+
+	if err := initEventTables(); err != nil {
+		return err
+	}
+
+	if err := initCalendarTables(); err != nil {
+		return err
+	}
+
+	if err := initJobTables(); err != nil {
+		return err
+	}
+
+	if err := initReminderTables(); err != nil {
+		return err
+	}
+
+	if err := initCollabTables(); err != nil {
+		return err
+	}
+
+	if err := initSquadTables(); err != nil {
+		return err
+	}
+
+	if err := initCommunityTables(); err != nil {
+		return err
+	}
+
+	if err := initBlockTables(); err != nil {
+		return err
+	}
+
+	if err := initMessageTables(); err != nil {
+		return err
+	}
+
+	if err := initChatTables(); err != nil {
+		return err
+	}
+
+	if err := initEventLogTables(); err != nil {
+		return err
+	}
+
+	if err := initNotificationTables(); err != nil {
+		return err
+	}
+
+	if err := initWebhookTables(); err != nil {
+		return err
+	}
+
+	if err := initEmailTables(); err != nil {
+		return err
+	}
+
+	if err := initVerificationTables(); err != nil {
+		return err
+	}
+
+	if err := initActivityTables(); err != nil {
+		return err
+	}
+
+	if err := initPostTables(); err != nil {
+		return err
+	}
+
 	return err
 }
 
+// migrateConnectedGames consolidates connected games on the user_games table.
+// Older databases kept a copy in users.connected_games and allowed duplicate
+// user_games rows; those are folded into a single row per (user_id, game_name).
+func migrateConnectedGames() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Keep the oldest row for each game, preferring one that has details set
+	_, err = tx.Exec(`
+		UPDATE user_games keep
+		SET game_username = COALESCE(keep.game_username, dup.game_username),
+			game_id = COALESCE(keep.game_id, dup.game_id)
+		FROM (
+			SELECT DISTINCT ON (user_id, game_name) user_id, game_name, game_username, game_id
+			FROM user_games
+			WHERE game_username IS NOT NULL OR game_id IS NOT NULL
+			ORDER BY user_id, game_name, id DESC
+		) dup
+		WHERE keep.user_id = dup.user_id AND keep.game_name = dup.game_name
+		AND keep.id = (
+			SELECT MIN(id) FROM user_games
+			WHERE user_id = keep.user_id AND game_name = keep.game_name
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM user_games a
+		USING user_games b
+		WHERE a.user_id = b.user_id AND a.game_name = b.game_name AND a.id > b.id
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS user_games_user_id_game_name_key
+		ON user_games (user_id, game_name)
+	`)
+	if err != nil {
+		return err
+	}
+
+	var hasLegacyColumn bool
+	err = tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema()
+			AND table_name = 'users' AND column_name = 'connected_games'
+		)
+	`).Scan(&hasLegacyColumn)
+	if err != nil {
+		return err
+	}
+
+	if hasLegacyColumn {
+		// Games that only ever made it into the array get a user_games row
+		_, err = tx.Exec(`
+			INSERT INTO user_games (user_id, game_name)
+			SELECT DISTINCT u.id, g.game_name
+			FROM users u, unnest(u.connected_games) AS g(game_name)
+			WHERE g.game_name IS NOT NULL AND g.game_name <> ''
+			ON CONFLICT (user_id, game_name) DO NOTHING
+		`)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`ALTER TABLE users DROP COLUMN connected_games`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// connectedGamesColumn selects a user's connected games from user_games so
+// that every response reads them from the same place.
+const connectedGamesColumn = `ARRAY(
+			SELECT game_name FROM user_games
+			WHERE user_games.user_id = users.id
+			ORDER BY user_games.created_at, user_games.id
+		) AS connected_games`
+
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Printf("No .env file found, using environment variables")
@@ -232,6 +602,44 @@ func main() {
 		log.Fatal("Error creating followers table:", err)
 	}
 
+	// Keep game statistics warm in the background
+	gameStats.start(gameStatsRefreshInterval())
+
+	// Cache the activity of accounts that appear in many feeds
+	feedCache.start(feedCacheRefreshInterval())
+
+	// Expire stale LFG posts
+	startLFGExpiry(time.Minute)
+
+	// Match queued players into groups
+	startMatchmaker(newMatchmaker(systemClock{}), matchmakingInterval())
+
+	// Log notifications for event streams and the notification center,
+	// then push them to connected clients as they happen
+	broker := newLocalBroker()
+	notificationLog = newEventLog(broker)
+	registerNotificationChannel(notificationLog)
+	registerNotificationChannel(notificationInbox{})
+	registerNotificationChannel(webhookChannel{})
+	realtime = newRealtimeHub(broker)
+	registerNotificationChannel(realtime)
+	registerChatRealtime(realtime)
+
+	// Email notifications and digests, when a mailer is configured
+	if m := newMailerFromEnv(); m != nil {
+		registerEmail(m)
+	}
+
+	// Run scheduled jobs such as event reminders
+	registerEventReminders(eventReminderOffsets())
+	registerEventLogPruning()
+	registerNotificationPruning()
+	registerActivityPruning()
+	startJobScheduler(jobSchedulerInterval())
+
+	// Send webhook deliveries as they fall due
+	startWebhookDelivery(jobSchedulerInterval())
+
 	router := mux.NewRouter()
 
 	// Update CORS configuration
@@ -250,10 +658,13 @@ func main() {
 	router.HandleFunc("/users", getAllUsersHandler).Methods("GET")
 	router.HandleFunc("/profile/{username}", getUserProfileHandler).Methods("GET")
 	router.HandleFunc("/games/search", searchGamesHandler).Methods("GET", "OPTIONS")
+	router.HandleFunc("/games/stats", gameStatsHandler).Methods("GET")
+	router.HandleFunc("/games/stats/{game}", gameDetailStatsHandler).Methods("GET")
 	router.HandleFunc("/follow/{username}", authMiddleware(followUserHandler)).Methods("POST", "OPTIONS")
 	router.HandleFunc("/unfollow/{username}", authMiddleware(unfollowUserHandler)).Methods("POST", "OPTIONS")
 	router.HandleFunc("/profile", authMiddleware(getProfileHandler)).Methods("GET")
 	router.HandleFunc("/privacy", authMiddleware(updatePrivacyHandler)).Methods("POST")
+	router.HandleFunc("/region", authMiddleware(updateRegionHandler)).Methods("POST")
 	router.HandleFunc("/connect/twitch", authMiddleware(connectTwitchHandler)).Methods("POST")
 	router.HandleFunc("/connect/discord", authMiddleware(connectDiscordHandler)).Methods("POST")
 	router.HandleFunc("/connect/instagram", authMiddleware(connectInstagramHandler)).Methods("POST")
@@ -262,9 +673,153 @@ func main() {
 	router.HandleFunc("/disconnect/instagram", authMiddleware(disconnectInstagramHandler)).Methods("POST")
 	router.HandleFunc("/disconnect/youtube", authMiddleware(disconnectYoutubeHandler)).Methods("POST")
 	router.HandleFunc("/disconnect/game", authMiddleware(disconnectGameHandler)).Methods("POST")
+	router.HandleFunc("/favorites", authMiddleware(setFavoriteGamesHandler)).Methods("PUT")
+	router.HandleFunc("/favorites/add", authMiddleware(addFavoriteGameHandler)).Methods("POST")
+	router.HandleFunc("/favorites/remove", authMiddleware(removeFavoriteGameHandler)).Methods("POST")
+	router.HandleFunc("/favorites/reorder", authMiddleware(reorderFavoriteGamesHandler)).Methods("POST")
 	router.HandleFunc("/api/follow/state/{username}", authMiddleware(getFollowStateHandler)).Methods("GET")
 	router.HandleFunc("/api/follow/accept/{username}", authMiddleware(acceptFollowRequestHandler)).Methods("POST")
 	router.HandleFunc("/api/follow/reject/{username}", authMiddleware(rejectFollowRequestHandler)).Methods("POST")
+	router.HandleFunc("/lfg", listLFGPostsHandler).Methods("GET")
+	router.HandleFunc("/lfg", authMiddleware(createLFGPostHandler)).Methods("POST")
+	router.HandleFunc("/lfg/{id}", getLFGPostHandler).Methods("GET")
+	router.HandleFunc("/lfg/{id}/join", authMiddleware(joinLFGPostHandler)).Methods("POST")
+	router.HandleFunc("/lfg/{id}/leave", authMiddleware(leaveLFGPostHandler)).Methods("POST")
+	router.HandleFunc("/lfg/{id}/accept/{username}", authMiddleware(acceptLFGRequestHandler)).Methods("POST")
+	router.HandleFunc("/lfg/{id}/reject/{username}", authMiddleware(rejectLFGRequestHandler)).Methods("POST")
+	router.HandleFunc("/lfg/{id}/close", authMiddleware(closeLFGPostHandler)).Methods("POST")
+	router.HandleFunc("/availability", authMiddleware(getAvailabilityHandler)).Methods("GET")
+	router.HandleFunc("/availability", authMiddleware(updateAvailabilityHandler)).Methods("PUT")
+	router.HandleFunc("/availability/overlap", authMiddleware(availabilityOverlapHandler)).Methods("GET")
+	router.HandleFunc("/events", authMiddleware(createEventHandler)).Methods("POST")
+	router.HandleFunc("/events/mine", authMiddleware(myEventsHandler)).Methods("GET")
+	router.HandleFunc("/events/following", authMiddleware(followingEventsHandler)).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}", getEventHandler).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}", authMiddleware(updateEventHandler)).Methods("PUT")
+	router.HandleFunc("/events/{id:[0-9]+}/cancel", authMiddleware(cancelEventHandler)).Methods("POST")
+	router.HandleFunc("/events/{id:[0-9]+}/invite", authMiddleware(inviteToEventHandler)).Methods("POST")
+	router.HandleFunc("/events/{id:[0-9]+}/rsvp", authMiddleware(rsvpEventHandler)).Methods("POST")
+	router.HandleFunc("/events/mine/occurrences", authMiddleware(myOccurrencesHandler)).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}/occurrences", eventOccurrencesHandler).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}/occurrences/{occurrence}", authMiddleware(updateOccurrenceHandler)).Methods("PUT")
+	router.HandleFunc("/events/{id:[0-9]+}/occurrences/{occurrence}", authMiddleware(restoreOccurrenceHandler)).Methods("DELETE")
+	router.HandleFunc("/events/{id:[0-9]+}/occurrences/{occurrence}/cancel", authMiddleware(cancelOccurrenceHandler)).Methods("POST")
+	router.HandleFunc("/users/{username}/events", userEventsHandler).Methods("GET")
+	router.HandleFunc("/events/{id:[0-9]+}.ics", eventCalendarHandler).Methods("GET")
+	router.HandleFunc("/users/{username}/calendar.ics", userCalendarHandler).Methods("GET")
+	router.HandleFunc("/calendar/token", authMiddleware(regenerateCalendarTokenHandler)).Methods("POST")
+	router.HandleFunc("/calendar/{token:[0-9a-f]{64}}.ics", subscriptionCalendarHandler).Methods("GET")
+	router.HandleFunc("/users/{username}/schedule", streamScheduleHandler).Methods("GET")
+	router.HandleFunc("/streams/airing", authMiddleware(airingHandler)).Methods("GET")
+	router.HandleFunc("/widget/{username}/schedule.json", scheduleWidgetJSONHandler).Methods("GET")
+	router.HandleFunc("/widget/{username}/schedule.html", scheduleWidgetHTMLHandler).Methods("GET")
+	router.HandleFunc("/squads", authMiddleware(createSquadHandler)).Methods("POST")
+	router.HandleFunc("/squads/invites", authMiddleware(mySquadInvitesHandler)).Methods("GET")
+	router.HandleFunc("/squads/{tag}", getSquadProfileHandler).Methods("GET")
+	router.HandleFunc("/squads/{tag}", authMiddleware(updateSquadHandler)).Methods("PUT")
+	router.HandleFunc("/squads/{tag}", authMiddleware(deleteSquadHandler)).Methods("DELETE")
+	router.HandleFunc("/squads/{tag}/invite", authMiddleware(inviteToSquadHandler)).Methods("POST")
+	router.HandleFunc("/squads/{tag}/join", authMiddleware(joinSquadHandler)).Methods("POST")
+	router.HandleFunc("/squads/{tag}/decline", authMiddleware(declineSquadInviteHandler)).Methods("POST")
+	router.HandleFunc("/squads/{tag}/requests", authMiddleware(squadRequestsHandler)).Methods("GET")
+	router.HandleFunc("/squads/{tag}/accept/{username}", authMiddleware(acceptSquadRequestHandler)).Methods("POST")
+	router.HandleFunc("/squads/{tag}/reject/{username}", authMiddleware(rejectSquadRequestHandler)).Methods("POST")
+	router.HandleFunc("/squads/{tag}/members/{username}", authMiddleware(setSquadRoleHandler)).Methods("PUT")
+	router.HandleFunc("/squads/{tag}/members/{username}", authMiddleware(removeSquadMemberHandler)).Methods("DELETE")
+	router.HandleFunc("/users/{username}/squads", userSquadsHandler).Methods("GET")
+	router.HandleFunc("/ws", websocketHandler).Methods("GET")
+	router.HandleFunc("/events/stream", authMiddleware(eventStreamHandler)).Methods("GET")
+	router.HandleFunc("/notifications", authMiddleware(listNotificationsHandler)).Methods("GET")
+	router.HandleFunc("/notifications/unread", authMiddleware(unreadNotificationsHandler)).Methods("GET")
+	router.HandleFunc("/notifications/read-all", authMiddleware(markAllNotificationsReadHandler)).Methods("POST")
+	router.HandleFunc("/notifications/preferences", authMiddleware(getNotificationPreferencesHandler)).Methods("GET")
+	router.HandleFunc("/notifications/preferences", authMiddleware(updateNotificationPreferencesHandler)).Methods("PUT")
+	router.HandleFunc("/notifications/{id:[0-9]+}/read", authMiddleware(markNotificationReadHandler)).Methods("POST")
+	router.HandleFunc("/notifications/{id:[0-9]+}/unread", authMiddleware(markNotificationUnreadHandler)).Methods("POST")
+	router.HandleFunc("/email/preferences", authMiddleware(getEmailPreferencesHandler)).Methods("GET")
+	router.HandleFunc("/email/preferences", authMiddleware(updateEmailPreferencesHandler)).Methods("PUT")
+	router.HandleFunc("/email/unsubscribe", unsubscribeHandler).Methods("GET", "POST")
+	router.HandleFunc("/profile/email", authMiddleware(updateEmailHandler)).Methods("PUT")
+	router.HandleFunc("/email/verify", verifyEmailHandler).Methods("POST")
+	router.HandleFunc("/email/verification/resend", authMiddleware(resendVerificationHandler)).Methods("POST")
+	router.HandleFunc("/email/change/confirm", confirmEmailChangeHandler).Methods("POST")
+	router.HandleFunc("/password/forgot", forgotPasswordHandler).Methods("POST")
+	router.HandleFunc("/password/reset", resetPasswordHandler).Methods("POST")
+	router.HandleFunc("/webhooks", authMiddleware(listWebhooksHandler)).Methods("GET")
+	router.HandleFunc("/webhooks", authMiddleware(createWebhookHandler)).Methods("POST")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", authMiddleware(updateWebhookHandler)).Methods("PUT")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", authMiddleware(deleteWebhookHandler)).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id:[0-9]+}/ping", authMiddleware(pingWebhookHandler)).Methods("POST")
+	router.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", authMiddleware(listWebhookDeliveriesHandler)).Methods("GET")
+	router.HandleFunc("/webhooks/{id:[0-9]+}/deliveries/{deliveryId:[0-9]+}/redeliver", authMiddleware(redeliverWebhookHandler)).Methods("POST")
+	router.HandleFunc("/block/{username}", authMiddleware(blockUserHandler)).Methods("POST")
+	router.HandleFunc("/unblock/{username}", authMiddleware(unblockUserHandler)).Methods("POST")
+	router.HandleFunc("/blocks", authMiddleware(listBlocksHandler)).Methods("GET")
+	router.HandleFunc("/mute/{username}", authMiddleware(muteUserHandler)).Methods("POST")
+	router.HandleFunc("/unmute/{username}", authMiddleware(unmuteUserHandler)).Methods("POST")
+	router.HandleFunc("/mutes", authMiddleware(listMutesHandler)).Methods("GET")
+	router.HandleFunc("/feed", authMiddleware(feedHandler)).Methods("GET")
+	router.HandleFunc("/posts", authMiddleware(createPostHandler)).Methods("POST")
+	router.HandleFunc("/posts/{id:[0-9]+}", getPostHandler).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}", authMiddleware(updatePostHandler)).Methods("PUT")
+	router.HandleFunc("/posts/{id:[0-9]+}", authMiddleware(deletePostHandler)).Methods("DELETE")
+	router.HandleFunc("/posts/{id:[0-9]+}/history", postHistoryHandler).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}/like", authMiddleware(likePostHandler)).Methods("POST")
+	router.HandleFunc("/posts/{id:[0-9]+}/like", authMiddleware(unlikePostHandler)).Methods("DELETE")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments", listPostCommentsHandler).Methods("GET")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments", authMiddleware(createPostCommentHandler)).Methods("POST")
+	router.HandleFunc("/posts/{id:[0-9]+}/comments/{commentId:[0-9]+}", authMiddleware(deletePostCommentHandler)).Methods("DELETE")
+	router.HandleFunc("/users/{username}/posts", userPostsHandler).Methods("GET")
+	router.HandleFunc("/conversations", authMiddleware(listConversationsHandler)).Methods("GET")
+	router.HandleFunc("/messages/unread", authMiddleware(unreadMessagesHandler)).Methods("GET")
+	router.HandleFunc("/messages/settings", authMiddleware(updateMessageSettingsHandler)).Methods("PUT")
+	// Conversations sit under /with so no username can collide with the
+	// routes above
+	router.HandleFunc("/messages/with/{username}", authMiddleware(messageHistoryHandler)).Methods("GET")
+	router.HandleFunc("/messages/with/{username}", authMiddleware(sendMessageHandler)).Methods("POST")
+	router.HandleFunc("/messages/with/{username}/read", authMiddleware(markConversationReadHandler)).Methods("POST")
+	router.HandleFunc("/chat/rooms", authMiddleware(listChatRoomsHandler)).Methods("GET")
+	router.HandleFunc("/chat/rooms/{id:[0-9]+}/messages", authMiddleware(chatHistoryHandler)).Methods("GET")
+	router.HandleFunc("/chat/rooms/{id:[0-9]+}/messages", authMiddleware(postChatMessageHandler)).Methods("POST")
+	router.HandleFunc("/chat/rooms/{id:[0-9]+}/messages/{messageId:[0-9]+}", authMiddleware(editChatMessageHandler)).Methods("PUT")
+	router.HandleFunc("/chat/rooms/{id:[0-9]+}/messages/{messageId:[0-9]+}", authMiddleware(deleteChatMessageHandler)).Methods("DELETE")
+	router.HandleFunc("/chat/rooms/{id:[0-9]+}/read", authMiddleware(markChatReadHandler)).Methods("POST")
+	router.HandleFunc("/chat/rooms/{id:[0-9]+}/reads", authMiddleware(chatReadReceiptsHandler)).Methods("GET")
+	router.HandleFunc("/chat/{kind:squad|community|lfg}/{ref}", authMiddleware(openChatRoomHandler)).Methods("GET")
+	router.HandleFunc("/communities", listCommunitiesHandler).Methods("GET")
+	router.HandleFunc("/communities", authMiddleware(createCommunityHandler)).Methods("POST")
+	router.HandleFunc("/communities/mine", authMiddleware(myCommunitiesHandler)).Methods("GET")
+	router.HandleFunc("/communities/{slug}", getCommunityHandler).Methods("GET")
+	router.HandleFunc("/communities/{slug}", authMiddleware(updateCommunityHandler)).Methods("PUT")
+	router.HandleFunc("/communities/{slug}", authMiddleware(deleteCommunityHandler)).Methods("DELETE")
+	router.HandleFunc("/communities/{slug}/join", authMiddleware(joinCommunityHandler)).Methods("POST")
+	router.HandleFunc("/communities/{slug}/leave", authMiddleware(leaveCommunityHandler)).Methods("POST")
+	router.HandleFunc("/communities/{slug}/requests", authMiddleware(communityJoinRequestsHandler)).Methods("GET")
+	router.HandleFunc("/communities/{slug}/accept/{username}", authMiddleware(acceptCommunityRequestHandler)).Methods("POST")
+	router.HandleFunc("/communities/{slug}/reject/{username}", authMiddleware(rejectCommunityRequestHandler)).Methods("POST")
+	router.HandleFunc("/communities/{slug}/members", communityMembersHandler).Methods("GET")
+	router.HandleFunc("/communities/{slug}/members/{username}", authMiddleware(setCommunityRoleHandler)).Methods("PUT")
+	router.HandleFunc("/communities/{slug}/members/{username}", authMiddleware(removeCommunityMemberHandler)).Methods("DELETE")
+	router.HandleFunc("/communities/{slug}/announcements", listAnnouncementsHandler).Methods("GET")
+	router.HandleFunc("/communities/{slug}/announcements", authMiddleware(createAnnouncementHandler)).Methods("POST")
+	router.HandleFunc("/communities/{slug}/announcements/{id:[0-9]+}", authMiddleware(updateAnnouncementHandler)).Methods("PUT")
+	router.HandleFunc("/communities/{slug}/announcements/{id:[0-9]+}", authMiddleware(deleteAnnouncementHandler)).Methods("DELETE")
+	router.HandleFunc("/communities/{slug}/announcements/{id:[0-9]+}/pin", authMiddleware(pinAnnouncementHandler)).Methods("POST")
+	router.HandleFunc("/communities/{slug}/announcements/{id:[0-9]+}/unpin", authMiddleware(unpinAnnouncementHandler)).Methods("POST")
+	router.HandleFunc("/collabs", authMiddleware(listCollabsHandler)).Methods("GET")
+	router.HandleFunc("/collabs", authMiddleware(createCollabHandler)).Methods("POST")
+	router.HandleFunc("/collabs/{id:[0-9]+}", authMiddleware(getCollabHandler)).Methods("GET")
+	router.HandleFunc("/collabs/{id:[0-9]+}/messages", authMiddleware(postCollabMessageHandler)).Methods("POST")
+	router.HandleFunc("/collabs/{id:[0-9]+}/counter", authMiddleware(counterCollabHandler)).Methods("POST")
+	router.HandleFunc("/collabs/{id:[0-9]+}/accept", authMiddleware(acceptCollabHandler)).Methods("POST")
+	router.HandleFunc("/collabs/{id:[0-9]+}/decline", authMiddleware(declineCollabHandler)).Methods("POST")
+	router.HandleFunc("/collabs/{id:[0-9]+}/cancel", authMiddleware(cancelCollabHandler)).Methods("POST")
+	router.HandleFunc("/matchmaking/queue", authMiddleware(listMatchmakingQueueHandler)).Methods("GET")
+	router.HandleFunc("/matchmaking/queue", authMiddleware(enqueueMatchmakingHandler)).Methods("POST")
+	router.HandleFunc("/matchmaking/queue/{id}/cancel", authMiddleware(cancelMatchmakingHandler)).Methods("POST")
+	router.HandleFunc("/matchmaking/proposals", authMiddleware(listMatchProposalsHandler)).Methods("GET")
+	router.HandleFunc("/matchmaking/proposals/{id}/accept", authMiddleware(acceptMatchProposalHandler)).Methods("POST")
+	router.HandleFunc("/matchmaking/proposals/{id}/decline", authMiddleware(declineMatchProposalHandler)).Methods("POST")
 
 	// Wrap router with CORS handler
 	handler := c.Handler(router)
@@ -302,8 +857,6 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Raw request body: %s", string(body))
-
 	var req RegisterRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		log.Printf("JSON parse error: %v", err)
@@ -331,6 +884,16 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var email *string
+	if strings.TrimSpace(req.Email) != "" {
+		normalized, err := normalizeEmail(req.Email)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		email = &normalized
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Printf("Password hashing error: %v", err)
@@ -338,18 +901,27 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO users (username, password, connected_games) 
-		VALUES ($1, $2, '{}'::text[])`,
-		username, string(hashedPassword))
+	var userID int
+	err = db.Get(&userID, `
+		INSERT INTO users (username, password, email) 
+		VALUES ($1, $2, $3)
+		RETURNING id`,
+		username, string(hashedPassword), email)
 	if err != nil {
 		log.Printf("Database error: %v", err)
 		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
 		return
 	}
 
-	rows, _ := result.RowsAffected()
-	log.Printf("User created successfully. Rows affected: %d", rows)
+	log.Printf("User created successfully with ID %d", userID)
+
+	// An address another account verified is accepted too, so signing up
+	// doesn't show who has an account; that account is told instead
+	if email != nil {
+		if err := sendEmailVerificationOrNotice(userID, username, *email); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -471,7 +1043,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 	err := db.Get(&user, `
 		SELECT id, username, twitch_username, discord_username, 
 			   instagram_handle, youtube_channel, favorite_games, 
-			   connected_games, is_private
+			   `+connectedGamesColumn+`, region, is_private
 		FROM users WHERE username = $1`, claims.Username)
 
 	if err != nil {
@@ -571,6 +1143,86 @@ func connectYoutubeHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "YouTube channel connected successfully"})
 }
 
+// gameCatalog lists the games users can search for and pick as favorites.
+var gameCatalog = []string{
+	"Valorant",
+	"BGMI",
+	"Counter-Strike 2",
+	"League of Legends",
+	"Dota 2",
+	"Apex Legends",
+	"Fortnite",
+	"Call of Duty: Warzone",
+	"PUBG: BATTLEGROUNDS",
+	"Minecraft",
+	"GTA V",
+	"Overwatch 2",
+	"Rainbow Six Siege",
+	"Rocket League",
+}
+
+// lookupCatalogGame returns the catalog spelling of name, matched
+// case-insensitively.
+func lookupCatalogGame(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	for _, game := range gameCatalog {
+		if strings.EqualFold(game, name) {
+			return game, true
+		}
+	}
+	return "", false
+}
+
+// regionCodes lists the regions users can play in.
+var regionCodes = []string{"NA", "SA", "EU", "ME", "AF", "IN", "SEA", "EA", "OCE"}
+
+// lookupRegion returns the canonical code for region, matched
+// case-insensitively.
+func lookupRegion(region string) (string, bool) {
+	region = strings.TrimSpace(region)
+	for _, code := range regionCodes {
+		if strings.EqualFold(code, region) {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+// rankTiers is the shared competitive ladder, lowest first. Per-game ranks are
+// mapped onto it so players can be compared across games.
+var rankTiers = []string{
+	"Iron",
+	"Bronze",
+	"Silver",
+	"Gold",
+	"Platinum",
+	"Diamond",
+	"Master",
+	"Grandmaster",
+	"Champion",
+}
+
+// lookupRankTier returns the canonical name of rank, matched
+// case-insensitively.
+func lookupRankTier(rank string) (string, bool) {
+	level, ok := rankLevel(rank)
+	if !ok {
+		return "", false
+	}
+	return rankTiers[level], true
+}
+
+// rankLevel returns the position of rank on the ladder.
+func rankLevel(rank string) (int, bool) {
+	rank = strings.TrimSpace(rank)
+	for i, tier := range rankTiers {
+		if strings.EqualFold(tier, rank) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 func searchGamesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -581,27 +1233,9 @@ func searchGamesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// List of popular games
-	popularGames := []string{
-		"Valorant",
-		"BGMI",
-		"Counter-Strike 2",
-		"League of Legends",
-		"Dota 2",
-		"Apex Legends",
-		"Fortnite",
-		"Call of Duty: Warzone",
-		"PUBG: BATTLEGROUNDS",
-		"Minecraft",
-		"GTA V",
-		"Overwatch 2",
-		"Rainbow Six Siege",
-		"Rocket League",
-	}
-
 	// Filter games based on search query
 	var results []string
-	for _, game := range popularGames {
+	for _, game := range gameCatalog {
 		if strings.Contains(strings.ToLower(game), query) {
 			results = append(results, game)
 		}
@@ -645,6 +1279,7 @@ func connectGameHandler(w http.ResponseWriter, r *http.Request) {
 		GameName     string `json:"gameName"`
 		GameUsername string `json:"gameUsername"`
 		GameId       string `json:"gameId"`
+		Rank         string `json:"rank"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -652,47 +1287,53 @@ func connectGameHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user ID
-	var userId int
-	err := db.QueryRow("SELECT id FROM users WHERE username = $1", claims.Username).Scan(&userId)
-	if err != nil {
-		http.Error(w, "Failed to get user ID", http.StatusInternalServerError)
+	requestBody.GameName = strings.TrimSpace(requestBody.GameName)
+	if requestBody.GameName == "" {
+		http.Error(w, "Game name is required", http.StatusBadRequest)
 		return
 	}
 
-	// Begin transaction
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
-		return
+	// Rank is optional but must be one of the known tiers when given
+	var rank *string
+	if strings.TrimSpace(requestBody.Rank) != "" {
+		tier, ok := lookupRankTier(requestBody.Rank)
+		if !ok {
+			http.Error(w, "Unknown rank", http.StatusBadRequest)
+			return
+		}
+		rank = &tier
 	}
-	defer tx.Rollback()
 
-	// Insert into user_games table
-	_, err = tx.Exec(`
-		INSERT INTO user_games (user_id, game_name, game_username, game_id)
-		VALUES ($1, $2, $3, $4)
-	`, userId, requestBody.GameName, requestBody.GameUsername, requestBody.GameId)
+	// Get user ID
+	var userId int
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", claims.Username).Scan(&userId)
 	if err != nil {
-		http.Error(w, "Failed to connect game", http.StatusInternalServerError)
+		http.Error(w, "Failed to get user ID", http.StatusInternalServerError)
 		return
 	}
 
-	// Update connected_games array in users table
-	_, err = tx.Exec(`
-		UPDATE users 
-		SET connected_games = array_append(COALESCE(connected_games, ARRAY[]::text[]), $1)
-		WHERE id = $2 AND NOT ($1 = ANY(COALESCE(connected_games, ARRAY[]::text[])))
-	`, requestBody.GameName, userId)
+	// Connecting a game twice updates its details instead of adding a row,
+	// keeping the stored rank when none is given
+	var inserted bool
+	err = db.QueryRow(`
+		INSERT INTO user_games (user_id, game_name, game_username, game_id, rank)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, game_name)
+		DO UPDATE SET game_username = EXCLUDED.game_username, game_id = EXCLUDED.game_id,
+			rank = COALESCE(EXCLUDED.rank, user_games.rank)
+		RETURNING xmax = 0
+	`, userId, requestBody.GameName, requestBody.GameUsername, requestBody.GameId, rank).Scan(&inserted)
 	if err != nil {
-		http.Error(w, "Failed to update user's connected games", http.StatusInternalServerError)
+		http.Error(w, "Failed to connect game", http.StatusInternalServerError)
 		return
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
-		return
+	// Only newly connected games show up in followers' feeds
+	if inserted {
+		recordActivity(userId, "game_connected", nil, &requestBody.GameName, map[string]interface{}{
+			"gameName": requestBody.GameName,
+			"rank":     rank,
+		})
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -706,7 +1347,7 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	err := db.Select(&users, `
 		SELECT id, username, twitch_username, discord_username, 
 			   instagram_handle, youtube_channel, favorite_games, 
-			   connected_games, is_private 
+			   `+connectedGamesColumn+`, region, is_private 
 		FROM users 
 		ORDER BY id DESC
 	`)
@@ -732,19 +1373,26 @@ type GameConnection struct {
 	Name     string `json:"name"`
 	Username string `json:"username,omitempty"`
 	GameID   string `json:"gameId,omitempty"`
+	Rank     string `json:"rank,omitempty"`
 }
 
 type UserProfileResponse struct {
-	Username        string           `json:"username"`
-	TwitchUsername  string           `json:"twitchUsername,omitempty"`
-	DiscordUsername string           `json:"discordUsername,omitempty"`
-	InstagramHandle string           `json:"instagramHandle,omitempty"`
-	YoutubeChannel  string           `json:"youtubeChannel,omitempty"`
-	ConnectedGames  []GameConnection `json:"connectedGames"`
-	IsPrivate       bool             `json:"isPrivate"`
-	FollowersCount  int              `json:"followersCount"`
-	FollowingCount  int              `json:"followingCount"`
-	IsFollowing     bool             `json:"isFollowing"`
+	Username        string                `json:"username"`
+	TwitchUsername  string                `json:"twitchUsername,omitempty"`
+	DiscordUsername string                `json:"discordUsername,omitempty"`
+	InstagramHandle string                `json:"instagramHandle,omitempty"`
+	YoutubeChannel  string                `json:"youtubeChannel,omitempty"`
+	Region          string                `json:"region,omitempty"`
+	ConnectedGames  []GameConnection      `json:"connectedGames"`
+	IsPrivate       bool                  `json:"isPrivate"`
+	FollowersCount  int                   `json:"followersCount"`
+	FollowingCount  int                   `json:"followingCount"`
+	IsFollowing     bool                  `json:"isFollowing"`
+	Availability    *AvailabilitySchedule `json:"availability,omitempty"`
+	// AvailabilityOverlap is the viewer's overlap with this user over the
+	// next week, present when the request is authenticated
+	AvailabilityOverlap *AvailabilityOverlap `json:"availabilityOverlap,omitempty"`
+	Squads              []UserSquad          `json:"squads"`
 }
 
 func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
@@ -761,6 +1409,7 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		DiscordUsername sql.NullString `db:"discord_username"`
 		InstagramHandle sql.NullString `db:"instagram_handle"`
 		YoutubeChannel  sql.NullString `db:"youtube_channel"`
+		Region          sql.NullString `db:"region"`
 		IsPrivate       bool           `db:"is_private"`
 	}
 
@@ -773,6 +1422,7 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 			discord_username,
 			instagram_handle,
 			youtube_channel,
+			region,
 			is_private
 		FROM users 
 		WHERE username = $1`,
@@ -794,7 +1444,8 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		SELECT 
 			game_name as name,
 			game_username as username,
-			game_id as "gameId"
+			game_id as "gameId",
+			rank
 		FROM user_games
 		WHERE user_id = $1`,
 		user.ID)
@@ -804,8 +1455,8 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		defer rows.Close()
 		for rows.Next() {
 			var game GameConnection
-			var username, gameID sql.NullString
-			err := rows.Scan(&game.Name, &username, &gameID)
+			var username, gameID, rank sql.NullString
+			err := rows.Scan(&game.Name, &username, &gameID, &rank)
 			if err != nil {
 				log.Printf("Error scanning game row: %v", err)
 				continue
@@ -816,6 +1467,9 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 			if gameID.Valid {
 				game.GameID = gameID.String
 			}
+			if rank.Valid {
+				game.Rank = rank.String
+			}
 			games = append(games, game)
 		}
 	}
@@ -827,13 +1481,30 @@ func getUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 		DiscordUsername: user.DiscordUsername.String,
 		InstagramHandle: user.InstagramHandle.String,
 		YoutubeChannel:  user.YoutubeChannel.String,
+		Region:          user.Region.String,
 		ConnectedGames:  games,
 		IsPrivate:       user.IsPrivate,
 		FollowersCount:  0, // Add follower count logic if needed
-		FollowingCount:  0, // Add following count logic if needed 
+		FollowingCount:  0, // Add following count logic if needed
 		IsFollowing:     false,
 	}
 
+	// Signed-in viewers also see when they and this user are both online
+	var viewerID int
+	if claims := optionalClaims(r); claims != nil {
+		if id, err := userIDByUsername(claims.Username); err == nil {
+			viewerID = id
+		}
+	}
+	response.Availability, response.AvailabilityOverlap, err = profileAvailability(viewerID, user.ID)
+	if err != nil {
+		log.Printf("Error loading availability: %v", err)
+	}
+	response.Squads, err = loadUserSquads(user.ID)
+	if err != nil {
+		log.Printf("Error loading squads: %v", err)
+	}
+
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Error encoding response: %v", err)
 		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
@@ -895,6 +1566,42 @@ func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func updateRegionHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var requestBody struct {
+		Region string `json:"region"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	// An empty region clears it
+	var region *string
+	if strings.TrimSpace(requestBody.Region) != "" {
+		code, ok := lookupRegion(requestBody.Region)
+		if !ok {
+			http.Error(w, `{"error":"Unknown region"}`, http.StatusBadRequest)
+			return
+		}
+		region = &code
+	}
+
+	_, err := db.Exec("UPDATE users SET region = $1 WHERE username = $2", region, claims.Username)
+	if err != nil {
+		log.Printf("Error updating region: %v", err)
+		http.Error(w, `{"error":"Error updating region"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Region updated",
+		"region":  region,
+	})
+}
+
 func disconnectInstagramHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 
@@ -935,6 +1642,13 @@ func disconnectGameHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Games are stored trimmed on connect
+	requestBody.GameName = strings.TrimSpace(requestBody.GameName)
+	if requestBody.GameName == "" {
+		http.Error(w, "Game name is required", http.StatusBadRequest)
+		return
+	}
+
 	// Get user ID
 	var userId int
 	err := db.QueryRow("SELECT id FROM users WHERE username = $1", claims.Username).Scan(&userId)
@@ -943,16 +1657,7 @@ func disconnectGameHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Begin transaction
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
-		return
-	}
-	defer tx.Rollback()
-
-	// Remove from user_games table
-	_, err = tx.Exec(`
+	_, err = db.Exec(`
 		DELETE FROM user_games 
 		WHERE user_id = $1 AND game_name = $2
 	`, userId, requestBody.GameName)
@@ -960,28 +1665,224 @@ func disconnectGameHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to disconnect game", http.StatusInternalServerError)
 		return
 	}
+	removeActivity(userId, "game_connected", nil, &requestBody.GameName)
 
-	// Update connected_games array in users table
-	_, err = tx.Exec(`
-		UPDATE users 
-		SET connected_games = array_remove(connected_games, $1)
-		WHERE id = $2
-	`, requestBody.GameName, userId)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Game disconnected successfully",
+	})
+}
+
+// maxFavoriteGames caps how many games a user can pin to their profile.
+const maxFavoriteGames = 5
+
+// favoriteGamesError reports a favorites change the user has to fix.
+type favoriteGamesError struct {
+	message string
+}
+
+func (e *favoriteGamesError) Error() string {
+	return e.message
+}
+
+// normalizeFavoriteGames checks games against the catalog and returns them
+// in catalog spelling, keeping the order given. Games already in current
+// are kept as stored, so favorites saved before the catalog existed or
+// since dropped from it don't block other changes, and a list already over
+// the limit may be reordered but not grown.
+func normalizeFavoriteGames(games []string, current StringArray) (StringArray, error) {
+	if len(games) > maxFavoriteGames && len(games) > len(current) {
+		return nil, &favoriteGamesError{fmt.Sprintf("At most %d favorite games are allowed", maxFavoriteGames)}
+	}
+
+	result := StringArray{}
+	seen := make(map[string]bool)
+	for _, name := range games {
+		game, ok := lookupFavoriteGame(name, current)
+		if !ok {
+			return nil, &favoriteGamesError{fmt.Sprintf("Unknown game: %s", name)}
+		}
+		if seen[game] {
+			return nil, &favoriteGamesError{fmt.Sprintf("Duplicate game: %s", game)}
+		}
+		seen[game] = true
+		result = append(result, game)
+	}
+
+	// A list already over the limit may be reordered or trimmed, but any
+	// game it gains must bring it within the limit
+	if len(result) > maxFavoriteGames {
+		for _, game := range result {
+			if !containsString(current, game) {
+				return nil, &favoriteGamesError{fmt.Sprintf("At most %d favorite games are allowed", maxFavoriteGames)}
+			}
+		}
+	}
+	return result, nil
+}
+
+// lookupFavoriteGame returns name as stored in current, or else in catalog
+// spelling.
+func lookupFavoriteGame(name string, current StringArray) (string, bool) {
+	trimmed := strings.TrimSpace(name)
+	for _, game := range current {
+		if strings.EqualFold(game, trimmed) {
+			return game, true
+		}
+	}
+	return lookupCatalogGame(name)
+}
+
+// updateFavoriteGames applies update to the user's current favorites while
+// holding a row lock, so concurrent edits don't overwrite each other.
+func updateFavoriteGames(username string, update func(current StringArray) (StringArray, error)) (StringArray, error) {
+	tx, err := db.Beginx()
 	if err != nil {
-		http.Error(w, "Failed to update user's connected games", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current StringArray
+	err = tx.Get(&current, "SELECT favorite_games FROM users WHERE username = $1 FOR UPDATE", username)
+	if err != nil {
+		return nil, err
+	}
+
+	games, err := update(current)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE users SET favorite_games = $1 WHERE username = $2", games, username)
+	if err != nil {
+		return nil, err
 	}
 
-	// Commit transaction
 	if err := tx.Commit(); err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		return nil, err
+	}
+	return games, nil
+}
+
+func writeFavoriteGamesResponse(w http.ResponseWriter, games StringArray, err error, message string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		if ferr, ok := err.(*favoriteGamesError); ok {
+			writeJSONError(w, http.StatusBadRequest, ferr.message)
+			return
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error updating favorite games: %v", err)
+		http.Error(w, `{"error":"Error updating favorite games"}`, http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Game disconnected successfully",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       message,
+		"favoriteGames": games,
+	})
+}
+
+func setFavoriteGamesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var requestBody struct {
+		Games []string `json:"games"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	games, err := updateFavoriteGames(claims.Username, func(current StringArray) (StringArray, error) {
+		return normalizeFavoriteGames(requestBody.Games, current)
+	})
+	writeFavoriteGamesResponse(w, games, err, "Favorite games updated")
+}
+
+func addFavoriteGameHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var requestBody struct {
+		GameName string `json:"gameName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	games, err := updateFavoriteGames(claims.Username, func(current StringArray) (StringArray, error) {
+		return normalizeFavoriteGames(append(current, requestBody.GameName), current)
+	})
+	writeFavoriteGamesResponse(w, games, err, "Favorite game added")
+}
+
+func removeFavoriteGameHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var requestBody struct {
+		GameName string `json:"gameName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	games, err := updateFavoriteGames(claims.Username, func(current StringArray) (StringArray, error) {
+		remaining := StringArray{}
+		found := false
+		for _, game := range current {
+			if strings.EqualFold(game, strings.TrimSpace(requestBody.GameName)) {
+				found = true
+				continue
+			}
+			remaining = append(remaining, game)
+		}
+		if !found {
+			return nil, &favoriteGamesError{"Game is not in favorites"}
+		}
+		return remaining, nil
+	})
+	writeFavoriteGamesResponse(w, games, err, "Favorite game removed")
+}
+
+func reorderFavoriteGamesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	var requestBody struct {
+		Games []string `json:"games"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	games, err := updateFavoriteGames(claims.Username, func(current StringArray) (StringArray, error) {
+		ordered, err := normalizeFavoriteGames(requestBody.Games, current)
+		if err != nil {
+			return nil, err
+		}
+
+		// A reorder must name exactly the games that are already favorites
+		currentSet := make(map[string]bool)
+		for _, game := range current {
+			currentSet[game] = true
+		}
+		if len(ordered) != len(currentSet) {
+			return nil, &favoriteGamesError{"Reorder must include every favorite game exactly once"}
+		}
+		for _, game := range ordered {
+			if !currentSet[game] {
+				return nil, &favoriteGamesError{fmt.Sprintf("Game is not in favorites: %s", game)}
+			}
+		}
+		return ordered, nil
 	})
+	writeFavoriteGamesResponse(w, games, err, "Favorite games reordered")
 }
 
 func followUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -1016,6 +1917,16 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	blocked, err := isBlocked(db, followerID, targetID)
+	if err != nil {
+		http.Error(w, "Failed to get target user", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "Cannot follow this user", http.StatusForbidden)
+		return
+	}
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
@@ -1024,9 +1935,10 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
+	var result sql.Result
 	if isPrivate {
 		// Create follow request for private accounts
-		_, err = tx.Exec(`
+		result, err = tx.Exec(`
 			INSERT INTO follow_requests (requester_id, target_id, status)
 			VALUES ($1, $2, 'pending')
 			ON CONFLICT (requester_id, target_id) 
@@ -1035,7 +1947,7 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 		`, followerID, targetID)
 	} else {
 		// Direct follow for public accounts
-		_, err = tx.Exec(`
+		result, err = tx.Exec(`
 			INSERT INTO followers (follower_id, following_id)
 			VALUES ($1, $2)
 			ON CONFLICT DO NOTHING
@@ -1052,6 +1964,18 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Repeating a follow or a pending request changes nothing and
+	// notifies no one
+	changed, _ := result.RowsAffected()
+	if changed == 1 {
+		if isPrivate {
+			notify(targetID, "follow_request", map[string]interface{}{"from": claims.Username})
+		} else {
+			notify(targetID, "new_follower", map[string]interface{}{"from": claims.Username})
+			recordActivity(followerID, "followed", &targetID, nil, map[string]interface{}{"username": targetUsername})
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	var followState string
 	var message string
@@ -1081,7 +2005,8 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	// Delete from both followers and follow_requests tables
-	_, err = tx.Exec(`
+	var followerID, targetID int
+	err = tx.QueryRow(`
 		WITH ids AS (
 			SELECT u1.id as follower_id, u2.id as target_id
 			FROM users u1, users u2
@@ -1090,7 +2015,12 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 		DELETE FROM followers 
 		WHERE follower_id = (SELECT follower_id FROM ids)
 		AND following_id = (SELECT target_id FROM ids)
-	`, claims.Username, targetUsername)
+		RETURNING follower_id, following_id
+	`, claims.Username, targetUsername).Scan(&followerID, &targetID)
+	unfollowed := err == nil
+	if err == sql.ErrNoRows {
+		err = nil
+	}
 
 	if err != nil {
 		http.Error(w, "Error removing follow relationship", http.StatusInternalServerError)
@@ -1119,6 +2049,10 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if unfollowed {
+		removeActivity(followerID, "followed", &targetID, nil)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"followState": "not_following",
@@ -1132,7 +2066,10 @@ func getProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 	var user User
 	err := db.Get(&user, `
-		SELECT * FROM users WHERE username = $1
+		SELECT id, username, password, twitch_username, discord_username,
+			   instagram_handle, youtube_channel, favorite_games,
+			   `+connectedGamesColumn+`, region, is_private
+		FROM users WHERE username = $1
 	`, username)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1144,6 +2081,14 @@ func getProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var account struct {
+		Email    *string `db:"email"`
+		Verified bool    `db:"email_verified"`
+	}
+	if err := db.Get(&account, "SELECT email, email_verified FROM users WHERE id = $1", user.ID); err != nil {
+		log.Printf("Error getting email: %v", err)
+	}
+
 	// Get follower and following counts
 	var followersCount, followingCount int
 	err = db.QueryRow(`
@@ -1159,12 +2104,16 @@ func getProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 	response := struct {
 		User
-		FollowersCount int `json:"followersCount"`
-		FollowingCount int `json:"followingCount"`
+		FollowersCount int     `json:"followersCount"`
+		FollowingCount int     `json:"followingCount"`
+		Email          *string `json:"email"`
+		EmailVerified  bool    `json:"emailVerified"`
 	}{
 		User:           user,
 		FollowersCount: followersCount,
 		FollowingCount: followingCount,
+		Email:          account.Email,
+		EmailVerified:  account.Verified,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1274,16 +2223,17 @@ func getFollowStateHandler(w http.ResponseWriter, r *http.Request) {
 func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 	vars := mux.Vars(r)
-	targetUsername := vars["username"]
+	requesterUsername := vars["username"]
 
-	var followerID, targetID int
+	// The caller answers a request that {username} sent them
+	var userID, requesterID int
 	err := db.QueryRow(`
 		SELECT 
-			(SELECT id FROM users WHERE username = $1) as follower_id,
-			u.id as target_id
+			(SELECT id FROM users WHERE username = $1) as user_id,
+			u.id as requester_id
 		FROM users u
 		WHERE u.username = $2
-	`, claims.Username, targetUsername).Scan(&followerID, &targetID)
+	`, claims.Username, requesterUsername).Scan(&userID, &requesterID)
 
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
@@ -1298,12 +2248,23 @@ func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	// Accept follow request
-	_, err = tx.Exec(`
+	// Accept follow request, unless it was already answered
+	result, err := tx.Exec(`
 		UPDATE follow_requests 
 		SET status = 'accepted'
-		WHERE requester_id = $1 AND target_id = $2
-	`, followerID, targetID)
+		WHERE requester_id = $1 AND target_id = $2 AND status = 'pending'
+	`, requesterID, userID)
+	var accepted int64
+	if err == nil {
+		accepted, _ = result.RowsAffected()
+	}
+	if err == nil && accepted == 1 {
+		_, err = tx.Exec(`
+			INSERT INTO followers (follower_id, following_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, requesterID, userID)
+	}
 
 	if err != nil {
 		http.Error(w, "Error accepting follow request", http.StatusInternalServerError)
@@ -1316,6 +2277,11 @@ func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if accepted == 1 {
+		notify(requesterID, "follow_request_accepted", map[string]interface{}{"by": claims.Username})
+		recordActivity(requesterID, "followed", &userID, nil, map[string]interface{}{"username": claims.Username})
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Follow request accepted",
@@ -1325,16 +2291,17 @@ func acceptFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 func rejectFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value(userClaimsKey).(*Claims)
 	vars := mux.Vars(r)
-	targetUsername := vars["username"]
+	requesterUsername := vars["username"]
 
-	var followerID, targetID int
+	// The caller answers a request that {username} sent them
+	var userID, requesterID int
 	err := db.QueryRow(`
 		SELECT 
-			(SELECT id FROM users WHERE username = $1) as follower_id,
-			u.id as target_id
+			(SELECT id FROM users WHERE username = $1) as user_id,
+			u.id as requester_id
 		FROM users u
 		WHERE u.username = $2
-	`, claims.Username, targetUsername).Scan(&followerID, &targetID)
+	`, claims.Username, requesterUsername).Scan(&userID, &requesterID)
 
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
@@ -1349,12 +2316,12 @@ func rejectFollowRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	// Reject follow request
+	// Reject follow request, unless it was already answered
 	_, err = tx.Exec(`
 		UPDATE follow_requests 
 		SET status = 'rejected'
-		WHERE requester_id = $1 AND target_id = $2
-	`, followerID, targetID)
+		WHERE requester_id = $1 AND target_id = $2 AND status = 'pending'
+	`, requesterID, userID)
 
 	if err != nil {
 		http.Error(w, "Error rejecting follow request", http.StatusInternalServerError)
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStringArrayRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value StringArray
+	}{
+		{"empty array", StringArray{}},
+		{"single element", StringArray{"Valorant"}},
+		{"empty string", StringArray{""}},
+		{"several empty strings", StringArray{"", "", ""}},
+		{"commas", StringArray{"a,b", ",", "trailing,"}},
+		{"double quotes", StringArray{`"quoted"`, `say "hi"`, `"`}},
+		{"braces", StringArray{"{", "}", "{a,b}", "{}"}},
+		{"backslashes", StringArray{`\`, `C:\Games\`, `\\`, `\"`}},
+		{"NULL as a string", StringArray{"NULL", "null", "Null"}},
+		{"whitespace", StringArray{" leading", "trailing ", "  both  ", " ", "\t\n"}},
+		{"multibyte UTF-8", StringArray{"ポケモン", "Café", "🎮 night", "日本語,中文"}},
+		{"everything", StringArray{` {"a\b", NULL} `, "ü", ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			literal, err := test.value.Value()
+			if err != nil {
+				t.Fatalf("Value() error: %v", err)
+			}
+			var got StringArray
+			if err := got.Scan(literal); err != nil {
+				t.Fatalf("Scan(%q) error: %v", literal, err)
+			}
+			if !reflect.DeepEqual(got, test.value) {
+				t.Errorf("Scan(Value(%q)) = %q via %q", test.value, got, literal)
+			}
+
+			// The driver may hand the value back as bytes
+			var fromBytes StringArray
+			if err := fromBytes.Scan([]byte(literal.(string))); err != nil {
+				t.Fatalf("Scan([]byte) error: %v", err)
+			}
+			if !reflect.DeepEqual(fromBytes, test.value) {
+				t.Errorf("Scan([]byte(Value(%q))) = %q", test.value, fromBytes)
+			}
+		})
+	}
+}
+
+func TestStringArrayScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		literal string
+		want    StringArray
+	}{
+		{"empty", "{}", StringArray{}},
+		{"empty with spaces", " { } ", StringArray{}},
+		{"unquoted", "{a,b,c}", StringArray{"a", "b", "c"}},
+		{"quoted", `{"a","b c"}`, StringArray{"a", "b c"}},
+		{"NULL element", "{a,NULL,b}", StringArray{"a", "", "b"}},
+		{"lowercase NULL element", "{null}", StringArray{""}},
+		{"quoted NULL string", `{"NULL"}`, StringArray{"NULL"}},
+		{"escaped NULL string", `{\NULL}`, StringArray{"NULL"}},
+		{"unquoted whitespace is trimmed", "{  a b  ,c }", StringArray{"a b", "c"}},
+		{"quoted whitespace is kept", `{"  a  "}`, StringArray{"  a  "}},
+		{"escaped trailing space is kept", `{a\ }`, StringArray{"a "}},
+		{"escapes in unquoted element", `{a\,b,c\}d}`, StringArray{"a,b", "c}d"}},
+		{"escapes in quoted element", `{"a\"b\\c"}`, StringArray{`a"b\c`}},
+		{"multibyte unquoted", "{ポケモン,Café}", StringArray{"ポケモン", "Café"}},
+		{"dimension decoration", "[0:1]={a,b}", StringArray{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got StringArray
+			if err := got.Scan(test.literal); err != nil {
+				t.Fatalf("Scan(%q) error: %v", test.literal, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Scan(%q) = %q, want %q", test.literal, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStringArrayScanNull(t *testing.T) {
+	got := StringArray{"stale"}
+	if err := got.Scan(nil); err != nil {
+		t.Fatalf("Scan(nil) error: %v", err)
+	}
+	if got == nil || len(got) != 0 {
+		t.Errorf("Scan(nil) = %#v, want an empty array", got)
+	}
+}
+
+func TestStringArrayScanMalformed(t *testing.T) {
+	literals := []string{
+		"",
+		"a,b",
+		"{",
+		"}",
+		"{a",
+		"{a,}",
+		"{,a}",
+		"{a,,b}",
+		`{"a}`,
+		`{"a"b}`,
+		`{a"b}`,
+		`{a\`,
+		`{"a\`,
+		"{{a},{b}}",
+		"{a}b",
+		"{a} {b}",
+		"[0:1]{a}",
+		"[0:1",
+	}
+	for _, literal := range literals {
+		var got StringArray
+		if err := got.Scan(literal); err == nil {
+			t.Errorf("Scan(%q) = %q, want an error", literal, got)
+		}
+	}
+
+	var got StringArray
+	if err := got.Scan(42); err == nil {
+		t.Error("Scan(42) succeeded, want an error")
+	}
+}
+
+func TestStringArrayValueRejectsNUL(t *testing.T) {
+	if _, err := (StringArray{"a", "b\x00c"}).Value(); err == nil {
+		t.Error("Value() with a NUL byte succeeded, want an error")
+	}
+}
+
+func FuzzStringArray(f *testing.F) {
+	seeds := []string{"", "a", "NULL", " ", `"`, `\`, "{}", "a,b", "ポケモン", " x ", `{"\}`}
+	for _, seed := range seeds {
+		f.Add(seed, seed+",")
+	}
+
+	f.Fuzz(func(t *testing.T, first, second string) {
+		if strings.IndexByte(first, 0) >= 0 || strings.IndexByte(second, 0) >= 0 {
+			t.Skip()
+		}
+		for _, value := range []StringArray{{first}, {first, second}, {second, "", first}} {
+			literal, err := value.Value()
+			if err != nil {
+				t.Fatalf("Value(%q) error: %v", value, err)
+			}
+			var got StringArray
+			if err := got.Scan(literal); err != nil {
+				t.Fatalf("Scan(%q) error: %v", literal, err)
+			}
+			if !reflect.DeepEqual(got, value) {
+				t.Fatalf("Scan(Value(%q)) = %q via %q", value, got, literal)
+			}
+		}
+	})
+}
+
+func TestNormalizeFavoriteGames(t *testing.T) {
+	legacy := StringArray{"Club Penguin", "valorant"}
+	full := StringArray{"Valorant", "BGMI", "Dota 2", "Fortnite", "Apex Legends", "Old Game"}
+
+	tests := []struct {
+		name    string
+		games   []string
+		current StringArray
+		want    StringArray
+		wantErr bool
+	}{
+		{"catalog spelling", []string{" valorant ", "dota 2"}, nil, StringArray{"Valorant", "Dota 2"}, false},
+		{"empty", []string{}, nil, StringArray{}, false},
+		{"unknown game", []string{"Valorant", "Club Penguin"}, nil, nil, true},
+		{"duplicate", []string{"Valorant", "VALORANT"}, nil, nil, true},
+		{"too many", []string{"Valorant", "BGMI", "Dota 2", "Fortnite", "Apex Legends", "Counter-Strike 2"}, nil, nil, true},
+		{"legacy names kept when adding", append(legacy, "BGMI"), legacy, StringArray{"Club Penguin", "valorant", "BGMI"}, false},
+		{"legacy names kept when reordering", []string{"VALORANT", "club penguin"}, legacy, StringArray{"valorant", "Club Penguin"}, false},
+		{"legacy duplicate of a catalog game", append(legacy, "Valorant"), legacy, nil, true},
+		{"added game still checked", append(legacy, "Terraria"), legacy, nil, true},
+		{"legacy list over the limit reordered", []string{"Old Game", "Apex Legends", "Fortnite", "Dota 2", "BGMI", "Valorant"}, full,
+			StringArray{"Old Game", "Apex Legends", "Fortnite", "Dota 2", "BGMI", "Valorant"}, false},
+		{"legacy list over the limit grown", append(full, "Counter-Strike 2"), full, nil, true},
+		{"legacy list over the limit trimmed", full, append(full, "Older Game"), full, false},
+		{"legacy list over the limit with a game swapped", append(full[:5:5], "Counter-Strike 2"), full, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := normalizeFavoriteGames(test.games, test.current)
+			if test.wantErr {
+				if _, ok := err.(*favoriteGamesError); !ok {
+					t.Errorf("normalizeFavoriteGames = %q, %v, want a favoriteGamesError", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeFavoriteGames error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("normalizeFavoriteGames = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// clock abstracts time.Now so the matcher can run against a fake clock.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// queueEntry is one player waiting for a group, as the matcher sees it.
+type queueEntry struct {
+	ID             int
+	UserID         int
+	Game           string
+	GroupSize      int
+	RankLevel      *int // the player's own rank for Game, from user_games
+	MinRank        *int // lowest teammate rank accepted
+	MaxRank        *int // highest teammate rank accepted
+	Region         string
+	Role           string
+	RolesNeeded    []string
+	Languages      []string
+	AvailableFrom  time.Time
+	AvailableUntil time.Time
+	CreatedAt      time.Time
+}
+
+// proposedGroup is a set of mutually compatible entries and the window in
+// which all of them are available.
+type proposedGroup struct {
+	Game    string
+	Entries []queueEntry
+	From    time.Time
+	Until   time.Time
+}
+
+// matchmaker forms groups from queue entries. Given the same entries and
+// clock it always produces the same groups: entries are considered oldest
+// first and each group is the earliest compatible combination found.
+type matchmaker struct {
+	clock clock
+	// minOverlap is how long every member must be available together.
+	minOverlap time.Duration
+	// maxSearch bounds the candidate combinations tried per anchor entry.
+	maxSearch int
+}
+
+func newMatchmaker(c clock) *matchmaker {
+	return &matchmaker{
+		clock:      c,
+		minOverlap: 30 * time.Minute,
+		maxSearch:  10000,
+	}
+}
+
+// buildGroups returns the groups that can be formed from entries. No entry
+// and no user appears in more than one group.
+func (m *matchmaker) buildGroups(entries []queueEntry) []proposedGroup {
+	now := m.clock.Now()
+
+	viable := make([]queueEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.GroupSize < 2 {
+			continue
+		}
+		from := laterTime(entry.AvailableFrom, now)
+		if entry.AvailableUntil.Sub(from) >= m.minOverlap {
+			viable = append(viable, entry)
+		}
+	}
+	sort.SliceStable(viable, func(i, j int) bool {
+		if !viable[i].CreatedAt.Equal(viable[j].CreatedAt) {
+			return viable[i].CreatedAt.Before(viable[j].CreatedAt)
+		}
+		return viable[i].ID < viable[j].ID
+	})
+
+	// Bucket by game and group size, keeping buckets in order of their
+	// oldest entry
+	type bucketKey struct {
+		game string
+		size int
+	}
+	var order []bucketKey
+	buckets := make(map[bucketKey][]queueEntry)
+	for _, entry := range viable {
+		key := bucketKey{entry.Game, entry.GroupSize}
+		if _, ok := buckets[key]; !ok {
+			order = append(order, key)
+		}
+		buckets[key] = append(buckets[key], entry)
+	}
+
+	usedUsers := make(map[int]bool)
+	var groups []proposedGroup
+	for _, key := range order {
+		bucket := buckets[key]
+		for i, anchor := range bucket {
+			if usedUsers[anchor.UserID] {
+				continue
+			}
+
+			var candidates []queueEntry
+			for _, entry := range bucket[i+1:] {
+				if !usedUsers[entry.UserID] {
+					candidates = append(candidates, entry)
+				}
+			}
+
+			group, ok := m.findGroup(anchor, candidates, now)
+			if !ok {
+				continue
+			}
+			for _, entry := range group.Entries {
+				usedUsers[entry.UserID] = true
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// findGroup searches candidates in order for members that complete a group
+// around anchor.
+func (m *matchmaker) findGroup(anchor queueEntry, candidates []queueEntry, now time.Time) (proposedGroup, bool) {
+	members := []queueEntry{anchor}
+	budget := m.maxSearch
+
+	var search func(start int, from, until time.Time) (proposedGroup, bool)
+	search = func(start int, from, until time.Time) (proposedGroup, bool) {
+		if len(members) == anchor.GroupSize {
+			if !rolesSatisfied(members) || !shareLanguage(members) {
+				return proposedGroup{}, false
+			}
+			group := proposedGroup{
+				Game:    anchor.Game,
+				Entries: append([]queueEntry(nil), members...),
+				From:    from,
+				Until:   until,
+			}
+			return group, true
+		}
+
+		for i := start; i < len(candidates); i++ {
+			if budget <= 0 {
+				return proposedGroup{}, false
+			}
+			budget--
+
+			candidate := candidates[i]
+			if !compatibleWithAll(candidate, members) {
+				continue
+			}
+			nextFrom := laterTime(from, candidate.AvailableFrom)
+			nextUntil := earlierTime(until, candidate.AvailableUntil)
+			if nextUntil.Sub(nextFrom) < m.minOverlap {
+				continue
+			}
+
+			members = append(members, candidate)
+			if !shareLanguage(members) {
+				members = members[:len(members)-1]
+				continue
+			}
+			if group, ok := search(i+1, nextFrom, nextUntil); ok {
+				return group, true
+			}
+			members = members[:len(members)-1]
+		}
+		return proposedGroup{}, false
+	}
+
+	return search(0, laterTime(anchor.AvailableFrom, now), anchor.AvailableUntil)
+}
+
+func compatibleWithAll(candidate queueEntry, members []queueEntry) bool {
+	for _, member := range members {
+		if !compatible(candidate, member) {
+			return false
+		}
+	}
+	return true
+}
+
+// compatible reports whether a and b can be in the same group, ignoring
+// availability, roles and languages which depend on the whole group.
+func compatible(a, b queueEntry) bool {
+	if a.UserID == b.UserID {
+		return false
+	}
+	if a.Region != "" && b.Region != "" && a.Region != b.Region {
+		return false
+	}
+	return rankAccepts(a, b) && rankAccepts(b, a)
+}
+
+// rankAccepts reports whether other's rank falls inside entry's rank window.
+// Unranked players only match entries without a window.
+func rankAccepts(entry, other queueEntry) bool {
+	if entry.MinRank == nil && entry.MaxRank == nil {
+		return true
+	}
+	if other.RankLevel == nil {
+		return false
+	}
+	if entry.MinRank != nil && *other.RankLevel < *entry.MinRank {
+		return false
+	}
+	if entry.MaxRank != nil && *other.RankLevel > *entry.MaxRank {
+		return false
+	}
+	return true
+}
+
+// rolesSatisfied reports whether every member's needed roles are filled by
+// the roles of the other members, counting duplicates.
+func rolesSatisfied(members []queueEntry) bool {
+	for i, member := range members {
+		if len(member.RolesNeeded) == 0 {
+			continue
+		}
+		available := make(map[string]int)
+		for j, other := range members {
+			if i != j && other.Role != "" {
+				available[strings.ToLower(other.Role)]++
+			}
+		}
+		for _, role := range member.RolesNeeded {
+			role = strings.ToLower(role)
+			if available[role] == 0 {
+				return false
+			}
+			available[role]--
+		}
+	}
+	return true
+}
+
+// shareLanguage reports whether all members that listed languages have at
+// least one in common.
+func shareLanguage(members []queueEntry) bool {
+	var common map[string]bool
+	for _, member := range members {
+		if len(member.Languages) == 0 {
+			continue
+		}
+		if common == nil {
+			common = make(map[string]bool)
+			for _, language := range member.Languages {
+				common[strings.ToLower(language)] = true
+			}
+			continue
+		}
+		next := make(map[string]bool)
+		for _, language := range member.Languages {
+			if common[strings.ToLower(language)] {
+				next[strings.ToLower(language)] = true
+			}
+		}
+		if len(next) == 0 {
+			return false
+		}
+		common = next
+	}
+	return true
+}
+
+func laterTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earlierTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
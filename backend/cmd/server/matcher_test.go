@@ -0,0 +1,345 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time {
+	return c.now
+}
+
+var matcherNow = time.Date(2026, 3, 14, 18, 0, 0, 0, time.UTC)
+
+func intPtr(value int) *int {
+	return &value
+}
+
+// queued returns a two-player entry for Valorant, available for the next
+// two hours and queued id minutes before now.
+func queued(id int, edit func(*queueEntry)) queueEntry {
+	entry := queueEntry{
+		ID:             id,
+		UserID:         id,
+		Game:           "Valorant",
+		GroupSize:      2,
+		AvailableFrom:  matcherNow,
+		AvailableUntil: matcherNow.Add(2 * time.Hour),
+		CreatedAt:      matcherNow.Add(-time.Duration(id) * time.Minute),
+	}
+	if edit != nil {
+		edit(&entry)
+	}
+	return entry
+}
+
+// groupIDs lists the entry ids of each group.
+func groupIDs(groups []proposedGroup) [][]int {
+	ids := [][]int{}
+	for _, group := range groups {
+		var members []int
+		for _, entry := range group.Entries {
+			members = append(members, entry.ID)
+		}
+		ids = append(ids, members)
+	}
+	return ids
+}
+
+func TestBuildGroupsFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []queueEntry
+		want    [][]int
+	}{
+		{
+			name:    "compatible pair",
+			entries: []queueEntry{queued(1, nil), queued(2, nil)},
+			want:    [][]int{{2, 1}},
+		},
+		{
+			name: "different games",
+			entries: []queueEntry{queued(1, nil), queued(2, func(e *queueEntry) {
+				e.Game = "Apex Legends"
+			})},
+			want: [][]int{},
+		},
+		{
+			name: "same user twice",
+			entries: []queueEntry{queued(1, nil), queued(2, func(e *queueEntry) {
+				e.UserID = 1
+			})},
+			want: [][]int{},
+		},
+		{
+			name: "rank inside window",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.MinRank, e.MaxRank = intPtr(3), intPtr(5) }),
+				queued(2, func(e *queueEntry) { e.RankLevel = intPtr(5) }),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "rank above window",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.MinRank, e.MaxRank = intPtr(3), intPtr(5) }),
+				queued(2, func(e *queueEntry) { e.RankLevel = intPtr(6) }),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "rank below window",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.MinRank = intPtr(3) }),
+				queued(2, func(e *queueEntry) { e.RankLevel = intPtr(2) }),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "unranked player and a window",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.MaxRank = intPtr(5) }),
+				queued(2, nil),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "window checked both ways",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.RankLevel = intPtr(8) }),
+				queued(2, func(e *queueEntry) { e.RankLevel = intPtr(4); e.MaxRank = intPtr(6) }),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "same region",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.Region = "eu" }),
+				queued(2, func(e *queueEntry) { e.Region = "eu" }),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "different regions",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.Region = "eu" }),
+				queued(2, func(e *queueEntry) { e.Region = "na" }),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "any region",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.Region = "eu" }),
+				queued(2, nil),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "needed role filled",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.RolesNeeded = []string{"Healer"} }),
+				queued(2, func(e *queueEntry) { e.Role = "healer" }),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "needed role missing",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.RolesNeeded = []string{"healer"} }),
+				queued(2, func(e *queueEntry) { e.Role = "tank" }),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "needed roles counted with duplicates",
+			entries: []queueEntry{
+				queued(4, func(e *queueEntry) { e.GroupSize = 3; e.RolesNeeded = []string{"dps", "dps"} }),
+				queued(3, func(e *queueEntry) { e.GroupSize = 3; e.Role = "dps" }),
+				queued(2, func(e *queueEntry) { e.GroupSize = 3; e.Role = "tank" }),
+				queued(1, func(e *queueEntry) { e.GroupSize = 3; e.Role = "dps" }),
+			},
+			want: [][]int{{4, 3, 1}},
+		},
+		{
+			name: "shared language",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.Languages = []string{"en", "DE"} }),
+				queued(2, func(e *queueEntry) { e.Languages = []string{"de"} }),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "no shared language",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.Languages = []string{"en"} }),
+				queued(2, func(e *queueEntry) { e.Languages = []string{"fr"} }),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "languages not listed",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.Languages = []string{"en"} }),
+				queued(2, nil),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "solo entries are ignored",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.GroupSize = 1 }),
+				queued(2, func(e *queueEntry) { e.GroupSize = 1 }),
+			},
+			want: [][]int{},
+		},
+	}
+
+	m := newMatchmaker(fakeClock{matcherNow})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := groupIDs(m.buildGroups(test.entries))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("groups = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildGroupsAvailabilityBoundary(t *testing.T) {
+	m := newMatchmaker(fakeClock{matcherNow})
+
+	tests := []struct {
+		name    string
+		entries []queueEntry
+		want    [][]int
+	}{
+		{
+			name: "ends exactly minOverlap from now",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.AvailableUntil = matcherNow.Add(m.minOverlap) }),
+				queued(2, nil),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "ends just short of minOverlap from now",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) { e.AvailableUntil = matcherNow.Add(m.minOverlap - time.Second) }),
+				queued(2, nil),
+			},
+			want: [][]int{},
+		},
+		{
+			name: "windows overlap by exactly minOverlap",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) {
+					e.AvailableFrom = matcherNow.Add(time.Hour)
+					e.AvailableUntil = matcherNow.Add(3 * time.Hour)
+				}),
+				queued(2, func(e *queueEntry) { e.AvailableUntil = matcherNow.Add(time.Hour + m.minOverlap) }),
+			},
+			want: [][]int{{2, 1}},
+		},
+		{
+			name: "windows overlap by less than minOverlap",
+			entries: []queueEntry{
+				queued(1, func(e *queueEntry) {
+					e.AvailableFrom = matcherNow.Add(time.Hour)
+					e.AvailableUntil = matcherNow.Add(3 * time.Hour)
+				}),
+				queued(2, func(e *queueEntry) { e.AvailableUntil = matcherNow.Add(time.Hour + m.minOverlap - time.Second) }),
+			},
+			want: [][]int{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := groupIDs(m.buildGroups(test.entries))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("groups = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildGroupsWindowFollowsClock(t *testing.T) {
+	entries := []queueEntry{
+		queued(1, func(e *queueEntry) { e.AvailableFrom = matcherNow.Add(-time.Hour) }),
+		queued(2, func(e *queueEntry) { e.AvailableFrom = matcherNow.Add(-2 * time.Hour) }),
+	}
+
+	groups := newMatchmaker(fakeClock{matcherNow}).buildGroups(entries)
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups))
+	}
+	if !groups[0].From.Equal(matcherNow) || !groups[0].Until.Equal(matcherNow.Add(2*time.Hour)) {
+		t.Errorf("window = %v to %v, want it to start now", groups[0].From, groups[0].Until)
+	}
+
+	// Later on, the same entries no longer overlap for long enough
+	later := newMatchmaker(fakeClock{matcherNow.Add(2 * time.Hour)}).buildGroups(entries)
+	if len(later) != 0 {
+		t.Errorf("got %d groups after the window closed, want 0", len(later))
+	}
+}
+
+func TestBuildGroupsDeterministic(t *testing.T) {
+	var entries []queueEntry
+	for id := 1; id <= 12; id++ {
+		id := id
+		entries = append(entries, queued(id, func(e *queueEntry) {
+			e.GroupSize = 2 + id%2
+			e.RankLevel = intPtr(id % 5)
+			if id%3 == 0 {
+				e.MinRank = intPtr(1)
+			}
+			if id%4 == 0 {
+				e.Region = "eu"
+			}
+		}))
+	}
+
+	m := newMatchmaker(fakeClock{matcherNow})
+	want := groupIDs(m.buildGroups(entries))
+	if len(want) == 0 {
+		t.Fatal("expected some groups")
+	}
+
+	// Input order doesn't matter, only queue order
+	for i := 0; i < 20; i++ {
+		shuffled := append([]queueEntry(nil), entries...)
+		for j := range shuffled {
+			k := (j*7 + i*5) % len(shuffled)
+			shuffled[j], shuffled[k] = shuffled[k], shuffled[j]
+		}
+		if got := groupIDs(m.buildGroups(shuffled)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: groups = %v, want %v", i, got, want)
+		}
+	}
+
+	used := make(map[int]bool)
+	for _, group := range want {
+		for _, id := range group {
+			if used[id] {
+				t.Fatalf("entry %d is in more than one group: %v", id, want)
+			}
+			used[id] = true
+		}
+	}
+}
+
+func TestBuildGroupsOldestFirst(t *testing.T) {
+	// Three compatible entries make one pair; the two queued longest win
+	entries := []queueEntry{queued(1, nil), queued(2, nil), queued(3, nil)}
+	got := groupIDs(newMatchmaker(fakeClock{matcherNow}).buildGroups(entries))
+	want := [][]int{{3, 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groups = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// proposalResponseWindow is how long players have to answer a proposal.
+	proposalResponseWindow = 10 * time.Minute
+	// maxQueueWindow bounds how far ahead a player can declare availability.
+	maxQueueWindow = 7 * 24 * time.Hour
+	// defaultQueueWindow applies when no availability is given.
+	defaultQueueWindow = 2 * time.Hour
+	maxQueueRoles      = 5
+	maxQueueLanguages  = 5
+	maxRoleLength      = 32
+	// matchmakingLockKey identifies the advisory lock that keeps two server
+	// instances from matching the same queue at once.
+	matchmakingLockKey = 7460301
+)
+
+var languageCodePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+type QueueEntry struct {
+	ID             int         `json:"id" db:"id"`
+	GameName       string      `json:"gameName" db:"game_name"`
+	GroupSize      int         `json:"groupSize" db:"group_size"`
+	MinRankLevel   *int        `json:"-" db:"min_rank"`
+	MaxRankLevel   *int        `json:"-" db:"max_rank"`
+	MinRank        string      `json:"minRank,omitempty" db:"-"`
+	MaxRank        string      `json:"maxRank,omitempty" db:"-"`
+	Region         *string     `json:"region,omitempty" db:"region"`
+	Role           string      `json:"role,omitempty" db:"role"`
+	RolesNeeded    StringArray `json:"rolesNeeded" db:"roles_needed"`
+	Languages      StringArray `json:"languages" db:"languages"`
+	AvailableFrom  time.Time   `json:"availableFrom" db:"available_from"`
+	AvailableUntil time.Time   `json:"availableUntil" db:"available_until"`
+	Status         string      `json:"status" db:"status"`
+	CreatedAt      time.Time   `json:"createdAt" db:"created_at"`
+}
+
+type MatchProposal struct {
+	ID          int                   `json:"id" db:"id"`
+	GameName    string                `json:"gameName" db:"game_name"`
+	Status      string                `json:"status" db:"status"`
+	WindowStart time.Time             `json:"windowStart" db:"window_start"`
+	WindowEnd   time.Time             `json:"windowEnd" db:"window_end"`
+	ExpiresAt   time.Time             `json:"expiresAt" db:"expires_at"`
+	CreatedAt   time.Time             `json:"createdAt" db:"created_at"`
+	Members     []MatchProposalMember `json:"members" db:"-"`
+}
+
+type MatchProposalMember struct {
+	Username string  `json:"username" db:"username"`
+	Rank     *string `json:"rank,omitempty" db:"rank"`
+	Role     string  `json:"role,omitempty" db:"role"`
+	Response string  `json:"response" db:"response"`
+}
+
+func initMatchmakingTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS matchmaking_queue (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		game_name VARCHAR(255) NOT NULL,
+		group_size INTEGER NOT NULL,
+		min_rank INTEGER,
+		max_rank INTEGER,
+		region VARCHAR(16),
+		role VARCHAR(32) NOT NULL DEFAULT '',
+		roles_needed TEXT[] NOT NULL DEFAULT '{}',
+		languages TEXT[] NOT NULL DEFAULT '{}',
+		available_from TIMESTAMPTZ NOT NULL,
+		available_until TIMESTAMPTZ NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'waiting',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS matchmaking_queue_active_idx
+		ON matchmaking_queue (user_id, game_name)
+		WHERE status IN ('waiting', 'proposed');
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS match_proposals (
+		id SERIAL PRIMARY KEY,
+		game_name VARCHAR(255) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		window_start TIMESTAMPTZ NOT NULL,
+		window_end TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS match_proposal_members (
+		proposal_id INTEGER NOT NULL REFERENCES match_proposals(id) ON DELETE CASCADE,
+		queue_entry_id INTEGER NOT NULL REFERENCES matchmaking_queue(id),
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		response VARCHAR(20) NOT NULL DEFAULT 'pending',
+		PRIMARY KEY (proposal_id, user_id)
+	);
+	`)
+	return err
+}
+
+func (e *QueueEntry) fillRankLabels() {
+	if e.MinRankLevel != nil && *e.MinRankLevel >= 0 && *e.MinRankLevel < len(rankTiers) {
+		e.MinRank = rankTiers[*e.MinRankLevel]
+	}
+	if e.MaxRankLevel != nil && *e.MaxRankLevel >= 0 && *e.MaxRankLevel < len(rankTiers) {
+		e.MaxRank = rankTiers[*e.MaxRankLevel]
+	}
+}
+
+// normalizeQueueList lower-cases and de-duplicates roles or languages,
+// keeping duplicates when keepDuplicates is set (a squad may need two of the
+// same role).
+func normalizeQueueList(values []string, max int, keepDuplicates bool, valid func(string) bool) (StringArray, bool) {
+	result := StringArray{}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" || !valid(value) {
+			return nil, false
+		}
+		if seen[value] && !keepDuplicates {
+			continue
+		}
+		seen[value] = true
+		result = append(result, value)
+	}
+	if len(result) > max {
+		return nil, false
+	}
+	return result, true
+}
+
+func validRole(role string) bool {
+	return len(role) <= maxRoleLength
+}
+
+func enqueueMatchmakingHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		GameName       string     `json:"gameName"`
+		GroupSize      int        `json:"groupSize"`
+		MinRank        string     `json:"minRank"`
+		MaxRank        string     `json:"maxRank"`
+		Region         string     `json:"region"`
+		Role           string     `json:"role"`
+		RolesNeeded    []string   `json:"rolesNeeded"`
+		Languages      []string   `json:"languages"`
+		AvailableFrom  *time.Time `json:"availableFrom"`
+		AvailableUntil *time.Time `json:"availableUntil"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	game, ok := lookupCatalogGame(requestBody.GameName)
+	if !ok {
+		http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.GroupSize == 0 {
+		requestBody.GroupSize = 2
+	}
+	if requestBody.GroupSize < 2 || requestBody.GroupSize > 5 {
+		http.Error(w, `{"error":"Group size must be between 2 and 5"}`, http.StatusBadRequest)
+		return
+	}
+
+	var minRank, maxRank *int
+	if strings.TrimSpace(requestBody.MinRank) != "" {
+		level, ok := rankLevel(requestBody.MinRank)
+		if !ok {
+			http.Error(w, `{"error":"Unknown minimum rank"}`, http.StatusBadRequest)
+			return
+		}
+		minRank = &level
+	}
+	if strings.TrimSpace(requestBody.MaxRank) != "" {
+		level, ok := rankLevel(requestBody.MaxRank)
+		if !ok {
+			http.Error(w, `{"error":"Unknown maximum rank"}`, http.StatusBadRequest)
+			return
+		}
+		maxRank = &level
+	}
+	if minRank != nil && maxRank != nil && *minRank > *maxRank {
+		http.Error(w, `{"error":"Minimum rank is above maximum rank"}`, http.StatusBadRequest)
+		return
+	}
+
+	var region *string
+	if strings.TrimSpace(requestBody.Region) != "" {
+		code, ok := lookupRegion(requestBody.Region)
+		if !ok {
+			http.Error(w, `{"error":"Unknown region"}`, http.StatusBadRequest)
+			return
+		}
+		region = &code
+	}
+
+	role := strings.ToLower(strings.TrimSpace(requestBody.Role))
+	if !validRole(role) {
+		http.Error(w, `{"error":"Role is too long"}`, http.StatusBadRequest)
+		return
+	}
+	rolesNeeded, ok := normalizeQueueList(requestBody.RolesNeeded, maxQueueRoles, true, validRole)
+	if !ok || len(rolesNeeded) > requestBody.GroupSize-1 {
+		http.Error(w, `{"error":"Invalid roles needed"}`, http.StatusBadRequest)
+		return
+	}
+	languages, ok := normalizeQueueList(requestBody.Languages, maxQueueLanguages, false, languageCodePattern.MatchString)
+	if !ok {
+		http.Error(w, `{"error":"Languages must be up to 5 language codes such as \"en\" or \"pt-br\""}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	availableFrom := now
+	if requestBody.AvailableFrom != nil {
+		availableFrom = *requestBody.AvailableFrom
+	}
+	availableUntil := availableFrom.Add(defaultQueueWindow)
+	if requestBody.AvailableUntil != nil {
+		availableUntil = *requestBody.AvailableUntil
+	}
+	if !availableUntil.After(now) || !availableUntil.After(availableFrom) || availableUntil.Sub(now) > maxQueueWindow {
+		http.Error(w, `{"error":"Availability must end after it starts, in the future and within 7 days"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Matching uses the rank from user_games, so the game must be connected
+	var connected bool
+	err = db.Get(&connected, `
+		SELECT EXISTS(SELECT 1 FROM user_games WHERE user_id = $1 AND game_name = $2)
+	`, userID, game)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !connected {
+		http.Error(w, `{"error":"Connect the game before queueing for it"}`, http.StatusBadRequest)
+		return
+	}
+
+	var entryID int
+	err = db.QueryRow(`
+		INSERT INTO matchmaking_queue (user_id, game_name, group_size, min_rank, max_rank, region,
+			role, roles_needed, languages, available_from, available_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (user_id, game_name) WHERE status IN ('waiting', 'proposed') DO NOTHING
+		RETURNING id
+	`, userID, game, requestBody.GroupSize, minRank, maxRank, region, role, rolesNeeded,
+		languages, availableFrom, availableUntil).Scan(&entryID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Already queued for this game"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error joining matchmaking queue: %v", err)
+		http.Error(w, `{"error":"Error joining queue"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var entry QueueEntry
+	err = db.Get(&entry, "SELECT "+queueEntryColumns+" FROM matchmaking_queue WHERE id = $1", entryID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	entry.fillRankLabels()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+const queueEntryColumns = `id, game_name, group_size, min_rank, max_rank, region, role,
+	roles_needed, languages, available_from, available_until, status, created_at`
+
+func listMatchmakingQueueHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	entries := []QueueEntry{}
+	err := db.Select(&entries, `
+		SELECT `+queueEntryColumns+`
+		FROM matchmaking_queue
+		WHERE user_id = (SELECT id FROM users WHERE username = $1)
+		AND status IN ('waiting', 'proposed')
+		ORDER BY created_at, id
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error listing matchmaking queue: %v", err)
+		http.Error(w, `{"error":"Error listing queue"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range entries {
+		entries[i].fillRankLabels()
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
+
+func cancelMatchmakingHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	entryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid queue entry id"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Entries already in a proposal are left alone; declining the
+	// proposal takes them out of the queue
+	result, err := db.Exec(`
+		UPDATE matchmaking_queue SET status = 'cancelled'
+		WHERE id = $1 AND user_id = (SELECT id FROM users WHERE username = $2)
+		AND status = 'waiting'
+	`, entryID, claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Error leaving queue"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No waiting queue entry of yours with that id"}`, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Left queue"})
+}
+
+func loadMatchProposal(q queryer, id int) (*MatchProposal, error) {
+	var proposal MatchProposal
+	err := q.Get(&proposal, `
+		SELECT id, game_name, status, window_start, window_end, expires_at, created_at
+		FROM match_proposals WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.Select(&proposal.Members, `
+		SELECT u.username, ug.rank, mq.role, pm.response
+		FROM match_proposal_members pm
+		JOIN users u ON u.id = pm.user_id
+		JOIN matchmaking_queue mq ON mq.id = pm.queue_entry_id
+		LEFT JOIN user_games ug ON ug.user_id = pm.user_id AND ug.game_name = mq.game_name
+		WHERE pm.proposal_id = $1
+		ORDER BY mq.created_at, mq.id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &proposal, nil
+}
+
+// queryer is satisfied by *sqlx.DB and *sqlx.Tx.
+type queryer interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+func listMatchProposalsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var ids []int
+	err := db.Select(&ids, `
+		SELECT p.id
+		FROM match_proposals p
+		JOIN match_proposal_members pm ON pm.proposal_id = p.id
+		WHERE pm.user_id = (SELECT id FROM users WHERE username = $1)
+		AND p.status = 'pending' AND p.expires_at > NOW()
+		ORDER BY p.created_at, p.id
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error listing match proposals: %v", err)
+		http.Error(w, `{"error":"Error listing proposals"}`, http.StatusInternalServerError)
+		return
+	}
+
+	proposals := []*MatchProposal{}
+	for _, id := range ids {
+		proposal, err := loadMatchProposal(db, id)
+		if err != nil {
+			log.Printf("Error loading match proposal %d: %v", id, err)
+			http.Error(w, `{"error":"Error listing proposals"}`, http.StatusInternalServerError)
+			return
+		}
+		proposals = append(proposals, proposal)
+	}
+
+	json.NewEncoder(w).Encode(proposals)
+}
+
+func respondToMatchProposal(w http.ResponseWriter, r *http.Request, accept bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	proposalID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid proposal id"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var proposal struct {
+		Status    string    `db:"status"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	err = tx.Get(&proposal, "SELECT status, expires_at FROM match_proposals WHERE id = $1 FOR UPDATE", proposalID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Proposal not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if proposal.Status != "pending" || !proposal.ExpiresAt.After(time.Now()) {
+		http.Error(w, `{"error":"Proposal is no longer pending"}`, http.StatusConflict)
+		return
+	}
+
+	response := "declined"
+	if accept {
+		response = "accepted"
+	}
+	result, err := tx.Exec(`
+		UPDATE match_proposal_members SET response = $3
+		WHERE proposal_id = $1 AND user_id = $2 AND response = 'pending'
+	`, proposalID, userID, response)
+	if err != nil {
+		http.Error(w, `{"error":"Error responding to proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"You have no pending response on this proposal"}`, http.StatusNotFound)
+		return
+	}
+
+	outcome, err := settleMatchProposal(tx, proposalID, false)
+	if err != nil {
+		log.Printf("Error settling match proposal %d: %v", proposalID, err)
+		http.Error(w, `{"error":"Error responding to proposal"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error responding to proposal"}`, http.StatusInternalServerError)
+		return
+	}
+	outcome.notify()
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"response":       response,
+		"proposalStatus": outcome.status,
+	})
+}
+
+func acceptMatchProposalHandler(w http.ResponseWriter, r *http.Request) {
+	respondToMatchProposal(w, r, true)
+}
+
+func declineMatchProposalHandler(w http.ResponseWriter, r *http.Request) {
+	respondToMatchProposal(w, r, false)
+}
+
+// proposalOutcome records who to tell once a settled proposal is committed.
+type proposalOutcome struct {
+	proposalID int
+	status     string
+	userIDs    []int
+}
+
+func (o proposalOutcome) notify() {
+	var kind string
+	switch o.status {
+	case "accepted":
+		kind = "match_confirmed"
+	case "declined", "expired":
+		kind = "match_cancelled"
+	default:
+		return
+	}
+	for _, userID := range o.userIDs {
+		notify(userID, kind, map[string]interface{}{
+			"proposalId": o.proposalID,
+			"status":     o.status,
+		})
+	}
+}
+
+// settleMatchProposal resolves a proposal from its members' responses. Once
+// everyone accepts, the group is confirmed. A decline, or expiry when
+// expired is set, cancels it: players who declined or never answered leave
+// the queue and the rest go back to waiting with their original priority.
+func settleMatchProposal(tx execQueryer, proposalID int, expired bool) (proposalOutcome, error) {
+	outcome := proposalOutcome{proposalID: proposalID, status: "pending"}
+
+	var pending, declined int
+	err := tx.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE response = 'pending'),
+			COUNT(*) FILTER (WHERE response = 'declined')
+		FROM match_proposal_members WHERE proposal_id = $1
+	`, proposalID).Scan(&pending, &declined)
+	if err != nil {
+		return outcome, err
+	}
+
+	switch {
+	case declined > 0:
+		outcome.status = "declined"
+	case pending == 0:
+		outcome.status = "accepted"
+	case expired:
+		outcome.status = "expired"
+	default:
+		return outcome, nil
+	}
+
+	_, err = tx.Exec("UPDATE match_proposals SET status = $2 WHERE id = $1", proposalID, outcome.status)
+	if err != nil {
+		return outcome, err
+	}
+
+	if outcome.status == "accepted" {
+		_, err = tx.Exec(`
+			UPDATE matchmaking_queue SET status = 'matched'
+			WHERE id IN (SELECT queue_entry_id FROM match_proposal_members WHERE proposal_id = $1)
+		`, proposalID)
+	} else {
+		_, err = tx.Exec(`
+			UPDATE matchmaking_queue mq
+			SET status = CASE WHEN pm.response = 'accepted' THEN 'waiting' ELSE 'cancelled' END
+			FROM match_proposal_members pm
+			WHERE pm.proposal_id = $1 AND mq.id = pm.queue_entry_id
+		`, proposalID)
+	}
+	if err != nil {
+		return outcome, err
+	}
+
+	rows, err := tx.Query("SELECT user_id FROM match_proposal_members WHERE proposal_id = $1 ORDER BY user_id", proposalID)
+	if err != nil {
+		return outcome, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return outcome, err
+		}
+		outcome.userIDs = append(outcome.userIDs, userID)
+	}
+	return outcome, rows.Err()
+}
+
+// startMatchmaker runs a matching pass every interval.
+func startMatchmaker(m *matchmaker, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := runMatchmakingPass(m); err != nil {
+				log.Printf("Error running matchmaking: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// runMatchmakingPass expires unanswered proposals, then proposes groups for
+// the players still waiting.
+func runMatchmakingPass(m *matchmaker) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.Get(&locked, "SELECT pg_try_advisory_xact_lock($1)", matchmakingLockKey); err != nil {
+		return err
+	}
+	if !locked {
+		// Another instance is matching right now
+		return nil
+	}
+
+	now := m.clock.Now()
+	var outcomes []proposalOutcome
+
+	var expiredIDs []int
+	err = tx.Select(&expiredIDs, `
+		SELECT id FROM match_proposals
+		WHERE status = 'pending' AND expires_at <= $1
+		ORDER BY id FOR UPDATE
+	`, now)
+	if err != nil {
+		return err
+	}
+	for _, id := range expiredIDs {
+		outcome, err := settleMatchProposal(tx, id, true)
+		if err != nil {
+			return err
+		}
+		outcomes = append(outcomes, outcome)
+	}
+
+	// Entries that can no longer fit a match window drop out of the queue
+	// before candidates are loaded. An entry exactly minOverlap from its end
+	// still fits, as in buildGroups.
+	_, err = tx.Exec(`
+		UPDATE matchmaking_queue SET status = 'expired'
+		WHERE status = 'waiting' AND available_until < $1
+	`, now.Add(m.minOverlap))
+	if err != nil {
+		return err
+	}
+
+	var rows []struct {
+		ID             int         `db:"id"`
+		UserID         int         `db:"user_id"`
+		GameName       string      `db:"game_name"`
+		GroupSize      int         `db:"group_size"`
+		Rank           *string     `db:"rank"`
+		MinRank        *int        `db:"min_rank"`
+		MaxRank        *int        `db:"max_rank"`
+		Region         *string     `db:"region"`
+		Role           string      `db:"role"`
+		RolesNeeded    StringArray `db:"roles_needed"`
+		Languages      StringArray `db:"languages"`
+		AvailableFrom  time.Time   `db:"available_from"`
+		AvailableUntil time.Time   `db:"available_until"`
+		CreatedAt      time.Time   `db:"created_at"`
+	}
+	err = tx.Select(&rows, `
+		SELECT mq.id, mq.user_id, mq.game_name, mq.group_size, ug.rank, mq.min_rank, mq.max_rank,
+			mq.region, mq.role, mq.roles_needed, mq.languages, mq.available_from,
+			mq.available_until, mq.created_at
+		FROM matchmaking_queue mq
+		JOIN user_games ug ON ug.user_id = mq.user_id AND ug.game_name = mq.game_name
+		WHERE mq.status = 'waiting'
+		ORDER BY mq.created_at, mq.id
+		FOR UPDATE OF mq
+	`)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]queueEntry, 0, len(rows))
+	for _, row := range rows {
+		entry := queueEntry{
+			ID:             row.ID,
+			UserID:         row.UserID,
+			Game:           row.GameName,
+			GroupSize:      row.GroupSize,
+			MinRank:        row.MinRank,
+			MaxRank:        row.MaxRank,
+			Role:           row.Role,
+			RolesNeeded:    row.RolesNeeded,
+			Languages:      row.Languages,
+			AvailableFrom:  row.AvailableFrom,
+			AvailableUntil: row.AvailableUntil,
+			CreatedAt:      row.CreatedAt,
+		}
+		if row.Rank != nil {
+			if level, ok := rankLevel(*row.Rank); ok {
+				entry.RankLevel = &level
+			}
+		}
+		if row.Region != nil {
+			entry.Region = *row.Region
+		}
+		entries = append(entries, entry)
+	}
+
+	type created struct {
+		proposalID int
+		userIDs    []int
+	}
+	var proposals []created
+	for _, group := range m.buildGroups(entries) {
+		var proposalID int
+		err = tx.QueryRow(`
+			INSERT INTO match_proposals (game_name, window_start, window_end, expires_at)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		`, group.Game, group.From, group.Until, now.Add(proposalResponseWindow)).Scan(&proposalID)
+		if err != nil {
+			return err
+		}
+
+		var userIDs []int
+		for _, entry := range group.Entries {
+			_, err = tx.Exec(`
+				INSERT INTO match_proposal_members (proposal_id, queue_entry_id, user_id)
+				VALUES ($1, $2, $3)
+			`, proposalID, entry.ID, entry.UserID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE matchmaking_queue SET status = 'proposed' WHERE id = $1", entry.ID)
+			if err != nil {
+				return err
+			}
+			userIDs = append(userIDs, entry.UserID)
+		}
+		proposals = append(proposals, created{proposalID, userIDs})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, outcome := range outcomes {
+		outcome.notify()
+	}
+	for _, proposal := range proposals {
+		for _, userID := range proposal.userIDs {
+			notify(userID, "match_proposed", map[string]interface{}{
+				"proposalId": proposal.proposalID,
+			})
+		}
+	}
+	if len(proposals) > 0 {
+		log.Printf("Matchmaking proposed %d group(s)", len(proposals))
+	}
+	return nil
+}
+
+// matchmakingInterval reads MATCHMAKING_INTERVAL, defaulting to 15 seconds.
+func matchmakingInterval() time.Duration {
+	if value := os.Getenv("MATCHMAKING_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		log.Printf("Invalid MATCHMAKING_INTERVAL %q, using default", value)
+	}
+	return 15 * time.Second
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxDirectMessageLength = 4000
+
+// Conversation is a 1:1 thread as seen by one of its two participants.
+type Conversation struct {
+	ID            int            `json:"id" db:"id"`
+	With          string         `json:"with" db:"with_username"`
+	LastMessage   *DirectMessage `json:"lastMessage,omitempty" db:"-"`
+	UnreadCount   int            `json:"unreadCount" db:"unread_count"`
+	LastMessageAt *time.Time     `json:"lastMessageAt,omitempty" db:"last_message_at"`
+}
+
+type DirectMessage struct {
+	ID        int64     `json:"id" db:"id"`
+	Sender    string    `json:"sender" db:"sender"`
+	Body      string    `json:"body" db:"body"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+func initMessageTables() error {
+	_, err := db.Exec(`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS allow_messages_from_anyone BOOLEAN NOT NULL DEFAULT FALSE;
+
+	CREATE TABLE IF NOT EXISTS conversations (
+		id SERIAL PRIMARY KEY,
+		user_low_id INTEGER NOT NULL REFERENCES users(id),
+		user_high_id INTEGER NOT NULL REFERENCES users(id),
+		last_message_at TIMESTAMPTZ,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_low_id, user_high_id),
+		CHECK (user_low_id < user_high_id)
+	);
+	CREATE INDEX IF NOT EXISTS conversations_user_high_id_idx ON conversations (user_high_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS direct_messages (
+		id BIGSERIAL PRIMARY KEY,
+		conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		sender_id INTEGER NOT NULL REFERENCES users(id),
+		body TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS direct_messages_conversation_id_idx ON direct_messages (conversation_id, id DESC);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// How far each participant has read, for unread counts
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS conversation_reads (
+		conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		last_read_id BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (conversation_id, user_id)
+	);
+	`)
+	return err
+}
+
+// conversationPair orders two user ids the way conversations stores them.
+func conversationPair(a, b int) (int, int) {
+	if a < b {
+		return a, b
+	}
+	return b, a
+}
+
+// messagingError is a message the sender is not allowed to send.
+type messagingError struct {
+	status  int
+	message string
+}
+
+func (e *messagingError) Error() string {
+	return e.message
+}
+
+// checkCanMessage applies the messaging rules: nobody can message someone
+// they have blocked or been blocked by, and a private account only hears
+// from mutual followers unless it has opted in to messages from anyone.
+func checkCanMessage(q queryer, senderID, recipientID int) error {
+	if senderID == recipientID {
+		return &messagingError{http.StatusBadRequest, "You cannot message yourself"}
+	}
+
+	blocked, err := isBlocked(q, senderID, recipientID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return &messagingError{http.StatusForbidden, "You can't message this user"}
+	}
+
+	var recipient struct {
+		IsPrivate bool `db:"is_private"`
+		AllowAll  bool `db:"allow_messages_from_anyone"`
+		Mutual    bool `db:"mutual"`
+	}
+	err = q.Get(&recipient, `
+		SELECT u.is_private, u.allow_messages_from_anyone,
+			EXISTS(SELECT 1 FROM followers WHERE follower_id = $1 AND following_id = $2)
+			AND EXISTS(SELECT 1 FROM followers WHERE follower_id = $2 AND following_id = $1) AS mutual
+		FROM users u WHERE u.id = $2
+	`, senderID, recipientID)
+	if err != nil {
+		return err
+	}
+	if recipient.IsPrivate && !recipient.AllowAll && !recipient.Mutual {
+		return &messagingError{http.StatusForbidden, "This account only accepts messages from mutual followers"}
+	}
+	return nil
+}
+
+// writeMessagingError responds to an error from checkCanMessage.
+func writeMessagingError(w http.ResponseWriter, err error) {
+	if merr, ok := err.(*messagingError); ok {
+		writeJSONError(w, merr.status, merr.message)
+		return
+	}
+	log.Printf("Error checking messaging permissions: %v", err)
+	http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+}
+
+// conversationWith looks up the caller's and the other user's ids from the
+// request, and their conversation id if they have one.
+func conversationWith(w http.ResponseWriter, r *http.Request) (int, int, int, bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return 0, 0, 0, false
+	}
+	otherID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return 0, 0, 0, false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, 0, 0, false
+	}
+
+	low, high := conversationPair(userID, otherID)
+	var conversationID int
+	err = db.Get(&conversationID, "SELECT id FROM conversations WHERE user_low_id = $1 AND user_high_id = $2", low, high)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, 0, 0, false
+	}
+	return userID, otherID, conversationID, true
+}
+
+// sendMessageHandler sends a direct message, starting the conversation on
+// first contact.
+func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body := strings.TrimSpace(requestBody.Body)
+	if body == "" || len(body) > maxDirectMessageLength {
+		writeJSONError(w, http.StatusBadRequest, "Message must be between 1 and "+strconv.Itoa(maxDirectMessageLength)+" characters")
+		return
+	}
+
+	userID, recipientID, _, ok := conversationWith(w, r)
+	if !ok {
+		return
+	}
+	if err := checkCanMessage(db, userID, recipientID); err != nil {
+		writeMessagingError(w, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	low, high := conversationPair(userID, recipientID)
+	var conversationID int
+	err = tx.QueryRow(`
+		INSERT INTO conversations (user_low_id, user_high_id, last_message_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (user_low_id, user_high_id) DO UPDATE SET last_message_at = NOW()
+		RETURNING id
+	`, low, high).Scan(&conversationID)
+	if err != nil {
+		log.Printf("Error starting conversation: %v", err)
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	message := DirectMessage{Sender: claims.Username, Body: body}
+	err = tx.QueryRow(`
+		INSERT INTO direct_messages (conversation_id, sender_id, body)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, conversationID, userID, body).Scan(&message.ID, &message.CreatedAt)
+	if err != nil {
+		log.Printf("Error sending message: %v", err)
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Sending a message means having read everything before it
+	_, err = tx.Exec(`
+		INSERT INTO conversation_reads (conversation_id, user_id, last_read_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET last_read_id = EXCLUDED.last_read_id
+	`, conversationID, userID, message.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error sending message"}`, http.StatusInternalServerError)
+		return
+	}
+
+	notify(recipientID, "direct_message", map[string]interface{}{
+		"conversationId": conversationID,
+		"messageId":      message.ID,
+		"from":           claims.Username,
+		"body":           body,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(message)
+}
+
+// messageHistoryHandler pages backwards through a conversation, newest
+// first. nextCursor, when present, is passed as before to get older
+// messages.
+func messageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+
+	_, _, conversationID, ok := conversationWith(w, r)
+	if !ok {
+		return
+	}
+
+	messages := []DirectMessage{}
+	if conversationID != 0 {
+		// Fetch one extra row to tell whether there is another page
+		err := db.Select(&messages, `
+			SELECT m.id, u.username AS sender, m.body, m.created_at
+			FROM direct_messages m
+			JOIN users u ON u.id = m.sender_id
+			WHERE m.conversation_id = $1 AND ($2 = 0 OR m.id < $2)
+			ORDER BY m.id DESC
+			LIMIT $3
+		`, conversationID, before, limit+1)
+		if err != nil {
+			log.Printf("Error loading messages: %v", err)
+			http.Error(w, `{"error":"Error loading messages"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := map[string]interface{}{"messages": messages}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		response["messages"] = messages
+		response["nextCursor"] = strconv.FormatInt(messages[limit-1].ID, 10)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// markConversationReadHandler marks the conversation read up to the given
+// message, or entirely if none is given.
+func markConversationReadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		MessageID int64 `json:"messageId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID, _, conversationID, ok := conversationWith(w, r)
+	if !ok {
+		return
+	}
+	if conversationID == 0 {
+		http.Error(w, `{"error":"Conversation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	// Read markers only move forward
+	_, err := db.Exec(`
+		INSERT INTO conversation_reads (conversation_id, user_id, last_read_id)
+		SELECT $1, $2, COALESCE(MAX(id), 0) FROM direct_messages
+		WHERE conversation_id = $1 AND ($3 = 0 OR id <= $3)
+		ON CONFLICT (conversation_id, user_id)
+		DO UPDATE SET last_read_id = GREATEST(conversation_reads.last_read_id, EXCLUDED.last_read_id)
+	`, conversationID, userID, requestBody.MessageID)
+	if err != nil {
+		log.Printf("Error marking conversation read: %v", err)
+		http.Error(w, `{"error":"Error marking conversation read"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Conversation marked read"})
+}
+
+// unreadCondition matches messages in c sent to $1 after their read marker.
+const unreadCondition = `
+	m.conversation_id = c.id AND m.sender_id <> $1
+	AND m.id > COALESCE((SELECT last_read_id FROM conversation_reads cr
+		WHERE cr.conversation_id = c.id AND cr.user_id = $1), 0)`
+
+// listConversationsHandler lists the caller's conversations, most recent
+// first, with the last message and unread count of each.
+func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var rows []struct {
+		Conversation
+		LastID        *int64     `db:"last_id"`
+		LastSender    *string    `db:"last_sender"`
+		LastBody      *string    `db:"last_body"`
+		LastCreatedAt *time.Time `db:"last_created_at"`
+	}
+	err = db.Select(&rows, `
+		SELECT c.id, o.username AS with_username, c.last_message_at,
+			(SELECT COUNT(*) FROM direct_messages m WHERE `+unreadCondition+`) AS unread_count,
+			last.id AS last_id, ls.username AS last_sender, last.body AS last_body, last.created_at AS last_created_at
+		FROM conversations c
+		JOIN users o ON o.id = CASE WHEN c.user_low_id = $1 THEN c.user_high_id ELSE c.user_low_id END
+		LEFT JOIN LATERAL (
+			SELECT id, sender_id, body, created_at FROM direct_messages
+			WHERE conversation_id = c.id ORDER BY id DESC LIMIT 1
+		) last ON TRUE
+		LEFT JOIN users ls ON ls.id = last.sender_id
+		WHERE c.user_low_id = $1 OR c.user_high_id = $1
+		ORDER BY c.last_message_at DESC NULLS LAST, c.id DESC
+		LIMIT $2 OFFSET $3
+	`, userID, limit, offset)
+	if err != nil {
+		log.Printf("Error listing conversations: %v", err)
+		http.Error(w, `{"error":"Error listing conversations"}`, http.StatusInternalServerError)
+		return
+	}
+
+	conversations := make([]Conversation, len(rows))
+	for i, row := range rows {
+		conversations[i] = row.Conversation
+		if row.LastID != nil {
+			conversations[i].LastMessage = &DirectMessage{
+				ID:        *row.LastID,
+				Sender:    *row.LastSender,
+				Body:      *row.LastBody,
+				CreatedAt: *row.LastCreatedAt,
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// unreadMessagesHandler returns the caller's total unread messages and how
+// many conversations they're spread over.
+func unreadMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var counts struct {
+		Messages      int `db:"messages"`
+		Conversations int `db:"conversations"`
+	}
+	err = db.Get(&counts, `
+		SELECT COALESCE(SUM(unread), 0) AS messages, COUNT(*) FILTER (WHERE unread > 0) AS conversations
+		FROM (
+			SELECT (SELECT COUNT(*) FROM direct_messages m WHERE `+unreadCondition+`) AS unread
+			FROM conversations c
+			WHERE c.user_low_id = $1 OR c.user_high_id = $1
+		) per_conversation
+	`, userID)
+	if err != nil {
+		log.Printf("Error counting unread messages: %v", err)
+		http.Error(w, `{"error":"Error counting unread messages"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]int{
+		"unreadMessages":      counts.Messages,
+		"unreadConversations": counts.Conversations,
+	})
+}
+
+// updateMessageSettingsHandler lets a private account accept messages from
+// people who aren't mutual followers.
+func updateMessageSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		AllowMessagesFromAnyone bool `json:"allowMessagesFromAnyone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("UPDATE users SET allow_messages_from_anyone = $1 WHERE username = $2",
+		requestBody.AllowMessagesFromAnyone, claims.Username)
+	if err != nil {
+		log.Printf("Error updating message settings: %v", err)
+		http.Error(w, `{"error":"Error updating message settings"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":                 "Message settings updated",
+		"allowMessagesFromAnyone": requestBody.AllowMessagesFromAnyone,
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeSocialGraph is who follows and blocks whom, and how each account
+// takes messages, for the messaging tests.
+type fakeSocialGraph struct {
+	follows  map[[2]int]bool
+	blocks   map[[2]int]bool
+	private  map[int]bool
+	allowAll map[int]bool
+}
+
+func newFakeSocialGraph() *fakeSocialGraph {
+	return &fakeSocialGraph{
+		follows:  make(map[[2]int]bool),
+		blocks:   make(map[[2]int]bool),
+		private:  make(map[int]bool),
+		allowAll: make(map[int]bool),
+	}
+}
+
+// answer registers the block and recipient lookups of checkCanMessage.
+func (g *fakeSocialGraph) answer(f *fakeDB) {
+	f.on("WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)", func(args []interface{}) fakeResult {
+		a, b := args[0].(int), args[1].(int)
+		return fakeRow("exists", g.blocks[[2]int{a, b}] || g.blocks[[2]int{b, a}])
+	})
+	f.on(`
+		EXISTS(SELECT 1 FROM followers WHERE follower_id = $1 AND following_id = $2)
+		AND EXISTS(SELECT 1 FROM followers WHERE follower_id = $2 AND following_id = $1) AS mutual
+		FROM users u WHERE u.id = $2
+	`, func(args []interface{}) fakeResult {
+		sender, recipient := args[0].(int), args[1].(int)
+		return fakeRows([]string{"is_private", "allow_messages_from_anyone", "mutual"}, []interface{}{
+			g.private[recipient], g.allowAll[recipient],
+			g.follows[[2]int{sender, recipient}] && g.follows[[2]int{recipient, sender}],
+		})
+	})
+}
+
+func TestCheckCanMessage(t *testing.T) {
+	const sender, recipient = 1, 2
+	tests := []struct {
+		name   string
+		self   bool
+		setup  func(g *fakeSocialGraph)
+		status int
+	}{
+		{name: "public account", setup: func(g *fakeSocialGraph) {}},
+		{name: "yourself", self: true, setup: func(g *fakeSocialGraph) {}, status: http.StatusBadRequest},
+		{name: "blocked by the recipient", setup: func(g *fakeSocialGraph) {
+			g.blocks[[2]int{recipient, sender}] = true
+		}, status: http.StatusForbidden},
+		{name: "blocking the recipient", setup: func(g *fakeSocialGraph) {
+			g.blocks[[2]int{sender, recipient}] = true
+		}, status: http.StatusForbidden},
+		{name: "blocked despite following each other", setup: func(g *fakeSocialGraph) {
+			g.follows[[2]int{sender, recipient}] = true
+			g.follows[[2]int{recipient, sender}] = true
+			g.blocks[[2]int{recipient, sender}] = true
+		}, status: http.StatusForbidden},
+		{name: "private account", setup: func(g *fakeSocialGraph) {
+			g.private[recipient] = true
+		}, status: http.StatusForbidden},
+		{name: "private account followed one way", setup: func(g *fakeSocialGraph) {
+			g.private[recipient] = true
+			g.follows[[2]int{sender, recipient}] = true
+		}, status: http.StatusForbidden},
+		{name: "private account, mutual followers", setup: func(g *fakeSocialGraph) {
+			g.private[recipient] = true
+			g.follows[[2]int{sender, recipient}] = true
+			g.follows[[2]int{recipient, sender}] = true
+		}},
+		{name: "private account open to anyone", setup: func(g *fakeSocialGraph) {
+			g.private[recipient] = true
+			g.allowAll[recipient] = true
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newFakeSocialGraph()
+			test.setup(g)
+			g.answer(useFakeDB(t))
+
+			to := recipient
+			if test.self {
+				to = sender
+			}
+			err := checkCanMessage(db, sender, to)
+			status := 0
+			if err != nil {
+				merr, ok := err.(*messagingError)
+				if !ok {
+					t.Fatalf("checkCanMessage error: %v", err)
+				}
+				status = merr.status
+			}
+			if status != test.status {
+				t.Errorf("checkCanMessage = %v, want status %d", err, test.status)
+			}
+		})
+	}
+}
+
+func TestSendMessageHandler(t *testing.T) {
+	userIDs := map[string]int{"ana": 1, "ben": 2}
+	for _, blocked := range []bool{false, true} {
+		f := useFakeDB(t)
+		f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+			return fakeRow("id", userIDs[args[0].(string)])
+		})
+		g := newFakeSocialGraph()
+		g.blocks[[2]int{2, 1}] = blocked
+		g.answer(f)
+		f.on("SELECT id FROM conversations WHERE user_low_id = $1 AND user_high_id = $2", func(args []interface{}) fakeResult {
+			return fakeRows([]string{"id"})
+		})
+		var sent []string
+		f.on("INSERT INTO conversations", func(args []interface{}) fakeResult {
+			return fakeRow("id", 11)
+		})
+		f.on("INSERT INTO direct_messages", func(args []interface{}) fakeResult {
+			sent = append(sent, args[2].(string))
+			return fakeRows([]string{"id", "created_at"}, []interface{}{31, time.Now()})
+		})
+		f.on("INSERT INTO conversation_reads", func(args []interface{}) fakeResult {
+			return fakeAffected(1)
+		})
+		notifications := recordNotifications(t)
+
+		r := mux.SetURLVars(testRequest("POST", "/messages/with/ben", `{"body":" gg "}`, "ana"), map[string]string{"username": "ben"})
+		w := serve(sendMessageHandler, r)
+
+		want, wantSent, wantNotified := http.StatusCreated, []string{"gg"}, []int{2}
+		if blocked {
+			want, wantSent, wantNotified = http.StatusForbidden, nil, nil
+		}
+		if w.Code != want {
+			t.Errorf("blocked %v: send = %d %s, want %d", blocked, w.Code, w.Body, want)
+		}
+		if !reflect.DeepEqual(sent, wantSent) {
+			t.Errorf("blocked %v: sent %q, want %q", blocked, sent, wantSent)
+		}
+		if got := notifications.recipients("direct_message"); !reflect.DeepEqual(got, wantNotified) {
+			t.Errorf("blocked %v: notified %v, want %v", blocked, got, wantNotified)
+		}
+	}
+}
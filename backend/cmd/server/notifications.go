@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// notificationRetention is how long read notifications are kept.
+const notificationRetention = 90 * 24 * time.Hour
+
+// notificationCategories are the groups users can mute. A notification's
+// category is the start of its type, so squad_invite is in "squad".
+var notificationCategories = []string{"follow", "chat", "collab", "community", "event", "match", "post", "squad"}
+
+// notificationCategoryOverrides names the category of types that don't
+// start with it.
+var notificationCategoryOverrides = map[string]string{
+	"new_follower": "follow",
+}
+
+// inboxSkippedTypes aren't kept in the notification center because they
+// have an inbox of their own.
+var inboxSkippedTypes = []string{"direct_message"}
+
+func notificationCategory(kind string) string {
+	if category, ok := notificationCategoryOverrides[kind]; ok {
+		return category
+	}
+	if i := strings.Index(kind, "_"); i > 0 {
+		return kind[:i]
+	}
+	return kind
+}
+
+// InboxNotification is a notification kept in the notification center.
+type InboxNotification struct {
+	ID        int64           `json:"id" db:"id"`
+	Type      string          `json:"type" db:"type"`
+	Category  string          `json:"category" db:"-"`
+	Payload   json.RawMessage `json:"payload" db:"-"`
+	RawData   string          `json:"-" db:"payload"`
+	Read      bool            `json:"read" db:"read"`
+	ReadAt    *time.Time      `json:"readAt,omitempty" db:"read_at"`
+	CreatedAt time.Time       `json:"createdAt" db:"created_at"`
+}
+
+type NotificationPreference struct {
+	Category string `json:"category"`
+	Muted    bool   `json:"muted"`
+}
+
+func initNotificationTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS notifications (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(64) NOT NULL,
+		payload JSONB NOT NULL DEFAULT '{}',
+		read_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id DESC);
+	CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS notification_mutes (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		category VARCHAR(32) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, category)
+	);
+	`)
+	return err
+}
+
+// isNotificationMuted reports whether userID has muted the category of
+// kind.
+func isNotificationMuted(q queryer, userID int, kind string) (bool, error) {
+	var muted bool
+	err := q.Get(&muted, `
+		SELECT EXISTS(SELECT 1 FROM notification_mutes WHERE user_id = $1 AND category = $2)
+	`, userID, notificationCategory(kind))
+	return muted, err
+}
+
+// notificationInbox is a notificationChannel that keeps notifications in
+// the notification center, unless the user has muted their category.
+// Muting doesn't stop live pushes, which clients rely on to stay current.
+type notificationInbox struct{}
+
+func (notificationInbox) Name() string {
+	return "inbox"
+}
+
+func (notificationInbox) Deliver(n Notification) error {
+	if containsString(inboxSkippedTypes, n.Type) {
+		return nil
+	}
+	muted, err := isNotificationMuted(db, n.UserID, n.Type)
+	if err != nil || muted {
+		return err
+	}
+
+	payload, err := json.Marshal(n.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO notifications (user_id, type, payload, created_at)
+		VALUES ($1, $2, $3, $4)
+	`, n.UserID, n.Type, string(payload), n.CreatedAt)
+	return err
+}
+
+// registerNotificationPruning drops old notifications that have been read.
+func registerNotificationPruning() {
+	registerJobPlanner(func(now time.Time) error {
+		_, err := db.Exec(`
+			DELETE FROM notifications WHERE read_at IS NOT NULL AND created_at < $1
+		`, now.Add(-notificationRetention))
+		return err
+	})
+}
+
+func unreadNotificationCount(userID int) (int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", userID)
+	return count, err
+}
+
+// publishUnreadNotifications tells the user's other open clients about a
+// change to their unread count.
+func publishUnreadNotifications(userID int) {
+	count, err := unreadNotificationCount(userID)
+	if err != nil {
+		log.Printf("Error counting unread notifications: %v", err)
+		return
+	}
+	err = realtime.publish([]int{userID}, "notifications_unread", map[string]int{"unreadCount": count})
+	if err != nil {
+		log.Printf("Error publishing unread notifications: %v", err)
+	}
+}
+
+// listNotificationsHandler pages backwards through the caller's
+// notifications, newest first. unread=true lists only unread ones.
+func listNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	notifications := []InboxNotification{}
+	err = db.Select(&notifications, `
+		SELECT id, type, payload, read_at IS NOT NULL AS read, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND ($2 = 0 OR id < $2) AND (NOT $3 OR read_at IS NULL)
+		ORDER BY id DESC
+		LIMIT $4
+	`, userID, before, unreadOnly, limit+1)
+	if err != nil {
+		log.Printf("Error listing notifications: %v", err)
+		http.Error(w, `{"error":"Error listing notifications"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range notifications {
+		notifications[i].Category = notificationCategory(notifications[i].Type)
+		notifications[i].Payload = json.RawMessage(notifications[i].RawData)
+	}
+
+	unreadCount, err := unreadNotificationCount(userID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"notifications": notifications, "unreadCount": unreadCount}
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		response["notifications"] = notifications
+		response["nextCursor"] = strconv.FormatInt(notifications[limit-1].ID, 10)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func unreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	count, err := unreadNotificationCount(userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error counting notifications"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"unreadCount": count})
+}
+
+// setNotificationRead marks the notification in the URL read or unread.
+func setNotificationRead(w http.ResponseWriter, r *http.Request, read bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	notificationID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid notification id"}`, http.StatusBadRequest)
+		return
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Marking read keeps the original read time
+	var readAt sql.NullTime
+	err = db.Get(&readAt, `
+		UPDATE notifications
+		SET read_at = CASE WHEN $3 THEN COALESCE(read_at, NOW()) ELSE NULL END
+		WHERE id = $1 AND user_id = $2
+		RETURNING read_at
+	`, notificationID, userID, read)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Notification not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error updating notification: %v", err)
+		http.Error(w, `{"error":"Error updating notification"}`, http.StatusInternalServerError)
+		return
+	}
+	publishUnreadNotifications(userID)
+
+	response := map[string]interface{}{"id": notificationID, "read": readAt.Valid}
+	if readAt.Valid {
+		response["readAt"] = readAt.Time
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	setNotificationRead(w, r, true)
+}
+
+func markNotificationUnreadHandler(w http.ResponseWriter, r *http.Request) {
+	setNotificationRead(w, r, false)
+}
+
+// markAllNotificationsReadHandler marks everything read, or everything up
+// to the given notification so ones arriving meanwhile stay unread.
+func markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Before int64 `json:"before"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE notifications SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL AND ($2 = 0 OR id <= $2)
+	`, userID, requestBody.Before)
+	if err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+		http.Error(w, `{"error":"Error marking notifications read"}`, http.StatusInternalServerError)
+		return
+	}
+	marked, _ := result.RowsAffected()
+	if marked > 0 {
+		publishUnreadNotifications(userID)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Notifications marked read",
+		"marked":  marked,
+	})
+}
+
+func loadNotificationPreferences(userID int) ([]NotificationPreference, error) {
+	var muted []string
+	if err := db.Select(&muted, "SELECT category FROM notification_mutes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	preferences := make([]NotificationPreference, len(notificationCategories))
+	for i, category := range notificationCategories {
+		preferences[i] = NotificationPreference{Category: category, Muted: containsString(muted, category)}
+	}
+	return preferences, nil
+}
+
+func getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	preferences, err := loadNotificationPreferences(userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error loading preferences"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(preferences)
+}
+
+// updateNotificationPreferencesHandler mutes or unmutes the categories in
+// the body, e.g. {"event": true, "squad": false}. Categories left out keep
+// their setting.
+func updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var muted map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&muted); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	var mute, unmute []string
+	for category, value := range muted {
+		if !containsString(notificationCategories, category) {
+			writeJSONError(w, http.StatusBadRequest, "Unknown notification category: "+category)
+			return
+		}
+		if value {
+			mute = append(mute, category)
+		} else {
+			unmute = append(unmute, category)
+		}
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO notification_mutes (user_id, category)
+		SELECT $1, UNNEST($2::TEXT[])
+		ON CONFLICT DO NOTHING
+	`, userID, pq.Array(mute))
+	if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM notification_mutes WHERE user_id = $1 AND category = ANY($2)
+		`, userID, pq.Array(unmute))
+	}
+	if err != nil {
+		log.Printf("Error updating notification preferences: %v", err)
+		http.Error(w, `{"error":"Error updating preferences"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating preferences"}`, http.StatusInternalServerError)
+		return
+	}
+
+	preferences, err := loadNotificationPreferences(userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error loading preferences"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(preferences)
+}
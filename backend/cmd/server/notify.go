@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Notification is an event addressed to a single user.
+type Notification struct {
+	UserID    int         `json:"-"`
+	Type      string      `json:"type"`
+	Payload   interface{} `json:"payload"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// notificationChannel delivers notifications through one medium. Deliver is
+// called synchronously by notify, so slow channels should hand work off.
+type notificationChannel interface {
+	Name() string
+	Deliver(n Notification) error
+}
+
+var (
+	notificationChannelsMu sync.RWMutex
+	notificationChannels   = []notificationChannel{logNotificationChannel{}}
+)
+
+// registerNotificationChannel adds a channel every later notification is
+// delivered through.
+func registerNotificationChannel(channel notificationChannel) {
+	notificationChannelsMu.Lock()
+	defer notificationChannelsMu.Unlock()
+	notificationChannels = append(notificationChannels, channel)
+}
+
+// notify sends a notification to userID through every registered channel.
+// Delivery failures are logged rather than returned so that callers never
+// fail a request because a channel is down.
+func notify(userID int, kind string, payload interface{}) {
+	n := Notification{
+		UserID:    userID,
+		Type:      kind,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	}
+
+	notificationChannelsMu.RLock()
+	channels := notificationChannels
+	notificationChannelsMu.RUnlock()
+
+	for _, channel := range channels {
+		if err := channel.Deliver(n); err != nil {
+			log.Printf("Error delivering %s notification to user %d via %s: %v", kind, userID, channel.Name(), err)
+		}
+	}
+}
+
+// logNotificationChannel records notifications in the server log.
+type logNotificationChannel struct{}
+
+func (logNotificationChannel) Name() string {
+	return "log"
+}
+
+func (logNotificationChannel) Deliver(n Notification) error {
+	log.Printf("Notification for user %d: %s", n.UserID, n.Type)
+	return nil
+}
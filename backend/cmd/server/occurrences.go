@@ -0,0 +1,677 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	// maxOccurrenceRange bounds a single expansion request.
+	maxOccurrenceRange = 366 * 24 * time.Hour
+	maxOccurrences     = 500
+	// nextOccurrenceHorizon is how far ahead the next occurrence of a
+	// recurring event is looked for.
+	nextOccurrenceHorizon = 366 * 24 * time.Hour
+)
+
+// EventOccurrence is one concrete instance of an event. OccurrenceID is the
+// original start from the recurrence rule and stays the same when the
+// occurrence is moved.
+type EventOccurrence struct {
+	EventID      int       `json:"eventId"`
+	OccurrenceID time.Time `json:"occurrenceId"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description,omitempty"`
+	StartsAt     time.Time `json:"startsAt"`
+	EndsAt       time.Time `json:"endsAt"`
+	Status       string    `json:"status"`
+	Modified     bool      `json:"modified"`
+}
+
+type eventException struct {
+	EventID         int       `db:"event_id"`
+	OccurrenceStart time.Time `db:"occurrence_start"`
+	Status          string    `db:"status"`
+	Title           *string   `db:"title"`
+	Description     *string   `db:"description"`
+	StartsAt        time.Time `db:"starts_at"`
+	EndsAt          time.Time `db:"ends_at"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
+
+// recurrence returns the event's rule and time zone, or a nil rule for
+// one-off events.
+func (e *Event) recurrence() (*recurrenceRule, *time.Location, error) {
+	if e.Recurrence == nil {
+		return nil, nil, nil
+	}
+	rule, err := parseRecurrenceRule(*e.Recurrence)
+	if err != nil {
+		return nil, nil, err
+	}
+	location, err := loadTimeZone(e.TimeZone)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rule, location, nil
+}
+
+// upcomingStart is the start of the next occurrence when known.
+func (e *Event) upcomingStart() time.Time {
+	if e.NextOccurrence != nil {
+		return e.NextOccurrence.StartsAt
+	}
+	return e.StartsAt
+}
+
+// loadEventExceptions returns the exceptions of the given events, grouped
+// by event. With a non-nil window only exceptions that can affect
+// occurrences overlapping it are loaded.
+func loadEventExceptions(eventIDs []int, window *TimeRange) (map[int][]eventException, error) {
+	byEvent := make(map[int][]eventException)
+	if len(eventIDs) == 0 {
+		return byEvent, nil
+	}
+	ids := make([]int64, len(eventIDs))
+	for i, id := range eventIDs {
+		ids[i] = int64(id)
+	}
+
+	query := `
+		SELECT event_id, occurrence_start, status, title, description, starts_at, ends_at, updated_at
+		FROM event_exceptions
+		WHERE event_id = ANY($1)`
+	args := []interface{}{pq.Array(ids)}
+	if window != nil {
+		// Either the original occurrence or the moved one may overlap
+		query += `
+		AND ((occurrence_start < $3 AND occurrence_start > $2 - $4 * INTERVAL '1 second')
+			OR (starts_at < $3 AND ends_at > $2))`
+		args = append(args, window.Start, window.End, int(maxEventDuration/time.Second))
+	}
+	query += " ORDER BY event_id, occurrence_start"
+
+	var exceptions []eventException
+	if err := db.Select(&exceptions, query, args...); err != nil {
+		return nil, err
+	}
+	for _, exception := range exceptions {
+		byEvent[exception.EventID] = append(byEvent[exception.EventID], exception)
+	}
+	return byEvent, nil
+}
+
+// expandEvent returns the event's occurrences that overlap [from, to),
+// with exceptions applied, ordered by start.
+func expandEvent(e *Event, exceptions []eventException, from, to time.Time) ([]EventOccurrence, error) {
+	duration := e.EndsAt.Sub(e.StartsAt)
+	var starts []time.Time
+	rule, location, err := e.recurrence()
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		starts = rule.occurrences(e.StartsAt, duration, location, from, to)
+	} else if e.StartsAt.Before(to) && e.EndsAt.After(from) {
+		starts = []time.Time{e.StartsAt}
+	}
+
+	byStart := make(map[int64]eventException, len(exceptions))
+	for _, exception := range exceptions {
+		byStart[exception.OccurrenceStart.Unix()] = exception
+	}
+
+	occurrences := []EventOccurrence{}
+	add := func(occurrence EventOccurrence) {
+		if occurrence.StartsAt.Before(to) && occurrence.EndsAt.After(from) {
+			occurrences = append(occurrences, occurrence)
+		}
+	}
+	for _, start := range starts {
+		occurrence := EventOccurrence{
+			EventID:      e.ID,
+			OccurrenceID: start,
+			Title:        e.Title,
+			Description:  e.Description,
+			StartsAt:     start,
+			EndsAt:       start.Add(duration),
+			Status:       e.Status,
+		}
+		if exception, ok := byStart[start.Unix()]; ok {
+			delete(byStart, start.Unix())
+			e.applyException(&occurrence, exception)
+		}
+		add(occurrence)
+	}
+	// Occurrences moved into the range from outside it
+	for _, exception := range byStart {
+		occurrence := EventOccurrence{EventID: e.ID, OccurrenceID: exception.OccurrenceStart}
+		e.applyException(&occurrence, exception)
+		add(occurrence)
+	}
+
+	sort.Slice(occurrences, func(i, j int) bool {
+		if !occurrences[i].StartsAt.Equal(occurrences[j].StartsAt) {
+			return occurrences[i].StartsAt.Before(occurrences[j].StartsAt)
+		}
+		return occurrences[i].OccurrenceID.Before(occurrences[j].OccurrenceID)
+	})
+	return occurrences, nil
+}
+
+func (e *Event) applyException(occurrence *EventOccurrence, exception eventException) {
+	occurrence.Modified = true
+	occurrence.Title = e.Title
+	if exception.Title != nil {
+		occurrence.Title = *exception.Title
+	}
+	occurrence.Description = e.Description
+	if exception.Description != nil {
+		occurrence.Description = *exception.Description
+	}
+	occurrence.StartsAt = exception.StartsAt
+	occurrence.EndsAt = exception.EndsAt
+	occurrence.Status = exception.Status
+	if e.Status == "cancelled" {
+		occurrence.Status = "cancelled"
+	}
+}
+
+// fillNextOccurrences sets NextOccurrence on recurring events to the first
+// scheduled occurrence that hasn't ended.
+func fillNextOccurrences(events []*Event) error {
+	var ids []int
+	for _, event := range events {
+		if event.Recurrence != nil {
+			ids = append(ids, event.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	window := &TimeRange{Start: now, End: now.Add(nextOccurrenceHorizon)}
+	exceptions, err := loadEventExceptions(ids, window)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if event.Recurrence == nil {
+			continue
+		}
+		occurrences, err := expandEvent(event, exceptions[event.ID], window.Start, window.End)
+		if err != nil {
+			return err
+		}
+		for i := range occurrences {
+			if occurrences[i].Status == "scheduled" {
+				event.NextOccurrence = &occurrences[i]
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// occurrenceRange reads from and to query parameters, defaulting to the
+// next 30 days.
+func occurrenceRange(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	from := time.Now()
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, `{"error":"from must be an RFC 3339 time"}`, http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+	to := from.Add(30 * 24 * time.Hour)
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, `{"error":"to must be an RFC 3339 time"}`, http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+	if !to.After(from) || to.Sub(from) > maxOccurrenceRange {
+		http.Error(w, `{"error":"to must be after from and at most a year later"}`, http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// writeOccurrences expands events over [from, to) and writes the
+// occurrences in start order.
+func writeOccurrences(w http.ResponseWriter, events []*Event, from, to time.Time) {
+	ids := make([]int, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	exceptions, err := loadEventExceptions(ids, &TimeRange{Start: from, End: to})
+	if err != nil {
+		log.Printf("Error loading event exceptions: %v", err)
+		http.Error(w, `{"error":"Error listing occurrences"}`, http.StatusInternalServerError)
+		return
+	}
+
+	occurrences := []EventOccurrence{}
+	for _, event := range events {
+		expanded, err := expandEvent(event, exceptions[event.ID], from, to)
+		if err != nil {
+			log.Printf("Error expanding event %d: %v", event.ID, err)
+			http.Error(w, `{"error":"Error listing occurrences"}`, http.StatusInternalServerError)
+			return
+		}
+		occurrences = append(occurrences, expanded...)
+	}
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartsAt.Before(occurrences[j].StartsAt)
+	})
+
+	truncated := len(occurrences) > maxOccurrences
+	if truncated {
+		occurrences = occurrences[:maxOccurrences]
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":        from,
+		"to":          to,
+		"occurrences": occurrences,
+		"truncated":   truncated,
+	})
+}
+
+// eventOccurrencesHandler expands one event over a date range.
+func eventOccurrencesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	from, to, ok := occurrenceRange(w, r)
+	if !ok {
+		return
+	}
+
+	event, err := loadEvent(db, eventID, viewerIDFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Event not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading event: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeOccurrences(w, []*Event{event}, from, to)
+}
+
+// myOccurrencesHandler is the caller's agenda: occurrences in a date range
+// of scheduled events they host or have responded to without declining.
+func myOccurrencesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from, to, ok := occurrenceRange(w, r)
+	if !ok {
+		return
+	}
+	viewerID := viewerIDFromRequest(r)
+
+	events := []*Event{}
+	err := db.Select(&events, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.status = 'scheduled'
+		AND `+eventVisibleTo("$1")+`
+		AND (e.host_id = $1 OR EXISTS(
+			SELECT 1 FROM event_rsvps r
+			WHERE r.event_id = e.id AND r.user_id = $1 AND r.status <> 'declined'))
+		AND (e.series_ends_at IS NULL OR e.series_ends_at > $2)
+		AND (e.starts_at < $3 OR EXISTS(
+			SELECT 1 FROM event_exceptions x WHERE x.event_id = e.id AND x.starts_at < $3))
+	`, viewerID, from, to)
+	if err != nil {
+		log.Printf("Error listing events: %v", err)
+		http.Error(w, `{"error":"Error listing occurrences"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeOccurrences(w, events, from, to)
+}
+
+// occurrenceInput is an edit to a single occurrence. An empty title or
+// description goes back to the series value.
+type occurrenceInput struct {
+	Title       *string    `json:"title"`
+	Description *string    `json:"description"`
+	StartsAt    *time.Time `json:"startsAt"`
+	EndsAt      *time.Time `json:"endsAt"`
+}
+
+// lockOccurrence locks a recurring event the caller hosts and checks that
+// the occurrence in the URL belongs to it.
+func lockOccurrence(w http.ResponseWriter, r *http.Request, tx queryer, hostID int) (int, *eventFields, time.Time, bool) {
+	eventID, ok := eventIDFromRequest(w, r)
+	if !ok {
+		return 0, nil, time.Time{}, false
+	}
+	occurrence, err := time.Parse(time.RFC3339, mux.Vars(r)["occurrence"])
+	if err != nil {
+		http.Error(w, `{"error":"Occurrence must be identified by its original start in RFC 3339"}`, http.StatusBadRequest)
+		return 0, nil, time.Time{}, false
+	}
+
+	fields, status, ok := lockHostedEvent(w, tx, eventID, hostID)
+	if !ok {
+		return 0, nil, time.Time{}, false
+	}
+	if status != "scheduled" {
+		http.Error(w, `{"error":"Cancelled events cannot be edited"}`, http.StatusConflict)
+		return 0, nil, time.Time{}, false
+	}
+	if fields.Recurrence == nil {
+		http.Error(w, `{"error":"Only recurring events have occurrences; edit the event instead"}`, http.StatusBadRequest)
+		return 0, nil, time.Time{}, false
+	}
+
+	rule, err := parseRecurrenceRule(*fields.Recurrence)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, nil, time.Time{}, false
+	}
+	location, err := loadTimeZone(fields.TimeZone)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, nil, time.Time{}, false
+	}
+	if !rule.includes(fields.StartsAt, location, occurrence) {
+		http.Error(w, `{"error":"Occurrence not found"}`, http.StatusNotFound)
+		return 0, nil, time.Time{}, false
+	}
+	return eventID, fields, occurrence, true
+}
+
+// loadException returns the stored exception for an occurrence, or a fresh
+// one matching the series when there is none.
+func loadException(q queryer, eventID int, fields *eventFields, occurrence time.Time) (eventException, bool, error) {
+	var exception eventException
+	err := q.Get(&exception, `
+		SELECT event_id, occurrence_start, status, title, description, starts_at, ends_at, updated_at
+		FROM event_exceptions WHERE event_id = $1 AND occurrence_start = $2
+	`, eventID, occurrence)
+	if err == sql.ErrNoRows {
+		return eventException{
+			EventID:         eventID,
+			OccurrenceStart: occurrence,
+			Status:          "scheduled",
+			StartsAt:        occurrence,
+			EndsAt:          occurrence.Add(fields.EndsAt.Sub(fields.StartsAt)),
+		}, false, nil
+	}
+	return exception, err == nil, err
+}
+
+// saveException stores an exception and bumps the event's revision so
+// calendar subscribers pick up the change.
+func saveException(tx execQueryer, exception eventException) error {
+	_, err := tx.Exec(`
+		INSERT INTO event_exceptions (event_id, occurrence_start, status, title, description, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (event_id, occurrence_start)
+		DO UPDATE SET status = EXCLUDED.status, title = EXCLUDED.title, description = EXCLUDED.description,
+			starts_at = EXCLUDED.starts_at, ends_at = EXCLUDED.ends_at, updated_at = CURRENT_TIMESTAMP
+	`, exception.EventID, exception.OccurrenceStart, exception.Status, exception.Title,
+		exception.Description, exception.StartsAt, exception.EndsAt)
+	if err != nil {
+		return err
+	}
+	return touchEventSeries(tx, exception.EventID, exception.EndsAt)
+}
+
+// touchEventSeries bumps the event's revision, extending series_ends_at
+// when an occurrence was moved past the end of a bounded series.
+func touchEventSeries(tx execQueryer, eventID int, endsAt time.Time) error {
+	_, err := tx.Exec(`
+		UPDATE events
+		SET series_ends_at = CASE WHEN series_ends_at IS NULL THEN NULL ELSE GREATEST(series_ends_at, $2) END,
+			updated_at = CURRENT_TIMESTAMP, sequence = sequence + 1
+		WHERE id = $1
+	`, eventID, endsAt)
+	return err
+}
+
+// occurrenceChanged commits tx and tells attendees about the change.
+func occurrenceChanged(w http.ResponseWriter, tx *sqlx.Tx, eventID int, occurrence time.Time, kind string) bool {
+	attendeeIDs, err := eventAttendeeIDs(tx, eventID)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating occurrence"}`, http.StatusInternalServerError)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating occurrence"}`, http.StatusInternalServerError)
+		return false
+	}
+	for _, userID := range attendeeIDs {
+		notify(userID, kind, map[string]interface{}{
+			"eventId":    eventID,
+			"occurrence": occurrence,
+		})
+	}
+	return true
+}
+
+// writeOccurrence responds with the current state of one occurrence.
+func writeOccurrence(w http.ResponseWriter, eventID, viewerID int, occurrence time.Time) {
+	event, err := loadEvent(db, eventID, viewerID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	exceptions, err := loadEventExceptions([]int{eventID}, nil)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, exception := range exceptions[eventID] {
+		if exception.OccurrenceStart.Equal(occurrence) {
+			result := EventOccurrence{EventID: eventID, OccurrenceID: occurrence}
+			event.applyException(&result, exception)
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(EventOccurrence{
+		EventID:      eventID,
+		OccurrenceID: occurrence,
+		Title:        event.Title,
+		Description:  event.Description,
+		StartsAt:     occurrence,
+		EndsAt:       occurrence.Add(event.EndsAt.Sub(event.StartsAt)),
+		Status:       event.Status,
+	})
+}
+
+func updateOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input occurrenceInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	eventID, fields, occurrence, ok := lockOccurrence(w, r, tx, hostID)
+	if !ok {
+		return
+	}
+	exception, _, err := loadException(tx, eventID, fields, occurrence)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if exception.Status == "cancelled" {
+		http.Error(w, `{"error":"Occurrence is cancelled; restore it before editing"}`, http.StatusConflict)
+		return
+	}
+
+	if input.Title != nil {
+		title := strings.TrimSpace(*input.Title)
+		if len(title) > maxEventTitleLength {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Title must be at most %d characters", maxEventTitleLength))
+			return
+		}
+		exception.Title = nil
+		if title != "" {
+			exception.Title = &title
+		}
+	}
+	if input.Description != nil {
+		description := strings.TrimSpace(*input.Description)
+		if len(description) > maxEventDescriptionLength {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Description must be at most %d characters", maxEventDescriptionLength))
+			return
+		}
+		exception.Description = nil
+		if description != "" {
+			exception.Description = &description
+		}
+	}
+	if input.StartsAt != nil {
+		exception.StartsAt = *input.StartsAt
+	}
+	if input.EndsAt != nil {
+		exception.EndsAt = *input.EndsAt
+	}
+	if !exception.EndsAt.After(exception.StartsAt) {
+		http.Error(w, `{"error":"Event must end after it starts"}`, http.StatusBadRequest)
+		return
+	}
+	if exception.EndsAt.Sub(exception.StartsAt) > maxEventDuration {
+		http.Error(w, `{"error":"Events can last at most 48 hours"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := saveException(tx, exception); err != nil {
+		log.Printf("Error saving occurrence: %v", err)
+		http.Error(w, `{"error":"Error updating occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+	if !occurrenceChanged(w, tx, eventID, occurrence, "event_occurrence_updated") {
+		return
+	}
+	writeOccurrence(w, eventID, hostID, occurrence)
+}
+
+func cancelOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	eventID, fields, occurrence, ok := lockOccurrence(w, r, tx, hostID)
+	if !ok {
+		return
+	}
+	exception, _, err := loadException(tx, eventID, fields, occurrence)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if exception.Status == "cancelled" {
+		http.Error(w, `{"error":"Occurrence is already cancelled"}`, http.StatusConflict)
+		return
+	}
+
+	exception.Status = "cancelled"
+	if err := saveException(tx, exception); err != nil {
+		log.Printf("Error cancelling occurrence: %v", err)
+		http.Error(w, `{"error":"Error updating occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+	if !occurrenceChanged(w, tx, eventID, occurrence, "event_occurrence_cancelled") {
+		return
+	}
+	writeOccurrence(w, eventID, hostID, occurrence)
+}
+
+// restoreOccurrenceHandler drops an occurrence's edits or cancellation so
+// it follows the series again.
+func restoreOccurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	hostID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	eventID, fields, occurrence, ok := lockOccurrence(w, r, tx, hostID)
+	if !ok {
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM event_exceptions WHERE event_id = $1 AND occurrence_start = $2", eventID, occurrence)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"Occurrence already follows the series"}`, http.StatusConflict)
+		return
+	}
+	if err := touchEventSeries(tx, eventID, occurrence.Add(fields.EndsAt.Sub(fields.StartsAt))); err != nil {
+		http.Error(w, `{"error":"Error updating occurrence"}`, http.StatusInternalServerError)
+		return
+	}
+	if !occurrenceChanged(w, tx, eventID, occurrence, "event_occurrence_updated") {
+		return
+	}
+	writeOccurrence(w, eventID, hostID, occurrence)
+}
@@ -0,0 +1,837 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxPostLength     = 2000
+	maxPostMedia      = 4
+	maxMediaURLLength = 2048
+	maxCommentLength  = 1000
+	// postExcerptLength is how much of a post its feed activity carries.
+	postExcerptLength = 140
+)
+
+// Post is an update on a user's profile, such as a clip, a highlight or a
+// call for teammates.
+type Post struct {
+	ID           int            `json:"id" db:"id"`
+	Author       string         `json:"author" db:"author"`
+	Body         string         `json:"body" db:"body"`
+	MediaURLs    pq.StringArray `json:"mediaUrls" db:"media_urls"`
+	GameName     *string        `json:"gameName,omitempty" db:"game_name"`
+	LikeCount    int            `json:"likeCount" db:"like_count"`
+	CommentCount int            `json:"commentCount" db:"comment_count"`
+	Liked        bool           `json:"liked" db:"liked"`
+	CreatedAt    time.Time      `json:"createdAt" db:"created_at"`
+	EditedAt     *time.Time     `json:"editedAt,omitempty" db:"edited_at"`
+}
+
+// PostEdit is an earlier version of a post, replaced at EditedAt.
+type PostEdit struct {
+	Body      string         `json:"body" db:"body"`
+	MediaURLs pq.StringArray `json:"mediaUrls" db:"media_urls"`
+	GameName  *string        `json:"gameName,omitempty" db:"game_name"`
+	EditedAt  time.Time      `json:"editedAt" db:"edited_at"`
+}
+
+// PostComment is a comment on a post. Replies are nested under the comment
+// they answer; deleted comments keep their place in the thread without
+// their author or body.
+type PostComment struct {
+	ID        int            `json:"id" db:"id"`
+	ParentID  *int           `json:"parentId,omitempty" db:"parent_id"`
+	Author    *string        `json:"author" db:"author"`
+	Body      string         `json:"body" db:"body"`
+	Deleted   bool           `json:"deleted" db:"deleted"`
+	CreatedAt time.Time      `json:"createdAt" db:"created_at"`
+	Replies   []*PostComment `json:"replies" db:"-"`
+}
+
+// postColumns selects posts p by authors a, with the likes of the viewer
+// whose id is bound to param.
+func postColumns(param string) string {
+	return `p.id, a.username AS author, p.body, p.media_urls, p.game_name,
+	(SELECT COUNT(*) FROM post_likes l WHERE l.post_id = p.id) AS like_count,
+	(SELECT COUNT(*) FROM post_comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL) AS comment_count,
+	EXISTS(SELECT 1 FROM post_likes l WHERE l.post_id = p.id AND l.user_id = ` + param + `) AS liked,
+	p.created_at, p.edited_at
+	FROM posts p
+	JOIN users a ON a.id = p.user_id`
+}
+
+// postVisibleTo returns a condition on posts p by authors a that holds when
+// the user whose id is bound to param may see the post. Like the rest of a
+// profile, a private account's posts are limited to its followers, and
+// blocks hide posts both ways. Anonymous viewers use 0.
+func postVisibleTo(param string) string {
+	return `(p.user_id = ` + param + ` OR (
+		NOT EXISTS(
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = ` + param + ` AND b.blocked_id = p.user_id)
+			OR (b.blocker_id = p.user_id AND b.blocked_id = ` + param + `))
+		AND (NOT a.is_private OR EXISTS(
+			SELECT 1 FROM followers f WHERE f.follower_id = ` + param + ` AND f.following_id = p.user_id))))`
+}
+
+// commentVisibleTo returns a condition on comments c that holds unless
+// the comment's author and the user whose id is bound to param have
+// blocked one another, as with posts.
+func commentVisibleTo(param string) string {
+	return `NOT EXISTS(
+		SELECT 1 FROM user_blocks b
+		WHERE (b.blocker_id = ` + param + ` AND b.blocked_id = c.user_id)
+		OR (b.blocker_id = c.user_id AND b.blocked_id = ` + param + `))`
+}
+
+func initPostTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS posts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		body TEXT NOT NULL DEFAULT '',
+		media_urls TEXT[] NOT NULL DEFAULT '{}',
+		game_name VARCHAR(255),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		edited_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS posts_user_id_id_idx ON posts (user_id, id DESC);
+
+	CREATE TABLE IF NOT EXISTS post_edits (
+		id SERIAL PRIMARY KEY,
+		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		media_urls TEXT[] NOT NULL,
+		game_name VARCHAR(255),
+		edited_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS post_edits_post_id_idx ON post_edits (post_id);
+
+	CREATE TABLE IF NOT EXISTS post_likes (
+		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (post_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS post_comments (
+		id SERIAL PRIMARY KEY,
+		post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		parent_id INTEGER REFERENCES post_comments(id) ON DELETE CASCADE,
+		root_id INTEGER REFERENCES post_comments(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		deleted_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS post_comments_post_id_idx ON post_comments (post_id, id DESC) WHERE parent_id IS NULL;
+	CREATE INDEX IF NOT EXISTS post_comments_root_id_idx ON post_comments (root_id);
+	`)
+	return err
+}
+
+// postInput is the body of a create or edit request.
+type postInput struct {
+	Body      string   `json:"body"`
+	MediaURLs []string `json:"mediaUrls"`
+	GameName  string   `json:"gameName"`
+}
+
+// postFields are the validated contents of a post.
+type postFields struct {
+	Body      string
+	MediaURLs []string
+	GameName  *string
+}
+
+func (input postInput) validate() (*postFields, error) {
+	fields := postFields{Body: strings.TrimSpace(input.Body), MediaURLs: []string{}}
+	if utf8.RuneCountInString(fields.Body) > maxPostLength {
+		return nil, fmt.Errorf("Posts must be at most %d characters", maxPostLength)
+	}
+
+	if len(input.MediaURLs) > maxPostMedia {
+		return nil, fmt.Errorf("Posts can have at most %d media links", maxPostMedia)
+	}
+	for _, link := range input.MediaURLs {
+		link = strings.TrimSpace(link)
+		parsed, err := url.Parse(link)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || len(link) > maxMediaURLLength {
+			return nil, fmt.Errorf("Media links must be http or https URLs")
+		}
+		fields.MediaURLs = append(fields.MediaURLs, link)
+	}
+
+	if fields.Body == "" && len(fields.MediaURLs) == 0 {
+		return nil, fmt.Errorf("Posts need text or media")
+	}
+
+	if strings.TrimSpace(input.GameName) != "" {
+		game, ok := lookupCatalogGame(input.GameName)
+		if !ok {
+			return nil, fmt.Errorf("Unknown game")
+		}
+		fields.GameName = &game
+	}
+	return &fields, nil
+}
+
+// postedActivity is the payload of a posted activity.
+func (f *postFields) postedActivity(postID int) map[string]interface{} {
+	return map[string]interface{}{
+		"postId":     postID,
+		"excerpt":    postExcerpt(f.Body),
+		"mediaCount": len(f.MediaURLs),
+	}
+}
+
+// postExcerpt shortens a post's text for its feed activity.
+func postExcerpt(body string) string {
+	if utf8.RuneCountInString(body) <= postExcerptLength {
+		return body
+	}
+	return string([]rune(body)[:postExcerptLength-1]) + "…"
+}
+
+func postIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid post id"}`, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// loadPost returns a post if viewerID may see it, and sql.ErrNoRows
+// otherwise.
+func loadPost(q queryer, postID, viewerID int) (*Post, error) {
+	var post Post
+	err := q.Get(&post, `
+		SELECT `+postColumns("$2")+`
+		WHERE p.id = $1 AND `+postVisibleTo("$2"), postID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// visiblePostAuthor returns the author of a post viewerID may see, writing
+// an error response if there is none.
+func visiblePostAuthor(w http.ResponseWriter, postID, viewerID int) (int, bool) {
+	var authorID int
+	err := db.Get(&authorID, `
+		SELECT p.user_id FROM posts p JOIN users a ON a.id = p.user_id
+		WHERE p.id = $1 AND `+postVisibleTo("$2"), postID, viewerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, false
+	}
+	return authorID, true
+}
+
+func createPostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input postInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	fields, err := input.validate()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var postID int
+	err = db.QueryRow(`
+		INSERT INTO posts (user_id, body, media_urls, game_name)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, fields.Body, pq.Array(fields.MediaURLs), fields.GameName).Scan(&postID)
+	if err != nil {
+		log.Printf("Error creating post: %v", err)
+		http.Error(w, `{"error":"Error creating post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	recordActivity(userID, "posted", &postID, fields.GameName, fields.postedActivity(postID))
+
+	post, err := loadPost(db, postID, userID)
+	if err != nil {
+		log.Printf("Error loading post: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(post)
+}
+
+func getPostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	post, err := loadPost(db, postID, viewerIDFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading post: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(post)
+}
+
+// userPostsHandler lists a user's posts, newest first, as far as the
+// viewer may see them. Pages are taken with the nextCursor of the
+// previous one as before.
+func userPostsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	before := 0
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+
+	authorID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	posts := []Post{}
+	err = db.Select(&posts, `
+		SELECT `+postColumns("$2")+`
+		WHERE p.user_id = $1 AND ($3 = 0 OR p.id < $3) AND `+postVisibleTo("$2")+`
+		ORDER BY p.id DESC
+		LIMIT $4
+	`, authorID, viewerIDFromRequest(r), before, limit+1)
+	if err != nil {
+		log.Printf("Error listing posts: %v", err)
+		http.Error(w, `{"error":"Error listing posts"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"posts": posts}
+	if len(posts) > limit {
+		posts = posts[:limit]
+		response["posts"] = posts
+		response["nextCursor"] = strconv.Itoa(posts[limit-1].ID)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// updatePostHandler edits the caller's post, keeping the version it
+// replaces in the post's history.
+func updatePostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var input postInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	fields, err := input.validate()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var current struct {
+		UserID int `db:"user_id"`
+		PostEdit
+	}
+	err = tx.Get(&current, `
+		SELECT user_id, body, media_urls, game_name
+		FROM posts WHERE id = $1 FOR UPDATE
+	`, postID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if current.UserID != userID {
+		http.Error(w, `{"error":"You can only edit your own posts"}`, http.StatusForbidden)
+		return
+	}
+
+	changed := current.Body != fields.Body || !equalStringPointers(current.GameName, fields.GameName) ||
+		len(current.MediaURLs) != len(fields.MediaURLs)
+	for i := 0; !changed && i < len(fields.MediaURLs); i++ {
+		changed = current.MediaURLs[i] != fields.MediaURLs[i]
+	}
+
+	if changed {
+		_, err = tx.Exec(`
+			INSERT INTO post_edits (post_id, body, media_urls, game_name)
+			VALUES ($1, $2, $3, $4)
+		`, postID, current.Body, current.MediaURLs, current.GameName)
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE posts SET body = $2, media_urls = $3, game_name = $4, edited_at = NOW()
+				WHERE id = $1
+			`, postID, fields.Body, pq.Array(fields.MediaURLs), fields.GameName)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error editing post: %v", err)
+			http.Error(w, `{"error":"Error editing post"}`, http.StatusInternalServerError)
+			return
+		}
+		updateActivity(userID, "posted", postID, fields.GameName, fields.postedActivity(postID))
+	}
+
+	post, err := loadPost(db, postID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(post)
+}
+
+func deletePostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM posts WHERE id = $1 AND user_id = $2", postID, userID)
+	if err != nil {
+		log.Printf("Error deleting post: %v", err)
+		http.Error(w, `{"error":"Error deleting post"}`, http.StatusInternalServerError)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		http.Error(w, `{"error":"Post not found"}`, http.StatusNotFound)
+		return
+	}
+	removeActivity(userID, "posted", &postID, nil)
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Post deleted"})
+}
+
+// postHistoryHandler lists the earlier versions of a post, most recent
+// first.
+func postHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := visiblePostAuthor(w, postID, viewerIDFromRequest(r)); !ok {
+		return
+	}
+
+	edits := []PostEdit{}
+	err := db.Select(&edits, `
+		SELECT body, media_urls, game_name, edited_at
+		FROM post_edits
+		WHERE post_id = $1
+		ORDER BY id DESC
+	`, postID)
+	if err != nil {
+		log.Printf("Error loading post history: %v", err)
+		http.Error(w, `{"error":"Error loading post history"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(edits)
+}
+
+func likePostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	authorID, ok := visiblePostAuthor(w, postID, userID)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO post_likes (post_id, user_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, postID, userID)
+	if err != nil {
+		log.Printf("Error liking post: %v", err)
+		http.Error(w, `{"error":"Error liking post"}`, http.StatusInternalServerError)
+		return
+	}
+	if liked, _ := result.RowsAffected(); liked > 0 && authorID != userID {
+		notify(authorID, "post_liked", map[string]interface{}{"postId": postID, "from": claims.Username})
+	}
+
+	writePostLikes(w, postID, true)
+}
+
+func unlikePostHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	if _, ok := visiblePostAuthor(w, postID, userID); !ok {
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM post_likes WHERE post_id = $1 AND user_id = $2", postID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error unliking post"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writePostLikes(w, postID, false)
+}
+
+func writePostLikes(w http.ResponseWriter, postID int, liked bool) {
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM post_likes WHERE post_id = $1", postID); err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"liked": liked, "likeCount": count})
+}
+
+// listPostCommentsHandler serves a page of a post's top-level comments,
+// newest first, each with its whole thread of replies oldest first.
+func listPostCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	before := 0
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+
+	viewerID := viewerIDFromRequest(r)
+	if _, ok := visiblePostAuthor(w, postID, viewerID); !ok {
+		return
+	}
+
+	const commentColumns = `
+		c.id, c.parent_id,
+		CASE WHEN c.deleted_at IS NULL THEN u.username END AS author,
+		CASE WHEN c.deleted_at IS NULL THEN c.body ELSE '' END AS body,
+		c.deleted_at IS NOT NULL AS deleted, c.created_at
+		FROM post_comments c
+		JOIN users u ON u.id = c.user_id`
+
+	roots := []*PostComment{}
+	err := db.Select(&roots, `
+		SELECT `+commentColumns+`
+		WHERE c.post_id = $1 AND c.parent_id IS NULL AND ($2 = 0 OR c.id < $2)
+		AND `+commentVisibleTo("$4")+`
+		ORDER BY c.id DESC
+		LIMIT $3
+	`, postID, before, limit+1, viewerID)
+	if err != nil {
+		log.Printf("Error listing comments: %v", err)
+		http.Error(w, `{"error":"Error listing comments"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{}
+	if len(roots) > limit {
+		roots = roots[:limit]
+		response["nextCursor"] = strconv.Itoa(roots[limit-1].ID)
+	}
+	response["comments"] = roots
+
+	rootIDs := make([]int, len(roots))
+	byID := make(map[int]*PostComment, len(roots))
+	for i, root := range roots {
+		root.Replies = []*PostComment{}
+		rootIDs[i] = root.ID
+		byID[root.ID] = root
+	}
+
+	replies := []*PostComment{}
+	err = db.Select(&replies, `
+		SELECT `+commentColumns+`
+		WHERE c.root_id = ANY($1) AND `+commentVisibleTo("$2")+`
+		ORDER BY c.id
+	`, pq.Array(rootIDs), viewerID)
+	if err != nil {
+		log.Printf("Error listing replies: %v", err)
+		http.Error(w, `{"error":"Error listing comments"}`, http.StatusInternalServerError)
+		return
+	}
+	// Replies come after what they answer, so parents are always placed
+	// before their children. Replies to hidden comments have no parent here
+	// and are left out with them.
+	for _, reply := range replies {
+		reply.Replies = []*PostComment{}
+		byID[reply.ID] = reply
+		if parent, ok := byID[*reply.ParentID]; ok {
+			parent.Replies = append(parent.Replies, reply)
+		}
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// createPostCommentHandler comments on a post, or replies to one of its
+// comments when parentId is given.
+func createPostCommentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Body     string `json:"body"`
+		ParentID *int   `json:"parentId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	body := strings.TrimSpace(requestBody.Body)
+	if body == "" {
+		http.Error(w, `{"error":"Comment cannot be empty"}`, http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Comments must be at most %d characters", maxCommentLength))
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	authorID, ok := visiblePostAuthor(w, postID, userID)
+	if !ok {
+		return
+	}
+
+	// A reply belongs to the thread of the top-level comment it's under
+	var rootID *int
+	var parentAuthorID int
+	if requestBody.ParentID != nil {
+		var parent struct {
+			UserID int  `db:"user_id"`
+			RootID *int `db:"root_id"`
+		}
+		err := db.Get(&parent, `
+			SELECT user_id, root_id FROM post_comments
+			WHERE id = $1 AND post_id = $2 AND deleted_at IS NULL
+		`, *requestBody.ParentID, postID)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Comment not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		rootID = requestBody.ParentID
+		if parent.RootID != nil {
+			rootID = parent.RootID
+		}
+		parentAuthorID = parent.UserID
+	}
+
+	comment := PostComment{
+		ParentID: requestBody.ParentID,
+		Author:   &claims.Username,
+		Body:     body,
+		Replies:  []*PostComment{},
+	}
+	err = db.QueryRow(`
+		INSERT INTO post_comments (post_id, user_id, parent_id, root_id, body)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, postID, userID, requestBody.ParentID, rootID, body).Scan(&comment.ID, &comment.CreatedAt)
+	if err != nil {
+		log.Printf("Error creating comment: %v", err)
+		http.Error(w, `{"error":"Error creating comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	payload := map[string]interface{}{"postId": postID, "commentId": comment.ID, "from": claims.Username}
+	if authorID != userID {
+		notify(authorID, "post_comment", payload)
+	}
+	if parentAuthorID != 0 && parentAuthorID != userID && parentAuthorID != authorID {
+		notify(parentAuthorID, "post_reply", payload)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// deletePostCommentHandler deletes a comment; its author and the post's
+// author may. Replies to it stay in the thread.
+func deletePostCommentHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, ok := postIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	commentID, err := strconv.Atoi(mux.Vars(r)["commentId"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid comment id"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var owners struct {
+		CommentAuthorID int `db:"comment_author_id"`
+		PostAuthorID    int `db:"post_author_id"`
+	}
+	err = db.Get(&owners, `
+		SELECT c.user_id AS comment_author_id, p.user_id AS post_author_id
+		FROM post_comments c
+		JOIN posts p ON p.id = c.post_id
+		WHERE c.id = $1 AND c.post_id = $2 AND c.deleted_at IS NULL
+	`, commentID, postID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Comment not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if owners.CommentAuthorID != userID && owners.PostAuthorID != userID {
+		http.Error(w, `{"error":"You cannot delete this comment"}`, http.StatusForbidden)
+		return
+	}
+
+	_, err = db.Exec("UPDATE post_comments SET deleted_at = NOW() WHERE id = $1", commentID)
+	if err != nil {
+		log.Printf("Error deleting comment: %v", err)
+		http.Error(w, `{"error":"Error deleting comment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted"})
+}
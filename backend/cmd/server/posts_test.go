@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// postAudienceIDs are the users of the post visibility tests: the author,
+// a follower of theirs, a stranger and someone the author has blocked who
+// still follows them.
+var postAudienceIDs = map[string]int{"author": 2, "follower": 3, "stranger": 4, "blocked": 5}
+
+// useFakePost answers lookups of post 1, by "author", whose account is
+// private or not.
+func useFakePost(f *fakeDB, private bool) {
+	f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRow("id", postAudienceIDs[args[0].(string)])
+	})
+	canSee := func(viewerID int) bool {
+		switch viewerID {
+		case postAudienceIDs["author"]:
+			return true
+		case postAudienceIDs["blocked"]:
+			return false
+		case postAudienceIDs["follower"]:
+			return true
+		}
+		return !private
+	}
+	f.on("SELECT p.user_id FROM posts p JOIN users a ON a.id = p.user_id WHERE p.id = $1 AND "+postVisibleTo("$2"), func(args []interface{}) fakeResult {
+		if !canSee(args[1].(int)) {
+			return fakeRows([]string{"user_id"})
+		}
+		return fakeRow("user_id", postAudienceIDs["author"])
+	})
+	f.on("WHERE p.id = $1 AND "+postVisibleTo("$2"), func(args []interface{}) fakeResult {
+		columns := []string{"id", "author", "body", "media_urls", "game_name", "like_count",
+			"comment_count", "liked", "created_at", "edited_at"}
+		if !canSee(args[1].(int)) {
+			return fakeRows(columns)
+		}
+		return fakeRows(columns, []interface{}{1, "author", "Clutch 1v4", nil, nil, 0, 0, false, time.Now(), nil})
+	})
+}
+
+func TestGetPostVisibility(t *testing.T) {
+	tests := []struct {
+		private bool
+		viewer  string
+		want    int
+	}{
+		{false, "", http.StatusOK},
+		{false, "stranger", http.StatusOK},
+		{false, "blocked", http.StatusNotFound},
+		{true, "", http.StatusNotFound},
+		{true, "stranger", http.StatusNotFound},
+		{true, "follower", http.StatusOK},
+		{true, "author", http.StatusOK},
+		{true, "blocked", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		useFakePost(useFakeDB(t), test.private)
+
+		r := mux.SetURLVars(testRequest("GET", "/posts/1", "", test.viewer), map[string]string{"id": "1"})
+		if w := serve(getPostHandler, r); w.Code != test.want {
+			t.Errorf("private %v, viewer %q: get = %d %s, want %d", test.private, test.viewer, w.Code, w.Body, test.want)
+		}
+	}
+}
+
+func TestLikesNeedAVisiblePost(t *testing.T) {
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		viewer  string
+		want    int
+	}{
+		{likePostHandler, "POST", "follower", http.StatusOK},
+		{likePostHandler, "POST", "stranger", http.StatusNotFound},
+		{likePostHandler, "POST", "blocked", http.StatusNotFound},
+		{unlikePostHandler, "DELETE", "follower", http.StatusOK},
+		{unlikePostHandler, "DELETE", "stranger", http.StatusNotFound},
+		{unlikePostHandler, "DELETE", "blocked", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		f := useFakeDB(t)
+		useFakePost(f, true)
+		var changed bool
+		f.on("INSERT INTO post_likes", func(args []interface{}) fakeResult {
+			changed = true
+			return fakeAffected(1)
+		})
+		f.on("DELETE FROM post_likes WHERE post_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+			changed = true
+			return fakeAffected(1)
+		})
+		f.on("SELECT COUNT(*) FROM post_likes WHERE post_id = $1", func(args []interface{}) fakeResult {
+			return fakeRow("count", 1)
+		})
+		notifications := recordNotifications(t)
+
+		r := mux.SetURLVars(testRequest(test.method, "/posts/1/like", "", test.viewer), map[string]string{"id": "1"})
+		w := serve(test.handler, r)
+		if w.Code != test.want {
+			t.Errorf("%s as %s = %d %s, want %d", test.method, test.viewer, w.Code, w.Body, test.want)
+		}
+		if changed != (test.want == http.StatusOK) {
+			t.Errorf("%s as %s changed likes: %v", test.method, test.viewer, changed)
+		}
+		var wantNotified []int
+		if test.method == "POST" && test.want == http.StatusOK {
+			wantNotified = []int{postAudienceIDs["author"]}
+		}
+		if got := notifications.recipients("post_liked"); !reflect.DeepEqual(got, wantNotified) {
+			t.Errorf("%s as %s notified %v, want %v", test.method, test.viewer, got, wantNotified)
+		}
+	}
+}
+
+func TestListPostCommentsHidesBlockedAuthors(t *testing.T) {
+	// Comment 11 and reply 12 are by someone the stranger has blocked;
+	// reply 13 answers 12, so it goes with it
+	const blockedCommenter = 6
+	type comment struct {
+		id, parentID, authorID int
+	}
+	roots := []comment{{11, 0, blockedCommenter}, {10, 0, postAudienceIDs["follower"]}}
+	replies := []comment{
+		{12, 10, blockedCommenter},
+		{13, 12, postAudienceIDs["follower"]},
+		{14, 10, postAudienceIDs["author"]},
+	}
+	visible := func(c comment, viewerID int) bool {
+		return !(c.authorID == blockedCommenter && viewerID == postAudienceIDs["stranger"])
+	}
+	rows := func(comments []comment, viewerID int) fakeResult {
+		var rows [][]interface{}
+		for _, c := range comments {
+			if !visible(c, viewerID) {
+				continue
+			}
+			var parentID interface{}
+			if c.parentID != 0 {
+				parentID = c.parentID
+			}
+			rows = append(rows, []interface{}{c.id, parentID, "someone", "gg", false, time.Now()})
+		}
+		return fakeRows([]string{"id", "parent_id", "author", "body", "deleted", "created_at"}, rows...)
+	}
+
+	tests := []struct {
+		viewer string
+		want   map[int][]int
+	}{
+		{"", map[int][]int{11: {}, 10: {12, 14}, 12: {13}, 13: {}, 14: {}}},
+		{"stranger", map[int][]int{10: {14}, 14: {}}},
+	}
+	for _, test := range tests {
+		f := useFakeDB(t)
+		useFakePost(f, false)
+		f.on("WHERE c.post_id = $1 AND c.parent_id IS NULL AND ($2 = 0 OR c.id < $2) AND "+commentVisibleTo("$4"), func(args []interface{}) fakeResult {
+			return rows(roots, args[3].(int))
+		})
+		f.on("WHERE c.root_id = ANY($1) AND "+commentVisibleTo("$2"), func(args []interface{}) fakeResult {
+			return rows(replies, args[1].(int))
+		})
+
+		r := mux.SetURLVars(testRequest("GET", "/posts/1/comments", "", test.viewer), map[string]string{"id": "1"})
+		w := serve(listPostCommentsHandler, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("viewer %q: comments = %d %s", test.viewer, w.Code, w.Body)
+		}
+		var response struct {
+			Comments []*PostComment `json:"comments"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[int][]int)
+		var walk func(comments []*PostComment)
+		walk = func(comments []*PostComment) {
+			for _, c := range comments {
+				got[c.ID] = []int{}
+				for _, reply := range c.Replies {
+					got[c.ID] = append(got[c.ID], reply.ID)
+				}
+				walk(c.Replies)
+			}
+		}
+		walk(response.Comments)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("viewer %q: threads %v, want %v", test.viewer, got, test.want)
+		}
+	}
+}
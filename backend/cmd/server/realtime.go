@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// realtimeWriteWait bounds how long one frame may take to write.
+	realtimeWriteWait = 10 * time.Second
+	// realtimePongWait is how long a connection may stay silent before it
+	// is considered dead; pings go out well within it.
+	realtimePongWait   = 60 * time.Second
+	realtimePingPeriod = realtimePongWait * 9 / 10
+	// realtimeSendBuffer is how many events may queue for one connection.
+	// A client that falls this far behind is disconnected and is expected
+	// to reconnect and catch up over REST.
+	realtimeSendBuffer   = 64
+	maxRealtimeFrameSize = 4096
+	// maxRealtimeConnections caps connections per user, e.g. open tabs.
+	maxRealtimeConnections = 8
+)
+
+// realtimeEvent is pushed to every connection of the listed users.
+type realtimeEvent struct {
+	UserIDs   []int           `json:"userIds"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// realtimeBroker carries events between server instances. Publish sends an
+// event to every subscriber on every instance, including this one, so the
+// hub only ever delivers what it receives from Subscribe.
+type realtimeBroker interface {
+	Publish(event realtimeEvent) error
+	Subscribe(handler func(event realtimeEvent)) (unsubscribe func())
+}
+
+// localBroker is a realtimeBroker for a single server instance.
+type localBroker struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[int]func(event realtimeEvent)
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{handlers: make(map[int]func(event realtimeEvent))}
+}
+
+func (b *localBroker) Publish(event realtimeEvent) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(handler func(event realtimeEvent)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// realtimeHandler handles one type of frame sent by clients.
+type realtimeHandler func(client *realtimeClient, payload json.RawMessage) error
+
+// realtimeHub tracks this instance's WebSocket connections by user and
+// delivers broker events to them.
+type realtimeHub struct {
+	broker realtimeBroker
+
+	mu      sync.RWMutex
+	clients map[int]map[*realtimeClient]struct{}
+
+	handlersMu sync.RWMutex
+	handlers   map[string]realtimeHandler
+}
+
+var realtime *realtimeHub
+
+func newRealtimeHub(broker realtimeBroker) *realtimeHub {
+	hub := &realtimeHub{
+		broker:   broker,
+		clients:  make(map[int]map[*realtimeClient]struct{}),
+		handlers: make(map[string]realtimeHandler),
+	}
+	broker.Subscribe(hub.deliver)
+	return hub
+}
+
+// publish sends an event to the given users wherever they are connected.
+func (h *realtimeHub) publish(userIDs []int, kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(realtimeEvent{
+		UserIDs:   userIDs,
+		Type:      kind,
+		Payload:   data,
+		CreatedAt: time.Now(),
+	})
+}
+
+// handle sets the handler for frames of the given type from clients.
+func (h *realtimeHub) handle(kind string, handler realtimeHandler) {
+	h.handlersMu.Lock()
+	defer h.handlersMu.Unlock()
+	h.handlers[kind] = handler
+}
+
+// Name and Deliver make the hub a notificationChannel, so every
+// notification is also pushed to the user's open connections.
+func (h *realtimeHub) Name() string {
+	return "realtime"
+}
+
+func (h *realtimeHub) Deliver(n Notification) error {
+	return h.publish([]int{n.UserID}, n.Type, n.Payload)
+}
+
+// deliver queues an event on the local connections of its users.
+func (h *realtimeHub) deliver(event realtimeEvent) {
+	frame, err := json.Marshal(struct {
+		Type      string          `json:"type"`
+		Payload   json.RawMessage `json:"payload"`
+		CreatedAt time.Time       `json:"createdAt"`
+	}{event.Type, event.Payload, event.CreatedAt})
+	if err != nil {
+		log.Printf("Error encoding realtime event: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, userID := range event.UserIDs {
+		for client := range h.clients[userID] {
+			client.enqueue(frame)
+		}
+	}
+}
+
+// connected reports whether userID has a connection to this instance.
+func (h *realtimeHub) connected(userID int) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[userID]) > 0
+}
+
+func (h *realtimeHub) register(client *realtimeClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients := h.clients[client.userID]
+	if clients == nil {
+		clients = make(map[*realtimeClient]struct{})
+		h.clients[client.userID] = clients
+	}
+	// Make room by dropping the oldest connection
+	if len(clients) >= maxRealtimeConnections {
+		var oldest *realtimeClient
+		for c := range clients {
+			if oldest == nil || c.connectedAt.Before(oldest.connectedAt) {
+				oldest = c
+			}
+		}
+		oldest.close()
+		delete(clients, oldest)
+	}
+	clients[client] = struct{}{}
+}
+
+func (h *realtimeHub) unregister(client *realtimeClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if clients := h.clients[client.userID]; clients != nil {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.clients, client.userID)
+		}
+	}
+}
+
+// realtimeClient is one WebSocket connection.
+type realtimeClient struct {
+	hub         *realtimeHub
+	conn        *websocket.Conn
+	userID      int
+	username    string
+	connectedAt time.Time
+	send        chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// enqueue queues a frame without blocking. A connection whose queue is
+// full is closed rather than allowed to hold up delivery to everyone else.
+func (c *realtimeClient) enqueue(frame []byte) {
+	select {
+	case <-c.done:
+	case c.send <- frame:
+	default:
+		log.Printf("Dropping slow realtime connection for user %d", c.userID)
+		c.close()
+	}
+}
+
+func (c *realtimeClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// sendEvent queues an event for this connection only.
+func (c *realtimeClient) sendEvent(kind string, payload interface{}) {
+	frame, err := json.Marshal(map[string]interface{}{
+		"type":      kind,
+		"payload":   payload,
+		"createdAt": time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error encoding realtime event: %v", err)
+		return
+	}
+	c.enqueue(frame)
+}
+
+// readPump handles frames from the client until the connection fails.
+// Frames are JSON objects with a type and payload, dispatched to the
+// handlers registered on the hub.
+func (c *realtimeClient) readPump() {
+	defer c.close()
+
+	c.conn.SetReadLimit(maxRealtimeFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(realtimePongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(realtimePongWait))
+	})
+
+	for {
+		var frame struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				c.sendEvent("error", map[string]string{"error": "Invalid frame"})
+				continue
+			}
+			return
+		}
+		// Any frame shows the client is alive
+		c.conn.SetReadDeadline(time.Now().Add(realtimePongWait))
+
+		if frame.Type == "ping" {
+			c.sendEvent("pong", nil)
+			continue
+		}
+
+		c.hub.handlersMu.RLock()
+		handler, ok := c.hub.handlers[frame.Type]
+		c.hub.handlersMu.RUnlock()
+		if !ok {
+			c.sendEvent("error", map[string]string{"error": "Unknown frame type", "frameType": frame.Type})
+			continue
+		}
+		if err := handler(c, frame.Payload); err != nil {
+			c.sendEvent("error", map[string]string{"error": err.Error(), "frameType": frame.Type})
+		}
+	}
+}
+
+// writePump writes queued frames and pings until the connection closes.
+// It is the only goroutine writing to the connection.
+func (c *realtimeClient) writePump() {
+	ticker := time.NewTicker(realtimePingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(realtimeWriteWait))
+			return
+		}
+	}
+}
+
+var realtimeUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || origin == "http://localhost:3000"
+	},
+}
+
+// websocketHandler upgrades to a WebSocket that pushes the caller's
+// notifications as they happen. Browsers can't set headers on WebSocket
+// requests, so the token may also come in the token query parameter.
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.URL.Query().Get("token")
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		tokenString = strings.Replace(authHeader, "Bearer ", "", 1)
+	}
+	if tokenString == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	claims, err := validateToken(tokenString)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := realtimeUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		return
+	}
+
+	client := &realtimeClient{
+		hub:         realtime,
+		conn:        conn,
+		userID:      userID,
+		username:    claims.Username,
+		connectedAt: time.Now(),
+		send:        make(chan []byte, realtimeSendBuffer),
+		done:        make(chan struct{}),
+	}
+	realtime.register(client)
+	client.sendEvent("ready", map[string]string{"username": claims.Username})
+
+	go client.writePump()
+	go func() {
+		client.readPump()
+		realtime.unregister(client)
+	}()
+}
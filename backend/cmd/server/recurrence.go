@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRecurrenceInterval = 52
+	maxRecurrenceCount    = 500
+	// maxRecurrenceSpan bounds how far UNTIL may be from the first
+	// occurrence.
+	maxRecurrenceSpan = 2 * 366 * 24 * time.Hour
+	// maxRecurrencePeriods stops expansion of open-ended rules far in the
+	// future.
+	maxRecurrencePeriods = 20000
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// recurrenceDay is a BYDAY entry. Ordinal picks the nth weekday of the
+// month, counting from the end when negative; 0 means every such weekday.
+type recurrenceDay struct {
+	Weekday time.Weekday
+	Ordinal int
+}
+
+func (d recurrenceDay) String() string {
+	name := strings.ToUpper(d.Weekday.String()[:2])
+	if d.Ordinal == 0 {
+		return name
+	}
+	return strconv.Itoa(d.Ordinal) + name
+}
+
+// recurrenceRule is the subset of RFC 5545 RRULE we support: DAILY
+// (optionally limited to some weekdays), WEEKLY on a set of weekdays and
+// MONTHLY on the start's day of month or by weekday (e.g. 2TU, -1FR),
+// bounded by COUNT, UNTIL or neither.
+//
+// Occurrences keep the first occurrence's wall-clock time in the event's
+// time zone, so a 19:00 weekly scrim stays at 19:00 across DST changes.
+type recurrenceRule struct {
+	Freq     string
+	Interval int
+	ByDay    []recurrenceDay
+	Count    int
+	Until    time.Time
+}
+
+// parseRecurrenceRule parses an RRULE value, with or without the "RRULE:"
+// prefix.
+func parseRecurrenceRule(value string) (*recurrenceRule, error) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 6 && strings.EqualFold(value[:6], "RRULE:") {
+		value = value[6:]
+	}
+	if value == "" {
+		return nil, fmt.Errorf("Recurrence rule is empty")
+	}
+
+	rule := &recurrenceRule{Interval: 1}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		val = strings.ToUpper(strings.TrimSpace(val))
+		if !ok || key == "" || val == "" {
+			return nil, fmt.Errorf("Invalid recurrence rule part %q", part)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("Recurrence rule repeats %s", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			if val != "DAILY" && val != "WEEKLY" && val != "MONTHLY" {
+				return nil, fmt.Errorf("Recurrence must be DAILY, WEEKLY or MONTHLY")
+			}
+			rule.Freq = val
+		case "INTERVAL":
+			interval, err := strconv.Atoi(val)
+			if err != nil || interval < 1 || interval > maxRecurrenceInterval {
+				return nil, fmt.Errorf("INTERVAL must be between 1 and %d", maxRecurrenceInterval)
+			}
+			rule.Interval = interval
+		case "COUNT":
+			count, err := strconv.Atoi(val)
+			if err != nil || count < 1 || count > maxRecurrenceCount {
+				return nil, fmt.Errorf("COUNT must be between 1 and %d", maxRecurrenceCount)
+			}
+			rule.Count = count
+		case "UNTIL":
+			until, err := parseRecurrenceUntil(val)
+			if err != nil {
+				return nil, err
+			}
+			rule.Until = until
+		case "BYDAY":
+			for _, entry := range strings.Split(val, ",") {
+				day, err := parseRecurrenceDay(entry)
+				if err != nil {
+					return nil, err
+				}
+				rule.ByDay = append(rule.ByDay, day)
+			}
+		case "WKST":
+			// Weeks start on Monday; other week starts only change
+			// multi-week rules and aren't supported
+			if val != "MO" {
+				return nil, fmt.Errorf("Only WKST=MO is supported")
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported recurrence rule part %s", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return nil, fmt.Errorf("Recurrence rule needs a FREQ")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, fmt.Errorf("Recurrence rule can't have both COUNT and UNTIL")
+	}
+	for _, day := range rule.ByDay {
+		if day.Ordinal != 0 && rule.Freq != "MONTHLY" {
+			return nil, fmt.Errorf("Numbered BYDAY entries are only allowed in MONTHLY rules")
+		}
+	}
+
+	// Normalise so equal rules compare equal
+	sort.Slice(rule.ByDay, func(i, j int) bool {
+		a, b := rule.ByDay[i], rule.ByDay[j]
+		if a.Ordinal != b.Ordinal {
+			return a.Ordinal < b.Ordinal
+		}
+		return mondayOffset(a.Weekday) < mondayOffset(b.Weekday)
+	})
+	unique := rule.ByDay[:0]
+	for i, day := range rule.ByDay {
+		if i == 0 || day != rule.ByDay[i-1] {
+			unique = append(unique, day)
+		}
+	}
+	rule.ByDay = unique
+	return rule, nil
+}
+
+// parseRecurrenceUntil reads UNTIL, which must be a UTC date-time since
+// events always carry a time zone.
+func parseRecurrenceUntil(value string) (time.Time, error) {
+	until, err := time.Parse(icsUTCLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("UNTIL must be a UTC date-time like 20261231T235959Z")
+	}
+	return until, nil
+}
+
+func parseRecurrenceDay(value string) (recurrenceDay, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 {
+		return recurrenceDay{}, fmt.Errorf("Invalid BYDAY entry %q", value)
+	}
+	weekday, ok := rruleWeekdays[value[len(value)-2:]]
+	if !ok {
+		return recurrenceDay{}, fmt.Errorf("Invalid BYDAY entry %q", value)
+	}
+	day := recurrenceDay{Weekday: weekday}
+	if prefix := value[:len(value)-2]; prefix != "" {
+		ordinal, err := strconv.Atoi(prefix)
+		if err != nil || ordinal == 0 || ordinal < -5 || ordinal > 5 {
+			return recurrenceDay{}, fmt.Errorf("Invalid BYDAY entry %q", value)
+		}
+		day.Ordinal = ordinal
+	}
+	return day, nil
+}
+
+// String returns the canonical RRULE value.
+func (rule *recurrenceRule) String() string {
+	parts := []string{"FREQ=" + rule.Freq}
+	if rule.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rule.Interval))
+	}
+	if len(rule.ByDay) > 0 {
+		days := make([]string, len(rule.ByDay))
+		for i, day := range rule.ByDay {
+			days[i] = day.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if rule.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rule.Count))
+	}
+	if !rule.Until.IsZero() {
+		parts = append(parts, "UNTIL="+rule.Until.UTC().Format(icsUTCLayout))
+	}
+	return strings.Join(parts, ";")
+}
+
+// validateStart checks that the series can start at start: the first
+// occurrence must be start itself and UNTIL must be reachable.
+func (rule *recurrenceRule) validateStart(start time.Time, loc *time.Location) error {
+	if !rule.Until.IsZero() {
+		if rule.Until.Before(start) {
+			return fmt.Errorf("Recurrence ends before the event starts")
+		}
+		if rule.Until.Sub(start) > maxRecurrenceSpan {
+			return fmt.Errorf("Recurrence can run for at most two years; leave out UNTIL to repeat indefinitely")
+		}
+	}
+	first := rule.occurrences(start, 0, loc, start, start.Add(time.Second))
+	if len(first) == 0 || !first[0].Equal(start) {
+		return fmt.Errorf("Event start must match the recurrence rule")
+	}
+	return nil
+}
+
+// includes reports whether occurrence is one of the series' starts.
+func (rule *recurrenceRule) includes(start time.Time, loc *time.Location, occurrence time.Time) bool {
+	matches := rule.occurrences(start, 0, loc, occurrence, occurrence.Add(time.Second))
+	return len(matches) > 0 && matches[0].Equal(occurrence)
+}
+
+// lastEnd returns when the final occurrence ends, or false for rules that
+// repeat indefinitely.
+func (rule *recurrenceRule) lastEnd(start time.Time, duration time.Duration, loc *time.Location) (time.Time, bool) {
+	if rule.Count == 0 && rule.Until.IsZero() {
+		return time.Time{}, false
+	}
+	last := start
+	rule.each(start, loc, func(occurrence time.Time) bool {
+		last = occurrence
+		return true
+	})
+	return last.Add(duration), true
+}
+
+// occurrences returns the starts of occurrences lasting duration that
+// overlap [from, to), for a series whose first occurrence is start.
+func (rule *recurrenceRule) occurrences(start time.Time, duration time.Duration, loc *time.Location, from, to time.Time) []time.Time {
+	var starts []time.Time
+	rule.each(start, loc, func(occurrence time.Time) bool {
+		if !occurrence.Before(to) {
+			return false
+		}
+		if occurrence.Add(duration).After(from) || occurrence.Equal(from) {
+			starts = append(starts, occurrence)
+		}
+		return true
+	})
+	return starts
+}
+
+// each calls fn with every occurrence start in order until fn returns
+// false or the rule is exhausted. COUNT includes the first occurrence.
+func (rule *recurrenceRule) each(start time.Time, loc *time.Location, fn func(time.Time) bool) {
+	local := start.In(loc)
+	firstDay := civilDate(local.Year(), local.Month(), local.Day())
+	hour, minute, second := local.Clock()
+
+	emitted := 0
+	// emit reports whether expansion should continue
+	emit := func(day time.Time) bool {
+		if day.Before(firstDay) {
+			return true
+		}
+		occurrence := wallTime(day, hour, minute, second, loc)
+		if !rule.Until.IsZero() && occurrence.After(rule.Until) {
+			return false
+		}
+		emitted++
+		if rule.Count > 0 && emitted > rule.Count {
+			return false
+		}
+		return fn(occurrence)
+	}
+
+	for period := 0; period < maxRecurrencePeriods; period++ {
+		for _, day := range rule.periodDays(firstDay, period) {
+			if !emit(day) {
+				return
+			}
+		}
+	}
+}
+
+// periodDays returns the days of the given period, in order, as UTC
+// midnights.
+func (rule *recurrenceRule) periodDays(firstDay time.Time, period int) []time.Time {
+	step := period * rule.Interval
+	switch rule.Freq {
+	case "DAILY":
+		day := firstDay.AddDate(0, 0, step)
+		if len(rule.ByDay) > 0 && !rule.hasWeekday(day.Weekday()) {
+			return nil
+		}
+		return []time.Time{day}
+
+	case "WEEKLY":
+		weekStart := firstDay.AddDate(0, 0, -mondayOffset(firstDay.Weekday())+7*step)
+		if len(rule.ByDay) == 0 {
+			return []time.Time{weekStart.AddDate(0, 0, mondayOffset(firstDay.Weekday()))}
+		}
+		days := make([]time.Time, 0, len(rule.ByDay))
+		for _, byDay := range rule.ByDay {
+			days = append(days, weekStart.AddDate(0, 0, mondayOffset(byDay.Weekday)))
+		}
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+		return days
+
+	case "MONTHLY":
+		month := civilDate(firstDay.Year(), firstDay.Month()+time.Month(step), 1)
+		if len(rule.ByDay) == 0 {
+			// Months without the start's day of month are skipped
+			day := civilDate(month.Year(), month.Month(), firstDay.Day())
+			if day.Month() != month.Month() {
+				return nil
+			}
+			return []time.Time{day}
+		}
+		return monthWeekdays(month, rule.ByDay)
+	}
+	return nil
+}
+
+func (rule *recurrenceRule) hasWeekday(weekday time.Weekday) bool {
+	for _, day := range rule.ByDay {
+		if day.Weekday == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// monthWeekdays returns the days in month matching any of byDay, in order
+// and without duplicates.
+func monthWeekdays(month time.Time, byDay []recurrenceDay) []time.Time {
+	daysInMonth := civilDate(month.Year(), month.Month()+1, 0).Day()
+	matched := make(map[int]bool)
+	for _, entry := range byDay {
+		var candidates []int
+		for d := 1; d <= daysInMonth; d++ {
+			if civilDate(month.Year(), month.Month(), d).Weekday() == entry.Weekday {
+				candidates = append(candidates, d)
+			}
+		}
+		switch {
+		case entry.Ordinal == 0:
+			for _, d := range candidates {
+				matched[d] = true
+			}
+		case entry.Ordinal > 0 && entry.Ordinal <= len(candidates):
+			matched[candidates[entry.Ordinal-1]] = true
+		case entry.Ordinal < 0 && -entry.Ordinal <= len(candidates):
+			matched[candidates[len(candidates)+entry.Ordinal]] = true
+		}
+	}
+
+	days := make([]time.Time, 0, len(matched))
+	for d := 1; d <= daysInMonth; d++ {
+		if matched[d] {
+			days = append(days, civilDate(month.Year(), month.Month(), d))
+		}
+	}
+	return days
+}
+
+// civilDate is a calendar date, kept in UTC so date arithmetic never meets
+// a DST transition.
+func civilDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// mondayOffset is the weekday's position in a Monday-first week.
+func mondayOffset(weekday time.Weekday) int {
+	return (int(weekday) + 6) % 7
+}
+
+// wallTime returns the instant at the given wall-clock time on day in loc.
+// A time skipped by a DST change is read with the offset in effect before
+// the change, as RFC 5545 requires, so 02:30 on a spring-forward night
+// becomes 03:30.
+func wallTime(day time.Time, hour, minute, second int, loc *time.Location) time.Time {
+	t := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, loc)
+	if t.Day() == day.Day() && t.Hour() == hour && t.Minute() == minute {
+		return t
+	}
+	naive := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, time.UTC)
+	_, before := naive.Add(-24 * time.Hour).In(loc).Zone()
+	return naive.Add(-time.Duration(before) * time.Second).In(loc)
+}
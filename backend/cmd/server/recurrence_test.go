@@ -0,0 +1,522 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	location, err := loadTimeZone(name)
+	if err != nil {
+		t.Fatalf("loadTimeZone(%q) error: %v", name, err)
+	}
+	return location
+}
+
+func mustRule(t *testing.T, value string) *recurrenceRule {
+	t.Helper()
+	rule, err := parseRecurrenceRule(value)
+	if err != nil {
+		t.Fatalf("parseRecurrenceRule(%q) error: %v", value, err)
+	}
+	return rule
+}
+
+func utc(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return parsed.UTC()
+}
+
+func utcTimes(values ...string) []time.Time {
+	times := make([]time.Time, len(values))
+	for i, value := range values {
+		times[i] = utc(value)
+	}
+	return times
+}
+
+// sameInstants compares times as instants, whatever their location.
+func sameInstants(got, want []time.Time) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !got[i].Equal(want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		zone     string
+		start    string
+		from, to string
+		want     []time.Time
+	}{
+		{
+			// 02:30 doesn't exist on 8 March; it is read with the EST
+			// offset and lands at 03:30 EDT
+			name:  "spring forward skips to 03:30",
+			rule:  "FREQ=DAILY",
+			zone:  "America/New_York",
+			start: "2026-03-07T02:30:00-05:00",
+			from:  "2026-03-07T00:00:00Z", to: "2026-03-10T00:00:00Z",
+			want: utcTimes(
+				"2026-03-07T02:30:00-05:00",
+				"2026-03-08T03:30:00-04:00",
+				"2026-03-09T02:30:00-04:00",
+			),
+		},
+		{
+			// 01:30 happens twice on 1 November; the first one is used
+			name:  "fall back uses the first repeated hour",
+			rule:  "FREQ=DAILY",
+			zone:  "America/New_York",
+			start: "2026-10-31T01:30:00-04:00",
+			from:  "2026-10-31T00:00:00Z", to: "2026-11-03T00:00:00Z",
+			want: utcTimes(
+				"2026-10-31T01:30:00-04:00",
+				"2026-11-01T01:30:00-04:00",
+				"2026-11-02T01:30:00-05:00",
+			),
+		},
+		{
+			name:  "weekly keeps wall clock across spring forward",
+			rule:  "FREQ=WEEKLY;BYDAY=TU,TH",
+			zone:  "America/New_York",
+			start: "2026-03-03T19:00:00-05:00",
+			from:  "2026-03-01T00:00:00Z", to: "2026-03-14T00:00:00Z",
+			want: utcTimes(
+				"2026-03-03T19:00:00-05:00",
+				"2026-03-05T19:00:00-05:00",
+				"2026-03-10T19:00:00-04:00",
+				"2026-03-12T19:00:00-04:00",
+			),
+		},
+		{
+			name:  "weekly keeps wall clock across fall back",
+			rule:  "FREQ=WEEKLY;INTERVAL=2",
+			zone:  "Europe/Berlin",
+			start: "2026-10-11T20:00:00+02:00",
+			from:  "2026-10-01T00:00:00Z", to: "2026-11-15T00:00:00Z",
+			want: utcTimes(
+				"2026-10-11T20:00:00+02:00",
+				"2026-10-25T20:00:00+01:00",
+				"2026-11-08T20:00:00+01:00",
+			),
+		},
+		{
+			name:  "weekly late evening stays on its local weekday",
+			rule:  "FREQ=WEEKLY;BYDAY=FR",
+			zone:  "Asia/Tokyo",
+			start: "2026-01-02T23:30:00+09:00",
+			from:  "2026-01-01T00:00:00Z", to: "2026-01-17T00:00:00Z",
+			want: utcTimes(
+				"2026-01-02T23:30:00+09:00",
+				"2026-01-09T23:30:00+09:00",
+				"2026-01-16T23:30:00+09:00",
+			),
+		},
+		{
+			name:  "monthly last Friday",
+			rule:  "FREQ=MONTHLY;BYDAY=-1FR",
+			zone:  "America/New_York",
+			start: "2026-01-30T20:00:00-05:00",
+			from:  "2026-01-01T00:00:00Z", to: "2026-06-01T00:00:00Z",
+			want: utcTimes(
+				"2026-01-30T20:00:00-05:00",
+				"2026-02-27T20:00:00-05:00",
+				"2026-03-27T20:00:00-04:00",
+				"2026-04-24T20:00:00-04:00",
+				"2026-05-29T20:00:00-04:00",
+			),
+		},
+		{
+			// February to April and June 2026 have only four Fridays
+			name:  "monthly fifth Friday skips short months",
+			rule:  "FREQ=MONTHLY;BYDAY=5FR",
+			zone:  "America/New_York",
+			start: "2026-01-30T20:00:00-05:00",
+			from:  "2026-01-01T00:00:00Z", to: "2026-08-02T00:00:00Z",
+			want: utcTimes(
+				"2026-01-30T20:00:00-05:00",
+				"2026-05-29T20:00:00-04:00",
+				"2026-07-31T20:00:00-04:00",
+			),
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			rule:  "FREQ=MONTHLY",
+			zone:  "UTC",
+			start: "2026-01-31T18:00:00Z",
+			from:  "2026-01-01T00:00:00Z", to: "2026-06-01T00:00:00Z",
+			want: utcTimes("2026-01-31T18:00:00Z", "2026-03-31T18:00:00Z", "2026-05-31T18:00:00Z"),
+		},
+		{
+			name:  "COUNT includes the first occurrence",
+			rule:  "FREQ=DAILY;COUNT=3",
+			zone:  "UTC",
+			start: "2026-03-01T18:00:00Z",
+			from:  "2026-03-01T00:00:00Z", to: "2026-04-01T00:00:00Z",
+			want: utcTimes("2026-03-01T18:00:00Z", "2026-03-02T18:00:00Z", "2026-03-03T18:00:00Z"),
+		},
+		{
+			name:  "COUNT counts occurrences before the range",
+			rule:  "FREQ=DAILY;COUNT=3",
+			zone:  "UTC",
+			start: "2026-03-01T18:00:00Z",
+			from:  "2026-03-03T00:00:00Z", to: "2026-04-01T00:00:00Z",
+			want: utcTimes("2026-03-03T18:00:00Z"),
+		},
+		{
+			name:  "UNTIL equal to an occurrence includes it",
+			rule:  "FREQ=DAILY;UNTIL=20260303T180000Z",
+			zone:  "UTC",
+			start: "2026-03-01T18:00:00Z",
+			from:  "2026-03-01T00:00:00Z", to: "2026-04-01T00:00:00Z",
+			want: utcTimes("2026-03-01T18:00:00Z", "2026-03-02T18:00:00Z", "2026-03-03T18:00:00Z"),
+		},
+		{
+			name:  "UNTIL just before an occurrence excludes it",
+			rule:  "FREQ=DAILY;UNTIL=20260303T175959Z",
+			zone:  "UTC",
+			start: "2026-03-01T18:00:00Z",
+			from:  "2026-03-01T00:00:00Z", to: "2026-04-01T00:00:00Z",
+			want: utcTimes("2026-03-01T18:00:00Z", "2026-03-02T18:00:00Z"),
+		},
+		{
+			// UNTIL is compared with the shifted start, not the wall time
+			name:  "UNTIL across spring forward",
+			rule:  "FREQ=DAILY;UNTIL=20260308T073000Z",
+			zone:  "America/New_York",
+			start: "2026-03-07T02:30:00-05:00",
+			from:  "2026-03-01T00:00:00Z", to: "2026-04-01T00:00:00Z",
+			want: utcTimes("2026-03-07T02:30:00-05:00", "2026-03-08T03:30:00-04:00"),
+		},
+		{
+			name:  "range end is exclusive",
+			rule:  "FREQ=DAILY",
+			zone:  "UTC",
+			start: "2026-03-01T18:00:00Z",
+			from:  "2026-03-01T00:00:00Z", to: "2026-03-03T18:00:00Z",
+			want: utcTimes("2026-03-01T18:00:00Z", "2026-03-02T18:00:00Z"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := mustRule(t, test.rule)
+			location := mustLocation(t, test.zone)
+			start := utc(test.start)
+			if err := rule.validateStart(start, location); err != nil {
+				t.Fatalf("validateStart error: %v", err)
+			}
+
+			got := rule.occurrences(start, time.Hour, location, utc(test.from), utc(test.to))
+			if !sameInstants(got, test.want) {
+				t.Errorf("occurrences = %v, want %v", got, test.want)
+			}
+			for _, occurrence := range test.want {
+				if !rule.includes(start, location, occurrence) {
+					t.Errorf("includes(%v) = false", occurrence)
+				}
+			}
+		})
+	}
+}
+
+func TestWallTime(t *testing.T) {
+	tests := []struct {
+		name         string
+		zone         string
+		day          string
+		hour, minute int
+		want         string
+	}{
+		{"ordinary day", "America/New_York", "2026-03-07", 19, 0, "2026-03-07T19:00:00-05:00"},
+		{"skipped by spring forward", "America/New_York", "2026-03-08", 2, 30, "2026-03-08T03:30:00-04:00"},
+		{"first moment skipped", "America/New_York", "2026-03-08", 2, 0, "2026-03-08T03:00:00-04:00"},
+		{"just after spring forward", "America/New_York", "2026-03-08", 3, 0, "2026-03-08T03:00:00-04:00"},
+		{"repeated by fall back", "America/New_York", "2026-11-01", 1, 30, "2026-11-01T01:30:00-04:00"},
+		{"skipped in Europe", "Europe/Berlin", "2026-03-29", 2, 30, "2026-03-29T03:30:00+02:00"},
+		{"half hour shift", "Australia/Lord_Howe", "2026-10-04", 2, 15, "2026-10-04T02:45:00+11:00"},
+		{"no DST", "Asia/Kolkata", "2026-03-08", 2, 30, "2026-03-08T02:30:00+05:30"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			day, err := time.Parse("2006-01-02", test.day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := wallTime(day, test.hour, test.minute, 0, mustLocation(t, test.zone))
+			if want := utc(test.want); !got.Equal(want) {
+				t.Errorf("wallTime = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRecurrenceOccurrencesOverlapRangeStart(t *testing.T) {
+	rule := mustRule(t, "FREQ=DAILY")
+	start := utc("2026-03-01T23:00:00Z")
+
+	// The 1 March occurrence runs past midnight into the range
+	got := rule.occurrences(start, 2*time.Hour, time.UTC, utc("2026-03-02T00:00:00Z"), utc("2026-03-03T00:00:00Z"))
+	want := utcTimes("2026-03-01T23:00:00Z", "2026-03-02T23:00:00Z")
+	if !sameInstants(got, want) {
+		t.Errorf("occurrences = %v, want %v", got, want)
+	}
+}
+
+func TestRecurrenceLastEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		want  time.Time
+		bound bool
+	}{
+		{"COUNT", "FREQ=WEEKLY;COUNT=4", utc("2026-03-22T20:00:00-04:00"), true},
+		{"UNTIL on an occurrence", "FREQ=WEEKLY;UNTIL=20260322T230000Z", utc("2026-03-22T20:00:00-04:00"), true},
+		{"UNTIL between occurrences", "FREQ=WEEKLY;UNTIL=20260325T000000Z", utc("2026-03-22T20:00:00-04:00"), true},
+		{"open ended", "FREQ=WEEKLY", time.Time{}, false},
+	}
+
+	location := mustLocation(t, "America/New_York")
+	start := utc("2026-03-01T19:00:00-05:00")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, bound := mustRule(t, test.rule).lastEnd(start, time.Hour, location)
+			if bound != test.bound || !got.Equal(test.want) {
+				t.Errorf("lastEnd = %v, %v, want %v, %v", got, bound, test.want, test.bound)
+			}
+		})
+	}
+}
+
+func TestRecurrenceValidateStart(t *testing.T) {
+	location := mustLocation(t, "America/New_York")
+	tests := []struct {
+		name  string
+		rule  string
+		start string
+		ok    bool
+	}{
+		{"start on a listed weekday", "FREQ=WEEKLY;BYDAY=TU,TH", "2026-03-03T19:00:00-05:00", true},
+		{"start on another weekday", "FREQ=WEEKLY;BYDAY=TU,TH", "2026-03-04T19:00:00-05:00", false},
+		{"start on the last Friday", "FREQ=MONTHLY;BYDAY=-1FR", "2026-01-30T20:00:00-05:00", true},
+		{"start on an earlier Friday", "FREQ=MONTHLY;BYDAY=-1FR", "2026-01-23T20:00:00-05:00", false},
+		{"UNTIL before start", "FREQ=DAILY;UNTIL=20260301T000000Z", "2026-03-03T19:00:00-05:00", false},
+		{"UNTIL too far out", "FREQ=DAILY;UNTIL=20300101T000000Z", "2026-03-03T19:00:00-05:00", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := mustRule(t, test.rule).validateStart(utc(test.start), location)
+			if (err == nil) != test.ok {
+				t.Errorf("validateStart error = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestParseRecurrenceRule(t *testing.T) {
+	valid := map[string]string{
+		"RRULE:FREQ=WEEKLY;BYDAY=TH,TU,TU":  "FREQ=WEEKLY;BYDAY=TU,TH",
+		"freq=monthly;byday=-1fr":           "FREQ=MONTHLY;BYDAY=-1FR",
+		"FREQ=DAILY;INTERVAL=1;WKST=MO":     "FREQ=DAILY",
+		"FREQ=DAILY;UNTIL=20261231T235959Z": "FREQ=DAILY;UNTIL=20261231T235959Z",
+	}
+	for value, want := range valid {
+		if got := mustRule(t, value).String(); got != want {
+			t.Errorf("parseRecurrenceRule(%q) = %q, want %q", value, got, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"FREQ=YEARLY",
+		"INTERVAL=2",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231T235959Z",
+		"FREQ=DAILY;UNTIL=20261231",
+		"FREQ=WEEKLY;BYDAY=1TU",
+		"FREQ=MONTHLY;BYDAY=6FR",
+		"FREQ=MONTHLY;BYDAY=0FR",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;WKST=SU",
+		"FREQ=DAILY;BYHOUR=3",
+	}
+	for _, value := range invalid {
+		if rule, err := parseRecurrenceRule(value); err == nil {
+			t.Errorf("parseRecurrenceRule(%q) = %q, want an error", value, rule)
+		}
+	}
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+// weeklyEvent is a recurring 19:00 New York event with a two hour
+// duration, starting on Tuesday 3 March 2026.
+func weeklyEvent(rule string) *Event {
+	return &Event{
+		ID:         7,
+		Title:      "Scrim",
+		StartsAt:   utc("2026-03-03T19:00:00-05:00"),
+		EndsAt:     utc("2026-03-03T21:00:00-05:00"),
+		TimeZone:   "America/New_York",
+		Recurrence: stringPtr(rule),
+		Status:     "scheduled",
+	}
+}
+
+type occurrenceSummary struct {
+	OccurrenceID time.Time
+	StartsAt     time.Time
+	Title        string
+	Status       string
+	Modified     bool
+}
+
+func summarize(occurrences []EventOccurrence) []occurrenceSummary {
+	summaries := []occurrenceSummary{}
+	for _, occurrence := range occurrences {
+		summaries = append(summaries, occurrenceSummary{
+			OccurrenceID: occurrence.OccurrenceID.UTC(),
+			StartsAt:     occurrence.StartsAt.UTC(),
+			Title:        occurrence.Title,
+			Status:       occurrence.Status,
+			Modified:     occurrence.Modified,
+		})
+	}
+	return summaries
+}
+
+func TestExpandEventExceptions(t *testing.T) {
+	week1 := utc("2026-03-03T19:00:00-05:00")
+	week2 := utc("2026-03-10T19:00:00-04:00")
+	week3 := utc("2026-03-17T19:00:00-04:00")
+	week4 := utc("2026-03-24T19:00:00-04:00")
+	week5 := utc("2026-03-31T19:00:00-04:00")
+	from, to := utc("2026-03-01T00:00:00Z"), utc("2026-03-28T00:00:00Z")
+
+	moved := func(original, start time.Time) eventException {
+		return eventException{EventID: 7, OccurrenceStart: original, Status: "scheduled", StartsAt: start, EndsAt: start.Add(2 * time.Hour)}
+	}
+	cancelled := func(original time.Time) eventException {
+		return eventException{EventID: 7, OccurrenceStart: original, Status: "cancelled", StartsAt: original, EndsAt: original.Add(2 * time.Hour)}
+	}
+
+	tests := []struct {
+		name       string
+		status     string
+		exceptions []eventException
+		want       []occurrenceSummary
+	}{
+		{
+			name: "no exceptions",
+			want: []occurrenceSummary{
+				{week1, week1, "Scrim", "scheduled", false},
+				{week2, week2, "Scrim", "scheduled", false},
+				{week3, week3, "Scrim", "scheduled", false},
+				{week4, week4, "Scrim", "scheduled", false},
+			},
+		},
+		{
+			name:       "cancelled occurrence stays listed",
+			exceptions: []eventException{cancelled(week2)},
+			want: []occurrenceSummary{
+				{week1, week1, "Scrim", "scheduled", false},
+				{week2, week2, "Scrim", "cancelled", true},
+				{week3, week3, "Scrim", "scheduled", false},
+				{week4, week4, "Scrim", "scheduled", false},
+			},
+		},
+		{
+			name: "moved occurrence is reordered and retitled",
+			exceptions: []eventException{func() eventException {
+				exception := moved(week2, week3.Add(time.Hour))
+				exception.Title = stringPtr("Late scrim")
+				return exception
+			}()},
+			want: []occurrenceSummary{
+				{week1, week1, "Scrim", "scheduled", false},
+				{week3, week3, "Scrim", "scheduled", false},
+				{week2, week3.Add(time.Hour), "Late scrim", "scheduled", true},
+				{week4, week4, "Scrim", "scheduled", false},
+			},
+		},
+		{
+			name:       "occurrence moved out of the range is dropped",
+			exceptions: []eventException{moved(week4, week5)},
+			want: []occurrenceSummary{
+				{week1, week1, "Scrim", "scheduled", false},
+				{week2, week2, "Scrim", "scheduled", false},
+				{week3, week3, "Scrim", "scheduled", false},
+			},
+		},
+		{
+			name:       "occurrence moved into the range is added",
+			exceptions: []eventException{moved(week5, week4.Add(24*time.Hour))},
+			want: []occurrenceSummary{
+				{week1, week1, "Scrim", "scheduled", false},
+				{week2, week2, "Scrim", "scheduled", false},
+				{week3, week3, "Scrim", "scheduled", false},
+				{week4, week4, "Scrim", "scheduled", false},
+				{week5, week4.Add(24 * time.Hour), "Scrim", "scheduled", true},
+			},
+		},
+		{
+			name:       "cancelled series cancels moved occurrences",
+			status:     "cancelled",
+			exceptions: []eventException{moved(week1, week1.Add(time.Hour))},
+			want: []occurrenceSummary{
+				{week1, week1.Add(time.Hour), "Scrim", "cancelled", true},
+				{week2, week2, "Scrim", "cancelled", false},
+				{week3, week3, "Scrim", "cancelled", false},
+				{week4, week4, "Scrim", "cancelled", false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := weeklyEvent("FREQ=WEEKLY")
+			if test.status != "" {
+				event.Status = test.status
+			}
+			occurrences, err := expandEvent(event, test.exceptions, from, to)
+			if err != nil {
+				t.Fatalf("expandEvent error: %v", err)
+			}
+			if got := summarize(occurrences); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("occurrences =\n%v\nwant\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpandEventCount(t *testing.T) {
+	event := weeklyEvent("FREQ=WEEKLY;COUNT=2")
+	occurrences, err := expandEvent(event, nil, utc("2026-03-01T00:00:00Z"), utc("2026-04-01T00:00:00Z"))
+	if err != nil {
+		t.Fatalf("expandEvent error: %v", err)
+	}
+	if len(occurrences) != 2 {
+		t.Fatalf("got %d occurrences, want 2", len(occurrences))
+	}
+	// Duration is kept in absolute time across the DST change
+	if got := occurrences[1].EndsAt.Sub(occurrences[1].StartsAt); got != 2*time.Hour {
+		t.Errorf("second occurrence lasts %v, want 2h", got)
+	}
+}
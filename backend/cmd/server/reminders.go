@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	eventReminderJob = "event_reminder"
+	// reminderPlanAhead is how early reminder jobs are enqueued. Keeping it
+	// short means edits to an event rarely leave stale jobs behind.
+	reminderPlanAhead = 10 * time.Minute
+	// reminderGrace lets a reminder planned slightly late, e.g. after a
+	// restart, still go out.
+	reminderGrace = 5 * time.Minute
+)
+
+type eventReminderPayload struct {
+	EventID    int       `json:"eventId"`
+	Occurrence time.Time `json:"occurrence"`
+	StartsAt   time.Time `json:"startsAt"`
+	Offset     string    `json:"offset"`
+}
+
+func initReminderTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS event_reminders_sent (
+		reminder_key VARCHAR(255) NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (reminder_key, user_id)
+	);
+	`)
+	return err
+}
+
+// eventReminderKey names one reminder of one occurrence. It is the
+// reminder job's dedupe key and marks who the reminder was sent to.
+func eventReminderKey(eventID int, occurrence, startsAt time.Time, offset string) string {
+	return fmt.Sprintf("%s:%d:%d:%d:%s", eventReminderJob, eventID, occurrence.Unix(), startsAt.Unix(), offset)
+}
+
+// eventReminderOffsets reads EVENT_REMINDER_OFFSETS, a comma-separated list
+// of durations before an event to remind attendees, defaulting to a day
+// and a quarter of an hour ahead.
+func eventReminderOffsets() []time.Duration {
+	defaults := []time.Duration{24 * time.Hour, 15 * time.Minute}
+	value := os.Getenv("EVENT_REMINDER_OFFSETS")
+	if value == "" {
+		return defaults
+	}
+
+	var offsets []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		offset, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || offset <= 0 {
+			log.Printf("Invalid EVENT_REMINDER_OFFSETS %q, using default", value)
+			return defaults
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
+
+// registerEventReminders plans and sends reminders at the given offsets
+// before every scheduled occurrence.
+func registerEventReminders(offsets []time.Duration) {
+	if len(offsets) == 0 {
+		return
+	}
+	registerJobHandler(eventReminderJob, sendEventReminder)
+	registerJobPlanner(func(now time.Time) error {
+		return planEventReminders(now, offsets)
+	})
+	registerJobPlanner(func(now time.Time) error {
+		_, err := db.Exec("DELETE FROM event_reminders_sent WHERE sent_at < $1", now.Add(-jobRetention))
+		return err
+	})
+}
+
+// planEventReminders enqueues reminders falling due soon. Each reminder's
+// dedupe key names the occurrence, its start and the offset, so planning
+// on every tick and on every instance still sends it once; a moved
+// occurrence gets fresh reminders for its new time.
+func planEventReminders(now time.Time, offsets []time.Duration) error {
+	horizon := now.Add(offsets[0] + reminderPlanAhead)
+
+	events := []*Event{}
+	err := db.Select(&events, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.status = 'scheduled'
+		AND (e.series_ends_at IS NULL OR e.series_ends_at > $1)
+		AND (e.starts_at < $2 OR EXISTS(
+			SELECT 1 FROM event_exceptions x WHERE x.event_id = e.id AND x.starts_at < $2))
+	`, now, horizon)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	exceptions, err := loadEventExceptions(ids, &TimeRange{Start: now, End: horizon})
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		occurrences, err := expandEvent(event, exceptions[event.ID], now, horizon)
+		if err != nil {
+			log.Printf("Error expanding event %d: %v", event.ID, err)
+			continue
+		}
+		for _, occurrence := range occurrences {
+			if occurrence.Status != "scheduled" || !occurrence.StartsAt.After(now) {
+				continue
+			}
+			for _, offset := range offsets {
+				runAt := occurrence.StartsAt.Add(-offset)
+				if runAt.Before(now.Add(-reminderGrace)) || runAt.After(now.Add(reminderPlanAhead)) {
+					continue
+				}
+				key := eventReminderKey(event.ID, occurrence.OccurrenceID, occurrence.StartsAt, offset.String())
+				_, err := enqueueJob(db, eventReminderJob, key, runAt, eventReminderPayload{
+					EventID:    event.ID,
+					Occurrence: occurrence.OccurrenceID,
+					StartsAt:   occurrence.StartsAt,
+					Offset:     offset.String(),
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sendEventReminder notifies the host and everyone going or maybe going.
+// Reminders for occurrences that have since been moved, cancelled or
+// started are dropped.
+//
+// The job is only marked done after this returns, so a crash or failed
+// commit runs it again. Each recipient is recorded as reminded, committed
+// on its own, before being notified, and recipients already recorded are
+// skipped; a crash in between loses that one reminder rather than sending
+// it twice.
+func sendEventReminder(raw json.RawMessage) error {
+	var payload eventReminderPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return err
+	}
+	if !payload.StartsAt.After(time.Now()) {
+		return nil
+	}
+
+	events := []*Event{}
+	err := db.Select(&events, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.id = $1 AND e.status = 'scheduled'
+	`, payload.EventID)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	event := events[0]
+
+	window := &TimeRange{Start: payload.StartsAt, End: payload.StartsAt.Add(time.Second)}
+	exceptions, err := loadEventExceptions([]int{event.ID}, window)
+	if err != nil {
+		return err
+	}
+	occurrences, err := expandEvent(event, exceptions[event.ID], window.Start, window.End)
+	if err != nil {
+		return err
+	}
+	var current *EventOccurrence
+	for i := range occurrences {
+		if occurrences[i].OccurrenceID.Equal(payload.Occurrence) && occurrences[i].StartsAt.Equal(payload.StartsAt) {
+			current = &occurrences[i]
+		}
+	}
+	if current == nil || current.Status != "scheduled" {
+		return nil
+	}
+
+	var recipients []int
+	err = db.Select(&recipients, `
+		SELECT host_id FROM events WHERE id = $1
+		UNION
+		SELECT user_id FROM event_rsvps WHERE event_id = $1 AND status IN ('going', 'maybe')
+	`, event.ID)
+	if err != nil {
+		return err
+	}
+
+	key := eventReminderKey(event.ID, payload.Occurrence, payload.StartsAt, payload.Offset)
+	for _, userID := range recipients {
+		result, err := db.Exec(`
+			INSERT INTO event_reminders_sent (reminder_key, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, key, userID)
+		if err != nil {
+			return err
+		}
+		if sent, _ := result.RowsAffected(); sent == 0 {
+			continue
+		}
+		notify(userID, "event_reminder", map[string]interface{}{
+			"eventId":    event.ID,
+			"occurrence": current.OccurrenceID,
+			"title":      current.Title,
+			"startsAt":   current.StartsAt,
+			"startsIn":   payload.Offset,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notificationRecorder is a notificationChannel that keeps what it is
+// given.
+type notificationRecorder struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (*notificationRecorder) Name() string {
+	return "recorder"
+}
+
+func (c *notificationRecorder) Deliver(n Notification) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, n)
+	return nil
+}
+
+// recipients returns who was sent kind, in order.
+func (c *notificationRecorder) recipients(kind string) []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var userIDs []int
+	for _, n := range c.sent {
+		if n.Type == kind {
+			userIDs = append(userIDs, n.UserID)
+		}
+	}
+	return userIDs
+}
+
+// recordNotifications sends notifications only to a recorder for the rest
+// of the test.
+func recordNotifications(t *testing.T) *notificationRecorder {
+	recorder := &notificationRecorder{}
+	notificationChannelsMu.Lock()
+	previous := notificationChannels
+	notificationChannels = []notificationChannel{recorder}
+	notificationChannelsMu.Unlock()
+	t.Cleanup(func() {
+		notificationChannelsMu.Lock()
+		notificationChannels = previous
+		notificationChannelsMu.Unlock()
+	})
+	return recorder
+}
+
+var reminderEventColumns = []string{"id", "host_username", "title", "kind", "starts_at", "ends_at",
+	"time_zone", "recurrence", "visibility", "status", "series_ends_at"}
+
+func reminderEventRow(id int, start time.Time) []interface{} {
+	return []interface{}{id, "host", "Scrims", "session", start, start.Add(time.Hour),
+		"UTC", nil, "public", "scheduled", start.Add(time.Hour)}
+}
+
+func TestEventReminderOffsets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []time.Duration
+	}{
+		{"", []time.Duration{24 * time.Hour, 15 * time.Minute}},
+		{"5m, 1h,30m", []time.Duration{time.Hour, 30 * time.Minute, 5 * time.Minute}},
+		{"1h,soon", []time.Duration{24 * time.Hour, 15 * time.Minute}},
+		{"1h,-5m", []time.Duration{24 * time.Hour, 15 * time.Minute}},
+	}
+	for _, test := range tests {
+		t.Setenv("EVENT_REMINDER_OFFSETS", test.value)
+		if got := eventReminderOffsets(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("EVENT_REMINDER_OFFSETS=%q: got %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPlanEventReminders(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	soon := now.Add(20 * time.Minute)
+	tomorrow := now.Add(24*time.Hour + 5*time.Minute)
+
+	f := useFakeDB(t)
+	f.on("WHERE e.status = 'scheduled' AND (e.series_ends_at IS NULL OR e.series_ends_at > $1)", func(args []interface{}) fakeResult {
+		return fakeRows(reminderEventColumns, reminderEventRow(1, soon), reminderEventRow(2, tomorrow))
+	})
+	f.on("FROM event_exceptions WHERE event_id = ANY($1)", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"event_id", "occurrence_start", "status", "title", "description", "starts_at", "ends_at", "updated_at"})
+	})
+	jobs := make(map[string]time.Time)
+	f.on("INSERT INTO jobs", func(args []interface{}) fakeResult {
+		if args[0] != eventReminderJob {
+			t.Errorf("enqueued a %v job", args[0])
+		}
+		jobs[*args[1].(*string)] = args[3].(time.Time)
+		return fakeAffected(1)
+	})
+
+	if err := planEventReminders(now, []time.Duration{24 * time.Hour, 15 * time.Minute}); err != nil {
+		t.Fatalf("planEventReminders error: %v", err)
+	}
+
+	// Only reminders falling due within reminderPlanAhead are enqueued; the
+	// day-ahead reminder of the first event has long passed
+	want := map[string]time.Time{
+		eventReminderKey(1, soon, soon, (15 * time.Minute).String()):       soon.Add(-15 * time.Minute),
+		eventReminderKey(2, tomorrow, tomorrow, (24 * time.Hour).String()): tomorrow.Add(-24 * time.Hour),
+	}
+	if len(jobs) != len(want) {
+		t.Fatalf("enqueued %v, want %v", jobs, want)
+	}
+	for key, runAt := range want {
+		if got, ok := jobs[key]; !ok || !got.Equal(runAt) {
+			t.Errorf("job %s runs at %v, want %v", key, got, runAt)
+		}
+	}
+}
+
+func TestSendEventReminder(t *testing.T) {
+	start := time.Now().Add(15 * time.Minute).Truncate(time.Second)
+
+	f := useFakeDB(t)
+	cancelled := false
+	f.on("WHERE e.id = $1 AND e.status = 'scheduled'", func(args []interface{}) fakeResult {
+		if cancelled {
+			return fakeRows(reminderEventColumns)
+		}
+		return fakeRows(reminderEventColumns, reminderEventRow(1, start))
+	})
+	f.on("FROM event_exceptions WHERE event_id = ANY($1)", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"event_id", "occurrence_start", "status", "title", "description", "starts_at", "ends_at", "updated_at"})
+	})
+	// The host and those going or maybe going; not anyone declined or
+	// waitlisted
+	f.on(`
+		SELECT host_id FROM events WHERE id = $1
+		UNION
+		SELECT user_id FROM event_rsvps WHERE event_id = $1 AND status IN ('going', 'maybe')
+	`, func(args []interface{}) fakeResult {
+		return fakeRows([]string{"host_id"}, []interface{}{2}, []interface{}{3}, []interface{}{4})
+	})
+	reminded := make(map[int]bool)
+	f.on("INSERT INTO event_reminders_sent", func(args []interface{}) fakeResult {
+		userID := args[1].(int)
+		if reminded[userID] {
+			return fakeAffected(0)
+		}
+		reminded[userID] = true
+		return fakeAffected(1)
+	})
+	notifications := recordNotifications(t)
+
+	send := func(startsAt time.Time) {
+		t.Helper()
+		payload, _ := json.Marshal(eventReminderPayload{EventID: 1, Occurrence: startsAt, StartsAt: startsAt, Offset: "15m0s"})
+		if err := sendEventReminder(payload); err != nil {
+			t.Fatalf("sendEventReminder error: %v", err)
+		}
+	}
+
+	send(start)
+	got := notifications.recipients("event_reminder")
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Fatalf("reminded %v, want [2 3 4]", got)
+	}
+
+	// A rerun job skips everyone already reminded
+	send(start)
+	if got := notifications.recipients("event_reminder"); len(got) != 3 {
+		t.Errorf("rerun reminded %v, want nobody more", got[3:])
+	}
+
+	// Reminders for a time the event no longer starts at, or for a cancelled
+	// event, are dropped
+	reminded = make(map[int]bool)
+	send(start.Add(-time.Hour))
+	cancelled = true
+	send(start)
+	if got := notifications.recipients("event_reminder"); len(got) != 3 {
+		t.Errorf("stale reminders went to %v", got[3:])
+	}
+}
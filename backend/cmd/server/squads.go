@@ -0,0 +1,1108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	minSquadNameLength = 3
+	maxSquadNameLength = 32
+	// defaultSquadRosterLimit applies to games without their own limit.
+	defaultSquadRosterLimit = 10
+)
+
+var (
+	squadRoles      = []string{"owner", "captain", "member"}
+	squadTagPattern = regexp.MustCompile(`^[A-Za-z0-9]{2,5}$`)
+)
+
+// squadRosterLimits caps squad size by main game: a full team plus
+// substitutes.
+var squadRosterLimits = map[string]int{
+	"Valorant":              7,
+	"BGMI":                  6,
+	"Counter-Strike 2":      7,
+	"League of Legends":     7,
+	"Dota 2":                7,
+	"Apex Legends":          5,
+	"Fortnite":              6,
+	"Call of Duty: Warzone": 6,
+	"PUBG: BATTLEGROUNDS":   6,
+	"Minecraft":             20,
+	"GTA V":                 30,
+	"Overwatch 2":           7,
+	"Rainbow Six Siege":     7,
+	"Rocket League":         5,
+}
+
+func squadRosterLimit(game string) int {
+	if limit, ok := squadRosterLimits[game]; ok {
+		return limit
+	}
+	return defaultSquadRosterLimit
+}
+
+type Squad struct {
+	ID          int       `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Tag         string    `json:"tag" db:"tag"`
+	LogoURL     *string   `json:"logoUrl,omitempty" db:"logo_url"`
+	MainGame    string    `json:"mainGame" db:"main_game"`
+	MemberCount int       `json:"memberCount" db:"member_count"`
+	RosterLimit int       `json:"rosterLimit" db:"-"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+type SquadMember struct {
+	Username string    `json:"username" db:"username"`
+	Role     string    `json:"role" db:"role"`
+	JoinedAt time.Time `json:"joinedAt" db:"joined_at"`
+}
+
+// SquadRequest is a pending invite from a squad or a request to join one.
+type SquadRequest struct {
+	Squad     string    `json:"squad" db:"squad"`
+	SquadName string    `json:"squadName" db:"squad_name"`
+	Username  string    `json:"username" db:"username"`
+	Kind      string    `json:"kind" db:"kind"`
+	InvitedBy *string   `json:"invitedBy,omitempty" db:"invited_by"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// UserSquad is a squad shown on a member's profile.
+type UserSquad struct {
+	Name     string  `json:"name" db:"name"`
+	Tag      string  `json:"tag" db:"tag"`
+	LogoURL  *string `json:"logoUrl,omitempty" db:"logo_url"`
+	MainGame string  `json:"mainGame" db:"main_game"`
+	Role     string  `json:"role" db:"role"`
+}
+
+const squadColumns = `
+	s.id, s.name, s.tag, s.logo_url, s.main_game, s.created_at,
+	(SELECT COUNT(*) FROM squad_members m WHERE m.squad_id = s.id) AS member_count`
+
+func initSquadTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS squads (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(32) NOT NULL,
+		tag VARCHAR(5) NOT NULL,
+		logo_url VARCHAR(500),
+		main_game VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS squads_name_idx ON squads (LOWER(name));
+	CREATE UNIQUE INDEX IF NOT EXISTS squads_tag_idx ON squads (tag);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS squad_members (
+		squad_id INTEGER NOT NULL REFERENCES squads(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		role VARCHAR(20) NOT NULL DEFAULT 'member',
+		joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (squad_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS squad_members_user_id_idx ON squad_members (user_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS squad_members_owner_idx ON squad_members (squad_id) WHERE role = 'owner';
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Like follow_requests, one row per squad and user: kind says who asked,
+	// and a rejected or withdrawn row can be reopened
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS squad_requests (
+		id SERIAL PRIMARY KEY,
+		squad_id INTEGER NOT NULL REFERENCES squads(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		kind VARCHAR(20) NOT NULL,
+		invited_by INTEGER REFERENCES users(id),
+		status VARCHAR(20) DEFAULT 'pending',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(squad_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS squad_requests_user_id_idx ON squad_requests (user_id) WHERE status = 'pending';
+	`)
+	return err
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint
+// failure.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func validateSquadName(name string) error {
+	if len(name) < minSquadNameLength || len(name) > maxSquadNameLength {
+		return fmt.Errorf("Name must be between %d and %d characters", minSquadNameLength, maxSquadNameLength)
+	}
+	return nil
+}
+
+func validateSquadTag(tag string) error {
+	if !squadTagPattern.MatchString(tag) {
+		return fmt.Errorf("Tag must be 2 to 5 letters or digits")
+	}
+	return nil
+}
+
+func validateLogoURL(link string) error {
+	parsed, err := url.Parse(link)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || len(link) > 500 {
+		return fmt.Errorf("Logo must be an http or https URL")
+	}
+	return nil
+}
+
+// squadTagFromRequest returns the squad tag in the URL, uppercased.
+func squadTagFromRequest(r *http.Request) string {
+	return strings.ToUpper(mux.Vars(r)["tag"])
+}
+
+// loadSquad returns the squad with the given tag.
+func loadSquad(q queryer, tag string) (*Squad, error) {
+	var squad Squad
+	err := q.Get(&squad, `SELECT `+squadColumns+` FROM squads s WHERE s.tag = $1`, tag)
+	if err != nil {
+		return nil, err
+	}
+	squad.RosterLimit = squadRosterLimit(squad.MainGame)
+	return &squad, nil
+}
+
+// squadMembership is a locked squad and the caller's role in it, empty if
+// they aren't a member.
+type squadMembership struct {
+	SquadID  int
+	Name     string
+	MainGame string
+	Role     string
+}
+
+func (m *squadMembership) isStaff() bool {
+	return m.Role == "owner" || m.Role == "captain"
+}
+
+// lockSquad locks the squad named in the URL, serialising roster changes so
+// the size limit holds.
+func lockSquad(w http.ResponseWriter, r *http.Request, tx queryer, userID int) (*squadMembership, bool) {
+	var squad struct {
+		ID       int    `db:"id"`
+		Name     string `db:"name"`
+		MainGame string `db:"main_game"`
+	}
+	err := tx.Get(&squad, "SELECT id, name, main_game FROM squads WHERE tag = $1 FOR UPDATE", squadTagFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Squad not found"}`, http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	membership := &squadMembership{SquadID: squad.ID, Name: squad.Name, MainGame: squad.MainGame}
+	err = tx.Get(&membership.Role, "SELECT role FROM squad_members WHERE squad_id = $1 AND user_id = $2", squad.ID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+	return membership, true
+}
+
+// addSquadMember adds userID to a locked squad if the roster has room and
+// closes their pending request.
+func addSquadMember(w http.ResponseWriter, tx execQueryer, m *squadMembership, userID int) bool {
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM squad_members WHERE squad_id = $1", m.SquadID).Scan(&count); err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return false
+	}
+	if limit := squadRosterLimit(m.MainGame); count >= limit {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("Squad roster is full (%d players for %s)", limit, m.MainGame))
+		return false
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO squad_members (squad_id, user_id, role)
+		VALUES ($1, $2, 'member')
+		ON CONFLICT DO NOTHING
+	`, m.SquadID, userID)
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE squad_requests SET status = 'accepted'
+			WHERE squad_id = $1 AND user_id = $2 AND status = 'pending'
+		`, m.SquadID, userID)
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Error adding squad member"}`, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// squadStaffIDs returns the owner and captains of a squad.
+func squadStaffIDs(q queryer, squadID int) ([]int, error) {
+	var ids []int
+	err := q.Select(&ids, `
+		SELECT user_id FROM squad_members
+		WHERE squad_id = $1 AND role IN ('owner', 'captain')
+		ORDER BY user_id
+	`, squadID)
+	return ids, err
+}
+
+func writeSquad(w http.ResponseWriter, tag string, status int) {
+	squad, err := loadSquad(db, tag)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(squad)
+}
+
+func createSquadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Name     string `json:"name"`
+		Tag      string `json:"tag"`
+		LogoURL  string `json:"logoUrl"`
+		MainGame string `json:"mainGame"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(requestBody.Name)
+	if err := validateSquadName(name); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tag := strings.ToUpper(strings.TrimSpace(requestBody.Tag))
+	if err := validateSquadTag(tag); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var logo *string
+	if link := strings.TrimSpace(requestBody.LogoURL); link != "" {
+		if err := validateLogoURL(link); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logo = &link
+	}
+	game, ok := lookupCatalogGame(requestBody.MainGame)
+	if !ok {
+		http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var squadID int
+	err = tx.QueryRow(`
+		INSERT INTO squads (name, tag, logo_url, main_game)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, name, tag, logo, game).Scan(&squadID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, `{"error":"Squad name or tag is already taken"}`, http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating squad: %v", err)
+		http.Error(w, `{"error":"Error creating squad"}`, http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO squad_members (squad_id, user_id, role) VALUES ($1, $2, 'owner')", squadID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error creating squad"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error creating squad"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeSquad(w, tag, http.StatusCreated)
+}
+
+// getSquadProfileHandler returns a squad and its roster, owner first.
+func getSquadProfileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	squad, err := loadSquad(db, squadTagFromRequest(r))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Squad not found"}`, http.StatusNotFound)
+			return
+		}
+		log.Printf("Error loading squad: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	members := []SquadMember{}
+	err = db.Select(&members, `
+		SELECT u.username, m.role, m.joined_at
+		FROM squad_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.squad_id = $1
+		ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'captain' THEN 1 ELSE 2 END, m.joined_at, u.id
+	`, squad.ID)
+	if err != nil {
+		log.Printf("Error loading squad members: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"squad":   squad,
+		"members": members,
+	})
+}
+
+// loadUserSquads lists the squads a user belongs to.
+func loadUserSquads(userID int) ([]UserSquad, error) {
+	squads := []UserSquad{}
+	err := db.Select(&squads, `
+		SELECT s.name, s.tag, s.logo_url, s.main_game, m.role
+		FROM squad_members m
+		JOIN squads s ON s.id = m.squad_id
+		WHERE m.user_id = $1
+		ORDER BY m.joined_at, s.id
+	`, userID)
+	return squads, err
+}
+
+func userSquadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	squads, err := loadUserSquads(userID)
+	if err != nil {
+		log.Printf("Error loading squads: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(squads)
+}
+
+// updateSquadHandler edits the squad profile. Captains can change the logo
+// and main game; renaming or retagging is left to the owner.
+func updateSquadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Name     *string `json:"name"`
+		Tag      *string `json:"tag"`
+		LogoURL  *string `json:"logoUrl"`
+		MainGame *string `json:"mainGame"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if !membership.isStaff() {
+		http.Error(w, `{"error":"Only the owner and captains can edit the squad"}`, http.StatusForbidden)
+		return
+	}
+	if (requestBody.Name != nil || requestBody.Tag != nil) && membership.Role != "owner" {
+		http.Error(w, `{"error":"Only the owner can rename the squad"}`, http.StatusForbidden)
+		return
+	}
+
+	var name, tag, logo, game *string
+	if requestBody.Name != nil {
+		value := strings.TrimSpace(*requestBody.Name)
+		if err := validateSquadName(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		name = &value
+	}
+	if requestBody.Tag != nil {
+		value := strings.ToUpper(strings.TrimSpace(*requestBody.Tag))
+		if err := validateSquadTag(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		tag = &value
+	}
+	clearLogo := false
+	if requestBody.LogoURL != nil {
+		value := strings.TrimSpace(*requestBody.LogoURL)
+		if value == "" {
+			clearLogo = true
+		} else if err := validateLogoURL(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		} else {
+			logo = &value
+		}
+	}
+	if requestBody.MainGame != nil {
+		value, ok := lookupCatalogGame(*requestBody.MainGame)
+		if !ok {
+			http.Error(w, `{"error":"Unknown game"}`, http.StatusBadRequest)
+			return
+		}
+		var count int
+		if err := tx.Get(&count, "SELECT COUNT(*) FROM squad_members WHERE squad_id = $1", membership.SquadID); err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+		if limit := squadRosterLimit(value); count > limit {
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("%s squads can have at most %d players", value, limit))
+			return
+		}
+		game = &value
+	}
+
+	var newTag string
+	err = tx.QueryRow(`
+		UPDATE squads
+		SET name = COALESCE($2, name), tag = COALESCE($3, tag),
+			logo_url = CASE WHEN $4 THEN NULL ELSE COALESCE($5, logo_url) END,
+			main_game = COALESCE($6, main_game), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING tag
+	`, membership.SquadID, name, tag, clearLogo, logo, game).Scan(&newTag)
+	if err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, `{"error":"Squad name or tag is already taken"}`, http.StatusConflict)
+			return
+		}
+		log.Printf("Error updating squad: %v", err)
+		http.Error(w, `{"error":"Error updating squad"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error updating squad"}`, http.StatusInternalServerError)
+		return
+	}
+
+	writeSquad(w, newTag, http.StatusOK)
+}
+
+func deleteSquadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "owner" {
+		http.Error(w, `{"error":"Only the owner can disband the squad"}`, http.StatusForbidden)
+		return
+	}
+
+	var memberIDs []int
+	err = tx.Select(&memberIDs, "SELECT user_id FROM squad_members WHERE squad_id = $1 AND user_id <> $2", membership.SquadID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Error disbanding squad"}`, http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM squads WHERE id = $1", membership.SquadID); err != nil {
+		http.Error(w, `{"error":"Error disbanding squad"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error disbanding squad"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for _, memberID := range memberIDs {
+		notify(memberID, "squad_disbanded", map[string]interface{}{"squad": membership.Name})
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Squad disbanded"})
+}
+
+// inviteToSquadHandler invites a player. If they already asked to join,
+// the invite accepts their request instead.
+func inviteToSquadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	inviteeID, err := userIDByUsername(requestBody.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if !membership.isStaff() {
+		http.Error(w, `{"error":"Only the owner and captains can invite players"}`, http.StatusForbidden)
+		return
+	}
+
+	var existing struct {
+		IsMember bool           `db:"is_member"`
+		Pending  sql.NullString `db:"pending"`
+	}
+	err = tx.Get(&existing, `
+		SELECT
+			EXISTS(SELECT 1 FROM squad_members WHERE squad_id = $1 AND user_id = $2) AS is_member,
+			(SELECT kind FROM squad_requests WHERE squad_id = $1 AND user_id = $2 AND status = 'pending') AS pending
+	`, membership.SquadID, inviteeID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if existing.IsMember {
+		http.Error(w, `{"error":"User is already in the squad"}`, http.StatusConflict)
+		return
+	}
+
+	joined := existing.Pending.String == "join"
+	if joined {
+		if !addSquadMember(w, tx, membership, inviteeID) {
+			return
+		}
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO squad_requests (squad_id, user_id, kind, invited_by, status)
+			VALUES ($1, $2, 'invite', $3, 'pending')
+			ON CONFLICT (squad_id, user_id)
+			DO UPDATE SET kind = 'invite', invited_by = EXCLUDED.invited_by, status = 'pending',
+				created_at = CURRENT_TIMESTAMP
+			WHERE squad_requests.status <> 'pending'
+		`, membership.SquadID, inviteeID, userID)
+		if err != nil {
+			http.Error(w, `{"error":"Error sending invite"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error sending invite"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if joined {
+		notify(inviteeID, "squad_request_accepted", map[string]interface{}{"squad": squadTagFromRequest(r)})
+		json.NewEncoder(w).Encode(map[string]string{"status": "member", "message": "Join request accepted"})
+		return
+	}
+	notify(inviteeID, "squad_invite", map[string]interface{}{
+		"squad": squadTagFromRequest(r),
+		"from":  claims.Username,
+	})
+	json.NewEncoder(w).Encode(map[string]string{"status": "invited", "message": "Invite sent"})
+}
+
+// joinSquadHandler asks to join a squad. If the squad already invited the
+// caller, this accepts the invite.
+func joinSquadHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "" {
+		http.Error(w, `{"error":"You are already in this squad"}`, http.StatusConflict)
+		return
+	}
+
+	var pending string
+	err = tx.Get(&pending, `
+		SELECT kind FROM squad_requests WHERE squad_id = $1 AND user_id = $2 AND status = 'pending'
+	`, membership.SquadID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	joined := pending == "invite"
+	if joined {
+		if !addSquadMember(w, tx, membership, userID) {
+			return
+		}
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO squad_requests (squad_id, user_id, kind, status)
+			VALUES ($1, $2, 'join', 'pending')
+			ON CONFLICT (squad_id, user_id)
+			DO UPDATE SET kind = 'join', invited_by = NULL, status = 'pending', created_at = CURRENT_TIMESTAMP
+			WHERE squad_requests.status <> 'pending'
+		`, membership.SquadID, userID)
+		if err != nil {
+			http.Error(w, `{"error":"Error sending join request"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	staffIDs, err := squadStaffIDs(tx, membership.SquadID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error sending join request"}`, http.StatusInternalServerError)
+		return
+	}
+
+	kind, status, message := "squad_join_request", "requested", "Join request sent"
+	if joined {
+		kind, status, message = "squad_member_joined", "member", "Joined squad"
+	}
+	for _, staffID := range staffIDs {
+		notify(staffID, kind, map[string]interface{}{
+			"squad":    squadTagFromRequest(r),
+			"username": claims.Username,
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": status, "message": message})
+}
+
+// declineSquadInviteHandler turns down an invite, or withdraws the
+// caller's own join request.
+func declineSquadInviteHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	result, err := db.Exec(`
+		UPDATE squad_requests q
+		SET status = CASE WHEN q.kind = 'invite' THEN 'rejected' ELSE 'cancelled' END
+		FROM squads s, users u
+		WHERE s.id = q.squad_id AND u.id = q.user_id
+		AND s.tag = $1 AND u.username = $2 AND q.status = 'pending'
+	`, squadTagFromRequest(r), claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Error declining invite"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"No pending invite or request"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Declined"})
+}
+
+// mySquadInvitesHandler lists squads that have invited the caller.
+func mySquadInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	requests := []SquadRequest{}
+	err := db.Select(&requests, `
+		SELECT s.tag AS squad, s.name AS squad_name, u.username, q.kind, i.username AS invited_by, q.created_at
+		FROM squad_requests q
+		JOIN squads s ON s.id = q.squad_id
+		JOIN users u ON u.id = q.user_id
+		LEFT JOIN users i ON i.id = q.invited_by
+		WHERE u.username = $1 AND q.status = 'pending'
+		ORDER BY q.created_at DESC, q.id DESC
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error listing squad invites: %v", err)
+		http.Error(w, `{"error":"Error listing invites"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(requests)
+}
+
+// squadRequestsHandler lists a squad's pending join requests and
+// outstanding invites for its owner and captains.
+func squadRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var role string
+	err := db.Get(&role, `
+		SELECT m.role FROM squad_members m
+		JOIN squads s ON s.id = m.squad_id
+		JOIN users u ON u.id = m.user_id
+		WHERE s.tag = $1 AND u.username = $2
+	`, squadTagFromRequest(r), claims.Username)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if role != "owner" && role != "captain" {
+		http.Error(w, `{"error":"Only the owner and captains can see requests"}`, http.StatusForbidden)
+		return
+	}
+
+	requests := []SquadRequest{}
+	err = db.Select(&requests, `
+		SELECT s.tag AS squad, s.name AS squad_name, u.username, q.kind, i.username AS invited_by, q.created_at
+		FROM squad_requests q
+		JOIN squads s ON s.id = q.squad_id
+		JOIN users u ON u.id = q.user_id
+		LEFT JOIN users i ON i.id = q.invited_by
+		WHERE s.tag = $1 AND q.status = 'pending'
+		ORDER BY q.created_at, q.id
+	`, squadTagFromRequest(r))
+	if err != nil {
+		log.Printf("Error listing squad requests: %v", err)
+		http.Error(w, `{"error":"Error listing requests"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(requests)
+}
+
+// acceptSquadRequestHandler lets the owner or a captain accept a join
+// request; rejectSquadRequestHandler turns it down or withdraws an invite.
+func acceptSquadRequestHandler(w http.ResponseWriter, r *http.Request) {
+	respondToSquadRequest(w, r, true)
+}
+
+func rejectSquadRequestHandler(w http.ResponseWriter, r *http.Request) {
+	respondToSquadRequest(w, r, false)
+}
+
+func respondToSquadRequest(w http.ResponseWriter, r *http.Request, accept bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	requesterID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if !membership.isStaff() {
+		http.Error(w, `{"error":"Only the owner and captains can answer requests"}`, http.StatusForbidden)
+		return
+	}
+
+	var kind string
+	err = tx.Get(&kind, `
+		SELECT kind FROM squad_requests WHERE squad_id = $1 AND user_id = $2 AND status = 'pending'
+	`, membership.SquadID, requesterID)
+	if err == sql.ErrNoRows || (err == nil && accept && kind != "join") {
+		http.Error(w, `{"error":"No pending join request"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if accept {
+		if !addSquadMember(w, tx, membership, requesterID) {
+			return
+		}
+	} else {
+		status := "rejected"
+		if kind == "invite" {
+			status = "cancelled"
+		}
+		_, err = tx.Exec(`
+			UPDATE squad_requests SET status = $3
+			WHERE squad_id = $1 AND user_id = $2
+		`, membership.SquadID, requesterID, status)
+		if err != nil {
+			http.Error(w, `{"error":"Error rejecting request"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error answering request"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if accept {
+		notify(requesterID, "squad_request_accepted", map[string]interface{}{"squad": squadTagFromRequest(r)})
+		json.NewEncoder(w).Encode(map[string]string{"message": "Join request accepted"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Request rejected"})
+}
+
+// setSquadRoleHandler changes a member's role. Only the owner can do it,
+// and making someone else owner hands the squad over, leaving the old
+// owner a captain.
+func setSquadRoleHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	role := strings.ToLower(strings.TrimSpace(requestBody.Role))
+	if !containsString(squadRoles, role) {
+		writeJSONError(w, http.StatusBadRequest, "Role must be one of "+strings.Join(squadRoles, ", "))
+		return
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	memberID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+	if membership.Role != "owner" {
+		http.Error(w, `{"error":"Only the owner can change roles"}`, http.StatusForbidden)
+		return
+	}
+	if memberID == userID {
+		http.Error(w, `{"error":"Make another member owner to step down"}`, http.StatusBadRequest)
+		return
+	}
+
+	if role == "owner" {
+		_, err = tx.Exec("UPDATE squad_members SET role = 'captain' WHERE squad_id = $1 AND user_id = $2", membership.SquadID, userID)
+		if err != nil {
+			http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	result, err := tx.Exec("UPDATE squad_members SET role = $3 WHERE squad_id = $1 AND user_id = $2", membership.SquadID, memberID, role)
+	if err != nil {
+		http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, `{"error":"User is not in the squad"}`, http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error changing role"}`, http.StatusInternalServerError)
+		return
+	}
+
+	notify(memberID, "squad_role_changed", map[string]interface{}{
+		"squad": squadTagFromRequest(r),
+		"role":  role,
+	})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role updated", "role": role})
+}
+
+// removeSquadMemberHandler removes a member, or lets the caller leave. The
+// owner can remove anyone, captains only plain members, and the owner has
+// to hand the squad over or disband it rather than leave.
+func removeSquadMemberHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	memberID, err := userIDByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership, ok := lockSquad(w, r, tx, userID)
+	if !ok {
+		return
+	}
+
+	var memberRole string
+	err = tx.Get(&memberRole, "SELECT role FROM squad_members WHERE squad_id = $1 AND user_id = $2", membership.SquadID, memberID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User is not in the squad"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	leaving := memberID == userID
+	switch {
+	case memberRole == "owner":
+		http.Error(w, `{"error":"The owner must hand over or disband the squad"}`, http.StatusConflict)
+		return
+	case leaving:
+	case membership.Role == "owner":
+	case membership.Role == "captain" && memberRole == "member":
+	default:
+		http.Error(w, `{"error":"You can't remove this member"}`, http.StatusForbidden)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM squad_members WHERE squad_id = $1 AND user_id = $2", membership.SquadID, memberID)
+	if err != nil {
+		http.Error(w, `{"error":"Error removing member"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error removing member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if leaving {
+		json.NewEncoder(w).Encode(map[string]string{"message": "Left squad"})
+		return
+	}
+	notify(memberID, "squad_removed", map[string]interface{}{"squad": squadTagFromRequest(r)})
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member removed"})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateSquadTag(t *testing.T) {
+	for _, tag := range []string{"GG", "ACE", "T1", "FNC42"} {
+		if err := validateSquadTag(tag); err != nil {
+			t.Errorf("validateSquadTag(%q) = %v", tag, err)
+		}
+	}
+	// Tags name squads in URLs, so none may look like another squad route
+	for _, tag := range []string{"", "A", "TOOLONG", "INVITES", "A-B", "A B", "É1"} {
+		if err := validateSquadTag(tag); err == nil {
+			t.Errorf("validateSquadTag(%q) accepted", tag)
+		}
+	}
+}
+
+// squadRosterIDs are the users of the squad permission tests.
+var squadRosterIDs = map[string]int{"owner": 1, "captain": 2, "member": 3, "rookie": 4, "outsider": 5}
+
+// fakeSquad is squad ACE as the squad permission tests see it: the role of
+// each member and the changes made to the roster.
+type fakeSquad struct {
+	roles   map[int]string
+	removed []int
+}
+
+// useFakeSquad answers the roster queries of the squad handlers for ACE,
+// owned by "owner", with "captain" a captain and "member" and "rookie"
+// plain members.
+func useFakeSquad(f *fakeDB) *fakeSquad {
+	squad := &fakeSquad{roles: map[int]string{1: "owner", 2: "captain", 3: "member", 4: "member"}}
+	f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRow("id", squadRosterIDs[args[0].(string)])
+	})
+	f.on("SELECT id, name, main_game FROM squads WHERE tag = $1 FOR UPDATE", func(args []interface{}) fakeResult {
+		if args[0] != "ACE" {
+			f.t.Errorf("locked squad %v", args[0])
+		}
+		return fakeRows([]string{"id", "name", "main_game"}, []interface{}{9, "Aces", "Valorant"})
+	})
+	f.on("SELECT role FROM squad_members WHERE squad_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+		role, ok := squad.roles[args[1].(int)]
+		if !ok {
+			return fakeRows([]string{"role"})
+		}
+		return fakeRow("role", role)
+	})
+	f.on("UPDATE squad_members SET role = 'captain' WHERE squad_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+		squad.roles[args[1].(int)] = "captain"
+		return fakeAffected(1)
+	})
+	f.on("UPDATE squad_members SET role = $3 WHERE squad_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+		if _, ok := squad.roles[args[1].(int)]; !ok {
+			return fakeAffected(0)
+		}
+		squad.roles[args[1].(int)] = args[2].(string)
+		return fakeAffected(1)
+	})
+	f.on("DELETE FROM squad_members WHERE squad_id = $1 AND user_id = $2", func(args []interface{}) fakeResult {
+		delete(squad.roles, args[1].(int))
+		squad.removed = append(squad.removed, args[1].(int))
+		return fakeAffected(1)
+	})
+	return squad
+}
+
+func TestSetSquadRoleHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		caller   string
+		member   string
+		role     string
+		want     int
+		roles    map[int]string
+		notified []int
+	}{
+		{name: "owner promotes", caller: "owner", member: "member", role: "captain", want: http.StatusOK,
+			roles: map[int]string{1: "owner", 2: "captain", 3: "captain", 4: "member"}, notified: []int{3}},
+		{name: "owner hands over", caller: "owner", member: "captain", role: "Owner", want: http.StatusOK,
+			roles: map[int]string{1: "captain", 2: "owner", 3: "member", 4: "member"}, notified: []int{2}},
+		{name: "captain can't", caller: "captain", member: "member", role: "captain", want: http.StatusForbidden},
+		{name: "member can't", caller: "member", member: "rookie", role: "captain", want: http.StatusForbidden},
+		{name: "outsider can't", caller: "outsider", member: "member", role: "owner", want: http.StatusForbidden},
+		{name: "owner can't step down alone", caller: "owner", member: "owner", role: "member", want: http.StatusBadRequest},
+		{name: "unknown role", caller: "owner", member: "member", role: "coach", want: http.StatusBadRequest},
+		{name: "not in the squad", caller: "owner", member: "outsider", role: "member", want: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			squad := useFakeSquad(useFakeDB(t))
+			before := map[int]string{}
+			for id, role := range squad.roles {
+				before[id] = role
+			}
+			notifications := recordNotifications(t)
+
+			r := mux.SetURLVars(testRequest("PUT", "/squads/ace/members/"+test.member, `{"role":"`+test.role+`"}`, test.caller),
+				map[string]string{"tag": "ace", "username": test.member})
+			w := serve(setSquadRoleHandler, r)
+			if w.Code != test.want {
+				t.Fatalf("set role = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+			// Refusals leave every role as it was
+			want := test.roles
+			if want == nil {
+				want = before
+			}
+			if !reflect.DeepEqual(squad.roles, want) {
+				t.Errorf("roles = %v, want %v", squad.roles, want)
+			}
+			if got := notifications.recipients("squad_role_changed"); !reflect.DeepEqual(got, test.notified) {
+				t.Errorf("notified %v, want %v", got, test.notified)
+			}
+		})
+	}
+}
+
+func TestRemoveSquadMemberHandler(t *testing.T) {
+	tests := []struct {
+		caller, member string
+		want           int
+	}{
+		{"owner", "captain", http.StatusOK},
+		{"owner", "member", http.StatusOK},
+		{"captain", "member", http.StatusOK},
+		{"captain", "captain", http.StatusOK},
+		{"member", "member", http.StatusOK},
+		{"captain", "owner", http.StatusConflict},
+		{"owner", "owner", http.StatusConflict},
+		{"member", "rookie", http.StatusForbidden},
+		{"member", "captain", http.StatusForbidden},
+		{"outsider", "member", http.StatusForbidden},
+		{"owner", "outsider", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.caller+" removes "+test.member, func(t *testing.T) {
+			squad := useFakeSquad(useFakeDB(t))
+			notifications := recordNotifications(t)
+
+			r := mux.SetURLVars(testRequest("DELETE", "/squads/ace/members/"+test.member, "", test.caller),
+				map[string]string{"tag": "ace", "username": test.member})
+			w := serve(removeSquadMemberHandler, r)
+			if w.Code != test.want {
+				t.Fatalf("remove = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+
+			memberID := squadRosterIDs[test.member]
+			var removed, notified []int
+			if test.want == http.StatusOK {
+				removed = []int{memberID}
+				// Nobody is told they left
+				if test.caller != test.member {
+					notified = []int{memberID}
+				}
+			}
+			if !reflect.DeepEqual(squad.removed, removed) {
+				t.Errorf("removed %v, want %v", squad.removed, removed)
+			}
+			if got := notifications.recipients("squad_removed"); !reflect.DeepEqual(got, notified) {
+				t.Errorf("notified %v, want %v", got, notified)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// sseKeepaliveInterval keeps idle streams open through proxies that
+	// drop silent connections.
+	sseKeepaliveInterval = 15 * time.Second
+	// sseRetry tells clients how long to wait before reconnecting.
+	sseRetry = 5 * time.Second
+	// eventLogRetention is how far back a reconnecting client can resume.
+	eventLogRetention = 7 * 24 * time.Hour
+	// eventLogBatchSize bounds how many events are read from the log at once.
+	eventLogBatchSize = 100
+	// eventLogLockClass keys the per-user advisory locks that order event
+	// log inserts, in the two-key space apart from the other locks.
+	eventLogLockClass = 7460303
+)
+
+// loggedEvent is a notification as stored in the event log.
+type loggedEvent struct {
+	ID        int64     `db:"id"`
+	Type      string    `db:"type"`
+	Payload   string    `db:"payload"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func initEventLogTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS event_log (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type VARCHAR(64) NOT NULL,
+		payload JSONB NOT NULL DEFAULT '{}',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS event_log_user_id_idx ON event_log (user_id, id);
+	CREATE INDEX IF NOT EXISTS event_log_created_at_idx ON event_log (created_at);
+	`)
+	return err
+}
+
+// eventLog is a notificationChannel that records every notification so
+// event streams can resume where they left off, and wakes the streams of
+// the notified user.
+type eventLog struct {
+	mu      sync.Mutex
+	waiters map[int]map[chan struct{}]struct{}
+}
+
+var notificationLog *eventLog
+
+// newEventLog returns an event log whose streams are also woken by the
+// broker's events, so a notification logged on another instance reaches
+// streams open on this one. The log must be registered as a channel before
+// the realtime hub for that event to arrive after the row is written.
+func newEventLog(broker realtimeBroker) *eventLog {
+	l := &eventLog{waiters: make(map[int]map[chan struct{}]struct{})}
+	broker.Subscribe(func(event realtimeEvent) {
+		for _, userID := range event.UserIDs {
+			l.wake(userID)
+		}
+	})
+	return l
+}
+
+func (l *eventLog) Name() string {
+	return "event_log"
+}
+
+// Deliver logs the notification. Streams resume after the last id they
+// saw, so a user's events must become visible in id order: an event whose
+// id was taken before another's but committed after it would be skipped.
+// The user's inserts are serialized by an advisory lock held until commit.
+func (l *eventLog) Deliver(n Notification) error {
+	payload, err := json.Marshal(n.Payload)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", eventLogLockClass, n.UserID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO event_log (user_id, type, payload, created_at)
+		VALUES ($1, $2, $3, $4)
+	`, n.UserID, n.Type, string(payload), n.CreatedAt)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	l.wake(n.UserID)
+	return nil
+}
+
+// subscribe returns a channel signalled whenever userID may have new
+// events. Signals are coalesced, so the stream should read everything
+// pending each time.
+func (l *eventLog) subscribe(userID int) (<-chan struct{}, func()) {
+	wake := make(chan struct{}, 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.waiters[userID] == nil {
+		l.waiters[userID] = make(map[chan struct{}]struct{})
+	}
+	l.waiters[userID][wake] = struct{}{}
+
+	return wake, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.waiters[userID], wake)
+		if len(l.waiters[userID]) == 0 {
+			delete(l.waiters, userID)
+		}
+	}
+}
+
+func (l *eventLog) wake(userID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for wake := range l.waiters[userID] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// registerEventLogPruning drops events too old to resume from.
+func registerEventLogPruning() {
+	registerJobPlanner(func(now time.Time) error {
+		_, err := db.Exec("DELETE FROM event_log WHERE created_at < $1", now.Add(-eventLogRetention))
+		return err
+	})
+}
+
+// eventStreamHandler streams the caller's notifications as Server-Sent
+// Events, for clients that can't use the WebSocket. Each event's id is its
+// position in the event log, so a client reconnecting with Last-Event-ID
+// gets everything it missed; without one the stream starts from now.
+func eventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `{"error":"Streaming unsupported"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// EventSource polyfills that can't set headers send it as a parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		parsed, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, `{"error":"Invalid Last-Event-ID"}`, http.StatusBadRequest)
+			return
+		}
+		lastID = parsed
+	}
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the log so nothing written in between is
+	// missed
+	wake, unsubscribe := notificationLog.subscribe(userID)
+	defer unsubscribe()
+
+	if lastEventID == "" {
+		err = db.Get(&lastID, "SELECT COALESCE(MAX(id), 0) FROM event_log WHERE user_id = $1", userID)
+		if err != nil {
+			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		lastID, err = writeLoggedEvents(w, userID, lastID)
+		if err != nil {
+			log.Printf("Error streaming events to user %d: %v", userID, err)
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeLoggedEvents writes the user's events after lastID and returns the
+// id of the last one written.
+func writeLoggedEvents(w http.ResponseWriter, userID int, lastID int64) (int64, error) {
+	for {
+		batch := []loggedEvent{}
+		err := db.Select(&batch, `
+			SELECT id, type, payload, created_at FROM event_log
+			WHERE user_id = $1 AND id > $2
+			ORDER BY id
+			LIMIT $3
+		`, userID, lastID, eventLogBatchSize)
+		if err != nil {
+			return lastID, err
+		}
+
+		for _, event := range batch {
+			data, err := json.Marshal(struct {
+				Payload   json.RawMessage `json:"payload"`
+				CreatedAt time.Time       `json:"createdAt"`
+			}{json.RawMessage(event.Payload), event.CreatedAt})
+			if err != nil {
+				return lastID, err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return lastID, err
+			}
+			lastID = event.ID
+		}
+		if len(batch) < eventLogBatchSize {
+			return lastID, nil
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// growthWeeks is how many weekly buckets the growth series covers.
+	growthWeeks = 12
+	// trendingWindow is the period newPlayers is counted over.
+	trendingWindow = 7 * 24 * time.Hour
+	// topStatsLimit caps the region and co-played lists per game.
+	topStatsLimit = 5
+)
+
+type GameStatCount struct {
+	Name    string `json:"name"`
+	Players int    `json:"players"`
+}
+
+type GameGrowthPoint struct {
+	WeekStart    time.Time `json:"weekStart"`
+	NewPlayers   int       `json:"newPlayers"`
+	TotalPlayers int       `json:"totalPlayers"`
+}
+
+type GameStats struct {
+	Game       string            `json:"game"`
+	Players    int               `json:"players"`
+	NewPlayers int               `json:"newPlayers"`
+	Growth     []GameGrowthPoint `json:"growth,omitempty"`
+	TopRegions []GameStatCount   `json:"topRegions,omitempty"`
+	Ranks      []GameStatCount   `json:"ranks,omitempty"`
+	CoPlayed   []GameStatCount   `json:"coPlayed,omitempty"`
+}
+
+// gameStatsSnapshot is one refresh worth of aggregates, keyed by game name.
+type gameStatsSnapshot struct {
+	games     map[string]*GameStats
+	updatedAt time.Time
+}
+
+// gameStatsCache serves aggregates from memory and recomputes them in the
+// background so stats requests never query user_games directly.
+type gameStatsCache struct {
+	mu       sync.RWMutex
+	snapshot *gameStatsSnapshot
+	refresh  sync.Mutex
+}
+
+var gameStats = &gameStatsCache{}
+
+// gameStatsRefreshInterval reads GAME_STATS_REFRESH_INTERVAL, defaulting to
+// five minutes.
+func gameStatsRefreshInterval() time.Duration {
+	if value := os.Getenv("GAME_STATS_REFRESH_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err == nil && interval > 0 {
+			return interval
+		}
+		log.Printf("Invalid GAME_STATS_REFRESH_INTERVAL %q, using default", value)
+	}
+	return 5 * time.Minute
+}
+
+// start refreshes the cache every interval until the process exits.
+func (c *gameStatsCache) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.reload(); err != nil {
+				log.Printf("Error refreshing game stats: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// get returns the current snapshot, loading it first if no refresh has
+// completed yet.
+func (c *gameStatsCache) get() (*gameStatsSnapshot, error) {
+	c.mu.RLock()
+	snapshot := c.snapshot
+	c.mu.RUnlock()
+	if snapshot != nil {
+		return snapshot, nil
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.snapshot, nil
+}
+
+func (c *gameStatsCache) reload() error {
+	// Only one refresh runs at a time; callers that arrive while one is in
+	// flight reuse its result
+	c.refresh.Lock()
+	defer c.refresh.Unlock()
+
+	c.mu.RLock()
+	fresh := c.snapshot != nil && time.Since(c.snapshot.updatedAt) < time.Second
+	c.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	snapshot, err := loadGameStats(time.Now())
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.snapshot = snapshot
+	c.mu.Unlock()
+	return nil
+}
+
+func loadGameStats(now time.Time) (*gameStatsSnapshot, error) {
+	snapshot := &gameStatsSnapshot{
+		games:     make(map[string]*GameStats),
+		updatedAt: now,
+	}
+	game := func(name string) *GameStats {
+		stats, ok := snapshot.games[name]
+		if !ok {
+			stats = &GameStats{Game: name}
+			snapshot.games[name] = stats
+		}
+		return stats
+	}
+
+	var players []struct {
+		Game       string `db:"game_name"`
+		Players    int    `db:"players"`
+		NewPlayers int    `db:"new_players"`
+	}
+	err := db.Select(&players, `
+		SELECT game_name,
+			COUNT(DISTINCT user_id) AS players,
+			COUNT(DISTINCT user_id) FILTER (WHERE created_at::TIMESTAMPTZ >= $1) AS new_players
+		FROM user_games
+		GROUP BY game_name
+	`, now.Add(-trendingWindow))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range players {
+		stats := game(row.Game)
+		stats.Players = row.Players
+		stats.NewPlayers = row.NewPlayers
+	}
+
+	// Weekly buckets for the last growthWeeks weeks, oldest first. Weeks
+	// start on Monday in UTC, whatever the zones of the server and the
+	// database session; created_at is read as the session wrote it.
+	firstWeek := startOfWeek(now).AddDate(0, 0, -7*(growthWeeks-1))
+	var growth []struct {
+		Game       string    `db:"game_name"`
+		WeekStart  time.Time `db:"week_start"`
+		NewPlayers int       `db:"new_players"`
+	}
+	err = db.Select(&growth, `
+		SELECT game_name,
+			date_trunc('week', created_at::TIMESTAMPTZ, 'UTC') AS week_start,
+			COUNT(*) AS new_players
+		FROM user_games
+		WHERE created_at::TIMESTAMPTZ >= $1
+		GROUP BY game_name, week_start
+	`, firstWeek)
+	if err != nil {
+		return nil, err
+	}
+	weekly := make(map[string]map[time.Time]int)
+	for _, row := range growth {
+		if weekly[row.Game] == nil {
+			weekly[row.Game] = make(map[time.Time]int)
+		}
+		weekly[row.Game][startOfWeek(row.WeekStart)] += row.NewPlayers
+	}
+	for name, stats := range snapshot.games {
+		stats.Growth = growthSeries(firstWeek, stats.Players, weekly[name])
+	}
+
+	var regions []struct {
+		Game    string `db:"game_name"`
+		Region  string `db:"region"`
+		Players int    `db:"players"`
+	}
+	err = db.Select(&regions, `
+		SELECT ug.game_name, u.region, COUNT(DISTINCT u.id) AS players
+		FROM user_games ug
+		JOIN users u ON u.id = ug.user_id
+		WHERE u.region IS NOT NULL
+		GROUP BY ug.game_name, u.region
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range regions {
+		stats := game(row.Game)
+		stats.TopRegions = append(stats.TopRegions, GameStatCount{Name: row.Region, Players: row.Players})
+	}
+
+	var ranks []struct {
+		Game    string `db:"game_name"`
+		Rank    string `db:"rank"`
+		Players int    `db:"players"`
+	}
+	err = db.Select(&ranks, `
+		SELECT game_name, rank, COUNT(DISTINCT user_id) AS players
+		FROM user_games
+		WHERE rank IS NOT NULL
+		GROUP BY game_name, rank
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range ranks {
+		stats := game(row.Game)
+		stats.Ranks = append(stats.Ranks, GameStatCount{Name: row.Rank, Players: row.Players})
+	}
+
+	var coPlayed []struct {
+		Game    string `db:"game_name"`
+		Other   string `db:"other_game"`
+		Players int    `db:"players"`
+	}
+	err = db.Select(&coPlayed, `
+		SELECT a.game_name, b.game_name AS other_game, COUNT(DISTINCT a.user_id) AS players
+		FROM user_games a
+		JOIN user_games b ON b.user_id = a.user_id AND b.game_name <> a.game_name
+		GROUP BY a.game_name, b.game_name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range coPlayed {
+		stats := game(row.Game)
+		stats.CoPlayed = append(stats.CoPlayed, GameStatCount{Name: row.Other, Players: row.Players})
+	}
+
+	for _, stats := range snapshot.games {
+		stats.TopRegions = topGameStatCounts(stats.TopRegions, topStatsLimit)
+		stats.CoPlayed = topGameStatCounts(stats.CoPlayed, topStatsLimit)
+		stats.Ranks = ladderRankCounts(stats.Ranks)
+	}
+
+	return snapshot, nil
+}
+
+// topGameStatCounts sorts counts by players, ties broken by name, and keeps
+// the first limit entries.
+func topGameStatCounts(counts []GameStatCount, limit int) []GameStatCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Players != counts[j].Players {
+			return counts[i].Players > counts[j].Players
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// growthSeries returns growthWeeks weekly points from firstWeek, given the
+// current total and the players added each week. Running totals are worked
+// out backwards from the current total.
+func growthSeries(firstWeek time.Time, total int, added map[time.Time]int) []GameGrowthPoint {
+	points := make([]GameGrowthPoint, growthWeeks)
+	for i := growthWeeks - 1; i >= 0; i-- {
+		week := firstWeek.AddDate(0, 0, 7*i)
+		points[i] = GameGrowthPoint{WeekStart: week, NewPlayers: added[week], TotalPlayers: total}
+		total -= added[week]
+	}
+	return points
+}
+
+// ladderRankCounts lists rank counts in ladder order rather than by
+// popularity, merging spellings of the same tier. Ranks off the ladder,
+// stored before ranks were checked, come last by name.
+func ladderRankCounts(counts []GameStatCount) []GameStatCount {
+	merged := []GameStatCount{}
+	index := make(map[string]int)
+	for _, count := range counts {
+		name := count.Name
+		if tier, ok := lookupRankTier(name); ok {
+			name = tier
+		}
+		if i, ok := index[name]; ok {
+			merged[i].Players += count.Players
+			continue
+		}
+		index[name] = len(merged)
+		merged = append(merged, GameStatCount{Name: name, Players: count.Players})
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		li, iOK := rankLevel(merged[i].Name)
+		lj, jOK := rankLevel(merged[j].Name)
+		if iOK != jOK {
+			return iOK
+		}
+		if iOK && li != lj {
+			return li < lj
+		}
+		return merged[i].Name < merged[j].Name
+	})
+	return merged
+}
+
+// startOfWeek truncates t to Monday 00:00 UTC, matching
+// date_trunc('week', t, 'UTC').
+func startOfWeek(t time.Time) time.Time {
+	t = t.UTC()
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	offset := (int(t.Weekday()) + 6) % 7
+	return t.AddDate(0, 0, -offset)
+}
+
+func gameStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	snapshot, err := gameStats.get()
+	if err != nil {
+		log.Printf("Error loading game stats: %v", err)
+		http.Error(w, `{"error":"Error loading game stats"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// The list view only carries the headline numbers
+	games := make([]GameStats, 0, len(snapshot.games))
+	for _, stats := range snapshot.games {
+		games = append(games, GameStats{
+			Game:       stats.Game,
+			Players:    stats.Players,
+			NewPlayers: stats.NewPlayers,
+		})
+	}
+
+	trending := r.URL.Query().Get("sort") == "trending"
+	sort.Slice(games, func(i, j int) bool {
+		if trending && games[i].NewPlayers != games[j].NewPlayers {
+			return games[i].NewPlayers > games[j].NewPlayers
+		}
+		if games[i].Players != games[j].Players {
+			return games[i].Players > games[j].Players
+		}
+		return games[i].Game < games[j].Game
+	})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"games":     games,
+		"updatedAt": snapshot.updatedAt,
+	})
+}
+
+func gameDetailStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := strings.TrimSpace(mux.Vars(r)["game"])
+	if catalogName, ok := lookupCatalogGame(name); ok {
+		name = catalogName
+	}
+
+	snapshot, err := gameStats.get()
+	if err != nil {
+		log.Printf("Error loading game stats: %v", err)
+		http.Error(w, `{"error":"Error loading game stats"}`, http.StatusInternalServerError)
+		return
+	}
+
+	stats, ok := snapshot.games[name]
+	if !ok {
+		if _, inCatalog := lookupCatalogGame(name); !inCatalog {
+			http.Error(w, `{"error":"Game not found"}`, http.StatusNotFound)
+			return
+		}
+		// Catalog games nobody has connected yet have empty stats
+		stats = &GameStats{Game: name}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stats":     stats,
+		"updatedAt": snapshot.updatedAt,
+	})
+}
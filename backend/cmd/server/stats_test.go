@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStartOfWeek(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		name string
+		in   time.Time
+		want time.Time
+	}{
+		{"midweek", utc("2026-10-15T13:45:00Z"), utc("2026-10-12T00:00:00Z")},
+		{"monday midnight", utc("2026-10-12T00:00:00Z"), utc("2026-10-12T00:00:00Z")},
+		{"sunday night", utc("2026-10-18T23:59:59Z"), utc("2026-10-12T00:00:00Z")},
+		// Still Sunday in New York, but already Monday in UTC
+		{"sunday night in new york", time.Date(2026, 10, 18, 21, 30, 0, 0, newYork), utc("2026-10-19T00:00:00Z")},
+		// Already Monday in Tokyo, but still Sunday in UTC
+		{"monday morning in tokyo", time.Date(2026, 10, 19, 8, 0, 0, 0, mustLocation(t, "Asia/Tokyo")), utc("2026-10-12T00:00:00Z")},
+	}
+	for _, test := range tests {
+		got := startOfWeek(test.in)
+		if !got.Equal(test.want) || got.Location() != time.UTC {
+			t.Errorf("%s: startOfWeek(%v) = %v, want %v", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestGrowthSeries(t *testing.T) {
+	firstWeek := utc("2026-07-27T00:00:00Z")
+	week := func(i int) time.Time { return firstWeek.AddDate(0, 0, 7*i) }
+	added := map[time.Time]int{
+		week(0):               2,
+		week(5):               3,
+		week(growthWeeks - 1): 4,
+		// Before the window, so it is already part of every total
+		week(-1): 6,
+	}
+
+	points := growthSeries(firstWeek, 20, added)
+	if len(points) != growthWeeks {
+		t.Fatalf("got %d points, want %d", len(points), growthWeeks)
+	}
+	for i, point := range points {
+		if !point.WeekStart.Equal(week(i)) {
+			t.Errorf("point %d starts %v, want %v", i, point.WeekStart, week(i))
+		}
+		want := 13
+		switch {
+		case i == growthWeeks-1:
+			want = 20
+		case i >= 5:
+			want = 16
+		}
+		if point.TotalPlayers != want {
+			t.Errorf("point %d total = %d, want %d", i, point.TotalPlayers, want)
+		}
+		if point.NewPlayers != added[week(i)] {
+			t.Errorf("point %d new = %d, want %d", i, point.NewPlayers, added[week(i)])
+		}
+	}
+}
+
+func TestTopGameStatCounts(t *testing.T) {
+	counts := []GameStatCount{
+		{Name: "EU", Players: 4},
+		{Name: "OCE", Players: 1},
+		{Name: "NA", Players: 7},
+		{Name: "BR", Players: 4},
+		{Name: "ASIA", Players: 2},
+	}
+	got := topGameStatCounts(counts, 3)
+	want := []GameStatCount{
+		{Name: "NA", Players: 7},
+		{Name: "BR", Players: 4},
+		{Name: "EU", Players: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topGameStatCounts = %v, want %v", got, want)
+	}
+
+	if got := topGameStatCounts(nil, 3); len(got) != 0 {
+		t.Errorf("topGameStatCounts(nil) = %v, want none", got)
+	}
+}
+
+func TestLadderRankCounts(t *testing.T) {
+	counts := []GameStatCount{
+		{Name: "Diamond", Players: 2},
+		{Name: "Wood", Players: 1},
+		{Name: "gold", Players: 3},
+		{Name: "Iron", Players: 5},
+		{Name: "Gold", Players: 4},
+		{Name: "Ascendant", Players: 2},
+		{Name: " Diamond ", Players: 1},
+	}
+	got := ladderRankCounts(counts)
+	want := []GameStatCount{
+		{Name: "Iron", Players: 5},
+		{Name: "Gold", Players: 7},
+		{Name: "Diamond", Players: 3},
+		{Name: "Ascendant", Players: 2},
+		{Name: "Wood", Players: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ladderRankCounts = %v, want %v", got, want)
+	}
+}
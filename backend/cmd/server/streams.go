@@ -0,0 +1,434 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultScheduleDays = 7
+	maxScheduleDays     = 28
+	// airingNextWindow is how far ahead "airing next" looks.
+	airingNextWindow = 14 * 24 * time.Hour
+	maxAiringNext    = 50
+)
+
+// streamPlatformHosts lists the hosts a stream link may point at on each
+// platform.
+var streamPlatformHosts = map[string][]string{
+	"twitch":  {"twitch.tv", "www.twitch.tv", "m.twitch.tv"},
+	"youtube": {"youtube.com", "www.youtube.com", "m.youtube.com", "youtu.be"},
+}
+
+var youtubeChannelIDPattern = regexp.MustCompile(`^UC[0-9A-Za-z_-]{22}$`)
+
+// StreamSlot is one scheduled occurrence of a creator's stream.
+type StreamSlot struct {
+	Creator      string    `json:"creator"`
+	EventID      int       `json:"eventId"`
+	OccurrenceID time.Time `json:"occurrenceId"`
+	Title        string    `json:"title"`
+	GameName     *string   `json:"gameName,omitempty"`
+	Platform     *string   `json:"platform,omitempty"`
+	StreamURL    *string   `json:"streamUrl,omitempty"`
+	StartsAt     time.Time `json:"startsAt"`
+	EndsAt       time.Time `json:"endsAt"`
+	Live         bool      `json:"live"`
+}
+
+// applyStream validates the platform and link of a stream. Other kinds of
+// event have neither, and a link given without a platform implies it.
+func (f *eventFields) applyStream(input eventInput) error {
+	if f.Kind != "stream" {
+		if (input.Platform != nil && strings.TrimSpace(*input.Platform) != "") ||
+			(input.StreamURL != nil && strings.TrimSpace(*input.StreamURL) != "") {
+			return fmt.Errorf("Only streams have a platform and stream link")
+		}
+		f.Platform = nil
+		f.StreamURL = nil
+		return nil
+	}
+
+	if input.Platform != nil {
+		platform := strings.ToLower(strings.TrimSpace(*input.Platform))
+		if platform == "" {
+			f.Platform = nil
+		} else if _, ok := streamPlatformHosts[platform]; !ok {
+			return fmt.Errorf("Platform must be twitch or youtube")
+		} else {
+			f.Platform = &platform
+		}
+	}
+
+	if input.StreamURL != nil {
+		link := strings.TrimSpace(*input.StreamURL)
+		if link == "" {
+			f.StreamURL = nil
+		} else {
+			platform, err := streamURLPlatform(link)
+			if err != nil {
+				return err
+			}
+			if f.Platform == nil {
+				f.Platform = &platform
+			} else if *f.Platform != platform {
+				return fmt.Errorf("Stream link doesn't match the platform")
+			}
+			f.StreamURL = &link
+		}
+	}
+
+	// A stored link for another platform is replaced by the default one
+	if f.StreamURL != nil {
+		platform, err := streamURLPlatform(*f.StreamURL)
+		if err != nil || f.Platform == nil || platform != *f.Platform {
+			f.StreamURL = nil
+		}
+	}
+	return nil
+}
+
+// fillStreamURL links a stream without an explicit link to the host's
+// connected account on its platform.
+func (f *eventFields) fillStreamURL(hostID int) error {
+	if f.Platform == nil || f.StreamURL != nil {
+		return nil
+	}
+
+	var accounts struct {
+		TwitchUsername *string `db:"twitch_username"`
+		YoutubeChannel *string `db:"youtube_channel"`
+	}
+	if err := db.Get(&accounts, "SELECT twitch_username, youtube_channel FROM users WHERE id = $1", hostID); err != nil {
+		return err
+	}
+
+	var link string
+	switch *f.Platform {
+	case "twitch":
+		if accounts.TwitchUsername == nil || strings.TrimSpace(*accounts.TwitchUsername) == "" {
+			return fmt.Errorf("Connect your Twitch account or give a stream link")
+		}
+		link = "https://www.twitch.tv/" + url.PathEscape(strings.TrimSpace(*accounts.TwitchUsername))
+	case "youtube":
+		if accounts.YoutubeChannel == nil || strings.TrimSpace(*accounts.YoutubeChannel) == "" {
+			return fmt.Errorf("Connect your YouTube channel or give a stream link")
+		}
+		link = youtubeChannelURL(strings.TrimSpace(*accounts.YoutubeChannel))
+	}
+	f.StreamURL = &link
+	return nil
+}
+
+// youtubeChannelURL links to a channel given by id, handle or full URL.
+func youtubeChannelURL(channel string) string {
+	if _, err := streamURLPlatform(channel); err == nil {
+		return channel
+	}
+	if youtubeChannelIDPattern.MatchString(channel) {
+		return "https://www.youtube.com/channel/" + channel
+	}
+	return "https://www.youtube.com/@" + url.PathEscape(strings.TrimPrefix(channel, "@"))
+}
+
+// streamURLPlatform returns the platform an https stream link points at.
+func streamURLPlatform(link string) (string, error) {
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" || len(link) > 500 {
+		return "", fmt.Errorf("Stream link must be an https Twitch or YouTube URL")
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for platform, hosts := range streamPlatformHosts {
+		if containsString(hosts, host) {
+			return platform, nil
+		}
+	}
+	return "", fmt.Errorf("Stream link must be an https Twitch or YouTube URL")
+}
+
+// loadStreamSlots expands the scheduled streams visible to viewerID that
+// match condition over [from, to), in start order. condition may refer to
+// the viewer as $1 and to args from $4.
+func loadStreamSlots(viewerID int, from, to time.Time, condition string, args ...interface{}) ([]StreamSlot, error) {
+	params := append([]interface{}{viewerID, from, to}, args...)
+	events := []*Event{}
+	err := db.Select(&events, `
+		SELECT `+eventColumns+`
+		FROM events e
+		JOIN users h ON h.id = e.host_id
+		WHERE e.kind = 'stream' AND e.status = 'scheduled'
+		AND `+eventVisibleTo("$1")+`
+		AND (e.series_ends_at IS NULL OR e.series_ends_at > $2)
+		AND (e.starts_at < $3 OR EXISTS(
+			SELECT 1 FROM event_exceptions x WHERE x.event_id = e.id AND x.starts_at < $3))
+		AND `+condition, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	exceptions, err := loadEventExceptions(ids, &TimeRange{Start: from, End: to})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	slots := []StreamSlot{}
+	for _, event := range events {
+		occurrences, err := expandEvent(event, exceptions[event.ID], from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, occurrence := range occurrences {
+			if occurrence.Status != "scheduled" {
+				continue
+			}
+			slots = append(slots, StreamSlot{
+				Creator:      event.HostUsername,
+				EventID:      event.ID,
+				OccurrenceID: occurrence.OccurrenceID,
+				Title:        occurrence.Title,
+				GameName:     event.GameName,
+				Platform:     event.Platform,
+				StreamURL:    event.StreamURL,
+				StartsAt:     occurrence.StartsAt,
+				EndsAt:       occurrence.EndsAt,
+				Live:         !occurrence.StartsAt.After(now) && occurrence.EndsAt.After(now),
+			})
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].StartsAt.Before(slots[j].StartsAt)
+	})
+	return slots, nil
+}
+
+// creatorSchedule is a creator's upcoming streams as shown on their
+// profile and in the widget.
+type creatorSchedule struct {
+	Creator  string       `json:"creator"`
+	TimeZone string       `json:"timeZone"`
+	From     time.Time    `json:"from"`
+	Until    time.Time    `json:"until"`
+	Slots    []StreamSlot `json:"slots"`
+}
+
+// loadCreatorSchedule reads the creator and the days and tz query
+// parameters and loads the schedule visible to viewerID. It writes the
+// error response itself and returns nil on failure.
+func loadCreatorSchedule(w http.ResponseWriter, r *http.Request, viewerID int) *creatorSchedule {
+	username := mux.Vars(r)["username"]
+
+	var creator struct {
+		ID       int            `db:"id"`
+		TimeZone sql.NullString `db:"time_zone"`
+	}
+	err := db.Get(&creator, "SELECT id, time_zone FROM users WHERE username = $1", username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return nil
+		}
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return nil
+	}
+
+	days := defaultScheduleDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxScheduleDays {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", maxScheduleDays))
+			return nil
+		}
+		days = parsed
+	}
+
+	// Times are shown in the requested zone, else the creator's own
+	zone := "UTC"
+	if creator.TimeZone.Valid {
+		zone = creator.TimeZone.String
+	}
+	if value := r.URL.Query().Get("tz"); value != "" {
+		zone = value
+	}
+	location, err := loadTimeZone(zone)
+	if err != nil {
+		http.Error(w, `{"error":"Unknown time zone"}`, http.StatusBadRequest)
+		return nil
+	}
+
+	now := time.Now()
+	until := now.Add(time.Duration(days) * 24 * time.Hour)
+	// Streams that are still live count too
+	slots, err := loadStreamSlots(viewerID, now, until, "e.host_id = $4", creator.ID)
+	if err != nil {
+		log.Printf("Error loading stream schedule: %v", err)
+		http.Error(w, `{"error":"Error loading schedule"}`, http.StatusInternalServerError)
+		return nil
+	}
+	for i := range slots {
+		slots[i].StartsAt = slots[i].StartsAt.In(location)
+		slots[i].EndsAt = slots[i].EndsAt.In(location)
+	}
+
+	return &creatorSchedule{
+		Creator:  username,
+		TimeZone: location.String(),
+		From:     now.In(location),
+		Until:    until.In(location),
+		Slots:    slots,
+	}
+}
+
+// streamScheduleHandler returns a creator's upcoming streams that the
+// caller may see.
+func streamScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	schedule := loadCreatorSchedule(w, r, viewerIDFromRequest(r))
+	if schedule == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// airingHandler shows which followed creators are live now and the next
+// stream of each creator who isn't.
+func airingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxAiringNext {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxAiringNext))
+			return
+		}
+		limit = parsed
+	}
+
+	viewerID := viewerIDFromRequest(r)
+	now := time.Now()
+	slots, err := loadStreamSlots(viewerID, now, now.Add(airingNextWindow), `e.host_id IN (
+		SELECT following_id FROM followers WHERE follower_id = $1)`)
+	if err != nil {
+		log.Printf("Error loading airing streams: %v", err)
+		http.Error(w, `{"error":"Error loading streams"}`, http.StatusInternalServerError)
+		return
+	}
+
+	live := []StreamSlot{}
+	next := []StreamSlot{}
+	seen := make(map[string]bool)
+	for _, slot := range slots {
+		if slot.Live {
+			live = append(live, slot)
+			seen[slot.Creator] = true
+		}
+	}
+	for _, slot := range slots {
+		if slot.Live || seen[slot.Creator] || len(next) >= limit {
+			continue
+		}
+		next = append(next, slot)
+		seen[slot.Creator] = true
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"now":  live,
+		"next": next,
+	})
+}
+
+// setWidgetHeaders lets any site fetch or frame the widget and lets
+// caches hold it briefly.
+func setWidgetHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+}
+
+// scheduleWidgetJSONHandler is the embeddable schedule as JSON. Only public
+// streams are included, whoever asks.
+func scheduleWidgetJSONHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	setWidgetHeaders(w)
+
+	schedule := loadCreatorSchedule(w, r, 0)
+	if schedule == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(schedule)
+}
+
+var scheduleWidgetTemplate = template.Must(template.New("widget").Funcs(template.FuncMap{
+	"when": func(slot StreamSlot) string {
+		if slot.Live {
+			return "Live now"
+		}
+		return slot.StartsAt.Format("Mon 2 Jan 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Creator}}'s stream schedule</title>
+<style>
+body { margin: 0; font: 14px/1.4 system-ui, sans-serif; color: #e8e8f0; background: #15151f; }
+.schedule { padding: 12px 16px; }
+h1 { margin: 0 0 8px; font-size: 16px; }
+ul { margin: 0; padding: 0; list-style: none; }
+li { display: flex; gap: 8px; padding: 6px 0; border-top: 1px solid #2a2a3a; }
+.when { flex: 0 0 9em; color: #9a9ab0; }
+.live .when { color: #ff4d6d; font-weight: 600; }
+a { color: #b9a3ff; text-decoration: none; }
+.game { color: #9a9ab0; }
+.footer { margin-top: 8px; font-size: 12px; color: #6a6a80; }
+</style>
+</head>
+<body>
+<div class="schedule">
+<h1>{{.Creator}} on airdate</h1>
+{{if .Slots}}<ul>
+{{range .Slots}}<li{{if .Live}} class="live"{{end}}>
+<span class="when">{{when .}}</span>
+<span>{{if .StreamURL}}<a href="{{.StreamURL}}" target="_blank" rel="noopener">{{.Title}}</a>{{else}}{{.Title}}{{end}}{{with .GameName}} <span class="game">· {{.}}</span>{{end}}</span>
+</li>
+{{end}}</ul>
+{{else}}<p>No streams scheduled.</p>
+{{end}}<p class="footer">Times in {{.TimeZone}}</p>
+</div>
+</body>
+</html>
+`))
+
+// scheduleWidgetHTMLHandler is the embeddable schedule as a small page for
+// an iframe.
+func scheduleWidgetHTMLHandler(w http.ResponseWriter, r *http.Request) {
+	setWidgetHeaders(w)
+
+	schedule := loadCreatorSchedule(w, r, 0)
+	if schedule == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := scheduleWidgetTemplate.Execute(w, schedule); err != nil {
+		log.Printf("Error rendering schedule widget: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStreamURLPlatform(t *testing.T) {
+	tests := []struct {
+		link     string
+		platform string
+	}{
+		{"https://www.twitch.tv/someone", "twitch"},
+		{"https://TWITCH.TV/someone", "twitch"},
+		{"https://youtu.be/abc123", "youtube"},
+		{"https://m.youtube.com/@someone/live", "youtube"},
+		{"http://www.twitch.tv/someone", ""},
+		{"https://twitch.tv.example.com/someone", ""},
+		{"https://example.com/?u=https://twitch.tv/someone", ""},
+		{"javascript:alert(1)", ""},
+		{"https://www.twitch.tv/" + strings.Repeat("a", 500), ""},
+	}
+	for _, test := range tests {
+		platform, err := streamURLPlatform(test.link)
+		if test.platform == "" {
+			if err == nil {
+				t.Errorf("streamURLPlatform(%q) = %q, want an error", test.link, platform)
+			}
+			continue
+		}
+		if err != nil || platform != test.platform {
+			t.Errorf("streamURLPlatform(%q) = %q, %v, want %q", test.link, platform, err, test.platform)
+		}
+	}
+}
+
+func TestApplyStream(t *testing.T) {
+	twitchLink := "https://www.twitch.tv/someone"
+	youtubeLink := "https://www.youtube.com/@someone"
+
+	tests := []struct {
+		name         string
+		fields       eventFields
+		input        eventInput
+		platform     *string
+		streamURL    *string
+		errorMessage string
+	}{
+		{
+			name:     "link implies the platform",
+			fields:   eventFields{Kind: "stream"},
+			input:    eventInput{StreamURL: &twitchLink},
+			platform: stringPtr("twitch"), streamURL: &twitchLink,
+		},
+		{
+			name:     "platform is normalized",
+			fields:   eventFields{Kind: "stream"},
+			input:    eventInput{Platform: stringPtr(" YouTube ")},
+			platform: stringPtr("youtube"),
+		},
+		{
+			name:         "unknown platform",
+			fields:       eventFields{Kind: "stream"},
+			input:        eventInput{Platform: stringPtr("kick")},
+			errorMessage: "Platform must be twitch or youtube",
+		},
+		{
+			name:         "link for another platform",
+			fields:       eventFields{Kind: "stream"},
+			input:        eventInput{Platform: stringPtr("youtube"), StreamURL: &twitchLink},
+			errorMessage: "Stream link doesn't match the platform",
+		},
+		{
+			name:     "changing platform drops the old link",
+			fields:   eventFields{Kind: "stream", Platform: stringPtr("twitch"), StreamURL: &twitchLink},
+			input:    eventInput{Platform: stringPtr("youtube")},
+			platform: stringPtr("youtube"),
+		},
+		{
+			name:      "changing both",
+			fields:    eventFields{Kind: "stream", Platform: stringPtr("twitch"), StreamURL: &twitchLink},
+			input:     eventInput{Platform: stringPtr("youtube"), StreamURL: &youtubeLink},
+			platform:  stringPtr("youtube"),
+			streamURL: &youtubeLink,
+		},
+		{
+			name:         "only streams have a link",
+			fields:       eventFields{Kind: "session"},
+			input:        eventInput{StreamURL: &twitchLink},
+			errorMessage: "Only streams have a platform and stream link",
+		},
+		{
+			name:   "no longer a stream",
+			fields: eventFields{Kind: "session", Platform: stringPtr("twitch"), StreamURL: &twitchLink},
+		},
+	}
+	for _, test := range tests {
+		fields := test.fields
+		err := fields.applyStream(test.input)
+		if test.errorMessage != "" {
+			if err == nil || err.Error() != test.errorMessage {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.errorMessage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields.Platform, test.platform) || !reflect.DeepEqual(fields.StreamURL, test.streamURL) {
+			t.Errorf("%s: platform %v, link %v, want %v, %v", test.name,
+				fields.Platform, fields.StreamURL, test.platform, test.streamURL)
+		}
+	}
+}
+
+// useFakeStreamSchedule answers schedule lookups for "host", who has a
+// public stream (event 1) and one for followers only (event 2).
+func useFakeStreamSchedule(f *fakeDB) {
+	f.on("SELECT id FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRow("id", eventAudienceIDs[args[0].(string)])
+	})
+	f.on("SELECT id, time_zone FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"id", "time_zone"}, []interface{}{eventAudienceIDs["host"], "UTC"})
+	})
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	f.on("WHERE e.kind = 'stream' AND e.status = 'scheduled' AND "+eventVisibleTo("$1"), func(args []interface{}) fakeResult {
+		if args[3] != eventAudienceIDs["host"] {
+			f.t.Errorf("loaded streams of host %v", args[3])
+		}
+		columns := []string{"id", "host_username", "title", "kind", "platform", "stream_url",
+			"starts_at", "ends_at", "time_zone", "visibility", "status", "series_ends_at"}
+		rows := [][]interface{}{{1, "host", "Open scrims", "stream", "twitch", "https://www.twitch.tv/host",
+			start, start.Add(time.Hour), "UTC", "public", "scheduled", start.Add(time.Hour)}}
+		if viewerID := args[0].(int); viewerID == eventAudienceIDs["host"] || viewerID == eventAudienceIDs["follower"] {
+			rows = append(rows, []interface{}{2, "host", "Subscriber night", "stream", "twitch", "https://www.twitch.tv/host",
+				start.Add(time.Hour), start.Add(2 * time.Hour), "UTC", "followers", "scheduled", start.Add(2 * time.Hour)})
+		}
+		return fakeRows(columns, rows...)
+	})
+	f.on("FROM event_exceptions WHERE event_id = ANY($1)", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"event_id", "occurrence_start", "status", "title", "description", "starts_at", "ends_at", "updated_at"})
+	})
+}
+
+func TestScheduleWidgetShowsOnlyPublicStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		viewer  string
+		want    []int
+	}{
+		{"schedule, anonymous", streamScheduleHandler, "", []int{1}},
+		{"schedule, stranger", streamScheduleHandler, "stranger", []int{1}},
+		{"schedule, follower", streamScheduleHandler, "follower", []int{1, 2}},
+		{"widget, anonymous", scheduleWidgetJSONHandler, "", []int{1}},
+		{"widget, follower", scheduleWidgetJSONHandler, "follower", []int{1}},
+		{"widget, host", scheduleWidgetJSONHandler, "host", []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useFakeStreamSchedule(useFakeDB(t))
+
+			r := mux.SetURLVars(testRequest("GET", "/streams/host/schedule", "", test.viewer), map[string]string{"username": "host"})
+			w := serve(test.handler, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("schedule = %d %s", w.Code, w.Body)
+			}
+			var schedule creatorSchedule
+			if err := json.NewDecoder(w.Body).Decode(&schedule); err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, slot := range schedule.Slots {
+				ids = append(ids, slot.EventID)
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("streams %v, want %v", ids, test.want)
+			}
+		})
+	}
+
+	t.Run("html widget, follower", func(t *testing.T) {
+		useFakeStreamSchedule(useFakeDB(t))
+
+		r := mux.SetURLVars(testRequest("GET", "/widget/host/schedule.html", "", "follower"), map[string]string{"username": "host"})
+		w := serve(scheduleWidgetHTMLHandler, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("widget = %d %s", w.Code, w.Body)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "Open scrims") || strings.Contains(body, "Subscriber night") {
+			t.Errorf("widget shows the wrong streams:\n%s", body)
+		}
+	})
+}
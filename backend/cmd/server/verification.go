@@ -0,0 +1,673 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxEmailLength = 255
+	// Links in account emails expire after these.
+	emailVerificationTTL = 48 * time.Hour
+	emailChangeTTL       = 24 * time.Hour
+	passwordResetTTL     = time.Hour
+	// emailResendInterval stops verification emails being sent in a loop.
+	emailResendInterval = time.Minute
+)
+
+func initVerificationTables() error {
+	// Only verified addresses are unique, so claiming someone else's
+	// address without verifying it can't keep it from them
+	_, err := db.Exec(`
+	DROP INDEX IF EXISTS users_email_idx;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_verified_email_idx ON users (LOWER(email)) WHERE email_verified;
+
+	CREATE TABLE IF NOT EXISTS email_changes (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		old_email VARCHAR(255) NOT NULL,
+		new_email VARCHAR(255) NOT NULL,
+		old_confirmed_at TIMESTAMPTZ,
+		new_confirmed_at TIMESTAMPTZ,
+		completed_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Like calendar tokens, only hashes are stored
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS email_tokens (
+		token_hash VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		purpose VARCHAR(20) NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		change_id INTEGER REFERENCES email_changes(id) ON DELETE CASCADE,
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS email_tokens_user_id_idx ON email_tokens (user_id, purpose);
+	`)
+	return err
+}
+
+// normalizeEmail checks that value is a bare email address and lowercases
+// it, so uniqueness ignores case.
+func normalizeEmail(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value || len(value) > maxEmailLength {
+		return "", fmt.Errorf("Invalid email address")
+	}
+	return strings.ToLower(value), nil
+}
+
+// emailHolder is the account an address was verified by.
+type emailHolder struct {
+	ID       int    `db:"id"`
+	Username string `db:"username"`
+}
+
+// verifiedEmailHolder returns the user other than userID who verified
+// email, or nil if nobody else did.
+func verifiedEmailHolder(q queryer, email string, userID int) (*emailHolder, error) {
+	var holder emailHolder
+	err := q.Get(&holder, `
+		SELECT id, username FROM users WHERE LOWER(email) = $1 AND email_verified AND id <> $2
+	`, email, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &holder, nil
+}
+
+// releaseUnverifiedEmail takes email away from the accounts other than
+// userID that added it without verifying it, once userID has.
+func releaseUnverifiedEmail(q execQueryer, email string, userID int) error {
+	_, err := q.Exec(`
+		UPDATE users SET email = NULL WHERE LOWER(email) = $1 AND NOT email_verified AND id <> $2
+	`, email, userID)
+	return err
+}
+
+// emailSentRecently reports whether a purpose token was created for userID
+// within emailResendInterval, so account emails can't be sent in a loop.
+func emailSentRecently(q queryer, userID int, purpose string) (bool, error) {
+	var recent bool
+	err := q.Get(&recent, `
+		SELECT EXISTS(
+			SELECT 1 FROM email_tokens
+			WHERE user_id = $1 AND purpose = $2 AND created_at > $3
+		)
+	`, userID, purpose, time.Now().Add(-emailResendInterval))
+	return recent, err
+}
+
+func hashEmailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createEmailToken stores a new single-use token and returns it.
+func createEmailToken(q execQueryer, userID int, purpose, email string, changeID *int, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	_, err := q.Exec(`
+		INSERT INTO email_tokens (token_hash, user_id, purpose, email, change_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, hashEmailToken(token), userID, purpose, email, changeID, time.Now().Add(ttl))
+	return token, err
+}
+
+// emailToken is an unused, unexpired token.
+type emailToken struct {
+	UserID   int    `db:"user_id"`
+	Purpose  string `db:"purpose"`
+	Email    string `db:"email"`
+	ChangeID *int   `db:"change_id"`
+}
+
+// useEmailToken consumes a token for one of purposes, returning
+// sql.ErrNoRows if it doesn't exist, has expired or was already used.
+func useEmailToken(tx queryer, token string, purposes ...string) (*emailToken, error) {
+	var t emailToken
+	err := tx.Get(&t, `
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = ANY($2) AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, purpose, email, change_id
+	`, hashEmailToken(token), pq.Array(purposes))
+	return &t, err
+}
+
+// mailLogLinks reports whether MAIL_LOG_LINKS=true asks for account email
+// links to be logged when there is no mailer. The links carry tokens that
+// reset passwords, so they stay out of logs unless a developer opts in.
+func mailLogLinks() bool {
+	return os.Getenv("MAIL_LOG_LINKS") == "true"
+}
+
+// sendAccountEmail sends one of the account emails, which link to a page
+// of the frontend carrying the token. With no mailer configured the email
+// is only logged, with its link when mailLogLinks is on, so the flows
+// still work in development.
+func sendAccountEmail(to, username, subject, message, action, path, token string, ttl time.Duration) error {
+	link := appURL() + path + "?token=" + token
+	if mailer == nil {
+		if mailLogLinks() {
+			log.Printf("No mailer configured; email %q to %s would link to %s", subject, to, link)
+		} else {
+			log.Printf("No mailer configured; email %q to %s not sent", subject, to)
+		}
+		return nil
+	}
+	email, err := renderEmail(to, subject, "account", map[string]interface{}{
+		"Username": username,
+		"Message":  message,
+		"Action":   action,
+		"Link":     link,
+		"Expires":  formatTTL(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return mailer.Send(email)
+}
+
+func formatTTL(ttl time.Duration) string {
+	if ttl >= 24*time.Hour {
+		return fmt.Sprintf("%d hours", int(ttl.Hours()))
+	}
+	if ttl == time.Hour {
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d minutes", int(ttl.Minutes()))
+}
+
+// sendEmailVerification sends a fresh verification link for email.
+func sendEmailVerification(userID int, username, email string) error {
+	token, err := createEmailToken(db, userID, "verify", email, nil, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	return sendAccountEmail(email, username, "Verify your email address",
+		"Confirm this is your email address to get notifications and be able to reset your password.",
+		"Verify email address", "/verify-email", token, emailVerificationTTL)
+}
+
+// sendPasswordReset sends a reset link to a verified address, introduced by
+// message. A link sent within emailResendInterval still works, so none is
+// sent then; callers respond the same either way.
+func sendPasswordReset(userID int, username, email, subject, message string) error {
+	recent, err := emailSentRecently(db, userID, "password_reset")
+	if err != nil || recent {
+		return err
+	}
+	token, err := createEmailToken(db, userID, "password_reset", email, nil, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	return sendAccountEmail(email, username, subject, message,
+		"Choose a new password", "/reset-password", token, passwordResetTTL)
+}
+
+// sendEmailInUseNotice tells the holder of a verified address that someone
+// tried to use it for another account. Telling whoever tried would show
+// who has an account, so they get the usual response instead. The notice
+// carries a reset link in case it was the holder, who forgot signing up.
+func sendEmailInUseNotice(holder *emailHolder, email string) error {
+	return sendPasswordReset(holder.ID, holder.Username, email, "Someone tried to use your email address",
+		fmt.Sprintf("Someone tried to use this email address for another Pixel & Chill account. It stays with your account, %s. If that was you and you've forgotten your password, choose a new one.", holder.Username))
+}
+
+// sendEmailVerificationOrNotice sends a verification link for the
+// unverified address email, or the in-use notice if another account
+// verified it first.
+func sendEmailVerificationOrNotice(userID int, username, email string) error {
+	holder, err := verifiedEmailHolder(db, email, userID)
+	if err != nil {
+		return err
+	}
+	if holder != nil {
+		return sendEmailInUseNotice(holder, email)
+	}
+	return sendEmailVerification(userID, username, email)
+}
+
+// verifyEmailHandler confirms the address a verification link was sent
+// to, provided it is still the user's address.
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.Token == "" {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := useEmailToken(tx, requestBody.Token, "verify")
+	if err == nil {
+		var result sql.Result
+		result, err = tx.Exec(`
+			UPDATE users SET email_verified = TRUE WHERE id = $1 AND LOWER(email) = $2
+		`, token.UserID, token.Email)
+		if err == nil {
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				err = sql.ErrNoRows
+			}
+		}
+		if err == nil {
+			err = releaseUnverifiedEmail(tx, token.Email, token.UserID)
+		}
+	}
+	// A unique violation means another account verified the address first
+	if err == sql.ErrNoRows || isUniqueViolation(err) {
+		http.Error(w, `{"error":"This link is invalid or has expired"}`, http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		http.Error(w, `{"error":"Error verifying email"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified"})
+}
+
+// resendVerificationHandler sends another verification link to the
+// caller's unverified address.
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var user struct {
+		ID       int     `db:"id"`
+		Email    *string `db:"email"`
+		Verified bool    `db:"email_verified"`
+	}
+	err := db.Get(&user, "SELECT id, email, email_verified FROM users WHERE username = $1", claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	if user.Email == nil {
+		http.Error(w, `{"error":"Add an email address first"}`, http.StatusBadRequest)
+		return
+	}
+	if user.Verified {
+		http.Error(w, `{"error":"Email is already verified"}`, http.StatusConflict)
+		return
+	}
+
+	recent, err := emailSentRecently(db, user.ID, "verify")
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if recent {
+		http.Error(w, `{"error":"A verification email was just sent; try again in a minute"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	if err := sendEmailVerificationOrNotice(user.ID, claims.Username, *user.Email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		http.Error(w, `{"error":"Error sending verification email"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+// updateEmailHandler sets the caller's email address. An unverified or
+// missing address is simply replaced and the new one sent a verification
+// link. A verified address only changes once both the old and the new
+// address confirm it, so a stolen session can't take over the account's
+// recovery address.
+func updateEmailHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(requestBody.Email)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var user struct {
+		ID       int     `db:"id"`
+		Email    *string `db:"email"`
+		Verified bool    `db:"email_verified"`
+	}
+	err = tx.Get(&user, "SELECT id, email, email_verified FROM users WHERE username = $1 FOR UPDATE", claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+	if user.Email != nil && strings.ToLower(*user.Email) == email {
+		http.Error(w, `{"error":"That is already your email address"}`, http.StatusBadRequest)
+		return
+	}
+	// An address verified by another account is accepted like any other,
+	// so the response doesn't show it's taken; that account is told instead
+	holder, err := verifiedEmailHolder(tx, email, user.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Any earlier change or verification in flight is superseded
+	_, err = tx.Exec(`
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose IN ('verify', 'change_old', 'change_new') AND used_at IS NULL
+	`, user.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Error updating email"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if user.Email == nil || !user.Verified {
+		_, err = tx.Exec("UPDATE users SET email = $2, email_verified = FALSE WHERE id = $1", user.ID, email)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Error updating email: %v", err)
+			http.Error(w, `{"error":"Error updating email"}`, http.StatusInternalServerError)
+			return
+		}
+		if holder != nil {
+			err = sendEmailInUseNotice(holder, email)
+		} else {
+			err = sendEmailVerification(user.ID, claims.Username, email)
+		}
+		if err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "verification_sent",
+			"message": "Email updated; check your inbox to verify it",
+		})
+		return
+	}
+
+	var changeID int
+	err = tx.Get(&changeID, `
+		INSERT INTO email_changes (user_id, old_email, new_email, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, user.ID, *user.Email, email, time.Now().Add(emailChangeTTL))
+	var oldToken, newToken string
+	if err == nil {
+		oldToken, err = createEmailToken(tx, user.ID, "change_old", *user.Email, &changeID, emailChangeTTL)
+	}
+	// The new address can't confirm if another account verified it, so
+	// the change just expires
+	if err == nil && holder == nil {
+		newToken, err = createEmailToken(tx, user.ID, "change_new", email, &changeID, emailChangeTTL)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error starting email change: %v", err)
+		http.Error(w, `{"error":"Error updating email"}`, http.StatusInternalServerError)
+		return
+	}
+
+	err = sendAccountEmail(*user.Email, claims.Username, "Confirm your email change",
+		fmt.Sprintf("Someone asked to change your email address to %s. Confirm from this address to allow it.", email),
+		"Confirm email change", "/confirm-email-change", oldToken, emailChangeTTL)
+	if err == nil && holder == nil {
+		err = sendAccountEmail(email, claims.Username, "Confirm your new email address",
+			"Confirm this is your new email address. Your old address has been asked to confirm too.",
+			"Confirm new email address", "/confirm-email-change", newToken, emailChangeTTL)
+	}
+	if err != nil {
+		log.Printf("Error sending email change confirmation: %v", err)
+		http.Error(w, `{"error":"Error sending confirmation emails"}`, http.StatusInternalServerError)
+		return
+	}
+	if holder != nil {
+		// Failing here would show the address is taken, so it's only logged
+		if err := sendEmailInUseNotice(holder, email); err != nil {
+			log.Printf("Error sending email in use notice: %v", err)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "confirmation_required",
+		"message": "Confirm the change from both your current and your new email address",
+	})
+}
+
+// confirmEmailChangeHandler records one side's confirmation of an email
+// change, and makes the change once both have confirmed.
+func confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.Token == "" {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := useEmailToken(tx, requestBody.Token, "change_old", "change_new")
+	if err == nil && token.ChangeID == nil {
+		err = sql.ErrNoRows
+	}
+	var change struct {
+		NewEmail       string     `db:"new_email"`
+		OldConfirmedAt *time.Time `db:"old_confirmed_at"`
+		NewConfirmedAt *time.Time `db:"new_confirmed_at"`
+	}
+	if err == nil {
+		column := "old_confirmed_at"
+		if token.Purpose == "change_new" {
+			column = "new_confirmed_at"
+		}
+		err = tx.Get(&change, `
+			UPDATE email_changes SET `+column+` = NOW()
+			WHERE id = $1 AND completed_at IS NULL AND expires_at > NOW()
+			RETURNING new_email, old_confirmed_at, new_confirmed_at
+		`, *token.ChangeID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"This link is invalid or has expired"}`, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error confirming email change: %v", err)
+		http.Error(w, `{"error":"Error confirming email change"}`, http.StatusInternalServerError)
+		return
+	}
+
+	status, message := "pending", "Confirmed; waiting for the other address to confirm"
+	if change.OldConfirmedAt != nil && change.NewConfirmedAt != nil {
+		_, err = tx.Exec("UPDATE users SET email = $2, email_verified = TRUE WHERE id = $1", token.UserID, change.NewEmail)
+		if err == nil {
+			err = releaseUnverifiedEmail(tx, change.NewEmail, token.UserID)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE email_changes SET completed_at = NOW() WHERE id = $1", *token.ChangeID)
+		}
+		if err != nil {
+			// Another account verified the new address first
+			if isUniqueViolation(err) {
+				http.Error(w, `{"error":"This link is invalid or has expired"}`, http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error completing email change: %v", err)
+			http.Error(w, `{"error":"Error confirming email change"}`, http.StatusInternalServerError)
+			return
+		}
+		status, message = "completed", "Email changed"
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Error confirming email change"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": status, "message": message})
+}
+
+// forgotPasswordHandler sends a reset link if the address belongs to an
+// account and is verified, at most once per emailResendInterval. The response is the same either way, so it
+// can't be used to find out who has an account.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(requestBody.Email)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var user struct {
+		ID       int    `db:"id"`
+		Username string `db:"username"`
+	}
+	err = db.Get(&user, `
+		SELECT id, username FROM users WHERE LOWER(email) = $1 AND email_verified
+	`, email)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		if err := sendPasswordReset(user.ID, user.Username, email, "Reset your password",
+			"Someone asked to reset the password of your Pixel & Chill account."); err != nil {
+			log.Printf("Error sending password reset: %v", err)
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If that address belongs to a verified account, a reset link is on its way",
+	})
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var requestBody struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.Token == "" {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	password := strings.TrimSpace(requestBody.Password)
+	if password == "" {
+		http.Error(w, `{"error":"Password is required"}`, http.StatusBadRequest)
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	token, err := useEmailToken(tx, requestBody.Token, "password_reset")
+	if err == nil {
+		// The address must still be the account's verified one
+		var result sql.Result
+		result, err = tx.Exec(`
+			UPDATE users SET password = $2 WHERE id = $1 AND LOWER(email) = $3 AND email_verified
+		`, token.UserID, string(hashedPassword), token.Email)
+		if err == nil {
+			if updated, _ := result.RowsAffected(); updated == 0 {
+				err = sql.ErrNoRows
+			}
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE email_tokens SET used_at = NOW()
+			WHERE user_id = $1 AND purpose = 'password_reset' AND used_at IS NULL
+		`, token.UserID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"This link is invalid or has expired"}`, http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, `{"error":"Error resetting password"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset; you can log in now"})
+}
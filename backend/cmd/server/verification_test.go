@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestSendAccountEmailWithoutMailer(t *testing.T) {
+	previous := mailer
+	mailer = nil
+	t.Cleanup(func() { mailer = previous })
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	send := func() string {
+		logged.Reset()
+		err := sendAccountEmail("zoe@example.com", "zoe", "Reset your password", "Someone asked to reset your password.",
+			"Reset password", "/reset-password", "secret-token", passwordResetTTL)
+		if err != nil {
+			t.Fatalf("sendAccountEmail error: %v", err)
+		}
+		return logged.String()
+	}
+
+	output := send()
+	if strings.Contains(output, "secret-token") {
+		t.Errorf("token logged without MAIL_LOG_LINKS: %q", output)
+	}
+	if !strings.Contains(output, `"Reset your password"`) || !strings.Contains(output, "zoe@example.com") {
+		t.Errorf("log %q should name the subject and recipient", output)
+	}
+
+	t.Setenv("MAIL_LOG_LINKS", "true")
+	if output := send(); !strings.Contains(output, "/reset-password?token=secret-token") {
+		t.Errorf("link not logged with MAIL_LOG_LINKS=true: %q", output)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		invalid bool
+	}{
+		{in: "zoe@example.com", want: "zoe@example.com"},
+		{in: "  Zoe@Example.COM\t", want: "zoe@example.com"},
+		{in: "zoe.smith+games@example.co.uk", want: "zoe.smith+games@example.co.uk"},
+		{in: "", invalid: true},
+		{in: "zoe", invalid: true},
+		{in: "zoe@", invalid: true},
+		{in: "Zoe <zoe@example.com>", invalid: true},
+		{in: "zoe@example.com, jonas@example.com", invalid: true},
+		{in: strings.Repeat("z", maxEmailLength) + "@example.com", invalid: true},
+	}
+	for _, test := range tests {
+		got, err := normalizeEmail(test.in)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("normalizeEmail(%q) = %q, want an error", test.in, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizeEmail(%q) = %q, %v, want %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+// storedEmailToken is a row of the fake email_tokens table.
+type storedEmailToken struct {
+	userID    int
+	purpose   string
+	email     string
+	createdAt time.Time
+	expiresAt time.Time
+	used      bool
+}
+
+// fakeEmailTokens serves the email_tokens statements from memory.
+type fakeEmailTokens struct {
+	tokens map[string]*storedEmailToken
+}
+
+func useFakeEmailTokens(f *fakeDB) *fakeEmailTokens {
+	store := &fakeEmailTokens{tokens: make(map[string]*storedEmailToken)}
+	f.on("INSERT INTO email_tokens", func(args []interface{}) fakeResult {
+		store.tokens[args[0].(string)] = &storedEmailToken{
+			userID: args[1].(int), purpose: args[2].(string), email: args[3].(string),
+			createdAt: time.Now(), expiresAt: args[5].(time.Time),
+		}
+		return fakeAffected(1)
+	})
+	f.on(`
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = ANY($2) AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id, purpose, email, change_id
+	`, func(args []interface{}) fakeResult {
+		columns := []string{"user_id", "purpose", "email", "change_id"}
+		token := store.tokens[args[0].(string)]
+		if token == nil || token.used || !token.expiresAt.After(time.Now()) ||
+			!containsString(*args[1].(*pq.StringArray), token.purpose) {
+			return fakeRows(columns)
+		}
+		token.used = true
+		return fakeRows(columns, []interface{}{token.userID, token.purpose, token.email, nil})
+	})
+	f.on(`
+		UPDATE email_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = 'password_reset' AND used_at IS NULL
+	`, func(args []interface{}) fakeResult {
+		for _, token := range store.tokens {
+			if token.userID == args[0].(int) && token.purpose == "password_reset" {
+				token.used = true
+			}
+		}
+		return fakeAffected(1)
+	})
+	f.on("FROM email_tokens WHERE user_id = $1 AND purpose = $2 AND created_at > $3", func(args []interface{}) fakeResult {
+		recent := false
+		for _, token := range store.tokens {
+			if token.userID == args[0].(int) && token.purpose == args[1].(string) && token.createdAt.After(args[2].(time.Time)) {
+				recent = true
+			}
+		}
+		return fakeRow("exists", recent)
+	})
+	return store
+}
+
+// age moves every token d into the past.
+func (s *fakeEmailTokens) age(d time.Duration) {
+	for _, token := range s.tokens {
+		token.createdAt = token.createdAt.Add(-d)
+		token.expiresAt = token.expiresAt.Add(-d)
+	}
+}
+
+// recordingMailer keeps the emails it is asked to send.
+type recordingMailer struct {
+	sent []Email
+}
+
+func (m *recordingMailer) Send(email Email) error {
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+func useRecordingMailer(t *testing.T) *recordingMailer {
+	previous := mailer
+	m := &recordingMailer{}
+	mailer = m
+	t.Cleanup(func() { mailer = previous })
+	return m
+}
+
+var emailTokenPattern = regexp.MustCompile(`token=([0-9a-f]{64})`)
+
+// lastEmailToken returns the token in the link of the last email sent.
+func (m *recordingMailer) lastEmailToken(t *testing.T) string {
+	t.Helper()
+	if len(m.sent) == 0 {
+		t.Fatal("no email sent")
+	}
+	match := emailTokenPattern.FindStringSubmatch(m.sent[len(m.sent)-1].Text)
+	if match == nil {
+		t.Fatalf("no token in email:\n%s", m.sent[len(m.sent)-1].Text)
+	}
+	return match[1]
+}
+
+func TestPasswordResetTokens(t *testing.T) {
+	f := useFakeDB(t)
+	tokens := useFakeEmailTokens(f)
+	sent := useRecordingMailer(t)
+
+	// Only zoe's verified address has an account, and lookups are by the
+	// normalized address
+	f.on("SELECT id, username FROM users WHERE LOWER(email) = $1 AND email_verified", func(args []interface{}) fakeResult {
+		columns := []string{"id", "username"}
+		if args[0] != "zoe@example.com" {
+			return fakeRows(columns)
+		}
+		return fakeRows(columns, []interface{}{1, "zoe"})
+	})
+	var passwordsSet int
+	f.on("UPDATE users SET password = $2 WHERE id = $1 AND LOWER(email) = $3 AND email_verified", func(args []interface{}) fakeResult {
+		if args[0] != 1 || args[2] != "zoe@example.com" {
+			return fakeAffected(0)
+		}
+		passwordsSet++
+		return fakeAffected(1)
+	})
+
+	forgot := func(email string) {
+		t.Helper()
+		w := serve(forgotPasswordHandler, testRequest("POST", "/forgot-password", `{"email":"`+email+`"}`, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("forgot password = %d %s", w.Code, w.Body)
+		}
+	}
+	reset := func(token string) int {
+		return serve(resetPasswordHandler, testRequest("POST", "/reset-password",
+			`{"token":"`+token+`","password":"hunter22"}`, "")).Code
+	}
+
+	forgot("nobody@example.com")
+	if len(sent.sent) != 0 {
+		t.Fatalf("sent %d emails for an unknown address", len(sent.sent))
+	}
+
+	forgot(" Zoe@Example.COM ")
+	if len(sent.sent) != 1 || sent.sent[0].To != "zoe@example.com" {
+		t.Fatalf("sent %+v, want one email to zoe@example.com", sent.sent)
+	}
+	first := sent.lastEmailToken(t)
+
+	// Asking again straight away sends nothing; the first link still works
+	forgot("zoe@example.com")
+	if len(sent.sent) != 1 {
+		t.Fatalf("sent %d emails within the resend interval, want 1", len(sent.sent))
+	}
+
+	tokens.age(emailResendInterval + time.Second)
+	forgot("zoe@example.com")
+	if len(sent.sent) != 2 {
+		t.Fatalf("sent %d emails after the resend interval, want 2", len(sent.sent))
+	}
+	second := sent.lastEmailToken(t)
+
+	if code := reset(second); code != http.StatusOK || passwordsSet != 1 {
+		t.Fatalf("reset = %d with %d passwords set, want 200 and 1", code, passwordsSet)
+	}
+	// A token works once, and resetting spends the other links too
+	if code := reset(second); code != http.StatusBadRequest {
+		t.Errorf("reusing a token = %d, want 400", code)
+	}
+	if code := reset(first); code != http.StatusBadRequest {
+		t.Errorf("an earlier link after a reset = %d, want 400", code)
+	}
+
+	tokens.age(emailResendInterval + time.Second)
+	forgot("zoe@example.com")
+	expired := sent.lastEmailToken(t)
+	tokens.age(passwordResetTTL + time.Second)
+	if code := reset(expired); code != http.StatusBadRequest {
+		t.Errorf("an expired token = %d, want 400", code)
+	}
+	if passwordsSet != 1 {
+		t.Errorf("%d passwords set, want 1", passwordsSet)
+	}
+}
+
+func TestEmailVerificationTokens(t *testing.T) {
+	f := useFakeDB(t)
+	tokens := useFakeEmailTokens(f)
+	sent := useRecordingMailer(t)
+
+	f.on("SELECT id, email, email_verified FROM users WHERE username = $1", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"id", "email", "email_verified"}, []interface{}{1, "zoe@example.com", false})
+	})
+	f.on("SELECT id, username FROM users WHERE LOWER(email) = $1 AND email_verified AND id <> $2", func(args []interface{}) fakeResult {
+		return fakeRows([]string{"id", "username"})
+	})
+	var verified int
+	f.on("UPDATE users SET email_verified = TRUE WHERE id = $1 AND LOWER(email) = $2", func(args []interface{}) fakeResult {
+		if args[0] != 1 || args[1] != "zoe@example.com" {
+			return fakeAffected(0)
+		}
+		verified++
+		return fakeAffected(1)
+	})
+	f.on("UPDATE users SET email = NULL WHERE LOWER(email) = $1 AND NOT email_verified AND id <> $2", func(args []interface{}) fakeResult {
+		return fakeAffected(0)
+	})
+
+	resend := func() int {
+		return serve(resendVerificationHandler, testRequest("POST", "/email/resend-verification", "", "zoe")).Code
+	}
+	verify := func(token string) int {
+		return serve(verifyEmailHandler, testRequest("POST", "/verify-email", `{"token":"`+token+`"}`, "")).Code
+	}
+
+	if code := resend(); code != http.StatusOK {
+		t.Fatalf("resend = %d, want 200", code)
+	}
+	token := sent.lastEmailToken(t)
+	if code := resend(); code != http.StatusTooManyRequests {
+		t.Errorf("resend within the interval = %d, want 429", code)
+	}
+	if len(sent.sent) != 1 {
+		t.Errorf("sent %d emails, want 1", len(sent.sent))
+	}
+
+	if code := verify(token); code != http.StatusOK || verified != 1 {
+		t.Fatalf("verify = %d with %d verifications, want 200 and 1", code, verified)
+	}
+	if code := verify(token); code != http.StatusBadRequest {
+		t.Errorf("reusing a token = %d, want 400", code)
+	}
+	if code := verify("not-a-token"); code != http.StatusBadRequest {
+		t.Errorf("an unknown token = %d, want 400", code)
+	}
+
+	tokens.age(emailResendInterval + time.Second)
+	if code := resend(); code != http.StatusOK {
+		t.Fatalf("resend after the interval = %d, want 200", code)
+	}
+	expired := sent.lastEmailToken(t)
+	tokens.age(emailVerificationTTL + time.Second)
+	if code := verify(expired); code != http.StatusBadRequest {
+		t.Errorf("an expired token = %d, want 400", code)
+	}
+	if verified != 1 {
+		t.Errorf("%d verifications, want 1", verified)
+	}
+}
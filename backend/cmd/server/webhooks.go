@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxWebhooksPerUser = 10
+	// maxWebhookAttempts with exponential backoff spreads retries over
+	// about a day before a delivery is given up on.
+	maxWebhookAttempts  = 8
+	webhookRetryBase    = 30 * time.Second
+	webhookRetryMax     = 6 * time.Hour
+	webhookTimeout      = 10 * time.Second
+	maxWebhookResponse  = 1024
+	maxWebhookURLLength = 500
+	// webhookWorkers bounds how many deliveries one instance sends at once.
+	webhookWorkers = 8
+	// webhookClaimLease is how long a claimed delivery is left to its
+	// worker before another instance may attempt it again. It must outlast
+	// a send, which webhookTimeout bounds.
+	webhookClaimLease = time.Minute
+)
+
+// webhookEventTypes are the notifications a webhook can subscribe to; "*"
+// subscribes to all of them.
+var webhookEventTypes = []string{
+	"new_follower", "follow_request", "follow_request_accepted",
+	"event_rsvp", "event_invite", "event_updated", "event_cancelled", "event_reminder",
+	"event_waitlist_promoted", "event_occurrence_updated", "event_occurrence_cancelled",
+	"collab_proposed", "collab_message", "collab_countered", "collab_accepted",
+	"collab_declined", "collab_cancelled",
+	"squad_invite", "squad_join_request", "squad_member_joined", "squad_request_accepted",
+	"squad_role_changed", "squad_removed", "squad_disbanded",
+	"community_join_request", "community_request_accepted", "community_role_changed",
+	"community_removed", "community_announcement",
+	"match_proposed", "match_confirmed", "match_cancelled",
+	"chat_mention", "direct_message",
+	"post_liked", "post_comment", "post_reply",
+}
+
+// blockedWebhookPrefixes are the private, loopback, link-local and other
+// special-purpose ranges webhooks may not reach, so a webhook can't be
+// used to probe services inside our network.
+var blockedWebhookPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/3"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// webhookAllowLocalhost lets webhooks reach loopback addresses, for
+// receivers stubbed out on a developer's machine.
+var webhookAllowLocalhost bool
+
+// webhookIPAllowed reports whether webhooks may connect to ip.
+func webhookIPAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	if webhookAllowLocalhost && ip.IsLoopback() {
+		return true
+	}
+	for _, prefix := range blockedWebhookPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialer checks the address it is about to connect to, after DNS
+// resolution, so a hostname resolving to an internal address is refused
+// as well as a literal one.
+var webhookDialer = &net.Dialer{
+	Timeout: webhookTimeout,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return err
+		}
+		if !webhookIPAllowed(ip) {
+			return fmt.Errorf("webhook address %s is not publicly routable", ip)
+		}
+		return nil
+	},
+}
+
+// webhookClient doesn't follow redirects, so a receiver can't bounce
+// signed payloads somewhere else. It never uses a proxy, which would leave
+// only the proxy's address checked.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext:         webhookDialer.DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type Webhook struct {
+	ID          int            `json:"id" db:"id"`
+	URL         string         `json:"url" db:"url"`
+	Description string         `json:"description" db:"description"`
+	EventTypes  pq.StringArray `json:"eventTypes" db:"event_types"`
+	Active      bool           `json:"active" db:"active"`
+	Secret      string         `json:"secret,omitempty" db:"-"`
+	CreatedAt   time.Time      `json:"createdAt" db:"created_at"`
+}
+
+// WebhookDelivery is one event sent to a webhook, with the outcome of its
+// latest attempt.
+type WebhookDelivery struct {
+	ID            int64      `json:"id" db:"id"`
+	EventType     string     `json:"eventType" db:"event_type"`
+	Status        string     `json:"status" db:"status"`
+	Attempts      int        `json:"attempts" db:"attempts"`
+	ResponseCode  *int       `json:"responseCode,omitempty" db:"response_code"`
+	ResponseBody  *string    `json:"responseBody,omitempty" db:"response_body"`
+	Error         *string    `json:"error,omitempty" db:"error"`
+	DurationMS    *int       `json:"durationMs,omitempty" db:"duration_ms"`
+	RedeliveryOf  *int64     `json:"redeliveryOf,omitempty" db:"redelivery_of"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty" db:"next_attempt_at"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty" db:"last_attempt_at"`
+	CreatedAt     time.Time  `json:"createdAt" db:"created_at"`
+}
+
+const webhookColumns = `id, url, description, event_types, active, created_at`
+
+const webhookDeliveryColumns = `
+	id, event_type, status, attempts, response_code, response_body, error, duration_ms,
+	redelivery_of, next_attempt_at, last_attempt_at, created_at`
+
+func initWebhookTables() error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url VARCHAR(500) NOT NULL,
+		description VARCHAR(200) NOT NULL DEFAULT '',
+		secret VARCHAR(64) NOT NULL,
+		event_types TEXT[] NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event_type VARCHAR(64) NOT NULL,
+		payload JSONB NOT NULL DEFAULT '{}',
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_code INTEGER,
+		response_body TEXT,
+		error TEXT,
+		duration_ms INTEGER,
+		redelivery_of BIGINT REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+		next_attempt_at TIMESTAMPTZ,
+		last_attempt_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id DESC);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	`)
+	return err
+}
+
+// webhookRetryDelay doubles from webhookRetryBase after each failed
+// attempt, up to webhookRetryMax.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return delay
+}
+
+// signWebhook returns the signature of a payload sent at timestamp. The
+// timestamp is signed too, so receivers can reject replayed requests.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateWebhookURL checks the URL's form. Hosts given as internal
+// addresses are refused here too, though the dialer makes the final check
+// once names are resolved.
+func validateWebhookURL(link string) error {
+	parsed, err := url.Parse(link)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || len(link) > maxWebhookURLLength {
+		return fmt.Errorf("URL must be an http or https URL of at most %d characters", maxWebhookURLLength)
+	}
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if ip, err := netip.ParseAddr(host); err == nil && !webhookIPAllowed(ip) {
+		return fmt.Errorf("URL must not point to a private or local address")
+	}
+	if (host == "localhost" || strings.HasSuffix(host, ".localhost")) && !webhookAllowLocalhost {
+		return fmt.Errorf("URL must not point to a private or local address")
+	}
+	return nil
+}
+
+func validateWebhookEventTypes(eventTypes []string) ([]string, error) {
+	if len(eventTypes) == 0 {
+		return nil, fmt.Errorf("Subscribe to at least one event type")
+	}
+	var valid []string
+	for _, eventType := range eventTypes {
+		eventType = strings.TrimSpace(eventType)
+		if eventType != "*" && !containsString(webhookEventTypes, eventType) {
+			return nil, fmt.Errorf("Unknown event type: %s", eventType)
+		}
+		if !containsString(valid, eventType) {
+			valid = append(valid, eventType)
+		}
+	}
+	return valid, nil
+}
+
+// webhookChannel is a notificationChannel that queues a delivery to each
+// of the user's webhooks subscribed to the notification.
+type webhookChannel struct{}
+
+func (webhookChannel) Name() string {
+	return "webhook"
+}
+
+func (webhookChannel) Deliver(n Notification) error {
+	payload, err := json.Marshal(n.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, created_at, next_attempt_at)
+		SELECT id, $2, $3, $4, $4 FROM webhooks
+		WHERE user_id = $1 AND active AND ($2 = ANY(event_types) OR '*' = ANY(event_types))
+	`, n.UserID, n.Type, string(payload), n.CreatedAt)
+	return err
+}
+
+// webhookAttempt is a delivery claimed for its next attempt.
+type webhookAttempt struct {
+	ID        int64     `db:"id"`
+	EventType string    `db:"event_type"`
+	Payload   string    `db:"payload"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Active    bool      `db:"active"`
+}
+
+// startWebhookDelivery sends due deliveries every interval.
+// WEBHOOK_ALLOW_LOCALHOST=true lets webhooks reach loopback addresses for
+// local testing.
+//
+// Deliveries are sent apart from the job scheduler, by webhookWorkers
+// workers, so slow receivers neither hold up other jobs nor keep rows
+// locked while they answer. A delivery is claimed by pushing its
+// next_attempt_at back by webhookClaimLease, in a statement that commits
+// at once; if the attempt's outcome is never recorded, say because the
+// instance died mid-send, the lease runs out and the delivery is attempted
+// again. Receivers can tell repeats apart by X-Webhook-Delivery.
+func startWebhookDelivery(interval time.Duration) {
+	webhookAllowLocalhost = os.Getenv("WEBHOOK_ALLOW_LOCALHOST") == "true"
+
+	attempts := make(chan webhookAttempt)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for attempt := range attempts {
+				if err := runWebhookAttempt(attempt); err != nil {
+					log.Printf("Error delivering webhook delivery %d: %v", attempt.ID, err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for {
+				// Claim no more than the workers can take on soon, so claims
+				// don't wait out their lease in line
+				batch, err := claimWebhookAttempts(webhookWorkers)
+				if err != nil {
+					log.Printf("Error claiming webhook deliveries: %v", err)
+					break
+				}
+				for _, attempt := range batch {
+					attempts <- attempt
+				}
+				if len(batch) < webhookWorkers {
+					break
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// claimWebhookAttempts claims up to limit due deliveries. SKIP LOCKED lets
+// instances claiming at the same time take different ones.
+func claimWebhookAttempts(limit int) ([]webhookAttempt, error) {
+	batch := []webhookAttempt{}
+	err := db.Select(&batch, `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event_type, d.payload, d.attempts, d.created_at, w.url, w.secret, w.active
+	`, limit, int(webhookClaimLease/time.Second))
+	return batch, err
+}
+
+// runWebhookAttempt makes one attempt at a claimed delivery and records
+// its outcome, scheduling a retry on the webhook backoff if it's still
+// pending. An outcome is only recorded against the attempt that was
+// claimed, so an attempt whose lease ran out can't overwrite a later one.
+func runWebhookAttempt(delivery webhookAttempt) error {
+	if !delivery.Active {
+		_, err := db.Exec(`
+			UPDATE webhook_deliveries SET status = 'failed', error = 'Webhook disabled', next_attempt_at = NULL
+			WHERE id = $1 AND status = 'pending' AND attempts = $2
+		`, delivery.ID, delivery.Attempts)
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":        delivery.ID,
+		"type":      delivery.EventType,
+		"createdAt": delivery.CreatedAt,
+		"data":      json.RawMessage(delivery.Payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	attempts := delivery.Attempts + 1
+	code, responseBody, duration, sendErr := sendWebhook(delivery.URL, delivery.Secret, delivery.ID, delivery.EventType, body)
+
+	var errorText *string
+	if sendErr != nil {
+		message := sendErr.Error()
+		errorText = &message
+	}
+	status := webhookAttemptStatus(code, sendErr, attempts)
+
+	var responseCode *int
+	if code != 0 {
+		responseCode = &code
+	}
+	var nextAttempt *time.Time
+	if status == "pending" {
+		runAt := time.Now().Add(webhookRetryDelay(attempts))
+		nextAttempt = &runAt
+	}
+	_, err = db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, response_code = $4, response_body = $5, error = $6,
+			duration_ms = $7, last_attempt_at = NOW(), next_attempt_at = $8
+		WHERE id = $1 AND status = 'pending' AND attempts = $9
+	`, delivery.ID, status, attempts, responseCode, responseBody, errorText, int(duration/time.Millisecond),
+		nextAttempt, delivery.Attempts)
+	return err
+}
+
+// webhookAttemptStatus is a delivery's status after its attempt number
+// attempts got code or err: succeeded on a 2xx response, failed once
+// maxWebhookAttempts are used up and pending otherwise.
+func webhookAttemptStatus(code int, err error, attempts int) string {
+	switch {
+	case err == nil && code >= 200 && code < 300:
+		return "succeeded"
+	case attempts >= maxWebhookAttempts:
+		return "failed"
+	}
+	return "pending"
+}
+
+// sendWebhook posts a signed payload and returns the response code and the
+// start of the response body.
+func sendWebhook(link, secret string, deliveryID int64, eventType string, body []byte) (int, *string, time.Duration, error) {
+	req, err := http.NewRequest("POST", link, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PixelAndChill-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(secret, timestamp, body))
+
+	started := time.Now()
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, nil, time.Since(started), err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	responseBody := string(data)
+	return resp.StatusCode, &responseBody, time.Since(started), nil
+}
+
+// webhookFromRequest returns the caller's webhook named in the URL.
+func webhookFromRequest(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid webhook id"}`, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return 0, 0, false
+	}
+
+	var exists bool
+	err = db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM webhooks WHERE id = $1 AND user_id = $2)", webhookID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	if !exists {
+		http.Error(w, `{"error":"Webhook not found"}`, http.StatusNotFound)
+		return 0, 0, false
+	}
+	return webhookID, userID, true
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	webhooks := []Webhook{}
+	err := db.Select(&webhooks, `
+		SELECT `+webhookColumns+` FROM webhooks
+		WHERE user_id = (SELECT id FROM users WHERE username = $1)
+		ORDER BY id
+	`, claims.Username)
+	if err != nil {
+		log.Printf("Error listing webhooks: %v", err)
+		http.Error(w, `{"error":"Error listing webhooks"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+type webhookInput struct {
+	URL         *string  `json:"url"`
+	Description *string  `json:"description"`
+	EventTypes  []string `json:"eventTypes"`
+	Active      *bool    `json:"active"`
+}
+
+// createWebhookHandler registers a webhook. Its signing secret is only
+// shown in this response.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(userClaimsKey).(*Claims)
+	w.Header().Set("Content-Type", "application/json")
+
+	var input webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if input.URL == nil {
+		http.Error(w, `{"error":"URL is required"}`, http.StatusBadRequest)
+		return
+	}
+	link := strings.TrimSpace(*input.URL)
+	if err := validateWebhookURL(link); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	eventTypes, err := validateWebhookEventTypes(input.EventTypes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	description := ""
+	if input.Description != nil {
+		description = strings.TrimSpace(*input.Description)
+	}
+	if len(description) > 200 {
+		http.Error(w, `{"error":"Description must be at most 200 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Error generating webhook secret: %v", err)
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	secret := hex.EncodeToString(raw)
+
+	userID, err := userIDByUsername(claims.Username)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get user ID"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM webhooks WHERE user_id = $1", userID); err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if count >= maxWebhooksPerUser {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("You can have at most %d webhooks", maxWebhooksPerUser))
+		return
+	}
+
+	var webhook Webhook
+	err = db.Get(&webhook, `
+		INSERT INTO webhooks (user_id, url, description, secret, event_types)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+webhookColumns, userID, link, description, secret, pq.Array(eventTypes))
+	if err != nil {
+		log.Printf("Error creating webhook: %v", err)
+		http.Error(w, `{"error":"Error creating webhook"}`, http.StatusInternalServerError)
+		return
+	}
+	webhook.Secret = secret
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// updateWebhookHandler changes the fields present in the body.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var input webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	webhookID, _, ok := webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var webhook Webhook
+	if err := db.Get(&webhook, `SELECT `+webhookColumns+` FROM webhooks WHERE id = $1`, webhookID); err != nil {
+		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if input.URL != nil {
+		webhook.URL = strings.TrimSpace(*input.URL)
+		if err := validateWebhookURL(webhook.URL); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if input.Description != nil {
+		webhook.Description = strings.TrimSpace(*input.Description)
+		if len(webhook.Description) > 200 {
+			http.Error(w, `{"error":"Description must be at most 200 characters"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if input.EventTypes != nil {
+		eventTypes, err := validateWebhookEventTypes(input.EventTypes)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		webhook.EventTypes = eventTypes
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	err := db.Get(&webhook, `
+		UPDATE webhooks
+		SET url = $2, description = $3, event_types = $4, active = $5, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+webhookColumns, webhookID, webhook.URL, webhook.Description, pq.Array(webhook.EventTypes), webhook.Active)
+	if err != nil {
+		log.Printf("Error updating webhook: %v", err)
+		http.Error(w, `{"error":"Error updating webhook"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	webhookID, _, ok := webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM webhooks WHERE id = $1", webhookID); err != nil {
+		http.Error(w, `{"error":"Error deleting webhook"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Webhook deleted"})
+}
+
+// pingWebhookHandler queues a ping delivery, to check a receiver without
+// waiting for a real event.
+func pingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	webhookID, _, ok := webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	queueWebhookDelivery(w, webhookID, `
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, next_attempt_at)
+		VALUES ($1, 'ping', '{}', NOW())
+		RETURNING `+webhookDeliveryColumns, webhookID)
+}
+
+// redeliverWebhookHandler sends a past delivery's event again as a new
+// delivery, whatever became of the original.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["deliveryId"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid delivery id"}`, http.StatusBadRequest)
+		return
+	}
+	webhookID, _, ok := webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	queueWebhookDelivery(w, webhookID, `
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, redelivery_of, next_attempt_at)
+		SELECT webhook_id, event_type, payload, id, NOW() FROM webhook_deliveries
+		WHERE id = $2 AND webhook_id = $1
+		RETURNING `+webhookDeliveryColumns, webhookID, deliveryID)
+}
+
+// queueWebhookDelivery inserts a delivery with query, which schedules its
+// first attempt right away.
+func queueWebhookDelivery(w http.ResponseWriter, webhookID int, query string, args ...interface{}) {
+	var delivery WebhookDelivery
+	err := db.Get(&delivery, query, args...)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Delivery not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error queueing delivery for webhook %d: %v", webhookID, err)
+		http.Error(w, `{"error":"Error queueing delivery"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// listWebhookDeliveriesHandler pages backwards through a webhook's
+// deliveries, newest first. status filters by pending, succeeded or
+// failed.
+func listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, `{"error":"Limit must be between 1 and 100"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			http.Error(w, `{"error":"Invalid cursor"}`, http.StatusBadRequest)
+			return
+		}
+		before = parsed
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "pending" && status != "succeeded" && status != "failed" {
+		http.Error(w, `{"error":"Status must be pending, succeeded or failed"}`, http.StatusBadRequest)
+		return
+	}
+
+	webhookID, _, ok := webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries := []WebhookDelivery{}
+	err := db.Select(&deliveries, `
+		SELECT `+webhookDeliveryColumns+`
+		FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2 = 0 OR id < $2) AND ($3 = '' OR status = $3)
+		ORDER BY id DESC
+		LIMIT $4
+	`, webhookID, before, status, limit+1)
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %v", err)
+		http.Error(w, `{"error":"Error listing deliveries"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"deliveries": deliveries}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		response["deliveries"] = deliveries
+		response["nextCursor"] = strconv.FormatInt(deliveries[limit-1].ID, 10)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// allowLocalhost lets webhooks reach httptest servers for the rest of the
+// test.
+func allowLocalhost(t *testing.T) {
+	t.Helper()
+	previous := webhookAllowLocalhost
+	webhookAllowLocalhost = true
+	t.Cleanup(func() { webhookAllowLocalhost = previous })
+}
+
+// expectedSignature is what a receiver computes to check a delivery.
+func expectedSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"id":1,"type":"ping"}`)
+	got := signWebhook("s3cret", 1767225600, body)
+	if want := expectedSignature("s3cret", "1767225600", body); got != want {
+		t.Errorf("signWebhook = %q, want %q", got, want)
+	}
+	if signWebhook("s3cret", 1767225601, body) == got {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+	if signWebhook("other", 1767225600, body) == got {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+func TestSendWebhookSignsRequest(t *testing.T) {
+	allowLocalhost(t)
+
+	var received *http.Request
+	var receivedBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, strings.Repeat("x", 2*maxWebhookResponse))
+	}))
+	defer server.Close()
+
+	body := []byte(`{"id":42,"type":"new_follower","data":{"username":"ada"}}`)
+	before := time.Now().Unix()
+	code, responseBody, _, err := sendWebhook(server.URL, "s3cret", 42, "new_follower", body)
+	if err != nil {
+		t.Fatalf("sendWebhook error: %v", err)
+	}
+	if code != http.StatusAccepted {
+		t.Errorf("code = %d, want %d", code, http.StatusAccepted)
+	}
+	if responseBody == nil || len(*responseBody) != maxWebhookResponse {
+		t.Errorf("response body not truncated to %d bytes", maxWebhookResponse)
+	}
+
+	if received.Method != http.MethodPost || string(receivedBody) != string(body) {
+		t.Fatalf("received %s %q, want POST %q", received.Method, receivedBody, body)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":       "application/json",
+		"X-Webhook-Event":    "new_follower",
+		"X-Webhook-Delivery": "42",
+	} {
+		if got := received.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	timestamp := received.Header.Get("X-Webhook-Timestamp")
+	if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || sent < before || sent > time.Now().Unix() {
+		t.Errorf("X-Webhook-Timestamp = %q, want the current time", timestamp)
+	}
+	if got, want := received.Header.Get("X-Webhook-Signature"), expectedSignature("s3cret", timestamp, body); got != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+	}
+}
+
+func TestSendWebhookDoesNotFollowRedirects(t *testing.T) {
+	allowLocalhost(t)
+
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer target.Close()
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer redirector.Close()
+
+	code, _, _, err := sendWebhook(redirector.URL, "s3cret", 1, "ping", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("sendWebhook error: %v", err)
+	}
+	if code != http.StatusTemporaryRedirect {
+		t.Errorf("code = %d, want %d", code, http.StatusTemporaryRedirect)
+	}
+	if status := webhookAttemptStatus(code, err, 1); status != "pending" {
+		t.Errorf("redirect left the delivery %s, want pending", status)
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Error("redirect was followed")
+	}
+}
+
+func TestSendWebhookRefusesLocalAddresses(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	// Only WEBHOOK_ALLOW_LOCALHOST lets the loopback server through
+	_, _, _, err := sendWebhook(server.URL, "s3cret", 1, "ping", []byte(`{}`))
+	if err == nil {
+		t.Fatal("sendWebhook reached a loopback address")
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Error("request reached the server")
+	}
+
+	// A name resolving to loopback is refused after resolution
+	link := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if _, _, _, err := sendWebhook(link, "s3cret", 1, "ping", []byte(`{}`)); err == nil {
+		t.Fatal("sendWebhook reached localhost")
+	}
+}
+
+// deliver runs attempts against link until the delivery leaves pending,
+// returning the status after each attempt and the delays in between.
+func deliver(t *testing.T, link string) ([]string, []time.Duration) {
+	t.Helper()
+	var statuses []string
+	var delays []time.Duration
+	for attempts := 1; ; attempts++ {
+		code, _, _, err := sendWebhook(link, "s3cret", 1, "ping", []byte(`{}`))
+		status := webhookAttemptStatus(code, err, attempts)
+		statuses = append(statuses, status)
+		if status != "pending" {
+			return statuses, delays
+		}
+		delays = append(delays, webhookRetryDelay(attempts))
+	}
+}
+
+func TestWebhookDeliverySucceedsAfterRetries(t *testing.T) {
+	allowLocalhost(t)
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	statuses, delays := deliver(t, server.URL)
+	if want := []string{"pending", "pending", "succeeded"}; strings.Join(statuses, ",") != strings.Join(want, ",") {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if len(delays) != 2 || delays[0] != webhookRetryBase || delays[1] != 2*webhookRetryBase {
+		t.Errorf("delays = %v, want %v then %v", delays, webhookRetryBase, 2*webhookRetryBase)
+	}
+}
+
+func TestWebhookDeliveryFailsAfterMaxAttempts(t *testing.T) {
+	allowLocalhost(t)
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	statuses, delays := deliver(t, server.URL)
+	if len(statuses) != maxWebhookAttempts || statuses[len(statuses)-1] != "failed" {
+		t.Fatalf("statuses = %v, want %d attempts ending in failed", statuses, maxWebhookAttempts)
+	}
+	if int(atomic.LoadInt32(&hits)) != maxWebhookAttempts {
+		t.Errorf("server saw %d attempts, want %d", hits, maxWebhookAttempts)
+	}
+	for i := 1; i < len(delays); i++ {
+		if delays[i] != 2*delays[i-1] && delays[i] != webhookRetryMax {
+			t.Errorf("delay %d = %v after %v, want it doubled or capped", i+1, delays[i], delays[i-1])
+		}
+	}
+}
+
+func TestWebhookAttemptStatus(t *testing.T) {
+	tests := []struct {
+		code     int
+		err      error
+		attempts int
+		want     string
+	}{
+		{200, nil, 1, "succeeded"},
+		{299, nil, maxWebhookAttempts, "succeeded"},
+		{500, nil, 1, "pending"},
+		{404, nil, maxWebhookAttempts - 1, "pending"},
+		{503, nil, maxWebhookAttempts, "failed"},
+		{0, io.ErrUnexpectedEOF, 1, "pending"},
+		{0, io.ErrUnexpectedEOF, maxWebhookAttempts, "failed"},
+		{302, nil, 1, "pending"},
+	}
+	for _, test := range tests {
+		if got := webhookAttemptStatus(test.code, test.err, test.attempts); got != test.want {
+			t.Errorf("webhookAttemptStatus(%d, %v, %d) = %q, want %q", test.code, test.err, test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, webhookRetryMax},
+		{100, webhookRetryMax},
+	}
+	for _, test := range tests {
+		if got := webhookRetryDelay(test.attempts); got != test.want {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestWebhookIPAllowed(t *testing.T) {
+	allowLocalhost(t)
+	tests := []struct {
+		ip        string
+		allowed   bool
+		localhost bool
+	}{
+		{"93.184.216.34", true, true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true, true},
+		{"127.0.0.1", false, true},
+		{"127.1.2.3", false, true},
+		{"::1", false, true},
+		{"::ffff:127.0.0.1", false, true},
+		{"10.1.2.3", false, false},
+		{"172.16.0.1", false, false},
+		{"172.31.255.255", false, false},
+		{"172.32.0.1", true, true},
+		{"192.168.1.1", false, false},
+		{"169.254.169.254", false, false},
+		{"::ffff:169.254.169.254", false, false},
+		{"100.64.0.1", false, false},
+		{"0.0.0.0", false, false},
+		{"::", false, false},
+		{"fc00::1", false, false},
+		{"fd12:3456::1", false, false},
+		{"fe80::1", false, false},
+		{"fe80::1%eth0", false, false},
+		{"224.0.0.1", false, false},
+		{"ff02::1", false, false},
+	}
+	for _, test := range tests {
+		ip := netip.MustParseAddr(test.ip)
+		for _, localhost := range []bool{false, true} {
+			webhookAllowLocalhost = localhost
+			want := test.allowed || (localhost && test.localhost)
+			if got := webhookIPAllowed(ip); got != want {
+				t.Errorf("webhookIPAllowed(%s) with localhost allowed %v = %v, want %v", test.ip, localhost, got, want)
+			}
+		}
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	valid := []string{
+		"https://example.com/hooks",
+		"http://hooks.example.com:8080/in?x=1",
+		"https://93.184.216.34/",
+	}
+	for _, link := range valid {
+		if err := validateWebhookURL(link); err != nil {
+			t.Errorf("validateWebhookURL(%q) error: %v", link, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"example.com/hooks",
+		"ftp://example.com/",
+		"https://",
+		"https://example.com/" + strings.Repeat("a", maxWebhookURLLength),
+		"http://localhost:3000/",
+		"http://LOCALHOST./",
+		"http://api.localhost/",
+		"http://127.0.0.1/",
+		"http://[::1]/",
+		"http://10.0.0.5/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[fd00::1]/",
+	}
+	for _, link := range invalid {
+		if err := validateWebhookURL(link); err == nil {
+			t.Errorf("validateWebhookURL(%q) succeeded, want an error", link)
+		}
+	}
+
+	allowLocalhost(t)
+	if err := validateWebhookURL("http://localhost:3000/"); err != nil {
+		t.Errorf("localhost refused with WEBHOOK_ALLOW_LOCALHOST: %v", err)
+	}
+	if err := validateWebhookURL("http://10.0.0.5/"); err == nil {
+		t.Error("private address accepted with WEBHOOK_ALLOW_LOCALHOST")
+	}
+}
@@ -18,7 +18,7 @@ interface UserProfile {
   discordUsername?: string;
   instagramHandle?: string;
   youtubeChannel?: string;
-  favoriteGames?: string;
+  favoriteGames?: string[];
   connectedGames: string[];
   isPrivate: boolean;
 }
@@ -150,7 +150,7 @@ export function UserFeed({
               ) : (
                 <>
                   {(user.discordUsername ||
-                    user.favoriteGames ||
+                    user.favoriteGames?.length ||
                     user.twitchUsername) && (
                     <div className="z-[20] flex items-center gap-2">
                       {user.twitchUsername && (
@@ -179,20 +179,18 @@ export function UserFeed({
                         </Badge>
                       )}
 
-                      {user.favoriteGames && (
+                      {user.favoriteGames && user.favoriteGames.length > 0 && (
                         <div className="mt-3">
                           <div className="text-sm font-semibold mb-1">
                             Favorite Games:
                           </div>
                           <div className="flex flex-wrap gap-2">
-                            {user.favoriteGames
-                              .split(",")
-                              .map((game: string, index: number) => (
+                            {user.favoriteGames.map((game: string, index: number) => (
                                 <span
                                   key={index}
                                   className="px-2 py-1  rounded text-sm"
                                 >
-                                  {game.trim()}
+                                  {game}
                                 </span>
                               ))}
                           </div>
@@ -241,20 +239,18 @@ export function UserFeed({
                 </div>
               )}
 
-              {user.favoriteGames && (
+              {user.favoriteGames && user.favoriteGames.length > 0 && (
                 <div className="mt-3">
                   <div className="text-sm font-semibold mb-1">
                     Favorite Games:
                   </div>
                   <div className="flex flex-wrap gap-2">
-                    {user.favoriteGames
-                      .split(",")
-                      .map((game: string, index: number) => (
+                    {user.favoriteGames.map((game: string, index: number) => (
                         <span
                           key={index}
                           className="px-2 py-1 bg-blue-100 dark:bg-blue-900 text-blue-800 dark:text-blue-100 rounded text-sm"
                         >
-                          {game.trim()}
+                          {game}
                         </span>
                       ))}
                   </div>